@@ -4,15 +4,24 @@ import (
 	"context"
 	"crypto/ecdsa"
 	"errors"
+	"fmt"
 	"log/slog"
 
 	attest "github.com/takimoto3/app-attest"
+	"github.com/takimoto3/app-attest-middleware/audit"
+	"github.com/takimoto3/app-attest-middleware/challenge"
+	"github.com/takimoto3/app-attest-middleware/metrics"
 	"github.com/takimoto3/app-attest-middleware/plugin"
 	"github.com/takimoto3/app-attest-middleware/requestid"
+	"github.com/takimoto3/app-attest-middleware/tracing"
 )
 
 var (
 	ErrAttestationRequired = errors.New("attestation required")
+	// ErrReplayDetected indicates the stored counter changed while the assertion
+	// was being verified, i.e. another request used the same counter value.
+	// It is returned together with ErrBadRequest.
+	ErrReplayDetected = errors.New("assertion replay detected")
 )
 
 // AssertionServiceProvider creates a new AssertionService for verifying an assertion.
@@ -29,15 +38,19 @@ type AssertionAdapter interface {
 
 type assertionAdapter struct {
 	logger *slog.Logger
+	appID  string
 	// Factory function for creating an AssertionService used to verify assertions.
 	NewService AssertionServiceProvider
 	plugin     plugin.AssertionPlugin
+	options
 }
 
-func NewAssertionAdapter(logger *slog.Logger, appID string, plugin plugin.AssertionPlugin) AssertionAdapter {
+func NewAssertionAdapter(logger *slog.Logger, appID string, plugin plugin.AssertionPlugin, opts ...Option) AssertionAdapter {
 	return &assertionAdapter{
-		logger: logger,
-		plugin: plugin,
+		logger:  logger,
+		appID:   appID,
+		plugin:  plugin,
+		options: newOptions(opts),
 		NewService: func(challenge string, pubkey *ecdsa.PublicKey, counter uint32) AssertionService {
 			return &attest.AssertionService{
 				AppID:     appID,
@@ -50,44 +63,212 @@ func NewAssertionAdapter(logger *slog.Logger, appID string, plugin plugin.Assert
 }
 
 func (a *assertionAdapter) Verify(ctx context.Context, r *plugin.AssertionRequest) error {
+	ctx, end := a.startVerification(ctx, tracing.SpanAssertion, metrics.OpAssertion)
+	err := a.verify(ctx, r)
+	end(err)
+	e := audit.Event{Type: audit.EventAssertionAccepted, KeyID: assertionKeyID(r)}
+	if err != nil {
+		e.Type = audit.EventAssertionRejected
+		e.Reason = string(ReasonOf(err))
+	}
+	a.emit(ctx, a.logger, r.Request, e)
+	return err
+}
+
+// assertionKeyID returns the ID of the key that signed the assertion, if known:
+// from Result after a successful verification, or from the decoded
+// plugin.AssertionPayload.
+func assertionKeyID(r *plugin.AssertionRequest) []byte {
+	if r.Result != nil && r.Result.KeyID != nil {
+		return r.Result.KeyID
+	}
+	return decodedKeyID(r)
+}
+
+// decodedKeyID returns the key ID of the decoded plugin.AssertionPayload, or
+// nil if the plugin decodes requests into another type.
+func decodedKeyID(r *plugin.AssertionRequest) []byte {
+	if payload, ok := r.Object.(*plugin.AssertionPayload); ok {
+		return payload.KeyID
+	}
+	return nil
+}
+
+func (a *assertionAdapter) verify(ctx context.Context, r *plugin.AssertionRequest) error {
 	requestID := requestid.FromContext(ctx)
 	logger := a.logger.With("request_id", requestID)
 	logger.Debug("starting assertion verification")
 
-	assertion, challenge, err := a.plugin.ParseRequest(ctx, r)
+	callCtx, end := a.startCall(ctx, metrics.OpAssertion, "ParseRequest")
+	assertion, challenge, err := a.plugin.ParseRequest(callCtx, r)
+	end(err)
 	if err != nil {
 		logger.Error("failed to parse request", "err", err)
-		return ErrBadRequest
+		return wrapPluginError(ReasonMalformedRequest, fmt.Errorf("failed to parse request: %w", err))
 	}
-	pubkey, counter, err := a.plugin.PublicKeyAndCounter(ctx, r)
+	callCtx, end = a.startCall(ctx, metrics.OpAssertion, "PublicKeyAndCounter")
+	pubkey, counter, err := a.plugin.PublicKeyAndCounter(callCtx, r)
+	end(err)
 	if err != nil {
 		logger.Error("failed to get public key and counter", "err", err)
-		return ErrInternal
+		return wrapPluginError(ReasonStoreUnavailable, fmt.Errorf("failed to get public key and counter: %w", err))
 	}
 	if pubkey == nil {
 		// User has not completed Attestation yet
 		// → redirect client to attestation flow
-		return ErrAttestationRequired
+		return NewVerificationError(ReasonUnknownKey, nil)
 	}
-	assignedChallenge, err := a.plugin.AssignedChallenge(ctx, r)
+	assignedChallenge, err := a.assignedChallenge(ctx, logger, r, challenge)
 	if err != nil {
-		logger.Error("failed to get assigned challenge", "err", err)
-		return ErrInternal
+		return err
 	}
-	if assignedChallenge == "" {
-		return ErrNewChallenge
+	clientData := r.Body
+	switch {
+	case r.ClientData != nil:
+		clientData, err = r.ClientData(challenge)
+		if err != nil {
+			logger.Warn("failed to build client data", "err", err)
+			return NewVerificationError(ReasonMalformedRequest, fmt.Errorf("failed to build client data: %w", err))
+		}
+	case a.challenges != nil:
+		// A stateless token is only checked against its MAC, so the assertion
+		// must sign it for the token to be bound to the request.
+		clientData = plugin.BodyClientData(challenge, r.Body)
 	}
 	service := a.NewService(assignedChallenge, pubkey, counter)
-	cnt, err := service.Verify(assertion, challenge, r.Body)
+	end = a.startService(ctx, metrics.OpAssertion)
+	cnt, err := service.Verify(assertion, challenge, clientData)
+	end(err)
 	if err != nil {
 		logger.Error("failed to verify assertion", "err", err)
-		return ErrBadRequest
+		return classifyServiceError(err)
 	}
 
-	if err = a.plugin.UpdateCounter(ctx, r, cnt); err != nil {
-		logger.Error("failed to store new counter", "err", err)
-		return ErrInternal
+	// Describe and admit the key before any state change, so that a failed
+	// lookup or a rejected key leaves the challenge and counter untouched.
+	result := &plugin.AssertionResult{Counter: cnt, AppID: a.appID}
+	describer, isDescriber := a.plugin.(plugin.KeyDescriber)
+	if isDescriber {
+		callCtx, end := a.startCall(ctx, metrics.OpAssertion, "KeyInfo")
+		info, err := describer.KeyInfo(callCtx, r)
+		end(err)
+		if err != nil {
+			logger.Error("failed to describe key", "err", err)
+			return wrapPluginError(ReasonStoreUnavailable, fmt.Errorf("failed to describe key: %w", err))
+		}
+		if info != nil {
+			result.KeyInfo = *info
+		}
+	}
+	// The key ID the client sent identifies the verified key, whether or not
+	// the plugin describes it.
+	if keyID := decodedKeyID(r); keyID != nil {
+		result.KeyID = keyID
+	}
+	if err := a.checkAssertionEnvironment(logger, isDescriber, result); err != nil {
+		return err
+	}
+	if err := a.checkAssertionRisk(logger, isDescriber, result); err != nil {
+		return err
 	}
 
+	// Stateless tokens are not stored, so there is nothing to consume.
+	if consumer, ok := a.plugin.(plugin.AssertionChallengeConsumer); ok && a.challenges == nil {
+		callCtx, end := a.startCall(ctx, metrics.OpAssertion, "ConsumeAssertionChallenge")
+		consumed, err := consumer.ConsumeAssertionChallenge(callCtx, r, assignedChallenge)
+		end(err)
+		if err != nil {
+			logger.Error("failed to consume challenge", "err", err)
+			return wrapPluginError(ReasonStoreUnavailable, fmt.Errorf("failed to consume challenge: %w", err))
+		}
+		if !consumed {
+			logger.Warn("challenge already used")
+			return NewVerificationError(ReasonChallengeUsed, ErrChallengeUsed)
+		}
+	}
+
+	if err := a.storeCounter(ctx, logger, r, counter, cnt); err != nil {
+		return err
+	}
+	a.emit(ctx, logger, r.Request, audit.Event{Type: audit.EventCounterUpdated, KeyID: assertionKeyID(r), Counter: cnt})
+
+	r.Result = result
 	return nil
 }
+
+// storeCounter persists the new counter. Plugins implementing plugin.CounterSwapper
+// get a conditional update against the counter the assertion was verified with.
+func (a *assertionAdapter) storeCounter(ctx context.Context, logger *slog.Logger, r *plugin.AssertionRequest, old, counter uint32) error {
+	swapper, ok := a.plugin.(plugin.CounterSwapper)
+	if !ok {
+		callCtx, end := a.startCall(ctx, metrics.OpAssertion, "UpdateCounter")
+		err := a.plugin.UpdateCounter(callCtx, r, counter)
+		end(err)
+		if err != nil {
+			logger.Error("failed to store new counter", "err", err)
+			return wrapPluginError(ReasonStoreUnavailable, fmt.Errorf("failed to store new counter: %w", err))
+		}
+		return nil
+	}
+
+	callCtx, end := a.startCall(ctx, metrics.OpAssertion, "CompareAndSwapCounter")
+	swapped, err := swapper.CompareAndSwapCounter(callCtx, r, old, counter)
+	end(err)
+	if err != nil {
+		logger.Error("failed to store new counter", "err", err)
+		return wrapPluginError(ReasonStoreUnavailable, fmt.Errorf("failed to store new counter: %w", err))
+	}
+	if !swapped {
+		logger.Warn("counter changed during verification, rejecting replayed assertion", "counter", counter)
+		return NewVerificationError(ReasonReplayDetected, ErrReplayDetected)
+	}
+	return nil
+}
+
+// assignedChallenge returns the challenge the assertion must carry. With stateless
+// challenges, the challenge sent by the client is verified and returned as is.
+func (a *assertionAdapter) assignedChallenge(ctx context.Context, logger *slog.Logger, r *plugin.AssertionRequest, sent string) (string, error) {
+	if a.challenges == nil {
+		callCtx, end := a.startCall(ctx, metrics.OpAssertion, "AssignedChallenge")
+		assigned, err := a.plugin.AssignedChallenge(callCtx, r)
+		end(err)
+		if err != nil {
+			logger.Error("failed to get assigned challenge", "err", err)
+			return "", wrapPluginError(ReasonStoreUnavailable, fmt.Errorf("failed to get assigned challenge: %w", err))
+		}
+		if assigned == "" {
+			return "", NewVerificationError(ReasonChallengeRequired, nil)
+		}
+		// A replayed assertion would fail the counter check before its
+		// challenge is consumed, so a used challenge is reported here.
+		if consumer, ok := a.plugin.(plugin.AssertionChallengeConsumer); ok {
+			callCtx, end := a.startCall(ctx, metrics.OpAssertion, "AssertionChallengeUsed")
+			used, err := consumer.AssertionChallengeUsed(callCtx, r, assigned)
+			end(err)
+			if err != nil {
+				logger.Error("failed to look up challenge", "err", err)
+				return "", wrapPluginError(ReasonStoreUnavailable, fmt.Errorf("failed to look up challenge: %w", err))
+			}
+			if used {
+				logger.Warn("challenge already used")
+				return "", NewVerificationError(ReasonChallengeUsed, ErrChallengeUsed)
+			}
+		}
+		return assigned, nil
+	}
+
+	_, binding, err := challengeBinding(ctx, a.plugin, r.Request)
+	if err != nil {
+		logger.Error("failed to get challenge binding", "err", err)
+		return "", NewVerificationError(ReasonInternal, fmt.Errorf("failed to get challenge binding: %w", err))
+	}
+	err = a.challenges.Verify(sent, challenge.Assert, binding)
+	if errors.Is(err, challenge.ErrExpired) {
+		return "", NewVerificationError(ReasonChallengeExpired, err)
+	}
+	if err != nil {
+		logger.Warn("invalid challenge", "err", err)
+		return "", NewVerificationError(ReasonChallengeInvalid, err)
+	}
+	return sent, nil
+}
@@ -9,9 +9,12 @@ import (
 	"io"
 	"log/slog"
 	"os"
+	"reflect"
 	"testing"
+	"time"
 
 	attest "github.com/takimoto3/app-attest"
+	"github.com/takimoto3/app-attest-middleware/audit"
 	"github.com/takimoto3/app-attest-middleware/plugin"
 )
 
@@ -272,3 +275,447 @@ func TestAssertionAdapter_NewServiceCreation(t *testing.T) {
 		t.Fatalf("NewService did not return *attest.AssertionService")
 	}
 }
+
+type mockSwapPlugin struct {
+	mockPlugin
+	CompareAndSwapCounterFn func(ctx context.Context, r *plugin.AssertionRequest, old, cnt uint32) (bool, error)
+}
+
+func (m *mockSwapPlugin) CompareAndSwapCounter(ctx context.Context, r *plugin.AssertionRequest, old, cnt uint32) (bool, error) {
+	return m.CompareAndSwapCounterFn(ctx, r, old, cnt)
+}
+
+func TestAssertionAdapter_VerifyCompareAndSwap(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	base := mockPlugin{
+		ParseRequestFn: func(ctx context.Context, r *plugin.AssertionRequest) (*attest.AssertionObject, string, error) {
+			return &attest.AssertionObject{}, "challenge", nil
+		},
+		PublicKeyAndCounterFn: func(ctx context.Context, r *plugin.AssertionRequest) (*ecdsa.PublicKey, uint32, error) {
+			return &ecdsa.PublicKey{}, 1, nil
+		},
+		AssignedChallengeFn: func(ctx context.Context, r *plugin.AssertionRequest) (string, error) {
+			return "challenge", nil
+		},
+		UpdateCounterFn: func(ctx context.Context, r *plugin.AssertionRequest, cnt uint32) error {
+			t.Error("UpdateCounter must not be called when CompareAndSwapCounter is implemented")
+			return nil
+		},
+	}
+	tests := map[string]struct {
+		swap    func(ctx context.Context, r *plugin.AssertionRequest, old, cnt uint32) (bool, error)
+		wantErr []error
+	}{
+		"swap succeeds": {
+			swap: func(ctx context.Context, r *plugin.AssertionRequest, old, cnt uint32) (bool, error) {
+				if old != 1 || cnt != 42 {
+					t.Errorf("unexpected swap arguments: old=%d, new=%d", old, cnt)
+				}
+				return true, nil
+			},
+		},
+		"lost race": {
+			swap: func(ctx context.Context, r *plugin.AssertionRequest, old, cnt uint32) (bool, error) {
+				return false, nil
+			},
+			wantErr: []error{ErrReplayDetected, ErrBadRequest},
+		},
+		"swap fails": {
+			swap: func(ctx context.Context, r *plugin.AssertionRequest, old, cnt uint32) (bool, error) {
+				return false, errors.New("db error")
+			},
+			wantErr: []error{ErrInternal},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			p := &mockSwapPlugin{mockPlugin: base, CompareAndSwapCounterFn: tc.swap}
+			adapter := NewAssertionAdapter(logger, "appID", p).(*assertionAdapter)
+			adapter.NewService = func(challenge string, pubkey *ecdsa.PublicKey, counter uint32) AssertionService {
+				return &mockAssertionService{
+					VerifyFn: func(assertObject *attest.AssertionObject, challenge string, clientData []byte) (uint32, error) {
+						return 42, nil
+					},
+				}
+			}
+
+			err := adapter.Verify(context.Background(), &plugin.AssertionRequest{})
+			if tc.wantErr == nil && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			}
+			for _, want := range tc.wantErr {
+				if !errors.Is(err, want) {
+					t.Errorf("got err %v, want %v", err, want)
+				}
+			}
+		})
+	}
+}
+
+type mockConsumePlugin struct {
+	mockPlugin
+	ConsumeAssertionChallengeFn func(ctx context.Context, r *plugin.AssertionRequest, challenge string) (bool, error)
+	AssertionChallengeUsedFn    func(ctx context.Context, r *plugin.AssertionRequest, challenge string) (bool, error)
+}
+
+func (m *mockConsumePlugin) AssertionChallengeUsed(ctx context.Context, r *plugin.AssertionRequest, challenge string) (bool, error) {
+	if m.AssertionChallengeUsedFn == nil {
+		return false, nil
+	}
+	return m.AssertionChallengeUsedFn(ctx, r, challenge)
+}
+
+func (m *mockConsumePlugin) ConsumeAssertionChallenge(ctx context.Context, r *plugin.AssertionRequest, challenge string) (bool, error) {
+	return m.ConsumeAssertionChallengeFn(ctx, r, challenge)
+}
+
+func TestAssertionAdapter_VerifyConsumeChallenge(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tests := map[string]struct {
+		used        func(ctx context.Context, r *plugin.AssertionRequest, challenge string) (bool, error)
+		consume     func(ctx context.Context, r *plugin.AssertionRequest, challenge string) (bool, error)
+		wantErr     []error
+		wantUpdated bool
+	}{
+		"challenge consumed": {
+			consume: func(ctx context.Context, r *plugin.AssertionRequest, challenge string) (bool, error) {
+				if challenge != "assigned" {
+					t.Errorf("unexpected challenge: got %s, want \"assigned\"", challenge)
+				}
+				return true, nil
+			},
+			wantUpdated: true,
+		},
+		"challenge already used": {
+			consume: func(ctx context.Context, r *plugin.AssertionRequest, challenge string) (bool, error) {
+				return false, nil
+			},
+			wantErr: []error{ErrChallengeUsed, ErrBadRequest},
+		},
+		"consume fails": {
+			consume: func(ctx context.Context, r *plugin.AssertionRequest, challenge string) (bool, error) {
+				return false, errors.New("db error")
+			},
+			wantErr: []error{ErrInternal},
+		},
+		"challenge used before verification": {
+			used: func(ctx context.Context, r *plugin.AssertionRequest, challenge string) (bool, error) {
+				if challenge != "assigned" {
+					t.Errorf("unexpected challenge: got %s, want \"assigned\"", challenge)
+				}
+				return true, nil
+			},
+			consume: func(ctx context.Context, r *plugin.AssertionRequest, challenge string) (bool, error) {
+				t.Error("used challenge consumed")
+				return false, nil
+			},
+			wantErr: []error{ErrChallengeUsed, ErrBadRequest},
+		},
+		"used lookup fails": {
+			used: func(ctx context.Context, r *plugin.AssertionRequest, challenge string) (bool, error) {
+				return false, errors.New("db error")
+			},
+			consume: func(ctx context.Context, r *plugin.AssertionRequest, challenge string) (bool, error) {
+				t.Error("challenge consumed after failed lookup")
+				return false, nil
+			},
+			wantErr: []error{ErrInternal},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			updated := false
+			p := &mockConsumePlugin{
+				mockPlugin: mockPlugin{
+					ParseRequestFn: func(ctx context.Context, r *plugin.AssertionRequest) (*attest.AssertionObject, string, error) {
+						return &attest.AssertionObject{}, "assigned", nil
+					},
+					PublicKeyAndCounterFn: func(ctx context.Context, r *plugin.AssertionRequest) (*ecdsa.PublicKey, uint32, error) {
+						return &ecdsa.PublicKey{}, 1, nil
+					},
+					AssignedChallengeFn: func(ctx context.Context, r *plugin.AssertionRequest) (string, error) {
+						return "assigned", nil
+					},
+					UpdateCounterFn: func(ctx context.Context, r *plugin.AssertionRequest, cnt uint32) error {
+						updated = true
+						return nil
+					},
+				},
+				ConsumeAssertionChallengeFn: tc.consume,
+				AssertionChallengeUsedFn:    tc.used,
+			}
+			adapter := NewAssertionAdapter(logger, "appID", p).(*assertionAdapter)
+			adapter.NewService = func(challenge string, pubkey *ecdsa.PublicKey, counter uint32) AssertionService {
+				return &mockAssertionService{
+					VerifyFn: func(assertObject *attest.AssertionObject, challenge string, clientData []byte) (uint32, error) {
+						return 2, nil
+					},
+				}
+			}
+
+			err := adapter.Verify(context.Background(), &plugin.AssertionRequest{})
+			if tc.wantErr == nil && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			}
+			for _, want := range tc.wantErr {
+				if !errors.Is(err, want) {
+					t.Errorf("got err %v, want %v", err, want)
+				}
+			}
+			if updated != tc.wantUpdated {
+				t.Errorf("counter updated = %v, want %v", updated, tc.wantUpdated)
+			}
+		})
+	}
+}
+
+func TestAssertionAdapter_VerifyClientData(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	privkey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		clientData     func(challenge string) ([]byte, error)
+		wantClientData string
+		wantErr        error
+	}{
+		"body by default": {
+			wantClientData: "body",
+		},
+		"built from challenge": {
+			clientData: func(challenge string) ([]byte, error) {
+				return []byte("canonical:" + challenge), nil
+			},
+			wantClientData: "canonical:sent",
+		},
+		"build fails": {
+			clientData: func(challenge string) ([]byte, error) {
+				return nil, errors.New("invalid query")
+			},
+			wantErr: ErrBadRequest,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			p := &mockPlugin{
+				ParseRequestFn: func(ctx context.Context, r *plugin.AssertionRequest) (*attest.AssertionObject, string, error) {
+					return &attest.AssertionObject{}, "sent", nil
+				},
+				PublicKeyAndCounterFn: func(ctx context.Context, r *plugin.AssertionRequest) (*ecdsa.PublicKey, uint32, error) {
+					return &privkey.PublicKey, 1, nil
+				},
+				AssignedChallengeFn: func(ctx context.Context, r *plugin.AssertionRequest) (string, error) {
+					return "sent", nil
+				},
+				UpdateCounterFn: func(ctx context.Context, r *plugin.AssertionRequest, cnt uint32) error {
+					return nil
+				},
+			}
+			a := NewAssertionAdapter(logger, "appID", p).(*assertionAdapter)
+			var gotClientData []byte
+			a.NewService = func(challenge string, pubkey *ecdsa.PublicKey, counter uint32) AssertionService {
+				return &mockAssertionService{
+					VerifyFn: func(assertObject *attest.AssertionObject, challenge string, clientData []byte) (uint32, error) {
+						gotClientData = clientData
+						return 2, nil
+					},
+				}
+			}
+
+			err := a.Verify(context.Background(), &plugin.AssertionRequest{Body: []byte("body"), ClientData: tc.clientData})
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("got err %v, want %v", err, tc.wantErr)
+			}
+			if tc.wantErr == nil && string(gotClientData) != tc.wantClientData {
+				t.Errorf("got client data %q, want %q", gotClientData, tc.wantClientData)
+			}
+		})
+	}
+}
+
+type mockDescriberPlugin struct {
+	mockPlugin
+	KeyInfoFn func(ctx context.Context, r *plugin.AssertionRequest) (*plugin.KeyInfo, error)
+}
+
+func (m *mockDescriberPlugin) KeyInfo(ctx context.Context, r *plugin.AssertionRequest) (*plugin.KeyInfo, error) {
+	return m.KeyInfoFn(ctx, r)
+}
+
+func TestAssertionAdapter_VerifyResult(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	privkey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attestedAt := time.Unix(1700000000, 0)
+	base := mockPlugin{
+		ParseRequestFn: func(ctx context.Context, r *plugin.AssertionRequest) (*attest.AssertionObject, string, error) {
+			return &attest.AssertionObject{}, "c", nil
+		},
+		PublicKeyAndCounterFn: func(ctx context.Context, r *plugin.AssertionRequest) (*ecdsa.PublicKey, uint32, error) {
+			return &privkey.PublicKey, 1, nil
+		},
+		AssignedChallengeFn: func(ctx context.Context, r *plugin.AssertionRequest) (string, error) {
+			return "c", nil
+		},
+		UpdateCounterFn: func(ctx context.Context, r *plugin.AssertionRequest, cnt uint32) error {
+			return nil
+		},
+	}
+
+	tests := map[string]struct {
+		plugin     plugin.AssertionPlugin
+		object     any
+		wantResult *plugin.AssertionResult
+		wantErr    error
+	}{
+		"without describer": {
+			plugin:     &base,
+			wantResult: &plugin.AssertionResult{Counter: 2, AppID: "appID"},
+		},
+		"decoded key ID without describer": {
+			plugin:     &base,
+			object:     &plugin.AssertionPayload{KeyID: []byte("key")},
+			wantResult: &plugin.AssertionResult{KeyInfo: plugin.KeyInfo{KeyID: []byte("key")}, Counter: 2, AppID: "appID"},
+		},
+		"with describer": {
+			plugin: &mockDescriberPlugin{
+				mockPlugin: base,
+				KeyInfoFn: func(ctx context.Context, r *plugin.AssertionRequest) (*plugin.KeyInfo, error) {
+					return &plugin.KeyInfo{KeyID: []byte("key"), Environment: attest.Production, AttestedAt: attestedAt}, nil
+				},
+			},
+			wantResult: &plugin.AssertionResult{
+				KeyInfo: plugin.KeyInfo{KeyID: []byte("key"), Environment: attest.Production, AttestedAt: attestedAt},
+				Counter: 2,
+				AppID:   "appID",
+			},
+		},
+		"describer fails": {
+			plugin: &mockDescriberPlugin{
+				mockPlugin: base,
+				KeyInfoFn: func(ctx context.Context, r *plugin.AssertionRequest) (*plugin.KeyInfo, error) {
+					return nil, errors.New("db error")
+				},
+			},
+			wantErr: ErrInternal,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			a := NewAssertionAdapter(logger, "appID", tc.plugin).(*assertionAdapter)
+			a.NewService = func(challenge string, pubkey *ecdsa.PublicKey, counter uint32) AssertionService {
+				return &mockAssertionService{
+					VerifyFn: func(assertObject *attest.AssertionObject, challenge string, clientData []byte) (uint32, error) {
+						return 2, nil
+					},
+				}
+			}
+			r := &plugin.AssertionRequest{Object: tc.object}
+			err := a.Verify(context.Background(), r)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("got err %v, want %v", err, tc.wantErr)
+			}
+			if !reflect.DeepEqual(r.Result, tc.wantResult) {
+				t.Errorf("got result %+v, want %+v", r.Result, tc.wantResult)
+			}
+		})
+	}
+}
+
+// mockStatePlugin is a describing, challenge-consuming plugin that records the
+// state changes made by the adapter. Its key starts at counter 1.
+type mockStatePlugin struct {
+	mockDescriberPlugin
+	consumed bool
+	counter  uint32
+}
+
+func (m *mockStatePlugin) AssertionChallengeUsed(ctx context.Context, r *plugin.AssertionRequest, challenge string) (bool, error) {
+	return m.consumed, nil
+}
+
+func (m *mockStatePlugin) ConsumeAssertionChallenge(ctx context.Context, r *plugin.AssertionRequest, challenge string) (bool, error) {
+	m.consumed = true
+	return true, nil
+}
+
+func newMockStatePlugin(pubkey *ecdsa.PublicKey, keyInfo func() (*plugin.KeyInfo, error)) *mockStatePlugin {
+	m := &mockStatePlugin{counter: 1}
+	m.mockPlugin = mockPlugin{
+		ParseRequestFn: func(ctx context.Context, r *plugin.AssertionRequest) (*attest.AssertionObject, string, error) {
+			return &attest.AssertionObject{}, "c", nil
+		},
+		PublicKeyAndCounterFn: func(ctx context.Context, r *plugin.AssertionRequest) (*ecdsa.PublicKey, uint32, error) {
+			return pubkey, m.counter, nil
+		},
+		AssignedChallengeFn: func(ctx context.Context, r *plugin.AssertionRequest) (string, error) {
+			return "c", nil
+		},
+		UpdateCounterFn: func(ctx context.Context, r *plugin.AssertionRequest, cnt uint32) error {
+			m.counter = cnt
+			return nil
+		},
+	}
+	m.KeyInfoFn = func(ctx context.Context, r *plugin.AssertionRequest) (*plugin.KeyInfo, error) {
+		return keyInfo()
+	}
+	return m
+}
+
+// verifyWithCounter verifies an assertion with a, whose service accepts any
+// assertion and returns counter cnt.
+func verifyWithCounter(a AssertionAdapter, cnt uint32) (*plugin.AssertionRequest, error) {
+	a.(*assertionAdapter).NewService = func(challenge string, pubkey *ecdsa.PublicKey, counter uint32) AssertionService {
+		return &mockAssertionService{
+			VerifyFn: func(assertObject *attest.AssertionObject, challenge string, clientData []byte) (uint32, error) {
+				return cnt, nil
+			},
+		}
+	}
+	r := &plugin.AssertionRequest{}
+	return r, a.Verify(context.Background(), r)
+}
+
+func TestAssertionAdapter_DescribeBeforeStateChange(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	privkey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		infoErr     error
+		wantErr     error
+		wantChanged bool
+	}{
+		"described":       {wantChanged: true},
+		"describe failed": {infoErr: errors.New("db error"), wantErr: ErrInternal},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			p := newMockStatePlugin(&privkey.PublicKey, func() (*plugin.KeyInfo, error) {
+				return &plugin.KeyInfo{KeyID: []byte("key")}, tc.infoErr
+			})
+			events := make(audit.Channel, 4)
+			_, err := verifyWithCounter(NewAssertionAdapter(logger, "appID", p, WithAuditSink(events)), 2)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("got err %v, want %v", err, tc.wantErr)
+			}
+			if changed := p.consumed || p.counter != 1; changed != tc.wantChanged {
+				t.Errorf("consumed = %v, counter = %d, want state changed = %v", p.consumed, p.counter, tc.wantChanged)
+			}
+			close(events)
+			for e := range events {
+				if e.Type == audit.EventCounterUpdated && !tc.wantChanged {
+					t.Errorf("unexpected audit event %+v", e)
+				}
+			}
+		})
+	}
+}
@@ -2,13 +2,19 @@ package adapter
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
 	"errors"
 	"fmt"
 	"log/slog"
 
 	attest "github.com/takimoto3/app-attest"
+	"github.com/takimoto3/app-attest-middleware/audit"
+	"github.com/takimoto3/app-attest-middleware/challenge"
+	"github.com/takimoto3/app-attest-middleware/metrics"
 	"github.com/takimoto3/app-attest-middleware/plugin"
 	"github.com/takimoto3/app-attest-middleware/requestid"
+	"github.com/takimoto3/app-attest-middleware/tracing"
 )
 
 var (
@@ -18,6 +24,9 @@ var (
 	ErrBadRequest = errors.New("bad request")
 	// ErrInternal indicates an internal server error
 	ErrInternal = errors.New("internal error")
+	// ErrChallengeUsed indicates the challenge has already been consumed by
+	// another request. It is returned together with ErrBadRequest.
+	ErrChallengeUsed = errors.New("challenge already used")
 )
 
 // AttestationService defines the interface for verifying attestation
@@ -37,70 +46,187 @@ type attestationAdapter struct {
 	logger  *slog.Logger
 	service AttestationService
 	plugin  plugin.AttestationPlugin
+	options
 }
 
 // NewAttestationAdapter creates a new AttestationAdapter
-func NewAttestationAdapter(logger *slog.Logger, service AttestationService, plugin plugin.AttestationPlugin) AttestationAdapter {
+func NewAttestationAdapter(logger *slog.Logger, service AttestationService, plugin plugin.AttestationPlugin, opts ...Option) AttestationAdapter {
 	return &attestationAdapter{
 		logger:  logger,
 		service: service,
 		plugin:  plugin,
+		options: newOptions(opts),
 	}
 }
 
 // NewChallenge requests a new challenge from the plugin
 func (a *attestationAdapter) NewChallenge(ctx context.Context, r *plugin.AttestationRequest) (string, error) {
+	ctx, end := a.startVerification(ctx, tracing.SpanChallenge, metrics.OpChallenge)
+	challenge, err := a.newChallenge(ctx, r)
+	end(err)
+	if err == nil {
+		a.emit(ctx, a.logger, r.Request, audit.Event{Type: audit.EventChallengeIssued})
+	}
+	return challenge, err
+}
+
+func (a *attestationAdapter) newChallenge(ctx context.Context, r *plugin.AttestationRequest) (string, error) {
 	requestID := requestid.FromContext(ctx)
 	logger := a.logger.With("request_id", requestID)
 	logger.Debug("requesting new challenge")
 
-	challenge, err := a.plugin.NewChallenge(ctx, r)
+	if a.challenges != nil {
+		purpose, binding, err := challengeBinding(ctx, a.plugin, r.Request)
+		if err != nil {
+			logger.Error("failed to get challenge binding", "err", err)
+			return "", NewVerificationError(ReasonInternal, fmt.Errorf("failed to get challenge binding: %w", err))
+		}
+		token, err := a.challenges.Issue(purpose, binding)
+		if err != nil {
+			logger.Error("failed to issue stateless challenge", "err", err)
+			return "", NewVerificationError(ReasonInternal, fmt.Errorf("failed to issue challenge: %w", err))
+		}
+		return token, nil
+	}
+
+	callCtx, end := a.startCall(ctx, metrics.OpChallenge, "NewChallenge")
+	challenge, err := a.plugin.NewChallenge(callCtx, r)
+	end(err)
 	if err != nil {
 		logger.Error(" failed to generate new challenge", "err", err)
-		return "", fmt.Errorf("%w: failed to generate new challenge: %v", ErrInternal, err)
+		return "", wrapPluginError(ReasonStoreUnavailable, fmt.Errorf("failed to generate new challenge: %w", err))
 	}
 	return challenge, nil
 }
 
 // Verify performs attestation verification
 func (a *attestationAdapter) Verify(ctx context.Context, r *plugin.AttestationRequest) error {
+	ctx, end := a.startVerification(ctx, tracing.SpanAttestation, metrics.OpAttestation)
+	err := a.verify(ctx, r)
+	end(err)
+	e := audit.Event{Type: audit.EventAttestationAccepted, KeyID: r.KeyID}
+	if err != nil {
+		e.Type = audit.EventAttestationRejected
+		e.Reason = string(ReasonOf(err))
+	}
+	a.emit(ctx, a.logger, r.Request, e)
+	return err
+}
+
+func (a *attestationAdapter) verify(ctx context.Context, r *plugin.AttestationRequest) error {
 	requestID := requestid.FromContext(ctx)
 	logger := a.logger.With("request_id", requestID)
 	logger.Debug("starting attestation verification")
 
 	// Extract attestation data from plugin
-	attestObj, clientDataHash, keyID, err := a.plugin.ExtractData(ctx, r)
+	callCtx, end := a.startCall(ctx, metrics.OpAttestation, "ExtractData")
+	attestObj, clientDataHash, keyID, err := a.plugin.ExtractData(callCtx, r)
+	end(err)
 	if err != nil {
 		logger.Error("failed to parse request", "err", err)
-		return fmt.Errorf("%w: failed to parse request: %v", ErrBadRequest, err)
+		return wrapPluginError(ReasonMalformedRequest, fmt.Errorf("failed to parse request: %w", err))
 	}
+	r.KeyID = keyID
 
-	// Check if challenge was assigned
-	assigned, err := a.plugin.IsChallengeAssigned(ctx, r)
-	if err != nil {
-		logger.Error("failed to check challenge assignment", "err", err)
-		return fmt.Errorf("%w: failed to check challenge: %v", ErrInternal, err)
-	}
-	if !assigned {
-		logger.Info("no challenge assigned, new challenge needed")
-		return ErrNewChallenge
+	if a.challenges != nil {
+		// Verify the self-contained challenge token
+		if err := a.verifyStatelessChallenge(ctx, logger, r, clientDataHash); err != nil {
+			return err
+		}
+	} else {
+		// Check if challenge was assigned
+		callCtx, end := a.startCall(ctx, metrics.OpAttestation, "IsChallengeAssigned")
+		assigned, err := a.plugin.IsChallengeAssigned(callCtx, r)
+		end(err)
+		if err != nil {
+			logger.Error("failed to check challenge assignment", "err", err)
+			return wrapPluginError(ReasonStoreUnavailable, fmt.Errorf("failed to check challenge: %w", err))
+		}
+		if !assigned {
+			logger.Info("no challenge assigned, new challenge needed")
+			return NewVerificationError(ReasonChallengeRequired, nil)
+		}
 	}
 
 	// Verify attestation with service
+	end = a.startService(ctx, metrics.OpAttestation)
 	result, err := a.service.Verify(attestObj, clientDataHash, keyID)
+	end(err)
 	if err != nil {
 		logger.Error("failed to verify attestation", "keyID", string(keyID), "err", err)
-		return fmt.Errorf("%w: failed to verify attestation: %v", ErrBadRequest, err)
+		return classifyServiceError(err)
 	}
 	r.Result = result
 	logger.Debug("attestation verified successfully", "keyID", string(keyID))
+	if err := a.checkAttestationEnvironment(logger, attestObj, result); err != nil {
+		return err
+	}
+	if err := a.checkAttestationRisk(logger, r); err != nil {
+		return err
+	}
+
+	// Consume the challenge so that it cannot be replayed. Stateless tokens
+	// are not stored, so there is nothing to consume.
+	if consumer, ok := a.plugin.(plugin.AttestationChallengeConsumer); ok && a.challenges == nil {
+		callCtx, end := a.startCall(ctx, metrics.OpAttestation, "ConsumeAttestationChallenge")
+		consumed, err := consumer.ConsumeAttestationChallenge(callCtx, r)
+		end(err)
+		if err != nil {
+			logger.Error("failed to consume challenge", "err", err)
+			return wrapPluginError(ReasonStoreUnavailable, fmt.Errorf("failed to consume challenge: %w", err))
+		}
+		if !consumed {
+			logger.Warn("challenge already used", "keyID", string(keyID))
+			return NewVerificationError(ReasonChallengeUsed, ErrChallengeUsed)
+		}
+	}
 
 	// Store verification result via plugin
-	if err := a.plugin.StoreResult(ctx, r); err != nil {
+	callCtx, end = a.startCall(ctx, metrics.OpAttestation, "StoreResult")
+	err = a.plugin.StoreResult(callCtx, r)
+	end(err)
+	if err != nil {
 		logger.Error("failed to store attestation result", "err", err)
-		return fmt.Errorf("%w: failed to store result: %v", ErrInternal, err)
+		return wrapPluginError(ReasonStoreUnavailable, fmt.Errorf("failed to store result: %w", err))
 	}
 	logger.Info("attestation result stored")
 
 	return nil
 }
+
+// verifyStatelessChallenge verifies the challenge token sent by the client and
+// checks that clientDataHash was computed from it.
+func (a *attestationAdapter) verifyStatelessChallenge(ctx context.Context, logger *slog.Logger, r *plugin.AttestationRequest, clientDataHash []byte) error {
+	extractor, ok := a.plugin.(plugin.AttestationChallengeExtractor)
+	if !ok {
+		logger.Error("plugin does not implement AttestationChallengeExtractor")
+		return NewVerificationError(ReasonInternal, errors.New("stateless challenges require plugin.AttestationChallengeExtractor"))
+	}
+	callCtx, end := a.startCall(ctx, metrics.OpAttestation, "AttestationChallenge")
+	token, err := extractor.AttestationChallenge(callCtx, r)
+	end(err)
+	if err != nil {
+		logger.Error("failed to extract challenge", "err", err)
+		return wrapPluginError(ReasonMalformedRequest, fmt.Errorf("failed to extract challenge: %w", err))
+	}
+	hash := sha256.Sum256([]byte(token))
+	if subtle.ConstantTimeCompare(hash[:], clientDataHash) != 1 {
+		logger.Warn("clientDataHash does not match challenge")
+		return NewVerificationError(ReasonChallengeMismatch, errors.New("clientDataHash does not match challenge"))
+	}
+	_, binding, err := challengeBinding(ctx, a.plugin, r.Request)
+	if err != nil {
+		logger.Error("failed to get challenge binding", "err", err)
+		return NewVerificationError(ReasonInternal, fmt.Errorf("failed to get challenge binding: %w", err))
+	}
+	err = a.challenges.Verify(token, challenge.Attest, binding)
+	if errors.Is(err, challenge.ErrExpired) {
+		logger.Info("challenge expired, new challenge needed")
+		return NewVerificationError(ReasonChallengeExpired, err)
+	}
+	if err != nil {
+		logger.Warn("invalid challenge", "err", err)
+		return NewVerificationError(ReasonChallengeInvalid, err)
+	}
+	return nil
+}
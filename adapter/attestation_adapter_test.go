@@ -194,3 +194,72 @@ func TestAttestationAdapter_NewChallenge(t *testing.T) {
 		})
 	}
 }
+
+type mockConsumePluginFunc struct {
+	mockPluginFunc
+	consumeChallenge func(ctx context.Context, r *plugin.AttestationRequest) (bool, error)
+}
+
+func (m *mockConsumePluginFunc) ConsumeAttestationChallenge(ctx context.Context, r *plugin.AttestationRequest) (bool, error) {
+	return m.consumeChallenge(ctx, r)
+}
+
+func TestAttestationAdapter_VerifyConsumeChallenge(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tests := map[string]struct {
+		consumeChallenge func(ctx context.Context, r *plugin.AttestationRequest) (bool, error)
+		wantErr          []error
+		wantStored       bool
+	}{
+		"challenge consumed": {
+			consumeChallenge: func(ctx context.Context, r *plugin.AttestationRequest) (bool, error) { return true, nil },
+			wantStored:       true,
+		},
+		"challenge already used": {
+			consumeChallenge: func(ctx context.Context, r *plugin.AttestationRequest) (bool, error) { return false, nil },
+			wantErr:          []error{ErrChallengeUsed, ErrBadRequest},
+		},
+		"consume error": {
+			consumeChallenge: func(ctx context.Context, r *plugin.AttestationRequest) (bool, error) {
+				return false, errors.New("consume error")
+			},
+			wantErr: []error{ErrInternal},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			stored := false
+			a := &attestationAdapter{
+				plugin: &mockConsumePluginFunc{
+					mockPluginFunc: mockPluginFunc{
+						extractData: func(ctx context.Context, r *plugin.AttestationRequest) (*attest.AttestationObject, []byte, []byte, error) {
+							return &attest.AttestationObject{}, []byte("hash"), []byte("key"), nil
+						},
+						isChallengeAssigned: func(ctx context.Context, r *plugin.AttestationRequest) (bool, error) { return true, nil },
+						storeResult: func(ctx context.Context, r *plugin.AttestationRequest) error {
+							stored = true
+							return nil
+						},
+					},
+					consumeChallenge: tt.consumeChallenge,
+				},
+				service: &mockServiceFunc{},
+				logger:  logger,
+			}
+
+			err := a.Verify(context.Background(), &plugin.AttestationRequest{})
+			if tt.wantErr == nil && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			}
+			for _, want := range tt.wantErr {
+				if !errors.Is(err, want) {
+					t.Errorf("expected error %v, got %v", want, err)
+				}
+			}
+			if stored != tt.wantStored {
+				t.Errorf("result stored = %v, want %v", stored, tt.wantStored)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package adapter
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	attest "github.com/takimoto3/app-attest"
+	"github.com/takimoto3/app-attest-middleware/plugin"
+)
+
+// AAGUIDs of the App Attest environments in the authenticator data of an
+// attestation.
+var (
+	aaguidDevelopment = []byte("appattestdevelop")
+	aaguidProduction  = append([]byte("appattest"), make([]byte, 7)...)
+)
+
+// EnvironmentPolicy selects the App Attest environments whose keys the adapters
+// admit.
+//
+// The attestation adapter reads the environment from the AAGUID of the
+// authenticator data, whatever the AttestationService reports, and records it
+// in attest.Result.Environment for the plugin to store. The assertion adapter
+// checks the environment reported by plugin.KeyDescriber, so that development
+// keys attested before the policy was set are rejected too. With
+// RequireProduction, it rejects keys whose environment is unknown, and fails
+// every assertion with ReasonInternal if the plugin is not a KeyDescriber.
+type EnvironmentPolicy struct {
+	// RequireProduction rejects keys of the development environment, except
+	// those of DevelopmentAppIDs. When false, keys of both environments are
+	// admitted and the environment is only recorded.
+	RequireProduction bool
+	// DevelopmentAppIDs lists the App IDs (team ID + "." + bundle ID) whose
+	// development keys are admitted when RequireProduction is set.
+	DevelopmentAppIDs []string
+}
+
+// WithEnvironmentPolicy makes the adapters check the App Attest environment of
+// keys against policy. A key of an environment the policy does not admit is
+// rejected with ReasonEnvironmentNotAllowed.
+func WithEnvironmentPolicy(policy EnvironmentPolicy) Option {
+	return func(o *options) {
+		o.environment = &policy
+	}
+}
+
+// allows reports whether the policy admits a key of env attested for the App
+// ID whose SHA-256 hash is appIDHash.
+func (p *EnvironmentPolicy) allows(env attest.Environment, appIDHash []byte) bool {
+	if !p.RequireProduction || env == attest.Production {
+		return true
+	}
+	if env != attest.Sandbox {
+		return false
+	}
+	for _, appID := range p.DevelopmentAppIDs {
+		hash := sha256.Sum256([]byte(appID))
+		if subtle.ConstantTimeCompare(hash[:], appIDHash) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// environmentOf returns the environment of the AAGUID in the authenticator data
+// of an attestation.
+func environmentOf(authData []byte) (attest.Environment, error) {
+	if len(authData) < 53 {
+		return 0, errors.New("authenticator data has no aaguid")
+	}
+	switch aaguid := authData[37:53]; {
+	case bytes.Equal(aaguid, aaguidProduction):
+		return attest.Production, nil
+	case bytes.Equal(aaguid, aaguidDevelopment):
+		return attest.Sandbox, nil
+	default:
+		return 0, fmt.Errorf("invalid aaguid %q", aaguid)
+	}
+}
+
+// checkAttestationEnvironment records the environment of the attestation in
+// result and checks it against the environment policy, if any.
+func (o *options) checkAttestationEnvironment(logger *slog.Logger, attestObj *attest.AttestationObject, result *attest.Result) error {
+	if o.environment == nil {
+		return nil
+	}
+	env, err := environmentOf(attestObj.AuthData)
+	if err != nil {
+		logger.Warn("failed to read attestation environment", "err", err)
+		return NewVerificationError(ReasonInvalidAuthenticatorData, err)
+	}
+	if result.Environment != 0 && result.Environment != env {
+		logger.Warn("attestation service reported another environment", "reported", result.Environment, "aaguid", env)
+	}
+	result.Environment = env
+	if !o.environment.allows(env, attestObj.AuthData[:32]) {
+		logger.Warn("attestation environment not allowed", "environment", env)
+		return NewVerificationError(ReasonEnvironmentNotAllowed, fmt.Errorf("%v keys are not allowed", env))
+	}
+	return nil
+}
+
+// checkAssertionEnvironment checks the environment of the key described by
+// result against the environment policy, if any.
+func (o *options) checkAssertionEnvironment(logger *slog.Logger, describer bool, result *plugin.AssertionResult) error {
+	if o.environment == nil || !o.environment.RequireProduction {
+		return nil
+	}
+	if !describer {
+		logger.Error("plugin does not implement KeyDescriber")
+		return NewVerificationError(ReasonInternal, errors.New("environment policy requires plugin.KeyDescriber"))
+	}
+	appIDHash := sha256.Sum256([]byte(result.AppID))
+	if !o.environment.allows(result.Environment, appIDHash[:]) {
+		logger.Warn("key environment not allowed", "environment", result.Environment)
+		return NewVerificationError(ReasonEnvironmentNotAllowed, fmt.Errorf("%v keys are not allowed", result.Environment))
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package adapter
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+
+	attest "github.com/takimoto3/app-attest"
+	"github.com/takimoto3/app-attest-middleware/audit"
+	"github.com/takimoto3/app-attest-middleware/plugin"
+)
+
+// authData returns authenticator data for appID with aaguid.
+func authData(appID string, aaguid []byte) []byte {
+	hash := sha256.Sum256([]byte(appID))
+	data := append(hash[:], 0x40, 0, 0, 0, 0)
+	return append(data, aaguid...)
+}
+
+func TestAttestationAdapter_EnvironmentPolicy(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	devApp := "TEAMID1234.com.example.dev"
+
+	tests := map[string]struct {
+		policy   EnvironmentPolicy
+		authData []byte
+		reported attest.Environment
+		wantErr  error
+		wantEnv  attest.Environment
+	}{
+		"record production": {
+			authData: authData("appID", aaguidProduction),
+			wantEnv:  attest.Production,
+		},
+		"record development": {
+			authData: authData("appID", aaguidDevelopment),
+			wantEnv:  attest.Sandbox,
+		},
+		"aaguid overrides service": {
+			authData: authData("appID", aaguidDevelopment),
+			reported: attest.Production,
+			wantEnv:  attest.Sandbox,
+		},
+		"production required": {
+			policy:   EnvironmentPolicy{RequireProduction: true},
+			authData: authData("appID", aaguidProduction),
+			wantEnv:  attest.Production,
+		},
+		"development rejected": {
+			policy:   EnvironmentPolicy{RequireProduction: true, DevelopmentAppIDs: []string{devApp}},
+			authData: authData("appID", aaguidDevelopment),
+			wantErr:  ErrBadRequest,
+		},
+		"development app allowed": {
+			policy:   EnvironmentPolicy{RequireProduction: true, DevelopmentAppIDs: []string{devApp}},
+			authData: authData(devApp, aaguidDevelopment),
+			wantEnv:  attest.Sandbox,
+		},
+		"unknown aaguid": {
+			authData: authData("appID", []byte("0123456789abcdef")),
+			wantErr:  ErrBadRequest,
+		},
+		"truncated": {
+			authData: authData("appID", nil),
+			wantErr:  ErrBadRequest,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			stored := false
+			a := NewAttestationAdapter(logger, &mockServiceFunc{
+				verify: func(attestObj *attest.AttestationObject, clientDataHash, keyID []byte) (*attest.Result, error) {
+					return &attest.Result{Environment: tc.reported}, nil
+				},
+			}, &mockPluginFunc{
+				extractData: func(ctx context.Context, r *plugin.AttestationRequest) (*attest.AttestationObject, []byte, []byte, error) {
+					return &attest.AttestationObject{AuthData: tc.authData}, []byte("hash"), []byte("key"), nil
+				},
+				isChallengeAssigned: func(ctx context.Context, r *plugin.AttestationRequest) (bool, error) { return true, nil },
+				storeResult: func(ctx context.Context, r *plugin.AttestationRequest) error {
+					stored = true
+					if r.Result.Environment != tc.wantEnv {
+						t.Errorf("stored environment %v, want %v", r.Result.Environment, tc.wantEnv)
+					}
+					return nil
+				},
+			}, WithEnvironmentPolicy(tc.policy))
+			err := a.Verify(context.Background(), &plugin.AttestationRequest{})
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("got err %v, want %v", err, tc.wantErr)
+			}
+			if tc.wantErr != nil {
+				if stored {
+					t.Error("rejected attestation was stored")
+				}
+				return
+			}
+			if !stored {
+				t.Error("attestation not stored")
+			}
+		})
+	}
+}
+
+func TestAssertionAdapter_EnvironmentPolicy(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	privkey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		appID            string
+		env              attest.Environment
+		policy           EnvironmentPolicy
+		withoutDescriber bool
+		wantReason       Reason
+	}{
+		"production": {
+			appID:  "appID",
+			env:    attest.Production,
+			policy: EnvironmentPolicy{RequireProduction: true},
+		},
+		"development rejected": {
+			appID:      "appID",
+			env:        attest.Sandbox,
+			policy:     EnvironmentPolicy{RequireProduction: true},
+			wantReason: ReasonEnvironmentNotAllowed,
+		},
+		"development app allowed": {
+			appID:  "devAppID",
+			env:    attest.Sandbox,
+			policy: EnvironmentPolicy{RequireProduction: true, DevelopmentAppIDs: []string{"devAppID"}},
+		},
+		"development recorded": {
+			appID: "appID",
+			env:   attest.Sandbox,
+		},
+		"unknown environment": {
+			appID:      "appID",
+			policy:     EnvironmentPolicy{RequireProduction: true},
+			wantReason: ReasonEnvironmentNotAllowed,
+		},
+		"unknown environment recorded": {
+			appID: "appID",
+		},
+		"without describer": {
+			appID:            "appID",
+			env:              attest.Production,
+			policy:           EnvironmentPolicy{RequireProduction: true},
+			withoutDescriber: true,
+			wantReason:       ReasonInternal,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			p := newMockStatePlugin(&privkey.PublicKey, func() (*plugin.KeyInfo, error) {
+				return &plugin.KeyInfo{Environment: tc.env}, nil
+			})
+			var ap plugin.AssertionPlugin = p
+			if tc.withoutDescriber {
+				ap = struct {
+					plugin.AssertionPlugin
+					plugin.AssertionChallengeConsumer
+				}{p, p}
+			}
+			events := make(audit.Channel, 4)
+			a := NewAssertionAdapter(logger, tc.appID, ap, WithAuditSink(events), WithEnvironmentPolicy(tc.policy))
+			_, err := verifyWithCounter(a, 2)
+			if got := ReasonOf(err); got != tc.wantReason {
+				t.Errorf("reason = %q, want %q (err: %v)", got, tc.wantReason, err)
+			}
+			// A rejected key leaves the challenge, counter and audit log untouched.
+			wantChanged := tc.wantReason == ""
+			if changed := p.consumed || p.counter != 1; changed != wantChanged {
+				t.Errorf("consumed = %v, counter = %d, want state changed = %v", p.consumed, p.counter, wantChanged)
+			}
+			close(events)
+			for e := range events {
+				if e.Type == audit.EventCounterUpdated && !wantChanged {
+					t.Errorf("unexpected audit event %+v", e)
+				}
+			}
+		})
+	}
+}
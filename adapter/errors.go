@@ -0,0 +1,177 @@
+package adapter
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	attest "github.com/takimoto3/app-attest"
+)
+
+// Reason is a machine-readable code describing why a verification failed.
+type Reason string
+
+const (
+	// ReasonMalformedRequest indicates the plugin could not parse the request.
+	ReasonMalformedRequest Reason = "malformed_request"
+	// ReasonMalformedCBOR indicates the attestation object or assertion is not valid CBOR.
+	ReasonMalformedCBOR Reason = "malformed_cbor"
+	// ReasonChallengeRequired indicates no challenge is assigned and a new one is needed.
+	ReasonChallengeRequired Reason = "challenge_required"
+	// ReasonChallengeExpired indicates the challenge has expired and a new one is needed.
+	ReasonChallengeExpired Reason = "challenge_expired"
+	// ReasonChallengeMismatch indicates the challenge sent by the client is not the assigned one.
+	ReasonChallengeMismatch Reason = "challenge_mismatch"
+	// ReasonChallengeInvalid indicates a stateless challenge token failed verification.
+	ReasonChallengeInvalid Reason = "challenge_invalid"
+	// ReasonChallengeUsed indicates the challenge has already been consumed.
+	ReasonChallengeUsed Reason = "challenge_used"
+	// ReasonNonceMismatch indicates the attestation nonce does not match the authenticator data and client data hash.
+	ReasonNonceMismatch Reason = "nonce_mismatch"
+	// ReasonCounterNotIncreasing indicates the assertion counter is not greater than the stored counter.
+	ReasonCounterNotIncreasing Reason = "counter_not_increasing"
+	// ReasonReplayDetected indicates the stored counter changed while the assertion was being verified.
+	ReasonReplayDetected Reason = "replay_detected"
+	// ReasonUnknownKey indicates no attested key is stored for the request.
+	ReasonUnknownKey Reason = "unknown_key"
+	// ReasonKeyIDMismatch indicates the key identifier does not match the attested public key.
+	ReasonKeyIDMismatch Reason = "key_id_mismatch"
+	// ReasonAppIDMismatch indicates the RP ID hash does not match the App ID.
+	ReasonAppIDMismatch Reason = "app_id_mismatch"
+	// ReasonBadSignature indicates the assertion signature is invalid.
+	ReasonBadSignature Reason = "bad_signature"
+	// ReasonInvalidAuthenticatorData indicates the authenticator data is malformed or has unexpected values.
+	ReasonInvalidAuthenticatorData Reason = "invalid_authenticator_data"
+	// ReasonCertificateChainInvalid indicates the attestation certificates are malformed or do not chain to the root.
+	ReasonCertificateChainInvalid Reason = "certificate_chain_invalid"
+	// ReasonVerificationFailed indicates a verification failure not covered by a more specific reason.
+	ReasonVerificationFailed Reason = "verification_failed"
+	// ReasonEnvironmentNotAllowed indicates the key belongs to an App Attest environment the EnvironmentPolicy does not admit.
+	ReasonEnvironmentNotAllowed Reason = "environment_not_allowed"
+	// ReasonReceiptInvalid indicates the receipt of an attestation failed verification.
+	ReasonReceiptInvalid Reason = "receipt_invalid"
+	// ReasonRiskMetricExceeded indicates the receipt risk metric of the key exceeds the RiskPolicy threshold.
+	ReasonRiskMetricExceeded Reason = "risk_metric_exceeded"
+	// ReasonReceiptStale indicates the receipt of the key is older than the RiskPolicy allows.
+	ReasonReceiptStale Reason = "receipt_stale"
+	// ReasonStoreUnavailable indicates the plugin's store failed.
+	ReasonStoreUnavailable Reason = "store_unavailable"
+	// ReasonInternal indicates a server-side failure other than the store.
+	ReasonInternal Reason = "internal"
+)
+
+// Sentinel returns the sentinel error the reason matches through errors.Is:
+// ErrInternal, ErrNewChallenge, ErrAttestationRequired, ErrRiskRejected or ErrBadRequest.
+func (r Reason) Sentinel() error {
+	switch r {
+	case ReasonRiskMetricExceeded, ReasonReceiptStale:
+		return ErrRiskRejected
+	case ReasonStoreUnavailable, ReasonInternal:
+		return ErrInternal
+	case ReasonChallengeRequired, ReasonChallengeExpired:
+		return ErrNewChallenge
+	case ReasonUnknownKey:
+		return ErrAttestationRequired
+	default:
+		return ErrBadRequest
+	}
+}
+
+// VerificationError is returned by the adapters when a verification fails.
+//
+// It matches the sentinel of its Reason and Err through errors.Is, so existing
+// checks such as errors.Is(err, ErrBadRequest) keep working, while
+// errors.As gives access to the reason and the underlying error.
+type VerificationError struct {
+	// Reason is the machine-readable failure code.
+	Reason Reason
+	// Err is the underlying error, if any.
+	Err error
+}
+
+// NewVerificationError returns a VerificationError for reason wrapping err.
+// Plugins may return it to report a more specific reason than ReasonMalformedRequest
+// or ReasonStoreUnavailable; the adapters pass it through unchanged.
+func NewVerificationError(reason Reason, err error) *VerificationError {
+	return &VerificationError{Reason: reason, Err: err}
+}
+
+func (e *VerificationError) Error() string {
+	msg := fmt.Sprintf("%v: %s", e.Reason.Sentinel(), e.Reason)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *VerificationError) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Reason.Sentinel()}
+	}
+	return []error{e.Reason.Sentinel(), e.Err}
+}
+
+// ReasonOf returns the reason of the VerificationError in err's tree, or ""
+// if there is none.
+func ReasonOf(err error) Reason {
+	var ve *VerificationError
+	if errors.As(err, &ve) {
+		return ve.Reason
+	}
+	return ""
+}
+
+// wrapPluginError returns err unchanged if the plugin already reported a
+// VerificationError, or wraps it with reason otherwise.
+func wrapPluginError(reason Reason, err error) error {
+	var ve *VerificationError
+	if errors.As(err, &ve) {
+		return err
+	}
+	return NewVerificationError(reason, err)
+}
+
+// libraryReasons maps the messages of the errors returned by the
+// github.com/takimoto3/app-attest verifiers, which are not exported as values,
+// to reasons.
+var libraryReasons = []struct {
+	prefix string
+	reason Reason
+}{
+	{"cbor:", ReasonMalformedCBOR},
+	{"parsing certificate", ReasonCertificateChainInvalid},
+	{"invalid certificate", ReasonCertificateChainInvalid},
+	{"certificate didn't contain credCert extension", ReasonCertificateChainInvalid},
+	{"credCertId parse error", ReasonCertificateChainInvalid},
+	{"certOctet parse error", ReasonCertificateChainInvalid},
+	{"invalid key algorithm", ReasonCertificateChainInvalid},
+	{"credCert extension does not match nonce", ReasonNonceMismatch},
+	{"the keyid is not match", ReasonKeyIDMismatch},
+	{"credential ID did not equal", ReasonKeyIDMismatch},
+	{"authenticator data", ReasonInvalidAuthenticatorData},
+	{"attestation missing attested credential data flag", ReasonInvalidAuthenticatorData},
+	{"invalid aaguid value", ReasonInvalidAuthenticatorData},
+	{"counter was not not greater than previous", ReasonCounterNotIncreasing},
+	{"invalid challenge", ReasonChallengeMismatch},
+}
+
+// classifyServiceError returns a VerificationError for an error returned by an
+// AttestationService or AssertionService.
+func classifyServiceError(err error) error {
+	var ve *VerificationError
+	switch {
+	case errors.As(err, &ve):
+		return err
+	case errors.Is(err, attest.ErrInvalidSignature):
+		return NewVerificationError(ReasonBadSignature, err)
+	case errors.Is(err, attest.ErrUnmatchRPIDHash):
+		return NewVerificationError(ReasonAppIDMismatch, err)
+	}
+	msg := err.Error()
+	for _, r := range libraryReasons {
+		if strings.HasPrefix(msg, r.prefix) {
+			return NewVerificationError(r.reason, err)
+		}
+	}
+	return NewVerificationError(ReasonVerificationFailed, err)
+}
@@ -0,0 +1,169 @@
+package adapter
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"testing"
+
+	attest "github.com/takimoto3/app-attest"
+	"github.com/takimoto3/app-attest-middleware/plugin"
+)
+
+func TestVerificationError(t *testing.T) {
+	tests := map[string]struct {
+		err      error
+		wantIs   []error
+		wantNot  []error
+		wantText string
+	}{
+		"bad request": {
+			err:      NewVerificationError(ReasonBadSignature, attest.ErrInvalidSignature),
+			wantIs:   []error{ErrBadRequest, attest.ErrInvalidSignature},
+			wantNot:  []error{ErrInternal, ErrNewChallenge},
+			wantText: "bad request: bad_signature: invalid the assertion signature",
+		},
+		"store unavailable": {
+			err:      NewVerificationError(ReasonStoreUnavailable, errors.New("db down")),
+			wantIs:   []error{ErrInternal},
+			wantNot:  []error{ErrBadRequest},
+			wantText: "internal error: store_unavailable: db down",
+		},
+		"challenge required without cause": {
+			err:      NewVerificationError(ReasonChallengeRequired, nil),
+			wantIs:   []error{ErrNewChallenge},
+			wantText: "no challenge assigned: challenge_required",
+		},
+		"unknown key": {
+			err:    NewVerificationError(ReasonUnknownKey, nil),
+			wantIs: []error{ErrAttestationRequired},
+		},
+		"risk step-up": {
+			err:     NewVerificationError(ReasonRiskMetricExceeded, ErrStepUpRequired),
+			wantIs:  []error{ErrRiskRejected, ErrStepUpRequired},
+			wantNot: []error{ErrBadRequest, ErrInternal},
+		},
+		"replay": {
+			err:    fmt.Errorf("context: %w", NewVerificationError(ReasonReplayDetected, ErrReplayDetected)),
+			wantIs: []error{ErrBadRequest, ErrReplayDetected},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			for _, target := range tc.wantIs {
+				if !errors.Is(tc.err, target) {
+					t.Errorf("errors.Is(%v, %v) = false, want true", tc.err, target)
+				}
+			}
+			for _, target := range tc.wantNot {
+				if errors.Is(tc.err, target) {
+					t.Errorf("errors.Is(%v, %v) = true, want false", tc.err, target)
+				}
+			}
+			if tc.wantText != "" && tc.err.Error() != tc.wantText {
+				t.Errorf("Error() = %q, want %q", tc.err.Error(), tc.wantText)
+			}
+			var ve *VerificationError
+			if !errors.As(tc.err, &ve) {
+				t.Fatal("errors.As failed")
+			}
+			if ReasonOf(tc.err) != ve.Reason {
+				t.Errorf("ReasonOf() = %q, want %q", ReasonOf(tc.err), ve.Reason)
+			}
+		})
+	}
+	if ReasonOf(errors.New("plain")) != "" {
+		t.Error("ReasonOf of a plain error is not empty")
+	}
+}
+
+func TestClassifyServiceError(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := &attest.AssertionService{AppID: "app", Challenge: "c", PublicKey: &key.PublicKey}
+	_, badSignature := service.Verify(&attest.AssertionObject{Signature: []byte("sig"), AuthData: make([]byte, 37)}, "c", nil)
+	malformed := (&attest.AssertionObject{}).UnmarshalCBOR([]byte{0x01})
+
+	tests := map[string]struct {
+		err  error
+		want Reason
+	}{
+		"bad signature":            {err: badSignature, want: ReasonBadSignature},
+		"rp id hash":               {err: attest.ErrUnmatchRPIDHash, want: ReasonAppIDMismatch},
+		"malformed cbor":           {err: malformed, want: ReasonMalformedCBOR},
+		"counter":                  {err: errors.New("counter was not not greater than previous [1, previous: 1]"), want: ReasonCounterNotIncreasing},
+		"challenge":                {err: errors.New("invalid challenge expected: a, received: b"), want: ReasonChallengeMismatch},
+		"certificate":              {err: errors.New("invalid certificate: x509: certificate signed by unknown authority"), want: ReasonCertificateChainInvalid},
+		"nonce":                    {err: errors.New("credCert extension does not match nonce"), want: ReasonNonceMismatch},
+		"key id":                   {err: errors.New("the keyid is not match public key's hash"), want: ReasonKeyIDMismatch},
+		"authenticator data":       {err: errors.New("authenticator data counter was not 0, received: 3"), want: ReasonInvalidAuthenticatorData},
+		"unknown":                  {err: errors.New("something else"), want: ReasonVerificationFailed},
+		"verification error as is": {err: NewVerificationError(ReasonUnknownKey, nil), want: ReasonUnknownKey},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := classifyServiceError(tc.err)
+			if ReasonOf(got) != tc.want {
+				t.Errorf("reason = %q, want %q", ReasonOf(got), tc.want)
+			}
+			if !errors.Is(got, tc.err) {
+				t.Errorf("classified error does not wrap %v", tc.err)
+			}
+		})
+	}
+}
+
+func TestAssertionAdapter_VerifyReasons(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pluginReason := NewVerificationError(ReasonMalformedCBOR, errors.New("truncated"))
+
+	tests := map[string]struct {
+		parseErr  error
+		pubkey    *ecdsa.PublicKey
+		verifyErr error
+		want      Reason
+	}{
+		"parse error":             {parseErr: errors.New("no header"), want: ReasonMalformedRequest},
+		"plugin-specified reason": {parseErr: pluginReason, want: ReasonMalformedCBOR},
+		"unknown key":             {want: ReasonUnknownKey},
+		"bad signature":           {pubkey: &key.PublicKey, verifyErr: attest.ErrInvalidSignature, want: ReasonBadSignature},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			p := &mockPlugin{
+				ParseRequestFn: func(ctx context.Context, r *plugin.AssertionRequest) (*attest.AssertionObject, string, error) {
+					return &attest.AssertionObject{}, "c", tc.parseErr
+				},
+				PublicKeyAndCounterFn: func(ctx context.Context, r *plugin.AssertionRequest) (*ecdsa.PublicKey, uint32, error) {
+					return tc.pubkey, 0, nil
+				},
+				AssignedChallengeFn: func(ctx context.Context, r *plugin.AssertionRequest) (string, error) {
+					return "c", nil
+				},
+			}
+			a := NewAssertionAdapter(logger, "appID", p).(*assertionAdapter)
+			a.NewService = func(challenge string, pubkey *ecdsa.PublicKey, counter uint32) AssertionService {
+				return &mockAssertionService{
+					VerifyFn: func(assertObject *attest.AssertionObject, challenge string, clientData []byte) (uint32, error) {
+						return 0, tc.verifyErr
+					},
+				}
+			}
+			err := a.Verify(context.Background(), &plugin.AssertionRequest{})
+			if got := ReasonOf(err); got != tc.want {
+				t.Errorf("reason = %q, want %q (err: %v)", got, tc.want, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package adapter
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/takimoto3/app-attest-middleware/audit"
+	"github.com/takimoto3/app-attest-middleware/challenge"
+	"github.com/takimoto3/app-attest-middleware/metrics"
+	"github.com/takimoto3/app-attest-middleware/plugin"
+	"github.com/takimoto3/app-attest-middleware/quarantine"
+	"github.com/takimoto3/app-attest-middleware/tracing"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Option configures optional behavior of the adapters.
+// Every Option can be passed to both NewAttestationAdapter and NewAssertionAdapter.
+type Option func(*options)
+
+type options struct {
+	challenges     ChallengeSigner
+	observer       metrics.Observer
+	tracerProvider trace.TracerProvider
+	tracer         trace.Tracer
+	auditSink      audit.Sink
+	quarantine     quarantine.Sink
+	risk           *RiskPolicy
+	environment    *EnvironmentPolicy
+}
+
+func newOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// Settings holds the instrumentation an adapter was created with. The handler
+// and the middleware read it with SettingsOf, so that it is configured once,
+// with the options of the adapter.
+type Settings struct {
+	// Observer is the observer passed to WithObserver.
+	Observer metrics.Observer
+	// TracerProvider is the provider passed to WithTracerProvider.
+	TracerProvider trace.TracerProvider
+	// AuditSink is the sink passed to WithAuditSink.
+	AuditSink audit.Sink
+	// Quarantine is the sink passed to WithQuarantine.
+	Quarantine quarantine.Sink
+}
+
+// SettingsProvider is implemented by adapters that report their Settings.
+// The adapters of this package do.
+type SettingsProvider interface {
+	Settings() Settings
+}
+
+// SettingsOf returns the Settings of adapter, or zero Settings if it does not
+// implement SettingsProvider.
+func SettingsOf(adapter any) Settings {
+	if p, ok := adapter.(SettingsProvider); ok {
+		return p.Settings()
+	}
+	return Settings{}
+}
+
+// Settings implements SettingsProvider.
+func (o *options) Settings() Settings {
+	return Settings{
+		Observer:       o.observer,
+		TracerProvider: o.tracerProvider,
+		AuditSink:      o.auditSink,
+		Quarantine:     o.quarantine,
+	}
+}
+
+// ChallengeSigner issues and verifies self-contained challenges.
+// *challenge.Signer implements it.
+type ChallengeSigner interface {
+	Issue(purpose challenge.Purpose, binding string) (string, error)
+	Verify(token string, purpose challenge.Purpose, binding string) error
+}
+
+// WithStatelessChallenges makes the adapters issue and verify challenges with signer
+// instead of the plugin's challenge store.
+//
+// The attestation adapter issues challenges with signer in NewChallenge and verifies
+// the token returned by plugin.AttestationChallengeExtractor instead of calling
+// IsChallengeAssigned. The assertion adapter verifies the challenge returned by
+// ParseRequest instead of calling AssignedChallenge. Neither calls the plugin's
+// challenge consumers, since tokens are not stored: a token can be reused until
+// it expires, and only the assertion counter stops a replayed assertion. Unless
+// the plugin sets plugin.AssertionRequest.ClientData, the assertion adapter
+// verifies assertions over plugin.BodyClientData, so that the token is signed.
+// Plugins may implement plugin.ChallengeBinder to bind challenges to a key or
+// session.
+func WithStatelessChallenges(signer ChallengeSigner) Option {
+	return func(o *options) {
+		o.challenges = signer
+	}
+}
+
+// challengeBinding returns the purpose and binding reported by the plugin,
+// or an unbound attestation purpose if the plugin is not a plugin.ChallengeBinder.
+func challengeBinding(ctx context.Context, p any, req any) (challenge.Purpose, string, error) {
+	binder, ok := p.(plugin.ChallengeBinder)
+	if !ok {
+		return challenge.Attest, "", nil
+	}
+	return binder.ChallengeBinding(ctx, req)
+}
+
+// WithObserver makes the adapters report the outcome, reason code and duration
+// of every verification and challenge issuance, and the latency of every plugin
+// call, to observer. The handler and the middleware of an adapter report every
+// request to it as well.
+func WithObserver(observer metrics.Observer) Option {
+	return func(o *options) {
+		o.observer = observer
+	}
+}
+
+// WithTracerProvider makes the adapters trace every verification and challenge
+// issuance with a tracer of tp, with child spans for each plugin call and for the
+// cryptographic verification step. The handler and the middleware of an
+// adapter open the root span of every request with tp as well.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(o *options) {
+		o.tracerProvider = tp
+		o.tracer = tracing.Tracer(tp)
+	}
+}
+
+// WithAuditSink makes the adapters record an audit event with sink for every
+// challenge issued, attestation and assertion accepted or rejected, and counter
+// updated. The handler and the middleware of an adapter record the requests
+// they reject before calling it with sink as well. A failure to record is
+// logged and does not fail the request.
+func WithAuditSink(sink audit.Sink) Option {
+	return func(o *options) {
+		o.auditSink = sink
+	}
+}
+
+// WithQuarantine makes the handler and the middleware of an adapter hand the
+// request of every attestation or assertion it rejects as ErrBadRequest, with
+// the body read from it, to sink for later replay. Replays, rejected with
+// ReasonChallengeUsed or ReasonReplayDetected, are only audited. The adapters
+// do not use sink themselves. See the quarantine package.
+func WithQuarantine(sink quarantine.Sink) Option {
+	return func(o *options) {
+		o.quarantine = sink
+	}
+}
+
+// emit records e with the audit sink, if set. req is the original request.
+func (o *options) emit(ctx context.Context, logger *slog.Logger, req any, e audit.Event) {
+	if o.auditSink == nil {
+		return
+	}
+	r, _ := req.(*http.Request)
+	if err := audit.Emit(ctx, o.auditSink, r, e); err != nil {
+		logger.Error("failed to record audit event", "type", e.Type, "err", err)
+	}
+}
+
+// startVerification starts the span of a verification. The returned function
+// ends the span and reports the verification to the observer.
+func (o *options) startVerification(ctx context.Context, name, operation string) (context.Context, func(error)) {
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, o.tracer, name, tracing.OperationKey.String(operation))
+	return ctx, func(err error) {
+		reason := string(ReasonOf(err))
+		tracing.SetOutcome(span, reason, err)
+		span.End()
+		if o.observer != nil {
+			o.observer.Verification(ctx, metrics.VerificationEvent{
+				Operation: operation,
+				Outcome:   metrics.Outcome(err),
+				Reason:    reason,
+				Duration:  time.Since(start),
+			})
+		}
+	}
+}
+
+// startCall starts the span of a plugin call. The returned function ends the
+// span and reports the call to the observer.
+func (o *options) startCall(ctx context.Context, operation, method string) (context.Context, func(error)) {
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, o.tracer, tracing.SpanPluginCallPrefix+method,
+		tracing.OperationKey.String(operation), tracing.MethodKey.String(method))
+	return ctx, func(err error) {
+		tracing.SetOutcome(span, string(ReasonOf(err)), err)
+		span.End()
+		if o.observer != nil {
+			o.observer.PluginCall(ctx, metrics.PluginCallEvent{
+				Operation: operation,
+				Method:    method,
+				Outcome:   metrics.Outcome(err),
+				Duration:  time.Since(start),
+			})
+		}
+	}
+}
+
+// startService starts the span of the cryptographic verification step.
+// The returned function ends it.
+func (o *options) startService(ctx context.Context, operation string) func(error) {
+	_, span := tracing.Start(ctx, o.tracer, tracing.SpanServiceVerify, tracing.OperationKey.String(operation))
+	return func(err error) {
+		if err != nil {
+			err = classifyServiceError(err)
+		}
+		tracing.SetOutcome(span, string(ReasonOf(err)), err)
+		span.End()
+	}
+}
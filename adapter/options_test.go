@@ -0,0 +1,362 @@
+package adapter
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"log/slog"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	attest "github.com/takimoto3/app-attest"
+	"github.com/takimoto3/app-attest-middleware/audit"
+	"github.com/takimoto3/app-attest-middleware/challenge"
+	"github.com/takimoto3/app-attest-middleware/metrics"
+	"github.com/takimoto3/app-attest-middleware/plugin"
+	"github.com/takimoto3/app-attest-middleware/quarantine"
+	"github.com/takimoto3/app-attest-middleware/tracing"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+type mockStatelessPluginFunc struct {
+	mockPluginFunc
+	token string
+}
+
+func (m *mockStatelessPluginFunc) AttestationChallenge(ctx context.Context, r *plugin.AttestationRequest) (string, error) {
+	return m.token, nil
+}
+
+func (m *mockStatelessPluginFunc) ChallengeBinding(ctx context.Context, req any) (challenge.Purpose, string, error) {
+	return challenge.Attest, "device", nil
+}
+
+func TestAttestationAdapter_StatelessChallenges(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	signer := challenge.NewSigner(challenge.Config{TTL: time.Minute}, challenge.Secret{ID: "k1", Key: []byte("secret")})
+	p := &mockStatelessPluginFunc{}
+	a := NewAttestationAdapter(logger, &mockServiceFunc{}, p, WithStatelessChallenges(signer))
+
+	token, err := a.NewChallenge(context.Background(), &plugin.AttestationRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := signer.Verify(token, challenge.Attest, "device"); err != nil {
+		t.Fatalf("issued challenge does not verify: %v", err)
+	}
+	unbound, err := signer.Issue(challenge.Attest, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertToken, err := signer.Issue(challenge.Assert, "device")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		token   string
+		hash    string
+		wantErr error
+	}{
+		"valid token":        {token: token, hash: token},
+		"hash mismatch":      {token: token, hash: "other", wantErr: ErrBadRequest},
+		"unbound token":      {token: unbound, hash: unbound, wantErr: ErrBadRequest},
+		"assertion token":    {token: assertToken, hash: assertToken, wantErr: ErrBadRequest},
+		"not a signed token": {token: "challenge", hash: "challenge", wantErr: ErrBadRequest},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			p.token = tt.token
+			p.extractData = func(ctx context.Context, r *plugin.AttestationRequest) (*attest.AttestationObject, []byte, []byte, error) {
+				hash := sha256.Sum256([]byte(tt.hash))
+				return &attest.AttestationObject{}, hash[:], []byte("key"), nil
+			}
+			p.isChallengeAssigned = func(ctx context.Context, r *plugin.AttestationRequest) (bool, error) {
+				t.Error("IsChallengeAssigned must not be called with stateless challenges")
+				return false, nil
+			}
+			err := a.Verify(context.Background(), &plugin.AttestationRequest{})
+			if tt.wantErr == nil && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestAttestationAdapter_StatelessChallengesRequireExtractor(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	signer := challenge.NewSigner(challenge.Config{}, challenge.Secret{ID: "k1", Key: []byte("secret")})
+	p := &mockPluginFunc{
+		extractData: func(ctx context.Context, r *plugin.AttestationRequest) (*attest.AttestationObject, []byte, []byte, error) {
+			return &attest.AttestationObject{}, []byte("hash"), []byte("key"), nil
+		},
+	}
+	a := NewAttestationAdapter(logger, &mockServiceFunc{}, p, WithStatelessChallenges(signer))
+	if err := a.Verify(context.Background(), &plugin.AttestationRequest{}); !errors.Is(err, ErrInternal) {
+		t.Errorf("expected ErrInternal, got %v", err)
+	}
+}
+
+func TestAssertionAdapter_StatelessChallenges(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	signer := challenge.NewSigner(challenge.Config{TTL: time.Minute}, challenge.Secret{ID: "k1", Key: []byte("secret")})
+	valid, err := signer.Issue(challenge.Assert, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	attestToken, err := signer.Issue(challenge.Attest, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := challenge.NewSigner(challenge.Config{TTL: -time.Minute}, challenge.Secret{ID: "k1", Key: []byte("secret")})
+	expiredToken, err := expired.Issue(challenge.Assert, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		token   string
+		wantErr error
+	}{
+		"valid token":       {token: valid},
+		"attestation token": {token: attestToken, wantErr: ErrBadRequest},
+		"expired token":     {token: expiredToken, wantErr: ErrNewChallenge},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			p := &mockPlugin{
+				ParseRequestFn: func(ctx context.Context, r *plugin.AssertionRequest) (*attest.AssertionObject, string, error) {
+					return &attest.AssertionObject{}, tc.token, nil
+				},
+				PublicKeyAndCounterFn: func(ctx context.Context, r *plugin.AssertionRequest) (*ecdsa.PublicKey, uint32, error) {
+					return &ecdsa.PublicKey{}, 1, nil
+				},
+				AssignedChallengeFn: func(ctx context.Context, r *plugin.AssertionRequest) (string, error) {
+					t.Error("AssignedChallenge must not be called with stateless challenges")
+					return "", nil
+				},
+			}
+			adapter := NewAssertionAdapter(logger, "appID", p, WithStatelessChallenges(signer)).(*assertionAdapter)
+			adapter.NewService = func(challenge string, pubkey *ecdsa.PublicKey, counter uint32) AssertionService {
+				if challenge != tc.token {
+					t.Errorf("service created with challenge %q, want %q", challenge, tc.token)
+				}
+				return &mockAssertionService{
+					VerifyFn: func(assertObject *attest.AssertionObject, challenge string, clientData []byte) (uint32, error) {
+						if want := plugin.BodyClientData(tc.token, []byte("body")); !bytes.Equal(clientData, want) {
+							t.Errorf("got client data %q, want %q", clientData, want)
+						}
+						return 2, nil
+					},
+				}
+			}
+
+			err := adapter.Verify(context.Background(), &plugin.AssertionRequest{Body: []byte("body")})
+			if tc.wantErr == nil && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			}
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("got err %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+type recordingObserver struct {
+	mu            sync.Mutex
+	verifications []metrics.VerificationEvent
+	calls         []string
+}
+
+func (o *recordingObserver) Verification(ctx context.Context, e metrics.VerificationEvent) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	e.Duration = 0
+	o.verifications = append(o.verifications, e)
+}
+
+func (o *recordingObserver) PluginCall(ctx context.Context, e metrics.PluginCallEvent) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.calls = append(o.calls, e.Method+":"+e.Outcome)
+}
+
+func (o *recordingObserver) Request(ctx context.Context, e metrics.RequestEvent) {}
+
+func TestAssertionAdapter_Observer(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := map[string]struct {
+		verifyErr error
+		updateErr error
+		want      metrics.VerificationEvent
+		wantCalls []string
+	}{
+		"success": {
+			want:      metrics.VerificationEvent{Operation: metrics.OpAssertion, Outcome: metrics.OutcomeSuccess},
+			wantCalls: []string{"ParseRequest:success", "PublicKeyAndCounter:success", "AssignedChallenge:success", "UpdateCounter:success"},
+		},
+		"counter regression": {
+			verifyErr: errors.New("counter was not not greater than previous"),
+			want:      metrics.VerificationEvent{Operation: metrics.OpAssertion, Outcome: metrics.OutcomeFailure, Reason: string(ReasonCounterNotIncreasing)},
+			wantCalls: []string{"ParseRequest:success", "PublicKeyAndCounter:success", "AssignedChallenge:success"},
+		},
+		"store failure": {
+			updateErr: errors.New("db error"),
+			want:      metrics.VerificationEvent{Operation: metrics.OpAssertion, Outcome: metrics.OutcomeFailure, Reason: string(ReasonStoreUnavailable)},
+			wantCalls: []string{"ParseRequest:success", "PublicKeyAndCounter:success", "AssignedChallenge:success", "UpdateCounter:failure"},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			p := &mockPlugin{
+				ParseRequestFn: func(ctx context.Context, r *plugin.AssertionRequest) (*attest.AssertionObject, string, error) {
+					return &attest.AssertionObject{}, "c", nil
+				},
+				PublicKeyAndCounterFn: func(ctx context.Context, r *plugin.AssertionRequest) (*ecdsa.PublicKey, uint32, error) {
+					return &ecdsa.PublicKey{}, 1, nil
+				},
+				AssignedChallengeFn: func(ctx context.Context, r *plugin.AssertionRequest) (string, error) {
+					return "c", nil
+				},
+				UpdateCounterFn: func(ctx context.Context, r *plugin.AssertionRequest, cnt uint32) error {
+					return tc.updateErr
+				},
+			}
+			observer := &recordingObserver{}
+			a := NewAssertionAdapter(logger, "appID", p, WithObserver(observer)).(*assertionAdapter)
+			a.NewService = func(challenge string, pubkey *ecdsa.PublicKey, counter uint32) AssertionService {
+				return &mockAssertionService{
+					VerifyFn: func(assertObject *attest.AssertionObject, challenge string, clientData []byte) (uint32, error) {
+						return 2, tc.verifyErr
+					},
+				}
+			}
+
+			a.Verify(context.Background(), &plugin.AssertionRequest{})
+			if want := []metrics.VerificationEvent{tc.want}; !reflect.DeepEqual(observer.verifications, want) {
+				t.Errorf("got verifications %+v, want %+v", observer.verifications, want)
+			}
+			if !reflect.DeepEqual(observer.calls, tc.wantCalls) {
+				t.Errorf("got plugin calls %v, want %v", observer.calls, tc.wantCalls)
+			}
+		})
+	}
+}
+
+func TestAttestationAdapter_Observer(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	p := &mockPluginFunc{
+		newChallenge: func(ctx context.Context, r *plugin.AttestationRequest) (string, error) {
+			return "", errors.New("db error")
+		},
+	}
+	observer := &recordingObserver{}
+	a := NewAttestationAdapter(logger, &mockServiceFunc{}, p, WithObserver(observer))
+
+	a.NewChallenge(context.Background(), &plugin.AttestationRequest{})
+	want := []metrics.VerificationEvent{{Operation: metrics.OpChallenge, Outcome: metrics.OutcomeFailure, Reason: string(ReasonStoreUnavailable)}}
+	if !reflect.DeepEqual(observer.verifications, want) {
+		t.Errorf("got verifications %+v, want %+v", observer.verifications, want)
+	}
+	if wantCalls := []string{"NewChallenge:failure"}; !reflect.DeepEqual(observer.calls, wantCalls) {
+		t.Errorf("got plugin calls %v, want %v", observer.calls, wantCalls)
+	}
+}
+
+func TestSettingsOf(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	observer := &recordingObserver{}
+	tp := sdktrace.NewTracerProvider()
+	sink := make(audit.Channel)
+	dir, err := quarantine.Open(t.TempDir(), quarantine.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := []Option{WithObserver(observer), WithTracerProvider(tp), WithAuditSink(sink), WithQuarantine(dir)}
+	want := Settings{Observer: observer, TracerProvider: tp, AuditSink: sink, Quarantine: dir}
+
+	tests := map[string]struct {
+		adapter any
+		want    Settings
+	}{
+		"attestation adapter": {adapter: NewAttestationAdapter(logger, &mockServiceFunc{}, &mockPluginFunc{}, opts...), want: want},
+		"assertion adapter":   {adapter: NewAssertionAdapter(logger, "appID", &mockPlugin{}, opts...), want: want},
+		"other adapter":       {adapter: &mockPlugin{}},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := SettingsOf(tc.adapter); got != tc.want {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAssertionAdapter_Tracing(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	p := &mockPlugin{
+		ParseRequestFn: func(ctx context.Context, r *plugin.AssertionRequest) (*attest.AssertionObject, string, error) {
+			return &attest.AssertionObject{}, "c", nil
+		},
+		PublicKeyAndCounterFn: func(ctx context.Context, r *plugin.AssertionRequest) (*ecdsa.PublicKey, uint32, error) {
+			return &ecdsa.PublicKey{}, 1, nil
+		},
+		AssignedChallengeFn: func(ctx context.Context, r *plugin.AssertionRequest) (string, error) {
+			return "c", nil
+		},
+		UpdateCounterFn: func(ctx context.Context, r *plugin.AssertionRequest, cnt uint32) error {
+			return errors.New("db error")
+		},
+	}
+	a := NewAssertionAdapter(logger, "appID", p, WithTracerProvider(tp)).(*assertionAdapter)
+	a.NewService = func(challenge string, pubkey *ecdsa.PublicKey, counter uint32) AssertionService {
+		return &mockAssertionService{
+			VerifyFn: func(assertObject *attest.AssertionObject, challenge string, clientData []byte) (uint32, error) {
+				return 2, nil
+			},
+		}
+	}
+	a.Verify(context.Background(), &plugin.AssertionRequest{})
+
+	spans := exporter.GetSpans()
+	var names []string
+	for _, s := range spans {
+		names = append(names, s.Name)
+	}
+	wantNames := []string{
+		"app_attest.plugin.ParseRequest",
+		"app_attest.plugin.PublicKeyAndCounter",
+		"app_attest.plugin.AssignedChallenge",
+		tracing.SpanServiceVerify,
+		"app_attest.plugin.UpdateCounter",
+		tracing.SpanAssertion,
+	}
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Fatalf("got spans %v, want %v", names, wantNames)
+	}
+	root := spans[len(spans)-1]
+	for _, s := range spans[:len(spans)-1] {
+		if s.Parent.SpanID() != root.SpanContext.SpanID() {
+			t.Errorf("span %s is not a child of %s", s.Name, root.Name)
+		}
+	}
+	for _, s := range []tracetest.SpanStub{spans[4], root} {
+		if s.Status.Code != codes.Error {
+			t.Errorf("span %s has status %v, want Error", s.Name, s.Status.Code)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package adapter
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/takimoto3/app-attest-middleware/plugin"
+	"github.com/takimoto3/app-attest-middleware/receipt"
+)
+
+var (
+	// ErrRiskRejected indicates the key failed a check of the RiskPolicy.
+	ErrRiskRejected = errors.New("rejected by risk policy")
+	// ErrStepUpRequired indicates the key failed a check of a RiskPolicy whose
+	// Action is RiskStepUp: the client must complete an additional
+	// authentication step before retrying. It is returned together with
+	// ErrRiskRejected.
+	ErrStepUpRequired = errors.New("step-up required")
+)
+
+// RiskAction selects how the assertion adapter answers the assertions of a key
+// that fails a check of a RiskPolicy.
+type RiskAction int
+
+const (
+	// RiskReject rejects the assertion with ErrRiskRejected.
+	RiskReject RiskAction = iota
+	// RiskReattest rejects the assertion with ErrAttestationRequired, so that
+	// the client attests a new key.
+	RiskReattest
+	// RiskStepUp rejects the assertion with ErrStepUpRequired.
+	RiskStepUp
+	// RiskFlag accepts the assertion and sets plugin.AssertionResult.Flagged
+	// to the reason of the failed check.
+	RiskFlag
+)
+
+// RiskPolicy admits keys by the risk metric and age of their App Attest receipt.
+//
+// The assertion adapter checks the risk metric and receipt creation time
+// reported by plugin.KeyDescriber, e.g. as stored by a receipt.Scheduler, once
+// the assertion signature is verified and before the challenge is consumed or
+// the counter stored. The age of a key whose receipt was never parsed is
+// measured from its attestation. The age check is skipped for a key whose
+// receipt creation and attestation times are both unknown.
+//
+// With Receipts set, the attestation adapter also checks the receipt embedded
+// in the attestation. A failed check rejects the attestation with
+// ErrRiskRejected, or only logs it if Action is RiskFlag.
+type RiskPolicy struct {
+	// MaxRiskMetric is the highest risk metric admitted. Zero disables the check.
+	MaxRiskMetric int
+	// MaxReceiptAge is the age of the oldest receipt admitted. Zero disables the
+	// check. Receipts of unknown age are admitted.
+	MaxReceiptAge time.Duration
+	// Action selects the answer to the assertions of keys failing a check.
+	// Defaults to RiskReject.
+	Action RiskAction
+	// Receipts, when set, verifies the receipts of attestations. An attestation
+	// with an invalid receipt is rejected with ReasonReceiptInvalid.
+	Receipts *receipt.Verifier
+
+	now func() time.Time
+}
+
+// WithRiskPolicy makes the adapters check keys against policy.
+// The assertion adapter requires a plugin implementing plugin.KeyDescriber.
+func WithRiskPolicy(policy RiskPolicy) Option {
+	if policy.now == nil {
+		policy.now = time.Now
+	}
+	return func(o *options) {
+		o.risk = &policy
+	}
+}
+
+// check returns the reason of the first check the receipt fails, or "" if it
+// passes. createdAt is when the receipt was created, or zero if unknown.
+func (p *RiskPolicy) check(riskMetric int, createdAt time.Time) Reason {
+	if p.MaxRiskMetric > 0 && riskMetric > p.MaxRiskMetric {
+		return ReasonRiskMetricExceeded
+	}
+	if p.MaxReceiptAge > 0 && !createdAt.IsZero() && p.now().Sub(createdAt) > p.MaxReceiptAge {
+		return ReasonReceiptStale
+	}
+	return ""
+}
+
+// checkAssertionRisk checks the key described by result against the risk
+// policy, if any. A key flagged by a RiskFlag policy is admitted with
+// result.Flagged set.
+func (o *options) checkAssertionRisk(logger *slog.Logger, describer bool, result *plugin.AssertionResult) error {
+	if o.risk == nil {
+		return nil
+	}
+	if !describer {
+		logger.Error("plugin does not implement KeyDescriber")
+		return NewVerificationError(ReasonInternal, errors.New("risk policy requires plugin.KeyDescriber"))
+	}
+	createdAt := result.ReceiptCreatedAt
+	if createdAt.IsZero() {
+		createdAt = result.AttestedAt
+	}
+	if createdAt.IsZero() && o.risk.MaxReceiptAge > 0 {
+		logger.Warn("receipt age unknown, skipping age check")
+	}
+	reason := o.risk.check(result.RiskMetric, createdAt)
+	if reason == "" {
+		return nil
+	}
+	logger.Warn("key failed risk policy", "reason", reason, "risk_metric", result.RiskMetric, "receipt_created_at", createdAt)
+	switch o.risk.Action {
+	case RiskFlag:
+		result.Flagged = string(reason)
+		return nil
+	case RiskReattest:
+		return NewVerificationError(reason, ErrAttestationRequired)
+	case RiskStepUp:
+		return NewVerificationError(reason, ErrStepUpRequired)
+	default:
+		return NewVerificationError(reason, nil)
+	}
+}
+
+// checkAttestationRisk verifies the receipt of the attestation r and checks it
+// against the risk policy, if the policy verifies receipts.
+func (o *options) checkAttestationRisk(logger *slog.Logger, r *plugin.AttestationRequest) error {
+	if o.risk == nil || o.risk.Receipts == nil {
+		return nil
+	}
+	rcpt, err := o.risk.Receipts.Verify(r.Result.Receipt)
+	if err != nil {
+		logger.Warn("invalid attestation receipt", "err", err)
+		return NewVerificationError(ReasonReceiptInvalid, err)
+	}
+	if !rcpt.PublicKey.Equal(r.Result.PublicKey) {
+		logger.Warn("attestation receipt is for another key")
+		return NewVerificationError(ReasonReceiptInvalid, fmt.Errorf("%w: receipt is for another key", receipt.ErrInvalidReceipt))
+	}
+	reason := o.risk.check(rcpt.RiskMetric, rcpt.CreationTime)
+	if reason == "" {
+		return nil
+	}
+	logger.Warn("attestation failed risk policy", "reason", reason, "risk_metric", rcpt.RiskMetric, "receipt_created_at", rcpt.CreationTime)
+	if o.risk.Action == RiskFlag {
+		return nil
+	}
+	return NewVerificationError(reason, nil)
+}
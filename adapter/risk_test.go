@@ -0,0 +1,269 @@
+package adapter
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	attest "github.com/takimoto3/app-attest"
+	"github.com/takimoto3/app-attest-middleware/attesttest"
+	"github.com/takimoto3/app-attest-middleware/audit"
+	"github.com/takimoto3/app-attest-middleware/plugin"
+	"github.com/takimoto3/app-attest-middleware/receipt"
+)
+
+func TestAssertionAdapter_RiskPolicy(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	privkey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := mockPlugin{
+		ParseRequestFn: func(ctx context.Context, r *plugin.AssertionRequest) (*attest.AssertionObject, string, error) {
+			return &attest.AssertionObject{}, "c", nil
+		},
+		PublicKeyAndCounterFn: func(ctx context.Context, r *plugin.AssertionRequest) (*ecdsa.PublicKey, uint32, error) {
+			return &privkey.PublicKey, 1, nil
+		},
+		AssignedChallengeFn: func(ctx context.Context, r *plugin.AssertionRequest) (string, error) {
+			return "c", nil
+		},
+	}
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	maxAge := 7 * 24 * time.Hour
+	risky := plugin.KeyInfo{RiskMetric: 20, ReceiptCreatedAt: now.Add(-time.Hour), AttestedAt: now.AddDate(0, 0, -30)}
+	policy := RiskPolicy{MaxRiskMetric: 10, MaxReceiptAge: maxAge, now: func() time.Time { return now }}
+
+	tests := map[string]struct {
+		info        *plugin.KeyInfo
+		action      RiskAction
+		wantErr     []error
+		wantReason  Reason
+		wantFlagged string
+	}{
+		"admitted": {
+			info: &plugin.KeyInfo{RiskMetric: 3, ReceiptCreatedAt: now.Add(-time.Hour)},
+		},
+		"reject": {
+			info:       &risky,
+			wantErr:    []error{ErrRiskRejected},
+			wantReason: ReasonRiskMetricExceeded,
+		},
+		"reattest": {
+			info:       &risky,
+			action:     RiskReattest,
+			wantErr:    []error{ErrRiskRejected, ErrAttestationRequired},
+			wantReason: ReasonRiskMetricExceeded,
+		},
+		"step-up": {
+			info:       &risky,
+			action:     RiskStepUp,
+			wantErr:    []error{ErrRiskRejected, ErrStepUpRequired},
+			wantReason: ReasonRiskMetricExceeded,
+		},
+		"flag": {
+			info:        &risky,
+			action:      RiskFlag,
+			wantFlagged: string(ReasonRiskMetricExceeded),
+		},
+		"receipt at max age": {
+			info: &plugin.KeyInfo{RiskMetric: 1, ReceiptCreatedAt: now.Add(-maxAge)},
+		},
+		"stale receipt": {
+			info:       &plugin.KeyInfo{RiskMetric: 1, ReceiptCreatedAt: now.Add(-maxAge - time.Second)},
+			wantErr:    []error{ErrRiskRejected},
+			wantReason: ReasonReceiptStale,
+		},
+		"never refreshed": {
+			info:       &plugin.KeyInfo{AttestedAt: now.Add(-maxAge - time.Second)},
+			wantErr:    []error{ErrRiskRejected},
+			wantReason: ReasonReceiptStale,
+		},
+		"unknown age": {
+			info: &plugin.KeyInfo{RiskMetric: 1},
+		},
+		"without describer": {
+			wantErr:    []error{ErrInternal},
+			wantReason: ReasonInternal,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var p plugin.AssertionPlugin = &base
+			if tc.info != nil {
+				p = &mockDescriberPlugin{
+					mockPlugin: base,
+					KeyInfoFn: func(ctx context.Context, r *plugin.AssertionRequest) (*plugin.KeyInfo, error) {
+						return tc.info, nil
+					},
+				}
+			}
+			policy := policy
+			policy.Action = tc.action
+			a := NewAssertionAdapter(logger, "appID", p, WithRiskPolicy(policy)).(*assertionAdapter)
+			a.NewService = func(challenge string, pubkey *ecdsa.PublicKey, counter uint32) AssertionService {
+				return &mockAssertionService{
+					VerifyFn: func(assertObject *attest.AssertionObject, challenge string, clientData []byte) (uint32, error) {
+						return 2, nil
+					},
+				}
+			}
+			r := &plugin.AssertionRequest{}
+			err := a.Verify(context.Background(), r)
+			for _, target := range tc.wantErr {
+				if !errors.Is(err, target) {
+					t.Errorf("got err %v, want %v", err, target)
+				}
+			}
+			if tc.wantErr == nil && err != nil {
+				t.Fatalf("got err %v", err)
+			}
+			if got := ReasonOf(err); got != tc.wantReason {
+				t.Errorf("reason = %q, want %q", got, tc.wantReason)
+			}
+			if tc.wantErr == nil && r.Result.Flagged != tc.wantFlagged {
+				t.Errorf("got flagged %q, want %q", r.Result.Flagged, tc.wantFlagged)
+			}
+		})
+	}
+}
+
+func TestAttestationAdapter_RiskPolicy(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ca, err := attesttest.NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCA, err := attesttest.NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	device, err := ca.NewDevice("appID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ca.NewDevice("appID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newReceipt := func(ca *attesttest.CA, template attesttest.ReceiptTemplate) []byte {
+		template.AppID = "appID"
+		if template.PublicKey == nil {
+			template.PublicKey = device.PublicKey()
+		}
+		data, err := ca.NewReceipt(template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	tests := map[string]struct {
+		receipt    []byte
+		action     RiskAction
+		wantErr    error
+		wantReason Reason
+		wantStored bool
+	}{
+		"admitted": {
+			receipt:    newReceipt(ca, attesttest.ReceiptTemplate{}),
+			wantStored: true,
+		},
+		"untrusted receipt": {
+			receipt:    newReceipt(otherCA, attesttest.ReceiptTemplate{}),
+			wantErr:    ErrBadRequest,
+			wantReason: ReasonReceiptInvalid,
+		},
+		"receipt of another key": {
+			receipt:    newReceipt(ca, attesttest.ReceiptTemplate{PublicKey: other.PublicKey()}),
+			wantErr:    ErrBadRequest,
+			wantReason: ReasonReceiptInvalid,
+		},
+		"risk metric exceeded": {
+			receipt:    newReceipt(ca, attesttest.ReceiptTemplate{Type: receipt.TypeReceipt, RiskMetric: 20}),
+			wantErr:    ErrRiskRejected,
+			wantReason: ReasonRiskMetricExceeded,
+		},
+		"flagged": {
+			receipt:    newReceipt(ca, attesttest.ReceiptTemplate{Type: receipt.TypeReceipt, RiskMetric: 20}),
+			action:     RiskFlag,
+			wantStored: true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			stored := false
+			a := NewAttestationAdapter(logger, &mockServiceFunc{
+				verify: func(attestObj *attest.AttestationObject, clientDataHash, keyID []byte) (*attest.Result, error) {
+					return &attest.Result{PublicKey: device.PublicKey(), Receipt: tc.receipt, Environment: attest.Production}, nil
+				},
+			}, &mockPluginFunc{
+				extractData: func(ctx context.Context, r *plugin.AttestationRequest) (*attest.AttestationObject, []byte, []byte, error) {
+					return &attest.AttestationObject{}, []byte("hash"), device.KeyID(), nil
+				},
+				isChallengeAssigned: func(ctx context.Context, r *plugin.AttestationRequest) (bool, error) { return true, nil },
+				storeResult: func(ctx context.Context, r *plugin.AttestationRequest) error {
+					stored = true
+					return nil
+				},
+			}, WithRiskPolicy(RiskPolicy{MaxRiskMetric: 10, Action: tc.action, Receipts: receipt.NewVerifier(ca.Pool(), "appID")}))
+			err := a.Verify(context.Background(), &plugin.AttestationRequest{})
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("got err %v, want %v", err, tc.wantErr)
+			}
+			if got := ReasonOf(err); got != tc.wantReason {
+				t.Errorf("reason = %q, want %q", got, tc.wantReason)
+			}
+			if stored != tc.wantStored {
+				t.Errorf("stored = %v, want %v", stored, tc.wantStored)
+			}
+		})
+	}
+}
+
+func TestAssertionAdapter_RiskPolicyBeforeStateChange(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	privkey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		action      RiskAction
+		wantErr     error
+		wantChanged bool
+	}{
+		"rejected": {wantErr: ErrRiskRejected},
+		"step-up":  {action: RiskStepUp, wantErr: ErrStepUpRequired},
+		"reattest": {action: RiskReattest, wantErr: ErrAttestationRequired},
+		"flagged":  {action: RiskFlag, wantChanged: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			p := newMockStatePlugin(&privkey.PublicKey, func() (*plugin.KeyInfo, error) {
+				return &plugin.KeyInfo{RiskMetric: 20, ReceiptCreatedAt: time.Now()}, nil
+			})
+			events := make(audit.Channel, 4)
+			a := NewAssertionAdapter(logger, "appID", p, WithAuditSink(events), WithRiskPolicy(RiskPolicy{MaxRiskMetric: 10, Action: tc.action}))
+			_, err := verifyWithCounter(a, 2)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("got err %v, want %v", err, tc.wantErr)
+			}
+			if changed := p.consumed || p.counter != 1; changed != tc.wantChanged {
+				t.Errorf("consumed = %v, counter = %d, want state changed = %v", p.consumed, p.counter, tc.wantChanged)
+			}
+			close(events)
+			for e := range events {
+				if e.Type == audit.EventCounterUpdated && !tc.wantChanged {
+					t.Errorf("unexpected audit event %+v", e)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,311 @@
+// Package attesttest mints synthetic App Attest attestations and assertions
+// for integration tests that cannot use real iOS devices.
+//
+// A CA is a local root and intermediate certificate authority standing in for
+// Apple's App Attest CA. Pass CA.Pool to attest.NewAttestationService and the
+// resulting adapters accept the attestation objects of any Device created by
+// the CA:
+//
+//	ca, err := attesttest.NewCA()
+//	service := attest.NewAttestationService(ca.Pool(), appID)
+//	device, err := ca.NewDevice(appID)
+//	hash := sha256.Sum256([]byte(challenge))
+//	attestation, err := device.AttestKey(hash[:])
+//	body, err := wire.EncodeAttestation(attestation, device.KeyID(), challenge)
+//
+// Never trust a CA pool from this package in production.
+package attesttest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"sync"
+	"time"
+
+	attest "github.com/takimoto3/app-attest"
+)
+
+// nonceOID is the credential certificate extension holding the attestation nonce.
+var nonceOID = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 8, 2}
+
+// attestedCredentialData is the authenticator data flag of attestations.
+const attestedCredentialData = 0x40
+
+// DefaultReceipt is the receipt placeholder embedded in attestation objects.
+// It is not a valid App Attest receipt.
+var DefaultReceipt = []byte("attesttest receipt")
+
+// CA is a fake App Attest certificate authority: a self-signed root and an
+// intermediate that issues the credential certificates of devices.
+type CA struct {
+	Root         *x509.Certificate
+	Intermediate *x509.Certificate
+
+	key *ecdsa.PrivateKey
+}
+
+// NewCA creates a CA with new P-384 keys, valid from an hour ago for ten years.
+func NewCA() (*CA, error) {
+	rootKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	rootTemplate := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Attesttest App Attestation Root CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	root, err := createCertificate(rootTemplate, rootTemplate, &rootKey.PublicKey, rootKey)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	intermediate, err := createCertificate(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Attesttest App Attestation CA 1"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}, root, &key.PublicKey, rootKey)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{Root: root, Intermediate: intermediate, key: key}, nil
+}
+
+// MarshalPEM encodes the root and intermediate certificates and the
+// intermediate key as PEM blocks, so that another process can load the CA with
+// ParseCA and a server can trust the root, e.g. with certs.LoadCertFiles.
+func (ca *CA) MarshalPEM() ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(ca.key)
+	if err != nil {
+		return nil, err
+	}
+	var b []byte
+	b = append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Root.Raw})...)
+	b = append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Intermediate.Raw})...)
+	b = append(b, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})...)
+	return b, nil
+}
+
+// ParseCA decodes a CA encoded by MarshalPEM.
+func ParseCA(data []byte) (*CA, error) {
+	var certs []*x509.Certificate
+	ca := &CA{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			certs = append(certs, cert)
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			ecKey, ok := key.(*ecdsa.PrivateKey)
+			if !ok {
+				return nil, errors.New("attesttest: CA key is not an ECDSA key")
+			}
+			ca.key = ecKey
+		}
+	}
+	if len(certs) != 2 || ca.key == nil {
+		return nil, errors.New("attesttest: expected a root, an intermediate and a key")
+	}
+	ca.Root, ca.Intermediate = certs[0], certs[1]
+	if !ca.key.PublicKey.Equal(ca.Intermediate.PublicKey) {
+		return nil, errors.New("attesttest: key does not match the intermediate certificate")
+	}
+	return ca, nil
+}
+
+// Pool returns a certificate pool holding the root of the CA.
+func (ca *CA) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Root)
+	return pool
+}
+
+// NewDevice creates a Device with a new P-256 key for appID in the production environment.
+func (ca *CA) NewDevice(appID string) (*Device, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	keyID := sha256.Sum256(attest.MarshalUncompressed(&key.PublicKey))
+	return &Device{
+		AppID:       appID,
+		Environment: attest.Production,
+		Receipt:     DefaultReceipt,
+		ca:          ca,
+		key:         key,
+		keyID:       keyID[:],
+	}, nil
+}
+
+// Device simulates one App Attest key on a device, following DCAppAttestService:
+// AttestKey attests the key once and GenerateAssertion signs with it.
+// It is safe for concurrent use.
+type Device struct {
+	// AppID is the App ID (team ID + "." + bundle ID) the key belongs to.
+	AppID string
+	// Environment selects the aaguid, attest.Production or attest.Sandbox.
+	Environment attest.Environment
+	// Receipt is embedded in attestation objects.
+	Receipt []byte
+
+	ca    *CA
+	key   *ecdsa.PrivateKey
+	keyID []byte
+
+	mu      sync.Mutex
+	counter uint32
+}
+
+// KeyID returns the key identifier, the SHA256 hash of the public key.
+func (d *Device) KeyID() []byte {
+	return d.keyID
+}
+
+// PublicKey returns the public key of the device.
+func (d *Device) PublicKey() *ecdsa.PublicKey {
+	return &d.key.PublicKey
+}
+
+// Counter returns the counter of the last assertion.
+func (d *Device) Counter() uint32 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.counter
+}
+
+// SetCounter sets the counter of the last assertion, e.g. to replay an old counter.
+func (d *Device) SetCounter(counter uint32) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.counter = counter
+}
+
+// AttestKey returns the CBOR attestation object for clientDataHash, with a
+// credential certificate issued by the CA.
+func (d *Device) AttestKey(clientDataHash []byte) ([]byte, error) {
+	aaguid := make([]byte, 16)
+	if d.Environment == attest.Sandbox {
+		copy(aaguid, "appattestdevelop")
+	} else {
+		copy(aaguid, "appattest")
+	}
+	authData := d.authData(attestedCredentialData, 0)
+	authData = append(authData, aaguid...)
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(d.keyID)))
+	authData = append(authData, d.keyID...)
+	authData = append(authData, d.coseKey()...)
+
+	nonce := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash...))
+	ext, err := asn1.Marshal(struct {
+		Nonce []byte `asn1:"tag:1,explicit"`
+	}{nonce[:]})
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	cred, err := createCertificate(&x509.Certificate{
+		Subject:         pkix.Name{CommonName: hex.EncodeToString(d.keyID)},
+		NotBefore:       now.Add(-time.Hour),
+		NotAfter:        now.AddDate(0, 0, 1),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtraExtensions: []pkix.Extension{{Id: nonceOID, Value: ext}},
+	}, d.ca.Intermediate, &d.key.PublicKey, d.ca.key)
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeCBOR(cborMap{
+		{"fmt", "apple-appattest"},
+		{"attStmt", cborMap{
+			{"x5c", [][]byte{cred.Raw, d.ca.Intermediate.Raw}},
+			{"receipt", d.Receipt},
+		}},
+		{"authData", authData},
+	}), nil
+}
+
+// GenerateAssertion increments the counter and returns the CBOR assertion
+// over clientDataHash, the SHA256 hash of the client data.
+func (d *Device) GenerateAssertion(clientDataHash []byte) ([]byte, error) {
+	d.mu.Lock()
+	d.counter++
+	counter := d.counter
+	d.mu.Unlock()
+
+	authData := d.authData(0, counter)
+	nonce := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash...))
+	digest := sha256.Sum256(nonce[:])
+	sig, err := ecdsa.SignASN1(rand.Reader, d.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	return encodeCBOR(cborMap{
+		{"signature", sig},
+		{"authenticatorData", authData},
+	}), nil
+}
+
+// authData returns the RP ID hash, flags and counter of the authenticator data.
+func (d *Device) authData(flags byte, counter uint32) []byte {
+	rpID := sha256.Sum256([]byte(d.AppID))
+	return binary.BigEndian.AppendUint32(append(rpID[:], flags), counter)
+}
+
+// coseKey returns the public key as a COSE_Key (EC2, ES256).
+func (d *Device) coseKey() []byte {
+	raw := attest.MarshalUncompressed(&d.key.PublicKey)
+	return encodeCBOR(cborMap{
+		{1, 2},
+		{3, -7},
+		{-1, 1},
+		{-2, raw[1:33]},
+		{-3, raw[33:]},
+	})
+}
+
+func createCertificate(template, parent *x509.Certificate, pub *ecdsa.PublicKey, signer *ecdsa.PrivateKey) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serial
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, pub, signer)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
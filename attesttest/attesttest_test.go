@@ -0,0 +1,284 @@
+package attesttest_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	attest "github.com/takimoto3/app-attest"
+	"github.com/takimoto3/app-attest-middleware/adapter"
+	"github.com/takimoto3/app-attest-middleware/attesttest"
+	"github.com/takimoto3/app-attest-middleware/challenge"
+	"github.com/takimoto3/app-attest-middleware/handler"
+	"github.com/takimoto3/app-attest-middleware/middleware"
+	"github.com/takimoto3/app-attest-middleware/plugin"
+	"github.com/takimoto3/app-attest-middleware/plugin/memory"
+	"github.com/takimoto3/app-attest-middleware/requestid"
+	"github.com/takimoto3/app-attest-middleware/wire"
+)
+
+const appID = "TEAMID1234.com.example.app"
+
+// newServer serves the attestation endpoints and an assertion-protected /api
+// on top of the in-memory plugin, trusting ca.
+func newServer(t *testing.T, ca *attesttest.CA, opts ...adapter.Option) (*httptest.Server, *memory.Plugin) {
+	t.Helper()
+	requestid.UseUUID()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := memory.New(memory.Config{})
+	service := attest.NewAttestationService(ca.Pool(), appID)
+	h := handler.NewAppAttestHandler(logger, adapter.NewAttestationAdapter(logger, service, store, opts...))
+	m := middleware.NewAssertionMiddleware(logger, middleware.Config{RequiredMode: middleware.RequiredStatus}, adapter.NewAssertionAdapter(logger, appID, store, opts...))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /challenge", h.NewChallenge)
+	mux.HandleFunc("POST /attest", h.Verify)
+	mux.Handle("POST /api", m.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv, store
+}
+
+func post(t *testing.T, req *http.Request) (int, string) {
+	t.Helper()
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, string(b)
+}
+
+func newChallenge(t *testing.T, srv *httptest.Server, d *attesttest.Device) string {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/challenge", nil)
+	req.Header.Set(wire.HeaderKeyID, base64.StdEncoding.EncodeToString(d.KeyID()))
+	status, challenge := post(t, req)
+	if status != http.StatusOK {
+		t.Fatalf("challenge: got status %d: %s", status, challenge)
+	}
+	return challenge
+}
+
+func attestDevice(t *testing.T, srv *httptest.Server, d *attesttest.Device) int {
+	t.Helper()
+	challenge := newChallenge(t, srv, d)
+	hash := sha256.Sum256([]byte(challenge))
+	obj, err := d.AttestKey(hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := wire.EncodeAttestation(obj, d.KeyID(), challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/attest", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(wire.HeaderKeyID, base64.StdEncoding.EncodeToString(d.KeyID()))
+	status, _ := post(t, req)
+	return status
+}
+
+func callAPI(t *testing.T, srv *httptest.Server, d *attesttest.Device, body string) int {
+	t.Helper()
+	challenge := newChallenge(t, srv, d)
+	hash := sha256.Sum256(plugin.BodyClientData(challenge, []byte(body)))
+	assertion, err := d.GenerateAssertion(hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api", bytes.NewBufferString(body))
+	wire.SetAssertion(req.Header, assertion, d.KeyID(), challenge)
+	status, _ := post(t, req)
+	return status
+}
+
+func TestEndToEnd(t *testing.T) {
+	ca, err := attesttest.NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, store := newServer(t, ca)
+
+	for name, env := range map[string]attest.Environment{"production": attest.Production, "sandbox": attest.Sandbox} {
+		t.Run(name, func(t *testing.T) {
+			d, err := ca.NewDevice(appID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d.Environment = env
+			if status := attestDevice(t, srv, d); status != http.StatusOK {
+				t.Fatalf("attestation: got status %d", status)
+			}
+			key, ok := store.Key(d.KeyID())
+			if !ok || !key.PublicKey.Equal(d.PublicKey()) || key.Environment != env || string(key.Receipt) != string(attesttest.DefaultReceipt) {
+				t.Fatalf("got stored key %+v, %v", key, ok)
+			}
+			for i := 0; i < 2; i++ {
+				if status := callAPI(t, srv, d, `{"n":1}`); status != http.StatusOK {
+					t.Fatalf("assertion %d: got status %d", i+1, status)
+				}
+			}
+			if key, _ := store.Key(d.KeyID()); key.Counter != 2 {
+				t.Errorf("got counter %d, want 2", key.Counter)
+			}
+		})
+	}
+}
+
+func TestEndToEnd_StatelessChallenges(t *testing.T) {
+	ca, err := attesttest.NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := challenge.NewSigner(challenge.Config{}, challenge.Secret{ID: "test", Key: []byte("0123456789abcdef0123456789abcdef")})
+	srv, store := newServer(t, ca, adapter.WithStatelessChallenges(signer))
+
+	d, err := ca.NewDevice(appID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := attestDevice(t, srv, d); status != http.StatusOK {
+		t.Fatalf("attestation: got status %d", status)
+	}
+	for i := 0; i < 2; i++ {
+		if status := callAPI(t, srv, d, `{"n":1}`); status != http.StatusOK {
+			t.Fatalf("assertion %d: got status %d", i+1, status)
+		}
+	}
+	if key, _ := store.Key(d.KeyID()); key.Counter != 2 {
+		t.Errorf("got counter %d, want 2", key.Counter)
+	}
+
+	// A challenge issued to another session is rejected.
+	other, err := ca.NewDevice(appID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := newChallenge(t, srv, other)
+	hash := sha256.Sum256(plugin.BodyClientData(token, []byte("a")))
+	assertion, err := d.GenerateAssertion(hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api", bytes.NewBufferString("a"))
+	wire.SetAssertion(req.Header, assertion, d.KeyID(), token)
+	if status, _ := post(t, req); status != http.StatusBadRequest {
+		t.Errorf("foreign challenge: got status %d, want 400", status)
+	}
+}
+
+func TestEndToEnd_Rejected(t *testing.T) {
+	ca, err := attesttest.NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCA, err := attesttest.NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, _ := newServer(t, ca)
+
+	t.Run("untrusted CA", func(t *testing.T) {
+		d, err := otherCA.NewDevice(appID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status := attestDevice(t, srv, d); status != http.StatusBadRequest {
+			t.Errorf("got status %d, want 400", status)
+		}
+	})
+	t.Run("other app", func(t *testing.T) {
+		d, err := ca.NewDevice("TEAMID1234.com.example.other")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status := attestDevice(t, srv, d); status != http.StatusBadRequest {
+			t.Errorf("got status %d, want 400", status)
+		}
+	})
+	t.Run("replayed counter", func(t *testing.T) {
+		d, err := ca.NewDevice(appID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status := attestDevice(t, srv, d); status != http.StatusOK {
+			t.Fatalf("attestation: got status %d", status)
+		}
+		if status := callAPI(t, srv, d, "a"); status != http.StatusOK {
+			t.Fatalf("got status %d", status)
+		}
+		d.SetCounter(0)
+		if status := callAPI(t, srv, d, "b"); status != http.StatusBadRequest {
+			t.Errorf("got status %d, want 400", status)
+		}
+	})
+	t.Run("assertion with another challenge", func(t *testing.T) {
+		d, err := ca.NewDevice(appID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status := attestDevice(t, srv, d); status != http.StatusOK {
+			t.Fatalf("attestation: got status %d", status)
+		}
+		// An assertion made for one challenge is sent with a fresh one.
+		hash := sha256.Sum256(plugin.BodyClientData(newChallenge(t, srv, d), []byte("a")))
+		assertion, err := d.GenerateAssertion(hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api", bytes.NewBufferString("a"))
+		wire.SetAssertion(req.Header, assertion, d.KeyID(), newChallenge(t, srv, d))
+		if status, _ := post(t, req); status != http.StatusBadRequest {
+			t.Errorf("got status %d, want 400", status)
+		}
+	})
+	t.Run("unattested key", func(t *testing.T) {
+		d, err := ca.NewDevice(appID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status := callAPI(t, srv, d, "a"); status != http.StatusUnauthorized {
+			t.Errorf("got status %d, want 401", status)
+		}
+	})
+}
+
+func TestParseCA(t *testing.T) {
+	ca, err := attesttest.NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ca.MarshalPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := attesttest.ParseCA(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A device of the parsed CA must be accepted by a server trusting the original one.
+	srv, _ := newServer(t, ca)
+	d, err := parsed.NewDevice(appID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := attestDevice(t, srv, d); status != http.StatusOK {
+		t.Errorf("got status %d", status)
+	}
+
+	if _, err := attesttest.ParseCA(data[:len(data)/2]); err == nil {
+		t.Error("expected an error for a truncated CA")
+	}
+}
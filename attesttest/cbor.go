@@ -0,0 +1,61 @@
+package attesttest
+
+import "encoding/binary"
+
+// The encoder below covers the CBOR items App Attest uses: text and byte
+// strings, arrays, integers and maps with text or integer keys.
+
+type cborPair struct {
+	key   any
+	value any
+}
+
+// cborMap is a map whose entries are encoded in the given order.
+type cborMap []cborPair
+
+func appendCBOR(b []byte, v any) []byte {
+	switch v := v.(type) {
+	case string:
+		return append(appendHeader(b, 3, uint64(len(v))), v...)
+	case []byte:
+		return append(appendHeader(b, 2, uint64(len(v))), v...)
+	case int:
+		if v < 0 {
+			return appendHeader(b, 1, uint64(-1-v))
+		}
+		return appendHeader(b, 0, uint64(v))
+	case [][]byte:
+		b = appendHeader(b, 4, uint64(len(v)))
+		for _, item := range v {
+			b = appendCBOR(b, item)
+		}
+		return b
+	case cborMap:
+		b = appendHeader(b, 5, uint64(len(v)))
+		for _, p := range v {
+			b = appendCBOR(appendCBOR(b, p.key), p.value)
+		}
+		return b
+	}
+	panic("attesttest: unsupported CBOR value")
+}
+
+func appendHeader(b []byte, major byte, n uint64) []byte {
+	mt := major << 5
+	switch {
+	case n < 24:
+		return append(b, mt|byte(n))
+	case n <= 0xff:
+		return append(b, mt|24, byte(n))
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16(append(b, mt|25), uint16(n))
+	case n <= 0xffffffff:
+		return binary.BigEndian.AppendUint32(append(b, mt|26), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(b, mt|27), n)
+}
+
+// encodeCBOR encodes v.
+func encodeCBOR(v any) []byte {
+	return appendCBOR(nil, v)
+}
@@ -0,0 +1,91 @@
+package attesttest
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/smallstep/pkcs7"
+)
+
+// ReceiptTemplate describes a receipt minted by CA.NewReceipt.
+type ReceiptTemplate struct {
+	// AppID is the App ID (team ID + "." + bundle ID) the key belongs to.
+	AppID string
+	// PublicKey is the attested key, e.g. Device.PublicKey.
+	PublicKey *ecdsa.PublicKey
+	// Type is "ATTEST" or "RECEIPT". Defaults to "ATTEST".
+	Type string
+	// CreationTime defaults to now.
+	CreationTime time.Time
+	// NotBefore defaults to a day after CreationTime.
+	NotBefore time.Time
+	// Expires defaults to 90 days after CreationTime.
+	Expires time.Time
+	// RiskMetric is included in receipts of type "RECEIPT" only.
+	RiskMetric int
+}
+
+// receiptAttribute is an attribute of the receipt payload.
+type receiptAttribute struct {
+	Type    int
+	Version int
+	Value   []byte
+}
+
+// NewReceipt returns a DER encoded PKCS#7 receipt for t, signed by the
+// intermediate of the CA. Set it as Device.Receipt to embed it in attestations.
+func (ca *CA) NewReceipt(t ReceiptTemplate) ([]byte, error) {
+	if t.PublicKey == nil {
+		return nil, errors.New("attesttest: receipt without a public key")
+	}
+	if t.Type == "" {
+		t.Type = "ATTEST"
+	}
+	if t.CreationTime.IsZero() {
+		t.CreationTime = time.Now()
+	}
+	if t.NotBefore.IsZero() {
+		t.NotBefore = t.CreationTime.AddDate(0, 0, 1)
+	}
+	if t.Expires.IsZero() {
+		t.Expires = t.CreationTime.AddDate(0, 0, 90)
+	}
+	cred, err := createCertificate(&x509.Certificate{
+		Subject:   pkix.Name{CommonName: "Attesttest attested key"},
+		NotBefore: t.CreationTime.Add(-time.Hour),
+		NotAfter:  t.Expires,
+		KeyUsage:  x509.KeyUsageDigitalSignature,
+	}, ca.Intermediate, t.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := []receiptAttribute{
+		{Type: 2, Version: 1, Value: []byte(t.AppID)},
+		{Type: 3, Version: 1, Value: cred.Raw},
+		{Type: 6, Version: 1, Value: []byte(t.Type)},
+		{Type: 12, Version: 1, Value: []byte(t.CreationTime.UTC().Format(time.RFC3339))},
+		{Type: 19, Version: 1, Value: []byte(t.NotBefore.UTC().Format(time.RFC3339))},
+		{Type: 21, Version: 1, Value: []byte(t.Expires.UTC().Format(time.RFC3339))},
+	}
+	if t.Type == "RECEIPT" {
+		attrs = append(attrs, receiptAttribute{Type: 17, Version: 1, Value: []byte(strconv.Itoa(t.RiskMetric))})
+	}
+	content, err := asn1.MarshalWithParams(attrs, "set")
+	if err != nil {
+		return nil, err
+	}
+	signed, err := pkcs7.NewSignedData(content)
+	if err != nil {
+		return nil, err
+	}
+	if err := signed.AddSigner(ca.Intermediate, ca.key, pkcs7.SignerInfoConfig{}); err != nil {
+		return nil, err
+	}
+	return signed.Finish()
+}
@@ -0,0 +1,138 @@
+// Package audit records security-relevant outcomes of the App Attest flows,
+// separately from debug logging.
+//
+// The adapters, the handler and the middleware emit an Event to a Sink for
+// every challenge issued, attestation and assertion accepted or rejected, and
+// counter updated. The bundled plugins emit EventKeyRevoked when a key is
+// revoked. JSONLines appends events to a file as JSON lines, Chain appends
+// them to a hash-chained file with signed checkpoints, and Channel hands them
+// to a goroutine.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/takimoto3/app-attest-middleware/requestid"
+)
+
+// EventType identifies what happened.
+type EventType string
+
+const (
+	EventChallengeIssued     EventType = "challenge_issued"
+	EventAttestationAccepted EventType = "attestation_accepted"
+	EventAttestationRejected EventType = "attestation_rejected"
+	EventAssertionAccepted   EventType = "assertion_accepted"
+	EventAssertionRejected   EventType = "assertion_rejected"
+	EventCounterUpdated      EventType = "counter_updated"
+	EventKeyRevoked          EventType = "key_revoked"
+)
+
+// Event is an audit record.
+type Event struct {
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+	// KeyID is the key the event is about, if known. It is encoded as base64 in JSON.
+	KeyID      []byte `json:"key_id,omitempty"`
+	RequestID  string `json:"request_id,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	// Reason is the reason code of a rejection, or the reason given for a revocation.
+	Reason string `json:"reason,omitempty"`
+	// Counter is the new counter of EventCounterUpdated.
+	Counter uint32 `json:"counter,omitempty"`
+}
+
+// Sink receives audit events. Implementations must be safe for concurrent use.
+type Sink interface {
+	Record(ctx context.Context, e Event) error
+}
+
+// Emit fills in the time, the request ID of ctx and the remote address of r,
+// when not already set, and records e with sink. r may be nil.
+// A nil sink discards the event.
+func Emit(ctx context.Context, sink Sink, r *http.Request, e Event) error {
+	if sink == nil {
+		return nil
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if e.RequestID == "" {
+		e.RequestID = requestid.FromContext(ctx)
+	}
+	if e.RemoteAddr == "" && r != nil {
+		e.RemoteAddr = r.RemoteAddr
+	}
+	return sink.Record(ctx, e)
+}
+
+// JSONLines writes each event as one JSON object per line.
+type JSONLines struct {
+	mu     sync.Mutex
+	enc    *json.Encoder
+	syncer interface{ Sync() error }
+	closer io.Closer
+}
+
+var _ Sink = (*JSONLines)(nil)
+
+// NewJSONLines creates a JSONLines writing to w.
+func NewJSONLines(w io.Writer) *JSONLines {
+	return &JSONLines{enc: json.NewEncoder(w)}
+}
+
+// OpenFile opens or creates the file at path for appending and returns a
+// JSONLines writing to it. Each event is synced to disk before Record returns.
+func OpenFile(path string) (*JSONLines, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	j := NewJSONLines(f)
+	j.syncer = f
+	j.closer = f
+	return j, nil
+}
+
+// Record implements Sink.
+func (j *JSONLines) Record(ctx context.Context, e Event) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.enc.Encode(e); err != nil {
+		return err
+	}
+	if j.syncer != nil {
+		return j.syncer.Sync()
+	}
+	return nil
+}
+
+// Close closes the file opened by OpenFile. It does nothing for NewJSONLines.
+func (j *JSONLines) Close() error {
+	if j.closer == nil {
+		return nil
+	}
+	return j.closer.Close()
+}
+
+// Channel sends events on a channel. Record blocks until the event is
+// received or ctx is done, so buffer the channel or drain it promptly.
+type Channel chan Event
+
+var _ Sink = Channel(nil)
+
+// Record implements Sink.
+func (c Channel) Record(ctx context.Context, e Event) error {
+	select {
+	case c <- e:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,117 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/takimoto3/app-attest-middleware/requestid"
+)
+
+type fixedGenerator struct{}
+
+func (fixedGenerator) NextID() (string, error) { return "req-1", nil }
+
+func TestEmit(t *testing.T) {
+	requestid.UseGenerator(fixedGenerator{})
+	r, _, err := requestid.EnsureRequest(httptest.NewRequest("POST", "/attest", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Unix(1700000000, 0)
+
+	tests := map[string]struct {
+		event Event
+		want  Event
+	}{
+		"fills in": {
+			event: Event{Type: EventAttestationRejected, Reason: "nonce_mismatch"},
+			want:  Event{Type: EventAttestationRejected, Reason: "nonce_mismatch", RequestID: "req-1", RemoteAddr: r.RemoteAddr},
+		},
+		"keeps set fields": {
+			event: Event{Type: EventKeyRevoked, Time: at, RequestID: "other", RemoteAddr: "10.0.0.1:1"},
+			want:  Event{Type: EventKeyRevoked, Time: at, RequestID: "other", RemoteAddr: "10.0.0.1:1"},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			ch := make(Channel, 1)
+			if err := Emit(r.Context(), ch, r, tc.event); err != nil {
+				t.Fatal(err)
+			}
+			got := <-ch
+			if tc.want.Time.IsZero() {
+				if got.Time.IsZero() {
+					t.Error("Time is not filled in")
+				}
+				got.Time = time.Time{}
+			}
+			if got.Type != tc.want.Type || !got.Time.Equal(tc.want.Time) || got.RequestID != tc.want.RequestID ||
+				got.RemoteAddr != tc.want.RemoteAddr || got.Reason != tc.want.Reason {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+
+	if err := Emit(context.Background(), nil, nil, Event{}); err != nil {
+		t.Errorf("nil sink returned %v", err)
+	}
+}
+
+func TestOpenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	events := []Event{
+		{Type: EventChallengeIssued, Time: time.Unix(1, 0).UTC(), RequestID: "a"},
+		{Type: EventCounterUpdated, Time: time.Unix(2, 0).UTC(), KeyID: []byte("key"), Counter: 7},
+	}
+	// Each event is written by a separately opened sink to check that the file is appended to.
+	for _, e := range events {
+		sink, err := OpenFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.Record(context.Background(), e); err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	want := []string{
+		`{"type":"challenge_issued","time":"1970-01-01T00:00:01Z","request_id":"a"}`,
+		`{"type":"counter_updated","time":"1970-01-01T00:00:02Z","key_id":"a2V5","counter":7}`,
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got lines\n%s\nwant\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+	var e Event
+	if err := json.Unmarshal([]byte(lines[1]), &e); err != nil || string(e.KeyID) != "key" {
+		t.Errorf("line does not round-trip: %+v, %v", e, err)
+	}
+}
+
+func TestChannel_Canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := make(Channel).Record(ctx, Event{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
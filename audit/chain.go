@@ -0,0 +1,332 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// checkpointVersion is the first line of the message signed by a checkpoint.
+const checkpointVersion = "APPATTEST-AUDIT-CHECKPOINT-V1"
+
+// genesis is the prev hash of the first record of a chain.
+var genesis = strings.Repeat("0", sha256.Size*2)
+
+var (
+	// ErrChainBroken indicates a record was altered, deleted, inserted or reordered.
+	ErrChainBroken = errors.New("audit: chain broken")
+	// ErrBadCheckpoint indicates a checkpoint signature does not verify.
+	ErrBadCheckpoint = errors.New("audit: invalid checkpoint signature")
+	// ErrUnsupportedKey indicates the checkpoint key is neither Ed25519 nor ECDSA.
+	ErrUnsupportedKey = errors.New("audit: unsupported checkpoint key")
+)
+
+// ChainRecord is one line of a hash-chained audit log. Exactly one of Event and
+// Checkpoint is set.
+type ChainRecord struct {
+	// Seq is the position of the record in the chain, starting at 1.
+	Seq uint64 `json:"seq"`
+	// Prev is the hex SHA-256 of the previous line, or 64 zeros for the first record.
+	Prev       string      `json:"prev"`
+	Event      *Event      `json:"event,omitempty"`
+	Checkpoint *Checkpoint `json:"checkpoint,omitempty"`
+}
+
+// Checkpoint signs the chain head, i.e. the Prev of its record, and with it
+// every record before it.
+type Checkpoint struct {
+	Time      time.Time `json:"time"`
+	Signature []byte    `json:"signature"`
+}
+
+// ChainConfig holds the settings of a Chain.
+type ChainConfig struct {
+	// Signer signs checkpoints. It must hold an Ed25519 or ECDSA key.
+	Signer crypto.Signer
+	// CheckpointEvery is the number of events after which a checkpoint is
+	// written. Defaults to 100. Call Chain.Checkpoint to checkpoint on a timer.
+	CheckpointEvery int
+}
+
+// Chain is a Sink that appends events to a tamper-evident log file. Each line
+// is a ChainRecord holding the hash of the previous line, and the head of the
+// chain is periodically signed in a checkpoint record. VerifyChain detects
+// altered, deleted or reordered records.
+type Chain struct {
+	config ChainConfig
+	now    func() time.Time
+
+	mu        sync.Mutex
+	f         *os.File
+	seq       uint64
+	head      string
+	since     int
+	truncated int
+}
+
+var _ Sink = (*Chain)(nil)
+
+// OpenChain opens or creates the chain file at path for appending. An existing
+// chain is continued from its last record. A last line without a newline is
+// left by a crash during a write; its record was never acknowledged by Record,
+// so OpenChain truncates the file back to the last complete line and reports
+// the dropped bytes in Chain.Truncated.
+func OpenChain(path string, config ChainConfig) (*Chain, error) {
+	if config.Signer == nil {
+		return nil, errors.New("audit: ChainConfig.Signer is required")
+	}
+	switch config.Signer.Public().(type) {
+	case ed25519.PublicKey, *ecdsa.PublicKey:
+	default:
+		return nil, ErrUnsupportedKey
+	}
+	if config.CheckpointEvery <= 0 {
+		config.CheckpointEvery = 100
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	c := &Chain{config: config, now: time.Now, f: f, head: genesis}
+	if err := c.resume(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// resume reads the existing chain to find its last sequence number and head,
+// and truncates an incomplete last line.
+func (c *Chain) resume() error {
+	r := bufio.NewReader(c.f)
+	var offset int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			if line[len(line)-1] != '\n' {
+				if err := c.f.Truncate(offset); err != nil {
+					return fmt.Errorf("audit: truncate incomplete last line: %w", err)
+				}
+				c.truncated = len(line)
+				return nil
+			}
+			offset += int64(len(line))
+			line = line[:len(line)-1]
+			var rec ChainRecord
+			if err := json.Unmarshal(line, &rec); err != nil {
+				return fmt.Errorf("%w: record %d: %v", ErrChainBroken, c.seq+1, err)
+			}
+			c.seq = rec.Seq
+			c.head = hashLine(line)
+			if rec.Checkpoint != nil {
+				c.since = 0
+			} else {
+				c.since++
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Record implements Sink. The record is synced to disk before Record returns.
+func (c *Chain) Record(ctx context.Context, e Event) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.append(ChainRecord{Event: &e}); err != nil {
+		return err
+	}
+	c.since++
+	if c.since >= c.config.CheckpointEvery {
+		return c.checkpoint()
+	}
+	return nil
+}
+
+// Checkpoint signs the current head of the chain.
+func (c *Chain) Checkpoint() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.checkpoint()
+}
+
+// Close writes a checkpoint if events were recorded since the last one and closes the file.
+func (c *Chain) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	if c.since > 0 {
+		err = c.checkpoint()
+	}
+	return errors.Join(err, c.f.Close())
+}
+
+// Truncated returns the number of bytes of an incomplete last line that
+// OpenChain removed, or 0 if the chain ended with a complete line.
+func (c *Chain) Truncated() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.truncated
+}
+
+// Head returns the sequence number and hash of the last record.
+func (c *Chain) Head() (uint64, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.seq, c.head
+}
+
+// checkpoint appends a signed checkpoint. The caller must hold c.mu.
+func (c *Chain) checkpoint() error {
+	cp := &Checkpoint{Time: c.now().UTC()}
+	sig, err := signCheckpoint(c.config.Signer, checkpointMessage(c.seq+1, c.head, cp.Time))
+	if err != nil {
+		return fmt.Errorf("audit: sign checkpoint: %w", err)
+	}
+	cp.Signature = sig
+	if err := c.append(ChainRecord{Checkpoint: cp}); err != nil {
+		return err
+	}
+	c.since = 0
+	return nil
+}
+
+// append writes rec as the next record. The caller must hold c.mu.
+func (c *Chain) append(rec ChainRecord) error {
+	rec.Seq = c.seq + 1
+	rec.Prev = c.head
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := c.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := c.f.Sync(); err != nil {
+		return err
+	}
+	c.seq = rec.Seq
+	c.head = hashLine(line)
+	return nil
+}
+
+// ChainReport summarizes a verified chain.
+type ChainReport struct {
+	// Events is the number of event records.
+	Events int
+	// Checkpoints is the number of checkpoint records.
+	Checkpoints int
+	// Seq and Head are the sequence number and hash of the last record.
+	// Compare them with a copy kept elsewhere to detect a truncated tail.
+	Seq  uint64
+	Head string
+	// Unsigned is the number of records after the last checkpoint. They are
+	// protected by the chain but not yet by a signature.
+	Unsigned int
+}
+
+// ChainError reports where a chain failed verification.
+type ChainError struct {
+	// Line is the 1-based line number of the offending record.
+	Line int
+	Err  error
+}
+
+func (e *ChainError) Error() string {
+	return "line " + strconv.Itoa(e.Line) + ": " + e.Err.Error()
+}
+
+func (e *ChainError) Unwrap() error { return e.Err }
+
+// VerifyChain reads a chain written by Chain and checks that every record
+// links to the previous one and that every checkpoint is signed by pub.
+// It returns a *ChainError wrapping ErrChainBroken or ErrBadCheckpoint
+// for the first offending record.
+func VerifyChain(r io.Reader, pub crypto.PublicKey) (*ChainReport, error) {
+	report := &ChainReport{Head: genesis}
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := br.ReadBytes('\n')
+		if len(line) == 0 && errors.Is(err, io.EOF) {
+			return report, nil
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return report, err
+		}
+		line = bytes.TrimSuffix(line, []byte("\n"))
+
+		var rec ChainRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return report, &ChainError{Line: n, Err: fmt.Errorf("%w: %v", ErrChainBroken, err)}
+		}
+		switch {
+		case rec.Seq != report.Seq+1:
+			return report, &ChainError{Line: n, Err: fmt.Errorf("%w: sequence %d follows %d", ErrChainBroken, rec.Seq, report.Seq)}
+		case rec.Prev != report.Head:
+			return report, &ChainError{Line: n, Err: fmt.Errorf("%w: previous record hash does not match", ErrChainBroken)}
+		case (rec.Event == nil) == (rec.Checkpoint == nil):
+			return report, &ChainError{Line: n, Err: fmt.Errorf("%w: record must hold one event or checkpoint", ErrChainBroken)}
+		}
+		if rec.Checkpoint != nil {
+			msg := checkpointMessage(rec.Seq, rec.Prev, rec.Checkpoint.Time)
+			if !verifyCheckpoint(pub, msg, rec.Checkpoint.Signature) {
+				return report, &ChainError{Line: n, Err: ErrBadCheckpoint}
+			}
+			report.Checkpoints++
+			report.Unsigned = 0
+		} else {
+			report.Events++
+			report.Unsigned++
+		}
+		report.Seq = rec.Seq
+		report.Head = hashLine(line)
+	}
+}
+
+func hashLine(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// checkpointMessage returns the bytes signed by the checkpoint record seq over head.
+func checkpointMessage(seq uint64, head string, t time.Time) []byte {
+	return []byte(checkpointVersion + "\n" + strconv.FormatUint(seq, 10) + "\n" + head + "\n" + t.UTC().Format(time.RFC3339Nano))
+}
+
+func signCheckpoint(signer crypto.Signer, msg []byte) ([]byte, error) {
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		return signer.Sign(rand.Reader, msg, crypto.Hash(0))
+	}
+	digest := sha256.Sum256(msg)
+	return signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+func verifyCheckpoint(pub crypto.PublicKey, msg, sig []byte) bool {
+	switch k := pub.(type) {
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, msg, sig)
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(msg)
+		return ecdsa.VerifyASN1(k, digest[:], sig)
+	}
+	return false
+}
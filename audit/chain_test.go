@@ -0,0 +1,216 @@
+package audit
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeChain records n events in a new chain at a temporary path, reopening
+// it halfway to check that the chain is continued, and returns the lines.
+func writeChain(t *testing.T, signer crypto.Signer, n int) []string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.chain")
+	for _, count := range []int{n / 2, n - n/2} {
+		c, err := OpenChain(path, ChainConfig{Signer: signer, CheckpointEvery: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < count; i++ {
+			e := Event{Type: EventAttestationAccepted, Time: time.Unix(int64(i), 0).UTC(), KeyID: []byte("key")}
+			if err := c.Record(context.Background(), e); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := c.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.SplitAfter(strings.TrimSuffix(string(b), "\n"), "\n")
+}
+
+func TestChain(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	for name, signer := range map[string]crypto.Signer{"ed25519": edKey, "ecdsa": ecKey} {
+		t.Run(name, func(t *testing.T) {
+			// 3 events and a checkpoint from the first session, then 2 events,
+			// a checkpoint and an event followed by the checkpoint of Close.
+			lines := writeChain(t, signer, 6)
+			if len(lines) != 10 {
+				t.Fatalf("got %d lines, want 10:\n%s", len(lines), strings.Join(lines, ""))
+			}
+			report, err := VerifyChain(strings.NewReader(strings.Join(lines, "")), signer.Public())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Events != 6 || report.Checkpoints != 4 || report.Seq != 10 || report.Unsigned != 0 {
+				t.Errorf("got report %+v", report)
+			}
+		})
+	}
+}
+
+func TestVerifyChain_Tampered(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	lines := writeChain(t, key, 4)
+
+	tests := map[string]struct {
+		edit     func(lines []string) []string
+		pub      crypto.PublicKey
+		wantErr  error
+		wantLine int
+	}{
+		"altered event": {
+			edit: func(lines []string) []string {
+				lines[1] = strings.Replace(lines[1], "attestation_accepted", "attestation_rejected", 1)
+				return lines
+			},
+			wantErr:  ErrChainBroken,
+			wantLine: 3,
+		},
+		"deleted record": {
+			edit:     func(lines []string) []string { return slices.Delete(lines, 1, 2) },
+			wantErr:  ErrChainBroken,
+			wantLine: 2,
+		},
+		"swapped records": {
+			edit: func(lines []string) []string {
+				lines[0], lines[1] = lines[1], lines[0]
+				return lines
+			},
+			wantErr:  ErrChainBroken,
+			wantLine: 1,
+		},
+		"truncated record": {
+			edit: func(lines []string) []string {
+				lines[len(lines)-1] = lines[len(lines)-1][:20]
+				return lines
+			},
+			wantErr:  ErrChainBroken,
+			wantLine: 6,
+		},
+		"other key": {
+			edit:     func(lines []string) []string { return lines },
+			pub:      otherKey.Public(),
+			wantErr:  ErrBadCheckpoint,
+			wantLine: 3,
+		},
+		"unsigned tail": {
+			edit: func(lines []string) []string { return lines[:len(lines)-1] },
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			pub := tc.pub
+			if pub == nil {
+				pub = key.Public()
+			}
+			edited := tc.edit(slices.Clone(lines))
+			report, err := VerifyChain(strings.NewReader(strings.Join(edited, "")), pub)
+			if tc.wantErr == nil {
+				if err != nil || report.Unsigned != 2 {
+					t.Errorf("got report %+v, err %v", report, err)
+				}
+				return
+			}
+			var chainErr *ChainError
+			if !errors.Is(err, tc.wantErr) || !errors.As(err, &chainErr) || chainErr.Line != tc.wantLine {
+				t.Errorf("expected %v at line %d, got %v", tc.wantErr, tc.wantLine, err)
+			}
+		})
+	}
+}
+
+func TestOpenChain_Errors(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	dir := t.TempDir()
+	broken := filepath.Join(dir, "broken.chain")
+	if err := os.WriteFile(broken, []byte("{\"seq\":1,\"prev\":\"00\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		path    string
+		config  ChainConfig
+		wantErr error
+	}{
+		"unsupported key": {path: filepath.Join(dir, "a.chain"), config: ChainConfig{Signer: unsupportedSigner{}}, wantErr: ErrUnsupportedKey},
+		"invalid line":    {path: broken, config: ChainConfig{Signer: key}, wantErr: ErrChainBroken},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := OpenChain(tc.path, tc.config); !errors.Is(err, tc.wantErr) {
+				t.Errorf("expected %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestOpenChain_Truncated(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	complete := strings.Join(writeChain(t, key, 3), "") + "\n"
+
+	tests := map[string]struct {
+		content string
+		partial string
+		wantSeq uint64
+	}{
+		"partial record":     {content: complete, partial: `{"seq":6,"prev":"ab`, wantSeq: 7},
+		"partial first line": {partial: `{"seq":1,"pr`, wantSeq: 2},
+		"complete":           {content: complete, wantSeq: 7},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.chain")
+			if err := os.WriteFile(path, []byte(tc.content+tc.partial), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			c, err := OpenChain(path, ChainConfig{Signer: key})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := c.Truncated(); got != len(tc.partial) {
+				t.Errorf("Truncated() = %d, want %d", got, len(tc.partial))
+			}
+			if err := c.Record(context.Background(), Event{Type: EventAttestationAccepted, Time: time.Unix(0, 0).UTC()}); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Close(); err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			report, err := VerifyChain(f, key.Public())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Seq != tc.wantSeq {
+				t.Errorf("got seq %d, want %d", report.Seq, tc.wantSeq)
+			}
+		})
+	}
+}
+
+type unsupportedSigner struct{ crypto.Signer }
+
+func (unsupportedSigner) Public() crypto.PublicKey { return "key" }
@@ -0,0 +1,193 @@
+// Package canonical builds the canonical request bytes used as assertion
+// client data.
+//
+// By default an assertion signs only the request body, so the method, path and
+// query of a request are not covered. With canonical request binding, the
+// client signs a deterministic byte string derived from the whole request
+// instead. The format is specified in docs/canonical-request.md; clients must
+// build exactly the same bytes.
+//
+// The canonical request is made of the following lines, separated by '\n',
+// without a trailing newline:
+//
+//	APPATTEST-REQUEST-V1
+//	<method>
+//	<canonical path>
+//	<canonical query>
+//	<signed header names>
+//	<name>:<value>          (one line per signed header)
+//	<hex SHA256 of the body>
+//	<challenge>
+package canonical
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Version is the first line of every canonical request.
+const Version = "APPATTEST-REQUEST-V1"
+
+var (
+	// ErrInvalidRequest indicates the request cannot be canonicalized.
+	ErrInvalidRequest = errors.New("canonical: invalid request")
+	// ErrInvalidConfig indicates the Config lists a header that cannot be signed.
+	ErrInvalidConfig = errors.New("canonical: invalid config")
+)
+
+// assertionHeaders are the headers that carry the assertion itself, in
+// lowercase. They cannot be signed, since the assertion is computed over the
+// canonical request.
+var assertionHeaders = []string{"x-app-attest-assertion", "x-app-attest-key-id", "x-app-attest-challenge"}
+
+// Config selects the parts of a request covered by the canonical request.
+type Config struct {
+	// Headers lists the names of the headers to sign. Names are case-insensitive.
+	// A listed header that is absent is signed with an empty value.
+	// The assertion headers themselves cannot be listed; Normalize rejects them
+	// with ErrInvalidConfig.
+	Headers []string
+}
+
+// Normalize returns c with the header names trimmed, lower-cased, sorted and
+// deduplicated, as they are signed. It returns ErrInvalidConfig for an empty or
+// malformed name and for the assertion headers. Servers call it once, when
+// they are configured.
+func (c Config) Normalize() (Config, error) {
+	for _, h := range c.Headers {
+		name := strings.ToLower(strings.TrimSpace(h))
+		if name == "" || strings.ContainsAny(name, ":;\r\n") {
+			return Config{}, fmt.Errorf("%w: invalid header name %q", ErrInvalidConfig, h)
+		}
+		if slices.Contains(assertionHeaders, name) {
+			return Config{}, fmt.Errorf("%w: assertion header %q cannot be signed", ErrInvalidConfig, h)
+		}
+	}
+	return Config{Headers: headerNames(c.Headers)}, nil
+}
+
+// Validate returns the error Normalize returns for c, if any. Call it on a
+// Config built at run time, e.g. from a configuration file, before passing it
+// to middleware.NewAssertionMiddleware, which panics on an invalid Config.
+func (c Config) Validate() error {
+	_, err := c.Normalize()
+	return err
+}
+
+// Build returns the canonical request for r with the given body and challenge.
+// body replaces r.Body, which is not read. The header names are signed as
+// Normalize returns them, without being validated; errors are only returned
+// for requests that cannot be canonicalized.
+func (c Config) Build(r *http.Request, body []byte, challenge string) ([]byte, error) {
+	if strings.ContainsAny(challenge, "\r\n") {
+		return nil, fmt.Errorf("%w: challenge contains a line break", ErrInvalidRequest)
+	}
+	query, err := canonicalQuery(r.URL.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+	names := headerNames(c.Headers)
+
+	var b strings.Builder
+	b.WriteString(Version)
+	b.WriteByte('\n')
+	b.WriteString(strings.ToUpper(r.Method))
+	b.WriteByte('\n')
+	b.WriteString(canonicalPath(r.URL.Path))
+	b.WriteByte('\n')
+	b.WriteString(query)
+	b.WriteByte('\n')
+	b.WriteString(strings.Join(names, ";"))
+	b.WriteByte('\n')
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteByte(':')
+		b.WriteString(headerValue(r, name))
+		b.WriteByte('\n')
+	}
+	sum := sha256.Sum256(body)
+	b.WriteString(hex.EncodeToString(sum[:]))
+	b.WriteByte('\n')
+	b.WriteString(challenge)
+	return []byte(b.String()), nil
+}
+
+// headerNames trims, lower-cases, sorts and deduplicates header names.
+func headerNames(headers []string) []string {
+	names := make([]string, len(headers))
+	for i, h := range headers {
+		names[i] = strings.ToLower(strings.TrimSpace(h))
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// canonicalPath percent-encodes the decoded path. An empty path becomes "/".
+func canonicalPath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return escape(path, true)
+}
+
+// canonicalQuery decodes the query, sorts the parameters by name and then by
+// value, and re-encodes them.
+func canonicalQuery(raw string) (string, error) {
+	values, err := url.ParseQuery(raw)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+	}
+	pairs := make([]string, 0, len(values))
+	for _, name := range slices.Sorted(maps.Keys(values)) {
+		vs := slices.Clone(values[name])
+		slices.Sort(vs)
+		for _, v := range vs {
+			pairs = append(pairs, escape(name, false)+"="+escape(v, false))
+		}
+	}
+	return strings.Join(pairs, "&"), nil
+}
+
+// headerValue joins the values of the header, trimmed of spaces and tabs, with ','.
+// The host header is read from r.Host, where net/http moves it.
+func headerValue(r *http.Request, name string) string {
+	if name == "host" {
+		return strings.Trim(r.Host, " \t")
+	}
+	values := r.Header.Values(name)
+	trimmed := make([]string, len(values))
+	for i, v := range values {
+		trimmed[i] = strings.Trim(v, " \t")
+	}
+	return strings.Join(trimmed, ",")
+}
+
+// escape percent-encodes every byte of s except the RFC 3986 unreserved
+// characters, and '/' when keepSlash is set. Hex digits are upper case.
+func escape(s string, keepSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isUnreserved(c) || (keepSlash && c == '/') {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hexDigits[c>>4])
+		b.WriteByte(hexDigits[c&0x0f])
+	}
+	return b.String()
+}
+
+func isUnreserved(c byte) bool {
+	return 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
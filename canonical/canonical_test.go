@@ -0,0 +1,166 @@
+package canonical
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// specExample is the example of docs/canonical-request.md.
+const specExample = "APPATTEST-REQUEST-V1\n" +
+	"POST\n" +
+	"/v1/orders/caf%C3%A9\n" +
+	"a=1&a=2&b=x%20y&limit=10\n" +
+	"content-type;host\n" +
+	"content-type:application/json\n" +
+	"host:api.example.com\n" +
+	"bc7941dfd513d3f2835d4657e52bbd3bd595dcd4cf6be133bbd5aa3b0b9bbd98\n" +
+	"k1.challenge.mac"
+
+func TestConfig_Build(t *testing.T) {
+	tests := map[string]struct {
+		method    string
+		target    string
+		headers   map[string][]string
+		config    Config
+		body      string
+		challenge string
+		want      string
+		wantErr   error
+	}{
+		"spec example": {
+			method:    http.MethodPost,
+			target:    "https://api.example.com/v1/orders/caf%C3%A9?limit=10&b=x+y&a=2&a=1",
+			headers:   map[string][]string{"Content-Type": {"application/json"}},
+			config:    Config{Headers: []string{"Content-Type", "Host"}},
+			body:      `{"item":42}`,
+			challenge: "k1.challenge.mac",
+			want:      specExample,
+		},
+		"get without query, headers or body": {
+			method:    http.MethodGet,
+			target:    "/hello",
+			challenge: "c",
+			want:      "APPATTEST-REQUEST-V1\nGET\n/hello\n\n\ne3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855\nc",
+		},
+		"header names are normalized and deduplicated": {
+			method:    http.MethodGet,
+			target:    "/",
+			headers:   map[string][]string{"X-B": {" 2 ", "3"}},
+			config:    Config{Headers: []string{"x-b", " X-A", "X-B"}},
+			challenge: "c",
+			want:      "APPATTEST-REQUEST-V1\nGET\n/\n\nx-a;x-b\nx-a:\nx-b:2,3\ne3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855\nc",
+		},
+		"reserved characters are escaped": {
+			method:    "get",
+			target:    "/a%20b/c%2Fd?q=%26%3D&e",
+			challenge: "c",
+			want:      "APPATTEST-REQUEST-V1\nGET\n/a%20b/c/d\ne=&q=%26%3D\n\ne3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855\nc",
+		},
+		"invalid query": {
+			method:  http.MethodGet,
+			target:  "/?a=%zz",
+			wantErr: ErrInvalidRequest,
+		},
+		"challenge with line break": {
+			method:    http.MethodGet,
+			target:    "/",
+			challenge: "a\nb",
+			wantErr:   ErrInvalidRequest,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.target, nil)
+			for k, vs := range tc.headers {
+				for _, v := range vs {
+					r.Header.Add(k, v)
+				}
+			}
+			got, err := tc.config.Build(r, []byte(tc.body), tc.challenge)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Build() error = %v, want %v", err, tc.wantErr)
+			}
+			if string(got) != tc.want {
+				t.Errorf("Build() =\n%s\nwant\n%s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestConfig_Normalize(t *testing.T) {
+	tests := map[string]struct {
+		config  Config
+		want    []string
+		wantErr error
+	}{
+		"names are normalized and deduplicated": {
+			config: Config{Headers: []string{"x-b", " X-A", "X-B"}},
+			want:   []string{"x-a", "x-b"},
+		},
+		"no headers": {
+			want: []string{},
+		},
+		"empty header name": {
+			config:  Config{Headers: []string{" "}},
+			wantErr: ErrInvalidConfig,
+		},
+		"invalid header name": {
+			config:  Config{Headers: []string{"a:b"}},
+			wantErr: ErrInvalidConfig,
+		},
+		"assertion header": {
+			config:  Config{Headers: []string{"Content-Type", "X-App-Attest-Key-Id"}},
+			wantErr: ErrInvalidConfig,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := tc.config.Validate(); !errors.Is(err, tc.wantErr) {
+				t.Errorf("Validate() error = %v, want %v", err, tc.wantErr)
+			}
+			got, err := tc.config.Normalize()
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Normalize() error = %v, want %v", err, tc.wantErr)
+			}
+			if tc.wantErr == nil && !slices.Equal(got.Headers, tc.want) {
+				t.Errorf("Normalize() headers = %q, want %q", got.Headers, tc.want)
+			}
+		})
+	}
+}
+
+func TestConfig_BuildIsDeterministic(t *testing.T) {
+	config := Config{Headers: []string{"X-Z", "X-A"}}
+	a := httptest.NewRequest(http.MethodGet, "/p?b=2&a=1&a=0", nil)
+	a.Header.Set("X-A", "1")
+	a.Header.Set("X-Z", "2")
+	b := httptest.NewRequest(http.MethodGet, "/p?a=0&a=1&b=2", nil)
+	b.Header.Set("x-z", "2")
+	b.Header.Set("x-a", "1")
+
+	got1, err := config.Build(a, nil, "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got2, err := Config{Headers: []string{"x-a", "x-z"}}.Build(b, nil, "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got1) != string(got2) {
+		t.Errorf("equivalent requests produced different bytes:\n%s\n%s", got1, got2)
+	}
+
+	c := httptest.NewRequest(http.MethodGet, "/p?a=0&a=1&b=3", nil)
+	c.Header = b.Header
+	got3, err := config.Build(c, nil, "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.EqualFold(string(got1), string(got3)) {
+		t.Error("tampered query produced the same bytes")
+	}
+}
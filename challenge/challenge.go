@@ -0,0 +1,186 @@
+// Package challenge issues and verifies stateless App Attest challenges.
+//
+// A challenge is a self-contained token made of a random nonce, its purpose
+// and an expiry, MACed with HMAC-SHA256 together with an optional key or
+// session binding. It can be verified without a server-side store. Secrets can
+// be rotated; tokens signed with a retired secret stay valid for a grace period.
+//
+// Token format:
+//
+//	<secret id>.<base64url(nonce[16] || expiry[8, big endian unix seconds] || purpose)>.<base64url(mac)>
+//
+// where mac = HMAC-SHA256(secret, secret id || 0x00 || payload || 0x00 || binding).
+package challenge
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrMalformed indicates the token cannot be parsed.
+	ErrMalformed = errors.New("challenge: malformed token")
+	// ErrInvalid indicates the MAC does not match or the secret is unknown or retired.
+	ErrInvalid = errors.New("challenge: invalid token")
+	// ErrExpired indicates the token has expired.
+	ErrExpired = errors.New("challenge: expired token")
+	// ErrPurposeMismatch indicates the token was issued for another purpose.
+	ErrPurposeMismatch = errors.New("challenge: purpose mismatch")
+)
+
+// Purpose is the flow a challenge is issued for.
+type Purpose string
+
+const (
+	// Attest is the purpose of challenges used for attestation.
+	Attest Purpose = "attest"
+	// Assert is the purpose of challenges used for assertions.
+	Assert Purpose = "assert"
+)
+
+const nonceSize = 16
+
+// Secret is an HMAC key identified by ID. The ID is embedded in issued tokens
+// and must not contain '.'.
+type Secret struct {
+	ID  string
+	Key []byte
+}
+
+// Config holds the settings of a Signer.
+type Config struct {
+	// TTL is how long an issued challenge stays valid. Defaults to 5 minutes.
+	TTL time.Duration
+	// Grace is how long tokens signed with a retired secret are still accepted
+	// after Rotate. Defaults to TTL.
+	Grace time.Duration
+}
+
+type retiredSecret struct {
+	Secret
+	until time.Time
+}
+
+// Signer issues and verifies challenges. It is safe for concurrent use.
+type Signer struct {
+	config Config
+	now    func() time.Time
+
+	mu      sync.RWMutex
+	current Secret
+	retired []retiredSecret
+}
+
+// NewSigner creates a Signer that signs with current.
+// Zero values in config are replaced by their defaults.
+func NewSigner(config Config, current Secret) *Signer {
+	s := &Signer{
+		config:  config,
+		now:     time.Now,
+		current: current,
+	}
+	if s.config.TTL == 0 {
+		s.config.TTL = 5 * time.Minute
+	}
+	if s.config.Grace == 0 {
+		s.config.Grace = s.config.TTL
+	}
+	return s
+}
+
+// Rotate makes next the signing secret. The previous secret is still accepted
+// for verification during the grace period.
+func (s *Signer) Rotate(next Secret) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	retired := s.retired[:0]
+	for _, r := range s.retired {
+		if now.Before(r.until) {
+			retired = append(retired, r)
+		}
+	}
+	s.retired = append(retired, retiredSecret{Secret: s.current, until: now.Add(s.config.Grace)})
+	s.current = next
+}
+
+// Issue creates a challenge for purpose, bound to binding. binding may be empty.
+func (s *Signer) Issue(purpose Purpose, binding string) (string, error) {
+	payload := make([]byte, nonceSize+8, nonceSize+8+len(purpose))
+	if _, err := rand.Read(payload[:nonceSize]); err != nil {
+		return "", err
+	}
+	binary.BigEndian.PutUint64(payload[nonceSize:], uint64(s.now().Add(s.config.TTL).Unix()))
+	payload = append(payload, purpose...)
+
+	s.mu.RLock()
+	secret := s.current
+	s.mu.RUnlock()
+
+	enc := base64.RawURLEncoding
+	return secret.ID + "." + enc.EncodeToString(payload) + "." + enc.EncodeToString(mac(secret, payload, binding)), nil
+}
+
+// Verify checks that token was issued by this Signer for purpose and binding
+// and has not expired.
+func (s *Signer) Verify(token string, purpose Purpose, binding string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrMalformed
+	}
+	enc := base64.RawURLEncoding
+	payload, err := enc.DecodeString(parts[1])
+	if err != nil || len(payload) < nonceSize+8 {
+		return ErrMalformed
+	}
+	sum, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return ErrMalformed
+	}
+
+	secret, ok := s.secret(parts[0])
+	if !ok || !hmac.Equal(sum, mac(secret, payload, binding)) {
+		return ErrInvalid
+	}
+	if Purpose(payload[nonceSize+8:]) != purpose {
+		return ErrPurposeMismatch
+	}
+	expiry := time.Unix(int64(binary.BigEndian.Uint64(payload[nonceSize:])), 0)
+	if !s.now().Before(expiry) {
+		return ErrExpired
+	}
+	return nil
+}
+
+// secret returns the current or an unexpired retired secret with the given ID.
+func (s *Signer) secret(id string) (Secret, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.current.ID == id {
+		return s.current, true
+	}
+	now := s.now()
+	for _, r := range s.retired {
+		if r.ID == id && now.Before(r.until) {
+			return r.Secret, true
+		}
+	}
+	return Secret{}, false
+}
+
+func mac(secret Secret, payload []byte, binding string) []byte {
+	h := hmac.New(sha256.New, secret.Key)
+	h.Write([]byte(secret.ID))
+	h.Write([]byte{0})
+	h.Write(payload)
+	h.Write([]byte{0})
+	h.Write([]byte(binding))
+	return h.Sum(nil)
+}
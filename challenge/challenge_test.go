@@ -0,0 +1,98 @@
+package challenge
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSigner_IssueVerify(t *testing.T) {
+	s := NewSigner(Config{TTL: time.Minute}, Secret{ID: "k1", Key: []byte("secret-1")})
+	now := time.Unix(1700000000, 0)
+	s.now = func() time.Time { return now }
+
+	token, err := s.Issue(Attest, "device-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := s.Issue(Attest, "device-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == other {
+		t.Fatal("two issued tokens are equal")
+	}
+
+	tests := map[string]struct {
+		token   string
+		purpose Purpose
+		binding string
+		advance time.Duration
+		wantErr error
+	}{
+		"valid":                 {token: token, purpose: Attest, binding: "device-1"},
+		"wrong purpose":         {token: token, purpose: Assert, binding: "device-1", wantErr: ErrPurposeMismatch},
+		"wrong binding":         {token: token, purpose: Attest, binding: "device-2", wantErr: ErrInvalid},
+		"expired":               {token: token, purpose: Attest, binding: "device-1", advance: time.Minute, wantErr: ErrExpired},
+		"malformed":             {token: "garbage", purpose: Attest, wantErr: ErrMalformed},
+		"bad encoding":          {token: "k1.!!!.!!!", purpose: Attest, wantErr: ErrMalformed},
+		"unknown secret":        {token: "k9" + strings.TrimPrefix(token, "k1"), purpose: Attest, binding: "device-1", wantErr: ErrInvalid},
+		"tampered payload":      {token: tamper(token, 1), purpose: Attest, binding: "device-1", wantErr: ErrInvalid},
+		"tampered mac":          {token: tamper(token, 2), purpose: Attest, binding: "device-1", wantErr: ErrInvalid},
+		"short payload":         {token: "k1.AAAA.AAAA", purpose: Attest, wantErr: ErrMalformed},
+		"empty binding differs": {token: token, purpose: Attest, binding: "", wantErr: ErrInvalid},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			now = time.Unix(1700000000, 0).Add(tc.advance)
+			err := s.Verify(tc.token, tc.purpose, tc.binding)
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("Verify() = %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestSigner_Rotate(t *testing.T) {
+	s := NewSigner(Config{TTL: time.Hour, Grace: time.Minute}, Secret{ID: "k1", Key: []byte("secret-1")})
+	now := time.Unix(1700000000, 0)
+	s.now = func() time.Time { return now }
+
+	old, err := s.Issue(Assert, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Rotate(Secret{ID: "k2", Key: []byte("secret-2")})
+	fresh, err := s.Issue(Assert, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(fresh, "k2.") {
+		t.Errorf("token not signed with the new secret: %s", fresh)
+	}
+	if err := s.Verify(old, Assert, ""); err != nil {
+		t.Errorf("token signed with retired secret rejected during grace period: %v", err)
+	}
+
+	now = now.Add(time.Minute)
+	if err := s.Verify(old, Assert, ""); !errors.Is(err, ErrInvalid) {
+		t.Errorf("token signed with retired secret accepted after grace period: %v", err)
+	}
+	if err := s.Verify(fresh, Assert, ""); err != nil {
+		t.Errorf("token signed with current secret rejected: %v", err)
+	}
+}
+
+// tamper flips a character in the given dot-separated part of token.
+func tamper(token string, part int) string {
+	parts := strings.Split(token, ".")
+	b := []byte(parts[part])
+	if b[0] == 'A' {
+		b[0] = 'B'
+	} else {
+		b[0] = 'A'
+	}
+	parts[part] = string(b)
+	return strings.Join(parts, ".")
+}
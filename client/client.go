@@ -0,0 +1,211 @@
+// Package client is a simulated App Attest client that behaves like the iOS
+// app, for end-to-end smoke tests, load tests and reproducing client bugs
+// without Xcode.
+//
+// A Client fetches a challenge from the NewChallenge endpoint, posts an
+// attestation to the Verify endpoint, and signs requests to
+// AssertionMiddleware-protected routes, all in the default wire format.
+// Combined with attesttest, it runs against a server that trusts the test CA:
+//
+//	device, err := ca.NewDevice(appID)
+//	c := client.New(device, client.Config{
+//	    ChallengeURL: srv.URL + "/attest/challenge",
+//	    AttestURL:    srv.URL + "/attest/verify",
+//	})
+//	err = c.Attest(ctx)
+//	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL+"/api", body)
+//	res, err := c.Do(req)
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	attest "github.com/takimoto3/app-attest"
+	"github.com/takimoto3/app-attest-middleware/canonical"
+	"github.com/takimoto3/app-attest-middleware/middleware"
+	"github.com/takimoto3/app-attest-middleware/plugin"
+	"github.com/takimoto3/app-attest-middleware/wire"
+)
+
+// Device holds the App Attest key of the client. *attesttest.Device implements it.
+type Device interface {
+	// KeyID returns the key identifier.
+	KeyID() []byte
+	// AttestKey returns the CBOR attestation object for clientDataHash.
+	AttestKey(clientDataHash []byte) ([]byte, error)
+	// GenerateAssertion returns the CBOR assertion for clientDataHash.
+	GenerateAssertion(clientDataHash []byte) ([]byte, error)
+}
+
+// Config holds the settings of a Client.
+type Config struct {
+	// ChallengeURL is the URL of the NewChallenge endpoint.
+	ChallengeURL string
+	// AttestURL is the URL of the Verify endpoint.
+	AttestURL string
+	// HTTPClient sends the requests. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+	// CanonicalRequest, when set, signs the canonical request instead of the
+	// body. It must match middleware.Config.CanonicalRequest.
+	CanonicalRequest *canonical.Config
+}
+
+// StatusError is returned when the challenge or attestation endpoint answers
+// with a status other than 200 OK.
+type StatusError struct {
+	StatusCode int
+	// Required is the X-App-Attest-Required header, if any.
+	Required string
+	Body     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("client: unexpected status %d: %s", e.StatusCode, e.Body)
+}
+
+// Client is a simulated App Attest client for one Device.
+// It is safe for concurrent use.
+type Client struct {
+	config Config
+	device Device
+
+	mu      sync.Mutex
+	counter uint32
+}
+
+// New creates a Client for device. Zero values in config are replaced by their defaults.
+func New(device Device, config Config) *Client {
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	return &Client{config: config, device: device}
+}
+
+// Counter returns the counter of the last assertion signed by the device, or
+// zero before the first one.
+func (c *Client) Counter() uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counter
+}
+
+// Challenge fetches a new challenge for the key of the device.
+func (c *Client) Challenge(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.config.ChallengeURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(wire.HeaderKeyID, base64.StdEncoding.EncodeToString(c.device.KeyID()))
+	body, err := c.send(req)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// Attest fetches a challenge and posts the attestation of the device key for it.
+// Only a 200 OK response is a success; an attestation whose challenge has
+// already been used is answered with 409 Conflict and a new challenge,
+// returned as a *StatusError.
+func (c *Client) Attest(ctx context.Context) error {
+	challenge, err := c.Challenge(ctx)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256([]byte(challenge))
+	obj, err := c.device.AttestKey(hash[:])
+	if err != nil {
+		return fmt.Errorf("client: attest key: %w", err)
+	}
+	body, err := wire.EncodeAttestation(obj, c.device.KeyID(), challenge)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.config.AttestURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(wire.HeaderKeyID, base64.StdEncoding.EncodeToString(c.device.KeyID()))
+	_, err = c.send(req)
+	return err
+}
+
+// Do fetches a challenge, signs req with an assertion and sends it. The body
+// of req is read and replaced. As with http.Client.Do, any response is
+// returned without error and the caller must close its body.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	challenge, err := c.Challenge(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	var body []byte
+	if req.Body != nil {
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+	req.ContentLength = int64(len(body))
+
+	clientData := plugin.BodyClientData(challenge, body)
+	if c.config.CanonicalRequest != nil {
+		if clientData, err = c.config.CanonicalRequest.Build(req, body, challenge); err != nil {
+			return nil, err
+		}
+	}
+	hash := sha256.Sum256(clientData)
+	assertion, err := c.device.GenerateAssertion(hash[:])
+	if err != nil {
+		return nil, fmt.Errorf("client: generate assertion: %w", err)
+	}
+	if err := c.track(assertion); err != nil {
+		return nil, err
+	}
+	wire.SetAssertion(req.Header, assertion, c.device.KeyID(), challenge)
+	return c.config.HTTPClient.Do(req)
+}
+
+// track records the counter of assertion.
+func (c *Client) track(assertion []byte) error {
+	obj := &attest.AssertionObject{}
+	if err := obj.UnmarshalCBOR(assertion); err != nil {
+		return fmt.Errorf("client: decode assertion: %w", err)
+	}
+	if len(obj.AuthData) < 37 {
+		return fmt.Errorf("client: authenticator data too short: %d bytes", len(obj.AuthData))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counter = binary.BigEndian.Uint32(obj.AuthData[33:37])
+	return nil
+}
+
+// send sends req and returns the body of a 200 OK response, or a *StatusError.
+func (c *Client) send(req *http.Request) ([]byte, error) {
+	res, err := c.config.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, &StatusError{StatusCode: res.StatusCode, Required: res.Header.Get(middleware.HeaderRequired), Body: string(body)}
+	}
+	return body, nil
+}
@@ -0,0 +1,164 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	attest "github.com/takimoto3/app-attest"
+	"github.com/takimoto3/app-attest-middleware/adapter"
+	"github.com/takimoto3/app-attest-middleware/attesttest"
+	"github.com/takimoto3/app-attest-middleware/canonical"
+	"github.com/takimoto3/app-attest-middleware/handler"
+	"github.com/takimoto3/app-attest-middleware/middleware"
+	"github.com/takimoto3/app-attest-middleware/plugin/memory"
+	"github.com/takimoto3/app-attest-middleware/requestid"
+)
+
+const appID = "TEAMID1234.com.example.app"
+
+var _ Device = (*attesttest.Device)(nil)
+
+// newServer serves the attestation endpoints and an assertion-protected /api
+// echoing the request body, trusting ca.
+func newServer(t *testing.T, ca *attesttest.CA, config middleware.Config) *httptest.Server {
+	t.Helper()
+	requestid.UseUUID()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := memory.New(memory.Config{})
+	service := attest.NewAttestationService(ca.Pool(), appID)
+	h := handler.NewAppAttestHandler(logger, adapter.NewAttestationAdapter(logger, service, store))
+	config.RequiredMode = middleware.RequiredStatus
+	m := middleware.NewAssertionMiddleware(logger, config, adapter.NewAssertionAdapter(logger, appID, store))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/attest/challenge", h.NewChallenge)
+	mux.HandleFunc("/attest/verify", h.Verify)
+	mux.Handle("/api/", m.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	})))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newClient(t *testing.T, ca *attesttest.CA, srv *httptest.Server, config Config) *Client {
+	t.Helper()
+	device, err := ca.NewDevice(appID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.ChallengeURL = srv.URL + "/attest/challenge"
+	config.AttestURL = srv.URL + "/attest/verify"
+	return New(device, config)
+}
+
+func TestClient(t *testing.T) {
+	ca, err := attesttest.NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	canonicalConfig := &canonical.Config{Headers: []string{"Content-Type"}}
+
+	tests := map[string]struct {
+		server middleware.Config
+		client Config
+	}{
+		"body":              {},
+		"canonical request": {server: middleware.Config{CanonicalRequest: canonicalConfig}, client: Config{CanonicalRequest: canonicalConfig}},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := newServer(t, ca, tc.server)
+			c := newClient(t, ca, srv, tc.client)
+			ctx := context.Background()
+			if err := c.Attest(ctx); err != nil {
+				t.Fatal(err)
+			}
+			for i := 1; i <= 3; i++ {
+				req, _ := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL+"/api/orders?b=2&a=1", bytes.NewBufferString("hello"))
+				req.Header.Set("Content-Type", "text/plain")
+				res, err := c.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, _ := io.ReadAll(res.Body)
+				res.Body.Close()
+				if res.StatusCode != http.StatusOK || string(body) != "hello" {
+					t.Fatalf("request %d: got status %d, body %q", i, res.StatusCode, body)
+				}
+				if got := c.Counter(); got != uint32(i) {
+					t.Errorf("got counter %d, want %d", got, i)
+				}
+			}
+		})
+	}
+}
+
+func TestClient_Errors(t *testing.T) {
+	ca, err := attesttest.NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCA, err := attesttest.NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(t, ca, middleware.Config{})
+	ctx := context.Background()
+
+	t.Run("untrusted attestation", func(t *testing.T) {
+		c := newClient(t, otherCA, srv, Config{})
+		var statusErr *StatusError
+		if err := c.Attest(ctx); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected a 400 StatusError, got %v", err)
+		}
+	})
+	t.Run("replayed challenge", func(t *testing.T) {
+		c := newClient(t, ca, srv, Config{})
+		challenge, err := c.Challenge(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, challenge)
+		}))
+		defer stub.Close()
+		c.config.ChallengeURL = stub.URL
+		if err := c.Attest(ctx); err != nil {
+			t.Fatal(err)
+		}
+		var statusErr *StatusError
+		if err := c.Attest(ctx); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusConflict {
+			t.Fatalf("expected a 409 StatusError, got %v", err)
+		}
+		if statusErr.Body == "" || statusErr.Body == challenge {
+			t.Errorf("expected a new challenge in the body, got %q", statusErr.Body)
+		}
+	})
+	t.Run("unattested key", func(t *testing.T) {
+		c := newClient(t, ca, srv, Config{})
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL+"/api/orders", nil)
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusUnauthorized || res.Header.Get(middleware.HeaderRequired) != middleware.RequiredAttestation {
+			t.Errorf("got status %d, %s %q", res.StatusCode, middleware.HeaderRequired, res.Header.Get(middleware.HeaderRequired))
+		}
+	})
+	t.Run("challenge endpoint down", func(t *testing.T) {
+		c := newClient(t, ca, srv, Config{})
+		c.config.ChallengeURL = srv.URL + "/missing"
+		var statusErr *StatusError
+		if _, err := c.Challenge(ctx); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+			t.Errorf("expected a 404 StatusError, got %v", err)
+		}
+	})
+}
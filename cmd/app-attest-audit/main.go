@@ -0,0 +1,74 @@
+// Command app-attest-audit verifies a hash-chained audit log written by
+// audit.Chain, offline.
+//
+// Usage:
+//
+//	app-attest-audit -pubkey checkpoint.pub.pem audit.chain
+//
+// The public key is a PEM "PUBLIC KEY" (PKIX) block holding the Ed25519 or
+// ECDSA key that signs the checkpoints. The command prints a summary and
+// exits with status 1 if a record was altered, deleted, inserted or reordered,
+// or a checkpoint signature does not verify.
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/takimoto3/app-attest-middleware/audit"
+)
+
+func main() {
+	pubPath := flag.String("pubkey", "", "PEM file with the public key of the checkpoint signer")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s -pubkey key.pem [file]\n\nReads standard input when no file is given.\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *pubPath == "" || flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(*pubPath, flag.Arg(0), os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "app-attest-audit:", err)
+		os.Exit(1)
+	}
+}
+
+func run(pubPath, chainPath string, stdin io.Reader, stdout io.Writer) error {
+	pub, err := readPublicKey(pubPath)
+	if err != nil {
+		return err
+	}
+	r := stdin
+	if chainPath != "" {
+		f, err := os.Open(chainPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	report, err := audit.VerifyChain(r, pub)
+	fmt.Fprintf(stdout, "events: %d\ncheckpoints: %d\nhead: %d %s\nunsigned: %d\n",
+		report.Events, report.Checkpoints, report.Seq, report.Head, report.Unsigned)
+	return err
+}
+
+func readPublicKey(path string) (crypto.PublicKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("no PEM PUBLIC KEY block in " + path)
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/takimoto3/app-attest-middleware/audit"
+)
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubPath := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	chainPath := filepath.Join(dir, "audit.chain")
+	c, err := audit.OpenChain(chainPath, audit.ChainConfig{Signer: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, typ := range []audit.EventType{audit.EventAttestationAccepted, audit.EventKeyRevoked} {
+		if err := c.Record(context.Background(), audit.Event{Type: typ}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(chainPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		chain   string
+		want    string
+		wantErr error
+	}{
+		"intact": {
+			chain: string(data),
+			want:  "events: 2\ncheckpoints: 1\n",
+		},
+		"altered": {
+			chain:   strings.Replace(string(data), "key_revoked", "challenge_issued", 1),
+			want:    "events: 2\ncheckpoints: 0\n",
+			wantErr: audit.ErrChainBroken,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var out strings.Builder
+			err := run(pubPath, "", strings.NewReader(tc.chain), &out)
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("expected %v, got %v", tc.wantErr, err)
+			}
+			if !strings.HasPrefix(out.String(), tc.want) {
+				t.Errorf("got output %q, want prefix %q", out.String(), tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	attest "github.com/takimoto3/app-attest"
+)
+
+// nonceOID is the credential certificate extension holding the attestation nonce.
+var nonceOID = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 8, 2}
+
+// options holds the expected values the payload is checked against. Checks
+// whose input is missing are skipped.
+type options struct {
+	AppID string
+	// ClientData is the client data; its SHA256 hash is the clientDataHash.
+	// For an attestation in the default wire format it is the challenge.
+	ClientData []byte
+	KeyID      []byte
+	Roots      *x509.CertPool
+	// PublicKey is the attested key that signed an assertion.
+	PublicKey *ecdsa.PublicKey
+	// Counter is the stored counter an assertion must exceed.
+	Counter uint32
+	Now     time.Time
+}
+
+// checker prints the outcome of the verification steps and remembers failures.
+type checker struct {
+	w      io.Writer
+	failed bool
+}
+
+func (c *checker) ok(step, format string, args ...any) {
+	fmt.Fprintf(c.w, "  ok    %s %s\n", step, fmt.Sprintf(format, args...))
+}
+
+func (c *checker) fail(step, format string, args ...any) {
+	c.failed = true
+	fmt.Fprintf(c.w, "  FAIL  %s %s\n", step, fmt.Sprintf(format, args...))
+}
+
+func (c *checker) skip(step, what, flag string) {
+	fmt.Fprintf(c.w, "  skip  %s %s (needs %s)\n", step, what, flag)
+}
+
+// inspectAttestation prints obj and checks it following the steps of
+// attest.AttestationService.Verify. It reports whether every check passed.
+func inspectAttestation(w io.Writer, obj *attest.AttestationObject, opts options) bool {
+	fmt.Fprintf(w, "attestation object\n  fmt: %s\n  receipt: %d bytes\n", obj.Format, len(obj.AttStmt.Receipt))
+	auth, authErr := parseAuthData(obj.AuthData)
+	printAuthData(w, obj.AuthData, auth, authErr, opts.AppID)
+
+	var certs []*x509.Certificate
+	fmt.Fprintln(w, "certificate chain (x5c)")
+	for i, der := range obj.AttStmt.X5C {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			fmt.Fprintf(w, "  [%d] invalid certificate: %v\n", i, err)
+			continue
+		}
+		certs = append(certs, cert)
+		printCertificate(w, i, cert, opts.Now)
+	}
+
+	c := &checker{w: w}
+	fmt.Fprintln(w, "checks")
+	if obj.Format == "apple-appattest" {
+		c.ok("0.", "fmt is apple-appattest")
+	} else {
+		c.fail("0.", "fmt is %q, want apple-appattest", obj.Format)
+	}
+	if len(certs) == 0 || len(certs) != len(obj.AttStmt.X5C) {
+		c.fail("1.", "x5c must hold the credential certificate followed by the intermediate")
+		return !c.failed
+	}
+	cred := certs[0]
+
+	// 1. Certificate chain
+	if opts.Roots == nil {
+		c.skip("1.", "certificate chain", "-roots")
+	} else {
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		if _, err := cred.Verify(x509.VerifyOptions{Roots: opts.Roots, Intermediates: intermediates, CurrentTime: opts.Now}); err != nil {
+			c.fail("1.", "certificate chain does not verify: %v", err)
+		} else {
+			c.ok("1.", "certificate chain verifies against the roots")
+		}
+	}
+
+	// 2-4. Nonce
+	certNonce, nonceErr := credentialNonce(cred)
+	switch {
+	case nonceErr != nil:
+		c.fail("2-4.", "nonce extension: %v", nonceErr)
+	case opts.ClientData == nil:
+		c.skip("2-4.", "nonce = SHA256(authData || SHA256(clientData)) matches the extension", "-challenge or -client-data")
+	default:
+		clientDataHash := sha256.Sum256(opts.ClientData)
+		nonce := sha256.Sum256(append(append([]byte{}, obj.AuthData...), clientDataHash[:]...))
+		if bytes.Equal(nonce[:], certNonce) {
+			c.ok("2-4.", "nonce matches the credential certificate extension")
+		} else {
+			c.fail("2-4.", "nonce %x does not match the extension %x: the attestation was made for another challenge, or the clientDataHash is not SHA256(challenge)", nonce, certNonce)
+		}
+	}
+
+	// 5. Key ID
+	pub, isECDSA := cred.PublicKey.(*ecdsa.PublicKey)
+	if !isECDSA {
+		c.fail("5.", "credential certificate key is %T, want ECDSA", cred.PublicKey)
+	} else {
+		keyHash := sha256.Sum256(attest.MarshalUncompressed(pub))
+		switch {
+		case opts.KeyID == nil:
+			c.skip("5.", fmt.Sprintf("SHA256(public key) = %x matches the key ID", keyHash), "-key-id")
+		case bytes.Equal(keyHash[:], opts.KeyID):
+			c.ok("5.", "SHA256(public key) matches the key ID")
+		default:
+			c.fail("5.", "SHA256(public key) = %x, key ID is %x", keyHash, opts.KeyID)
+		}
+	}
+
+	if authErr != nil {
+		c.fail("6-9.", "authenticator data: %v", authErr)
+		return !c.failed
+	}
+	if !auth.HasAttestedCredentialData() {
+		c.fail("6-9.", "authenticator data lacks the attested credential data flag")
+		return !c.failed
+	}
+	checkRPID(c, "6.", auth, opts.AppID)
+
+	// 7. Counter
+	if auth.Counter == 0 {
+		c.ok("7.", "counter is 0")
+	} else {
+		c.fail("7.", "counter is %d, want 0", auth.Counter)
+	}
+
+	// 8. AAGUID
+	if env := environment(auth.CredentialData.AAGUID); env != "" {
+		c.ok("8.", "aaguid is valid (%s)", env)
+	} else {
+		c.fail("8.", "aaguid %q is neither appattest nor appattestdevelop", auth.CredentialData.AAGUID)
+	}
+
+	// 9. Credential ID
+	switch {
+	case opts.KeyID == nil:
+		c.skip("9.", "credential ID matches the key ID", "-key-id")
+	case bytes.Equal(auth.CredentialData.CredentialID, opts.KeyID):
+		c.ok("9.", "credential ID matches the key ID")
+	default:
+		c.fail("9.", "credential ID %x, key ID is %x", auth.CredentialData.CredentialID, opts.KeyID)
+	}
+	return !c.failed
+}
+
+// inspectAssertion prints obj and checks it following the steps of
+// attest.AssertionService.Verify. It reports whether every check passed.
+func inspectAssertion(w io.Writer, obj *attest.AssertionObject, opts options) bool {
+	fmt.Fprintf(w, "assertion\n  signature: %d bytes\n", len(obj.Signature))
+	auth, authErr := parseAuthData(obj.AuthData)
+	printAuthData(w, obj.AuthData, auth, authErr, opts.AppID)
+
+	c := &checker{w: w}
+	fmt.Fprintln(w, "checks")
+	// 1-3. Signature
+	switch {
+	case opts.PublicKey == nil:
+		c.skip("1-3.", "signature over SHA256(authData || SHA256(clientData))", "-pubkey")
+	case opts.ClientData == nil:
+		c.skip("1-3.", "signature over SHA256(authData || SHA256(clientData))", "-client-data")
+	default:
+		clientDataHash := sha256.Sum256(opts.ClientData)
+		nonce := sha256.Sum256(append(append([]byte{}, obj.AuthData...), clientDataHash[:]...))
+		digest := sha256.Sum256(nonce[:])
+		if ecdsa.VerifyASN1(opts.PublicKey, digest[:], obj.Signature) {
+			c.ok("1-3.", "signature is valid")
+		} else {
+			c.fail("1-3.", "signature does not verify: the client data differs from what the app signed (e.g. body, canonical request), or the key is not the attested key")
+		}
+	}
+	if authErr != nil {
+		c.fail("4-5.", "authenticator data: %v", authErr)
+		return !c.failed
+	}
+	checkRPID(c, "4.", auth, opts.AppID)
+
+	// 5. Counter
+	if auth.Counter > opts.Counter {
+		c.ok("5.", "counter %d is greater than the stored counter %d", auth.Counter, opts.Counter)
+	} else {
+		c.fail("5.", "counter %d is not greater than the stored counter %d", auth.Counter, opts.Counter)
+	}
+	return !c.failed
+}
+
+func checkRPID(c *checker, step string, auth *attest.AuthenticatorData, appID string) {
+	if appID == "" {
+		c.skip(step, "RP ID hash matches SHA256(App ID)", "-app-id")
+		return
+	}
+	hash := sha256.Sum256([]byte(appID))
+	if bytes.Equal(auth.RPIDHash, hash[:]) {
+		c.ok(step, "RP ID hash matches SHA256(%q)", appID)
+	} else {
+		c.fail(step, "RP ID hash %x does not match SHA256(%q) = %x: wrong team ID or bundle ID", auth.RPIDHash, appID, hash)
+	}
+}
+
+// parseAuthData decodes authenticator data, checking the lengths that
+// attest.AuthenticatorData.Unmarshal assumes.
+func parseAuthData(raw []byte) (*attest.AuthenticatorData, error) {
+	if len(raw) > 37 && raw[32]&attest.Attested != 0 {
+		if len(raw) < 55 || len(raw) < 55+int(binary.BigEndian.Uint16(raw[53:55])) {
+			return nil, errors.New("attested credential data truncated")
+		}
+	}
+	auth := &attest.AuthenticatorData{}
+	if err := auth.Unmarshal(raw); err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+func printAuthData(w io.Writer, raw []byte, auth *attest.AuthenticatorData, err error, appID string) {
+	fmt.Fprintf(w, "authenticator data (%d bytes)\n", len(raw))
+	if err != nil {
+		fmt.Fprintf(w, "  invalid: %v\n", err)
+		return
+	}
+	fmt.Fprintf(w, "  rpIdHash: %x\n", auth.RPIDHash)
+	if appID != "" {
+		hash := sha256.Sum256([]byte(appID))
+		fmt.Fprintf(w, "  SHA256(app ID): %x\n", hash)
+	}
+	var flags []string
+	if auth.HasAttestedCredentialData() {
+		flags = append(flags, "AT")
+	}
+	fmt.Fprintf(w, "  flags: 0x%02x %s\n", auth.Flags, strings.Join(flags, " "))
+	fmt.Fprintf(w, "  counter: %d\n", auth.Counter)
+	if cred := auth.CredentialData; cred.AAGUID != nil {
+		env := environment(cred.AAGUID)
+		if env == "" {
+			env = "invalid"
+		}
+		fmt.Fprintf(w, "  aaguid: %q (%s)\n", bytes.TrimRight(cred.AAGUID, "\x00"), env)
+		fmt.Fprintf(w, "  credentialId: %x\n", cred.CredentialID)
+		fmt.Fprintf(w, "  credentialId (base64): %s\n", base64.StdEncoding.EncodeToString(cred.CredentialID))
+		fmt.Fprintf(w, "  credentialPublicKey: %d bytes\n", len(cred.CredentialPublicKey))
+	}
+}
+
+func printCertificate(w io.Writer, i int, cert *x509.Certificate, now time.Time) {
+	fmt.Fprintf(w, "  [%d] subject: %s\n", i, cert.Subject)
+	fmt.Fprintf(w, "      issuer: %s\n", cert.Issuer)
+	validity := "valid"
+	switch {
+	case now.Before(cert.NotBefore):
+		validity = "not yet valid"
+	case now.After(cert.NotAfter):
+		validity = "expired"
+	}
+	fmt.Fprintf(w, "      validity: %s to %s (%s)\n", cert.NotBefore.UTC().Format(time.RFC3339), cert.NotAfter.UTC().Format(time.RFC3339), validity)
+	fmt.Fprintf(w, "      CA: %t\n", cert.IsCA)
+	if pub, ok := cert.PublicKey.(*ecdsa.PublicKey); ok {
+		fmt.Fprintf(w, "      key: ECDSA %s\n", pub.Curve.Params().Name)
+	}
+	if nonce, err := credentialNonce(cert); err == nil {
+		fmt.Fprintf(w, "      nonce extension: %x\n", nonce)
+	} else if !errors.Is(err, errNoNonce) {
+		fmt.Fprintf(w, "      nonce extension: %v\n", err)
+	}
+}
+
+var errNoNonce = errors.New("certificate has no nonce extension")
+
+// credentialNonce returns the nonce of the extension 1.2.840.113635.100.8.2,
+// a sequence holding one explicitly tagged octet string.
+func credentialNonce(cert *x509.Certificate) ([]byte, error) {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(nonceOID) {
+			continue
+		}
+		var seq []asn1.RawValue
+		if _, err := asn1.Unmarshal(ext.Value, &seq); err != nil || len(seq) == 0 {
+			return nil, fmt.Errorf("malformed nonce extension: %v", err)
+		}
+		var octets asn1.RawValue
+		if _, err := asn1.Unmarshal(seq[0].Bytes, &octets); err != nil {
+			return nil, fmt.Errorf("malformed nonce extension: %v", err)
+		}
+		return octets.Bytes, nil
+	}
+	return nil, errNoNonce
+}
+
+func environment(aaguid []byte) string {
+	switch string(bytes.TrimRight(aaguid, "\x00")) {
+	case "appattest":
+		return "production"
+	case "appattestdevelop":
+		return "development"
+	}
+	return ""
+}
@@ -0,0 +1,222 @@
+// Command app-attest-inspect decodes an App Attest attestation object or
+// assertion offline and explains which verification step fails.
+//
+// Usage:
+//
+//	app-attest-inspect [flags] [file]
+//
+// The payload is read from file, or standard input, as raw CBOR, base64 (any
+// alphabet, padded or not) or the JSON attestation body of the default wire
+// format, whose keyId and challenge are used unless given as flags. The
+// command prints the authenticator data, the certificate chain with validity
+// dates and the nonce extension, then checks each verification step against
+// the given flags, skipping the steps whose input is missing. It exits with
+// status 1 if a check fails.
+//
+// Check an attestation:
+//
+//	app-attest-inspect -app-id TEAMID.com.example.app -challenge "$CHALLENGE" \
+//	    -key-id "$KEY_ID" -roots Apple_App_Attestation_Root_CA.pem attestation.b64
+//
+// Check an assertion over a request body and its challenge, with the attested
+// key:
+//
+//	app-attest-inspect -app-id TEAMID.com.example.app -challenge "$CHALLENGE" \
+//	    -client-data body.json -pubkey key.pem -counter 41 assertion.b64
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	attest "github.com/takimoto3/app-attest"
+	"github.com/takimoto3/app-attest-middleware/plugin"
+	"github.com/takimoto3/app-attest/certs"
+)
+
+func main() {
+	var (
+		appID      = flag.String("app-id", "", "App ID (team ID + \".\" + bundle ID) to check the RP ID hash against")
+		challenge  = flag.String("challenge", "", "challenge of an attestation, whose clientDataHash is SHA256(challenge), or of an assertion over -client-data")
+		clientData = flag.String("client-data", "", "file holding the client data; with -challenge, the request body of an assertion")
+		keyID      = flag.String("key-id", "", "key identifier, base64")
+		roots      = flag.String("roots", "", "PEM or CER file with the App Attest root certificate")
+		pubkey     = flag.String("pubkey", "", "PEM file with the attested public key or credential certificate, for assertions")
+		counter    = flag.Uint("counter", 0, "stored counter the assertion must exceed")
+	)
+	flag.Parse()
+	if flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	opts := options{AppID: *appID, Counter: uint32(*counter), Now: time.Now()}
+	err := func() error {
+		var err error
+		if *challenge != "" {
+			opts.ClientData = []byte(*challenge)
+		}
+		if *clientData != "" {
+			if opts.ClientData, err = os.ReadFile(*clientData); err != nil {
+				return err
+			}
+			if *challenge != "" {
+				opts.ClientData = plugin.BodyClientData(*challenge, opts.ClientData)
+			}
+		}
+		if *keyID != "" {
+			if opts.KeyID, err = decodeBase64(*keyID); err != nil {
+				return fmt.Errorf("-key-id: %w", err)
+			}
+		}
+		if *roots != "" {
+			if opts.Roots, err = certs.LoadCertFiles(*roots); err != nil {
+				return err
+			}
+		}
+		if *pubkey != "" {
+			if opts.PublicKey, err = readPublicKey(*pubkey); err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "app-attest-inspect:", err)
+		os.Exit(2)
+	}
+
+	in := io.Reader(os.Stdin)
+	if flag.NArg() == 1 {
+		f, err := os.Open(flag.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "app-attest-inspect:", err)
+			os.Exit(2)
+		}
+		defer f.Close()
+		in = f
+	}
+	ok, err := run(in, os.Stdout, opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "app-attest-inspect:", err)
+		os.Exit(2)
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// run decodes the payload read from in, prints it and its checks to out, and
+// reports whether every check passed.
+func run(in io.Reader, out io.Writer, opts options) (bool, error) {
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return false, err
+	}
+	raw, err := decodePayload(data, &opts)
+	if err != nil {
+		return false, err
+	}
+
+	attestation := &attest.AttestationObject{}
+	if err := attestation.UnmarshalCBOR(raw); err == nil && attestation.Format != "" {
+		return inspectAttestation(out, attestation, opts), nil
+	}
+	assertion := &attest.AssertionObject{}
+	if err := assertion.UnmarshalCBOR(raw); err != nil {
+		return false, fmt.Errorf("not an attestation object or assertion: %w", err)
+	}
+	if len(assertion.Signature) == 0 && len(assertion.AuthData) == 0 {
+		return false, errors.New("not an attestation object or assertion")
+	}
+	return inspectAssertion(out, assertion, opts), nil
+}
+
+// decodePayload returns the CBOR payload of data. For a JSON attestation
+// body, it fills in the key ID and client data of opts if they are unset.
+func decodePayload(data []byte, opts *options) ([]byte, error) {
+	// Raw CBOR is returned untrimmed: its last byte may be a space or newline.
+	text := bytes.TrimSpace(data)
+	if len(text) > 0 && text[0] == '{' {
+		var body struct {
+			AttestationObject string `json:"attestationObject"`
+			KeyID             string `json:"keyId"`
+			Challenge         string `json:"challenge"`
+		}
+		if err := json.Unmarshal(text, &body); err != nil {
+			return nil, fmt.Errorf("decode JSON body: %w", err)
+		}
+		if opts.KeyID == nil && body.KeyID != "" {
+			keyID, err := decodeBase64(body.KeyID)
+			if err != nil {
+				return nil, fmt.Errorf("keyId: %w", err)
+			}
+			opts.KeyID = keyID
+		}
+		if opts.ClientData == nil && body.Challenge != "" {
+			opts.ClientData = []byte(body.Challenge)
+		}
+		raw, err := decodeBase64(body.AttestationObject)
+		if err != nil {
+			return nil, fmt.Errorf("attestationObject: %w", err)
+		}
+		return raw, nil
+	}
+	if raw, err := decodeBase64(string(text)); err == nil {
+		return raw, nil
+	}
+	return data, nil
+}
+
+func decodeBase64(s string) ([]byte, error) {
+	var err error
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		var b []byte
+		if b, err = enc.DecodeString(s); err == nil {
+			return b, nil
+		}
+	}
+	return nil, err
+}
+
+// readPublicKey reads an ECDSA key from a PEM PUBLIC KEY or CERTIFICATE block.
+func readPublicKey(path string) (*ecdsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block in " + path)
+	}
+	var key any
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			key = cert.PublicKey
+		}
+	default:
+		return nil, fmt.Errorf("unexpected PEM block %q in %s", block.Type, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s does not hold an ECDSA key", path)
+	}
+	return pub, nil
+}
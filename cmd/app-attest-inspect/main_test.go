@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/takimoto3/app-attest-middleware/attesttest"
+	"github.com/takimoto3/app-attest-middleware/wire"
+)
+
+const appID = "TEAMID1234.com.example.app"
+
+func TestRun(t *testing.T) {
+	ca, err := attesttest.NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCA, err := attesttest.NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	device, err := ca.NewDevice(appID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256([]byte("challenge-1"))
+	attestation, err := device.AttestKey(hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonBody, err := wire.EncodeAttestation(attestation, device.KeyID(), "challenge-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte(`{"n":1}`)
+	hash = sha256.Sum256(body)
+	assertion, err := device.GenerateAssertion(hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := base64.StdEncoding.EncodeToString
+
+	full := options{AppID: appID, ClientData: []byte("challenge-1"), KeyID: device.KeyID(), Roots: ca.Pool(), Now: time.Now()}
+	tests := map[string]struct {
+		input  string
+		opts   options
+		wantOK bool
+		// want lists lines the output must contain.
+		want []string
+	}{
+		"attestation": {
+			input:  b64(attestation),
+			opts:   full,
+			wantOK: true,
+			want: []string{
+				"fmt: apple-appattest",
+				"counter: 0",
+				`aaguid: "appattest" (production)`,
+				"credentialId (base64): " + b64(device.KeyID()),
+				"nonce extension: ",
+				"(valid)",
+				"ok    1. certificate chain verifies against the roots",
+				"ok    2-4. nonce matches",
+				"ok    5. ",
+				"ok    6. RP ID hash matches",
+				"ok    8. aaguid is valid (production)",
+				"ok    9. ",
+			},
+		},
+		"raw CBOR without expectations": {
+			input:  string(attestation),
+			opts:   options{Now: time.Now()},
+			wantOK: true,
+			want:   []string{"skip  1. certificate chain (needs -roots)", "skip  6. RP ID hash matches SHA256(App ID) (needs -app-id)"},
+		},
+		"JSON body": {
+			input:  string(jsonBody),
+			opts:   options{AppID: appID, Roots: ca.Pool(), Now: time.Now()},
+			wantOK: true,
+			want:   []string{"ok    2-4. nonce matches", "ok    9. credential ID matches the key ID"},
+		},
+		"untrusted root": {
+			input: b64(attestation),
+			opts:  options{Roots: otherCA.Pool(), Now: time.Now()},
+			want:  []string{"FAIL  1. certificate chain does not verify"},
+		},
+		"other challenge": {
+			input: b64(attestation),
+			opts:  options{ClientData: []byte("challenge-2"), Now: time.Now()},
+			want:  []string{"FAIL  2-4. nonce "},
+		},
+		"other app": {
+			input: b64(attestation),
+			opts:  options{AppID: "TEAMID1234.com.example.other", Now: time.Now()},
+			want:  []string{"FAIL  6. RP ID hash"},
+		},
+		"other key ID": {
+			input: b64(attestation),
+			opts:  options{KeyID: []byte("other"), Now: time.Now()},
+			want:  []string{"FAIL  5. ", "FAIL  9. "},
+		},
+		"expired certificates": {
+			input: b64(attestation),
+			opts:  options{Roots: ca.Pool(), Now: time.Now().AddDate(0, 0, 2)},
+			want:  []string{"(expired)", "FAIL  1. "},
+		},
+		"assertion": {
+			input:  base64.RawURLEncoding.EncodeToString(assertion),
+			opts:   options{AppID: appID, ClientData: body, PublicKey: device.PublicKey()},
+			wantOK: true,
+			want:   []string{"assertion", "counter: 1", "ok    1-3. signature is valid", "ok    4. ", "ok    5. counter 1 is greater than the stored counter 0"},
+		},
+		"assertion over other client data": {
+			input: b64(assertion),
+			opts:  options{ClientData: []byte(`{"n":2}`), PublicKey: device.PublicKey()},
+			want:  []string{"FAIL  1-3. signature does not verify"},
+		},
+		"replayed assertion": {
+			input: b64(assertion),
+			opts:  options{Counter: 1},
+			want:  []string{"skip  1-3. ", "FAIL  5. counter 1 is not greater than the stored counter 1"},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var out strings.Builder
+			ok, err := run(strings.NewReader(tc.input), &out, tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tc.wantOK {
+				t.Errorf("got ok %t, want %t", ok, tc.wantOK)
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("output does not contain %q:\n%s", want, out.String())
+				}
+			}
+		})
+	}
+}
+
+func TestRun_Invalid(t *testing.T) {
+	tests := map[string]string{
+		"empty":       "",
+		"not CBOR":    "hello world",
+		"bad JSON":    `{"attestationObject": 1}`,
+		"CBOR string": "\x65hello",
+	}
+	for name, input := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := run(strings.NewReader(input), &strings.Builder{}, options{}); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestDecodePayload(t *testing.T) {
+	tests := map[string]struct {
+		input string
+		want  string
+	}{
+		"base64":                   {input: " aGVsbG8=\n", want: "hello"},
+		"raw CBOR ending in space": {input: "\xa1\x61a\x20", want: "\xa1\x61a\x20"},
+		"raw CBOR ending in LF":    {input: "\xa1\x61a\x0a", want: "\xa1\x61a\x0a"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := decodePayload([]byte(tc.input), &options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
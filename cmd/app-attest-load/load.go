@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/takimoto3/app-attest-middleware/attesttest"
+	"github.com/takimoto3/app-attest-middleware/client"
+	"github.com/takimoto3/app-attest-middleware/middleware"
+	"github.com/takimoto3/app-attest-middleware/problem"
+)
+
+// Operation kinds of the report.
+const (
+	opAttestation = "attestation"
+	opAssertion   = "assertion"
+)
+
+// config holds the settings of a load test.
+type config struct {
+	CA     *attesttest.CA
+	AppID  string
+	Client *http.Client
+
+	ChallengeURL string
+	AttestURL    string
+	// AssertURL is the assertion-protected route, called with AssertMethod and Body.
+	AssertURL    string
+	AssertMethod string
+	Body         []byte
+
+	// Devices is the number of simulated devices.
+	Devices int
+	// Workers is the number of concurrent workers sharing each device. More
+	// than one makes assertions of the same key race on UpdateCounter.
+	Workers int
+	// AttestRatio is the fraction of operations that attest a new key instead
+	// of sending an assertion with the key of the device.
+	AttestRatio float64
+	// Duration and Requests stop the test; zero means no limit on that side.
+	Duration time.Duration
+	Requests int64
+}
+
+// stats collects the outcomes of one kind of operation.
+type stats struct {
+	latencies []time.Duration
+	failures  int
+}
+
+// report is the result of a load test.
+type report struct {
+	elapsed time.Duration
+	ops     map[string]*stats
+	// failures counts the failed operations by kind and reason.
+	failures map[string]int
+}
+
+type recorder struct {
+	mu     sync.Mutex
+	report report
+}
+
+func (r *recorder) record(op string, d time.Duration, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.report.ops[op]
+	if !ok {
+		s = &stats{}
+		r.report.ops[op] = s
+	}
+	s.latencies = append(s.latencies, d)
+	if reason != "" {
+		s.failures++
+		r.report.failures[op+" "+reason]++
+	}
+}
+
+// run attests every device and then runs the operation mix until the duration
+// elapses or the number of requests is reached.
+func run(ctx context.Context, c config) (*report, error) {
+	if c.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Duration)
+		defer cancel()
+	}
+	rec := &recorder{report: report{ops: make(map[string]*stats), failures: make(map[string]int)}}
+	var issued atomic.Int64
+	next := func() bool {
+		return ctx.Err() == nil && (c.Requests <= 0 || issued.Add(1) <= c.Requests)
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range c.Devices {
+		cl, err := c.newClient()
+		if err != nil {
+			return nil, err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !next() {
+				return
+			}
+			// Every worker of the device waits for its attestation.
+			if reason := c.attest(ctx, rec, cl); reason != "" {
+				return
+			}
+			var workers sync.WaitGroup
+			for range c.Workers {
+				workers.Add(1)
+				go func() {
+					defer workers.Done()
+					for next() {
+						if rand.Float64() < c.AttestRatio {
+							fresh, err := c.newClient()
+							if err == nil {
+								c.attest(ctx, rec, fresh)
+							}
+							continue
+						}
+						c.assert(ctx, rec, cl)
+					}
+				}()
+			}
+			workers.Wait()
+		}()
+	}
+	wg.Wait()
+	rec.report.elapsed = time.Since(start)
+	return &rec.report, nil
+}
+
+func (c config) newClient() (*client.Client, error) {
+	device, err := c.CA.NewDevice(c.AppID)
+	if err != nil {
+		return nil, err
+	}
+	return client.New(device, client.Config{
+		ChallengeURL: c.ChallengeURL,
+		AttestURL:    c.AttestURL,
+		HTTPClient:   c.Client,
+	}), nil
+}
+
+// attest attests the key of cl and returns the failure reason, if any.
+func (c config) attest(ctx context.Context, rec *recorder, cl *client.Client) string {
+	start := time.Now()
+	err := cl.Attest(ctx)
+	if ctx.Err() != nil {
+		// Requests cut off by the end of the test are not counted.
+		return "canceled"
+	}
+	reason := ""
+	if err != nil {
+		reason = errorReason(err)
+	}
+	rec.record(opAttestation, time.Since(start), reason)
+	return reason
+}
+
+// assert sends one assertion-protected request with the key of cl.
+func (c config) assert(ctx context.Context, rec *recorder, cl *client.Client) {
+	start := time.Now()
+	req, err := http.NewRequestWithContext(ctx, c.AssertMethod, c.AssertURL, bytes.NewReader(c.Body))
+	if err != nil {
+		rec.record(opAssertion, 0, "invalid request")
+		return
+	}
+	res, err := cl.Do(req)
+	if ctx.Err() != nil {
+		if err == nil {
+			res.Body.Close()
+		}
+		return
+	}
+	if err != nil {
+		rec.record(opAssertion, time.Since(start), errorReason(err))
+		return
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	reason := ""
+	if res.StatusCode >= 300 {
+		reason = responseReason(res.StatusCode, res.Header.Get(middleware.HeaderRequired), body)
+	}
+	rec.record(opAssertion, time.Since(start), reason)
+}
+
+func errorReason(err error) string {
+	var statusErr *client.StatusError
+	if errors.As(err, &statusErr) {
+		return responseReason(statusErr.StatusCode, statusErr.Required, []byte(statusErr.Body))
+	}
+	return "transport error"
+}
+
+// responseReason names a failed response by its status and, when the server
+// renders problem.JSON, its reason code.
+func responseReason(status int, required string, body []byte) string {
+	var d problem.Details
+	if json.Unmarshal(body, &d) == nil && d.Reason != "" {
+		return fmt.Sprintf("%d %s", status, d.Reason)
+	}
+	if required != "" {
+		return fmt.Sprintf("%d %s required", status, required)
+	}
+	return fmt.Sprintf("%d %s", status, http.StatusText(status))
+}
+
+// write prints the report.
+func (r *report) write(w io.Writer) {
+	fmt.Fprintf(w, "elapsed: %s\n", r.elapsed.Round(time.Millisecond))
+	for _, op := range []string{opAttestation, opAssertion} {
+		s, ok := r.ops[op]
+		if !ok {
+			continue
+		}
+		slices.Sort(s.latencies)
+		fmt.Fprintf(w, "%s: %d requests, %d failed, %.1f/s, p50 %s p90 %s p99 %s max %s\n",
+			op, len(s.latencies), s.failures, float64(len(s.latencies))/r.elapsed.Seconds(),
+			percentile(s.latencies, 50), percentile(s.latencies, 90), percentile(s.latencies, 99),
+			percentile(s.latencies, 100))
+	}
+	if len(r.failures) > 0 {
+		fmt.Fprintln(w, "failures:")
+		for _, key := range slices.Sorted(maps.Keys(r.failures)) {
+			fmt.Fprintf(w, "  %s: %d\n", key, r.failures[key])
+		}
+	}
+}
+
+// percentile returns the p-th percentile of sorted, by the nearest-rank method.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	return sorted[max(rank, 1)-1].Round(time.Microsecond)
+}
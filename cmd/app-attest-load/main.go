@@ -0,0 +1,124 @@
+// Command app-attest-load drives many simulated App Attest devices against a
+// server, to size plugins and observe counter contention before a launch.
+//
+// The server must trust the root of a test CA, created with -init-ca:
+//
+//	app-attest-load -ca ca.pem -init-ca
+//
+// ca.pem holds the root and intermediate certificates and the intermediate
+// key; load it on the server with certs.LoadCertFiles("ca.pem") in place of
+// Apple's root. Then run the load:
+//
+//	app-attest-load -ca ca.pem -app-id TEAMID.com.example.app \
+//	    -url http://localhost:8080 -assert-path /api/ping \
+//	    -devices 50 -workers 2 -attest-ratio 0.1 -duration 30s
+//
+// Each device is attested first. Its workers then send assertion-protected
+// requests, or, with probability -attest-ratio, attest the key of a new
+// install. Workers of the same device race on its counter. The command prints
+// throughput, latency percentiles and failures by reason code; reason codes
+// are shown when the server renders problem.JSON.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/takimoto3/app-attest-middleware/attesttest"
+)
+
+func main() {
+	var (
+		caPath      = flag.String("ca", "", "PEM file with the test CA (required)")
+		initCA      = flag.Bool("init-ca", false, "create a new test CA in the -ca file and exit")
+		appID       = flag.String("app-id", "", "App ID (team ID + \".\" + bundle ID) of the devices")
+		baseURL     = flag.String("url", "", "base URL of the server")
+		challenge   = flag.String("challenge-path", "/attest/challenge", "path of the NewChallenge endpoint")
+		attest      = flag.String("attest-path", "/attest/verify", "path of the Verify endpoint")
+		assert      = flag.String("assert-path", "", "path of an assertion-protected route")
+		method      = flag.String("method", http.MethodPost, "method of assertion-protected requests")
+		body        = flag.String("body", "{}", "body of assertion-protected requests")
+		devices     = flag.Int("devices", 10, "number of simulated devices")
+		workers     = flag.Int("workers", 1, "concurrent workers per device")
+		attestRatio = flag.Float64("attest-ratio", 0, "fraction of operations attesting a new key")
+		duration    = flag.Duration("duration", 10*time.Second, "how long to run; 0 for no limit")
+		requests    = flag.Int64("requests", 0, "total number of operations; 0 for no limit")
+		timeout     = flag.Duration("timeout", 10*time.Second, "timeout of each HTTP request")
+	)
+	flag.Parse()
+
+	if *caPath == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *initCA {
+		if err := writeCA(*caPath); err != nil {
+			fmt.Fprintln(os.Stderr, "app-attest-load:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *appID == "" || *baseURL == "" || *assert == "" || *devices < 1 || *workers < 1 || (*duration == 0 && *requests == 0) {
+		flag.Usage()
+		os.Exit(2)
+	}
+	ca, err := readCA(*caPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "app-attest-load:", err)
+		os.Exit(1)
+	}
+
+	base := strings.TrimSuffix(*baseURL, "/")
+	c := config{
+		CA:    ca,
+		AppID: *appID,
+		Client: &http.Client{
+			Timeout:   *timeout,
+			Transport: &http.Transport{MaxIdleConnsPerHost: *devices * *workers},
+		},
+		ChallengeURL: base + *challenge,
+		AttestURL:    base + *attest,
+		AssertURL:    base + *assert,
+		AssertMethod: *method,
+		Body:         []byte(*body),
+		Devices:      *devices,
+		Workers:      *workers,
+		AttestRatio:  *attestRatio,
+		Duration:     *duration,
+		Requests:     *requests,
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	r, err := run(ctx, c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "app-attest-load:", err)
+		os.Exit(1)
+	}
+	r.write(os.Stdout)
+}
+
+func writeCA(path string) error {
+	ca, err := attesttest.NewCA()
+	if err != nil {
+		return err
+	}
+	data, err := ca.MarshalPEM()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+func readCA(path string) (*attesttest.CA, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return attesttest.ParseCA(data)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	attest "github.com/takimoto3/app-attest"
+	"github.com/takimoto3/app-attest-middleware/adapter"
+	"github.com/takimoto3/app-attest-middleware/handler"
+	"github.com/takimoto3/app-attest-middleware/middleware"
+	"github.com/takimoto3/app-attest-middleware/plugin/memory"
+	"github.com/takimoto3/app-attest-middleware/problem"
+	"github.com/takimoto3/app-attest-middleware/requestid"
+)
+
+const appID = "TEAMID1234.com.example.app"
+
+func TestRun(t *testing.T) {
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	if err := writeCA(caPath); err != nil {
+		t.Fatal(err)
+	}
+	ca, err := readCA(caPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requestid.UseUUID()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := memory.New(memory.Config{})
+	h := handler.NewAppAttestHandler(logger, adapter.NewAttestationAdapter(logger, attest.NewAttestationService(ca.Pool(), appID), store))
+	h.Renderer = problem.JSON{}
+	m := middleware.NewAssertionMiddleware(logger, middleware.Config{Renderer: problem.JSON{}, RequiredMode: middleware.RequiredStatus},
+		adapter.NewAssertionAdapter(logger, appID, store))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/attest/challenge", h.NewChallenge)
+	mux.HandleFunc("/attest/verify", h.Verify)
+	mux.Handle("/api/ping", m.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	tests := map[string]struct {
+		appID    string
+		devices  int
+		workers  int
+		ratio    float64
+		requests int64
+		// wantFailures is a failure line expected in the report, if any.
+		wantFailures string
+	}{
+		"mix":       {appID: appID, devices: 3, workers: 1, ratio: 0.3, requests: 30},
+		"contended": {appID: appID, devices: 1, workers: 4, requests: 40},
+		"other app": {appID: "TEAMID1234.com.example.other", devices: 2, workers: 1, requests: 10, wantFailures: "attestation 400 app_id_mismatch: 2"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			r, err := run(context.Background(), config{
+				CA:           ca,
+				AppID:        tc.appID,
+				Client:       srv.Client(),
+				ChallengeURL: srv.URL + "/attest/challenge",
+				AttestURL:    srv.URL + "/attest/verify",
+				AssertURL:    srv.URL + "/api/ping",
+				AssertMethod: http.MethodPost,
+				Body:         []byte("{}"),
+				Devices:      tc.devices,
+				Workers:      tc.workers,
+				AttestRatio:  tc.ratio,
+				Duration:     time.Minute,
+				Requests:     tc.requests,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var total int
+			for _, s := range r.ops {
+				total += len(s.latencies)
+			}
+			var out strings.Builder
+			r.write(&out)
+			if tc.wantFailures == "" {
+				if total != int(tc.requests) {
+					t.Errorf("got %d operations, want %d:\n%s", total, tc.requests, out.String())
+				}
+				if name != "contended" && len(r.failures) > 0 {
+					t.Errorf("unexpected failures:\n%s", out.String())
+				}
+				return
+			}
+			if !strings.Contains(out.String(), tc.wantFailures) {
+				t.Errorf("report does not contain %q:\n%s", tc.wantFailures, out.String())
+			}
+		})
+	}
+}
+
+func TestResponseReason(t *testing.T) {
+	tests := map[string]struct {
+		status   int
+		required string
+		body     string
+		want     string
+	}{
+		"problem json": {status: 400, body: `{"type":"urn:app-attest:problem:counter_not_increasing","status":400,"reason":"counter_not_increasing"}`, want: "400 counter_not_increasing"},
+		"required":     {status: 428, required: "challenge", body: "Precondition Required\n", want: "428 challenge required"},
+		"plain text":   {status: 500, body: "Internal Server Error\n", want: "500 Internal Server Error"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := responseReason(tc.status, tc.required, []byte(tc.body)); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 200; i++ {
+		sorted = append(sorted, time.Duration(i)*time.Millisecond)
+	}
+	tests := map[string]struct {
+		p    int
+		want time.Duration
+	}{
+		"p50": {p: 50, want: 100 * time.Millisecond},
+		"p99": {p: 99, want: 198 * time.Millisecond},
+		"max": {p: 100, want: 200 * time.Millisecond},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := percentile(sorted, tc.p); got != tc.want {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+	if got := percentile(nil, 50); got != 0 {
+		t.Errorf("got %s for no samples", got)
+	}
+}
+
+func TestReadCA_Missing(t *testing.T) {
+	if _, err := readCA(filepath.Join(t.TempDir(), "missing.pem")); !os.IsNotExist(err) {
+		t.Errorf("expected a not-exist error, got %v", err)
+	}
+}
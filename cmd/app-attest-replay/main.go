@@ -0,0 +1,203 @@
+// Command app-attest-replay re-runs quarantined App Attest payloads against
+// the current verifier configuration.
+//
+// Usage:
+//
+//	app-attest-replay [flags] dir|file...
+//
+// The records are read from the quarantine directories and files given as
+// arguments, as written by quarantine.Dir, and replayed in capture order with
+// replay.Replayer. Attestations are verified against the -roots
+// certificates; assertions against the keys of the -keys file and of the
+// attestations that pass. For each record, the command prints the reason it
+// was rejected with and the outcome of the replay, then a summary. Challenge
+// and counter state is not replayed.
+//
+//	app-attest-replay -app-id TEAMID.com.example.app \
+//	    -roots Apple_App_Attestation_Root_CA.pem -keys keys.pem /var/lib/app/quarantine
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	attest "github.com/takimoto3/app-attest"
+	"github.com/takimoto3/app-attest-middleware/adapter"
+	"github.com/takimoto3/app-attest-middleware/canonical"
+	"github.com/takimoto3/app-attest-middleware/quarantine"
+	"github.com/takimoto3/app-attest-middleware/quarantine/replay"
+	"github.com/takimoto3/app-attest/certs"
+)
+
+func main() {
+	var (
+		appID   = flag.String("app-id", "", "App ID (team ID + \".\" + bundle ID) to verify against")
+		roots   = flag.String("roots", "", "PEM or CER file with the App Attest root certificate; attestations are skipped without it")
+		keys    = flag.String("keys", "", "PEM file with the attested public keys or credential certificates of assertions")
+		headers = flag.String("canonical-headers", "", "comma-separated headers of the canonical request, if the middleware signs canonical requests")
+		signed  = flag.Bool("canonical", false, "assertions sign the canonical request instead of the body")
+	)
+	flag.Parse()
+	if flag.NArg() == 0 || *appID == "" {
+		fmt.Fprintln(os.Stderr, "usage: app-attest-replay -app-id ID [flags] dir|file...")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	replayer := &replay.Replayer{AppID: *appID}
+	err := func() error {
+		if *roots != "" {
+			pool, err := certs.LoadCertFiles(*roots)
+			if err != nil {
+				return err
+			}
+			replayer.AttestationService = attest.NewAttestationService(pool, *appID)
+		}
+		if *keys != "" {
+			known, err := readPublicKeys(*keys)
+			if err != nil {
+				return err
+			}
+			replayer.PublicKey = func(ctx context.Context, keyID []byte) (*ecdsa.PublicKey, error) {
+				return known[string(keyID)], nil
+			}
+		}
+		if *signed || *headers != "" {
+			replayer.CanonicalRequest = &canonical.Config{}
+			if *headers != "" {
+				replayer.CanonicalRequest.Headers = strings.Split(*headers, ",")
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "app-attest-replay:", err)
+		os.Exit(2)
+	}
+
+	records, err := readRecords(flag.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "app-attest-replay:", err)
+		os.Exit(2)
+	}
+	run(context.Background(), os.Stdout, replayer, records)
+}
+
+// readRecords reads the records of the quarantine directories and files in paths.
+func readRecords(paths []string) ([]*quarantine.Record, error) {
+	var records []*quarantine.Record
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			recs, err := quarantine.ReadDir(path)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, recs...)
+			continue
+		}
+		rec, err := quarantine.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// summary counts the outcomes of a replay.
+type summary struct {
+	records, passed, failed, skipped int
+	// changed counts the failed records whose reason differs from the recorded one.
+	changed int
+}
+
+// run replays records with replayer and prints the outcome of each and a summary to out.
+func run(ctx context.Context, out io.Writer, replayer *replay.Replayer, records []*quarantine.Record) summary {
+	var s summary
+	for _, rec := range records {
+		s.records++
+		err := replayer.Replay(ctx, rec)
+		var now string
+		switch {
+		case err == nil:
+			s.passed++
+			now = "ok"
+		case errors.Is(err, replay.ErrNotReplayable):
+			s.skipped++
+			now = "skipped: " + strings.TrimPrefix(err.Error(), replay.ErrNotReplayable.Error()+": ")
+		default:
+			s.failed++
+			reason := string(adapter.ReasonOf(err))
+			if reason == "" {
+				reason = err.Error()
+			}
+			if reason != rec.Reason {
+				s.changed++
+			}
+			now = reason
+		}
+		id := rec.RequestID
+		if id == "" {
+			id = "-"
+		}
+		fmt.Fprintf(out, "%s %s %s: was %s, now %s\n", rec.Name, rec.Kind, id, rec.Reason, now)
+	}
+	fmt.Fprintf(out, "%d records: %d pass, %d fail (%d with a different reason), %d skipped\n",
+		s.records, s.passed, s.failed, s.changed, s.skipped)
+	return s
+}
+
+// readPublicKeys reads the ECDSA keys of the PEM PUBLIC KEY and CERTIFICATE
+// blocks of the file at path, by key ID.
+func readPublicKeys(path string) (map[string]*ecdsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*ecdsa.PublicKey)
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		var key any
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			return nil, fmt.Errorf("unexpected PEM block %q in %s", block.Type, path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%s holds a key that is not an ECDSA key", path)
+		}
+		keyID := sha256.Sum256(attest.MarshalUncompressed(pub))
+		keys[string(keyID[:])] = pub
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no PEM block in " + path)
+	}
+	return keys, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	attest "github.com/takimoto3/app-attest"
+	"github.com/takimoto3/app-attest-middleware/adapter"
+	"github.com/takimoto3/app-attest-middleware/attesttest"
+	"github.com/takimoto3/app-attest-middleware/plugin"
+	"github.com/takimoto3/app-attest-middleware/quarantine"
+	"github.com/takimoto3/app-attest-middleware/quarantine/replay"
+	"github.com/takimoto3/app-attest-middleware/wire"
+)
+
+const appID = "TEAMID1234.com.example.app"
+
+func TestRun(t *testing.T) {
+	ca, err := attesttest.NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	device, err := ca.NewDevice(appID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := t.TempDir()
+	dir, err := quarantine.Open(path, quarantine.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	capture := func(kind quarantine.Kind, r *http.Request, body []byte, reason adapter.Reason) {
+		t.Helper()
+		if err := quarantine.Capture(context.Background(), dir, r, kind, body, string(reason), adapter.NewVerificationError(reason, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// An attestation rejected by a server that did not trust the CA.
+	hash := sha256.Sum256([]byte("challenge-1"))
+	obj, err := device.AttestKey(hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := wire.EncodeAttestation(obj, device.KeyID(), "challenge-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/attest/verify", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	capture(quarantine.KindAttestation, r, body, adapter.ReasonCertificateChainInvalid)
+
+	// An assertion that was rejected for a stale counter and one whose body was altered.
+	for _, sent := range []string{"signed", "altered"} {
+		hash := sha256.Sum256(plugin.BodyClientData("challenge-2", []byte("signed")))
+		assertion, err := device.GenerateAssertion(hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(http.MethodPost, "/api", strings.NewReader(sent))
+		wire.SetAssertion(r.Header, assertion, device.KeyID(), "challenge-2")
+		capture(quarantine.KindAssertion, r, []byte(sent), adapter.ReasonCounterNotIncreasing)
+	}
+
+	records, err := readRecords([]string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	s := run(context.Background(), &out, &replay.Replayer{
+		AppID:              appID,
+		AttestationService: attest.NewAttestationService(ca.Pool(), appID),
+	}, records)
+	if s != (summary{records: 3, passed: 2, failed: 1, changed: 1}) {
+		t.Errorf("got %+v\n%s", s, out.String())
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	for i, want := range []string{
+		"attestation -: was certificate_chain_invalid, now ok",
+		"assertion -: was counter_not_increasing, now ok",
+		"assertion -: was counter_not_increasing, now bad_signature",
+		"3 records: 2 pass, 1 fail (1 with a different reason), 0 skipped",
+	} {
+		if i >= len(lines) || !strings.HasSuffix(lines[i], want) {
+			t.Errorf("line %d: want suffix %q\n%s", i, want, out.String())
+		}
+	}
+}
+
+func TestReadPublicKeys(t *testing.T) {
+	ca, err := attesttest.NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data []byte
+	var devices []*attesttest.Device
+	for range 2 {
+		device, err := ca.NewDevice(appID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.MarshalPKIXPublicKey(device.PublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})...)
+		devices = append(devices, device)
+	}
+	path := filepath.Join(t.TempDir(), "keys.pem")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := readPublicKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("got %d keys, want 2", len(keys))
+	}
+	for i, device := range devices {
+		if key := keys[string(device.KeyID())]; key == nil || !key.Equal(device.PublicKey()) {
+			t.Errorf("device %d: key not found by key ID", i)
+		}
+	}
+}
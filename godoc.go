@@ -5,7 +5,27 @@
 // integrate attestation verification into Go web services.
 //
 // Subpackages:
+//   - audit: audit events with JSON-lines file, hash-chained file and channel sinks
+//   - attesttest: fake App Attest CA and devices for integration tests
+//   - client: simulated App Attest client for end-to-end and load tests
+//   - cmd/app-attest-audit: offline verifier for hash-chained audit logs
+//   - cmd/app-attest-inspect: offline decoder and checker for attestation and assertion payloads
+//   - cmd/app-attest-load: load test driving many simulated devices
+//   - cmd/app-attest-replay: replays quarantined payloads against the current verifier configuration
 //   - handler: contains HTTP route handlers for verification endpoints
 //   - middleware: provides common middleware like request ID injection
+//   - metrics: Observer interface with expvar and Prometheus implementations
+//   - problem: plain-text and RFC 9457 problem+json error responses
+//   - quarantine: bounded capture of rejected payloads
+//   - quarantine/replay: replay of quarantined payloads through the adapters
+//   - receipt: receipt verification, refresh client and refresh scheduler
+//   - receipt/receipttest: fake attestation data endpoint for receipt tests
 //   - requestid: handles request ID generation and propagation
+//   - tracing: OpenTelemetry span names and attributes
+//   - wire: default wire format and payload decoders for plugins
+//   - canonical: canonical request bytes used as assertion client data
+//   - challenge: issues and verifies stateless HMAC-signed challenges
+//   - plugin/memory: in-memory reference implementation of the plugin interfaces
+//   - plugin/sqlstore: database/sql implementation of the plugin interfaces
+//   - plugintest: conformance suite for plugin implementations
 package appattest
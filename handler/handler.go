@@ -1,19 +1,29 @@
 package handler
 
 import (
+	"bytes"
 	"errors"
+	"io"
 	"log/slog"
 	"net/http"
+	"time"
 
 	"github.com/takimoto3/app-attest-middleware/adapter"
+	"github.com/takimoto3/app-attest-middleware/audit"
+	"github.com/takimoto3/app-attest-middleware/metrics"
 	"github.com/takimoto3/app-attest-middleware/plugin"
+	"github.com/takimoto3/app-attest-middleware/problem"
+	"github.com/takimoto3/app-attest-middleware/quarantine"
 	"github.com/takimoto3/app-attest-middleware/requestid"
+	"github.com/takimoto3/app-attest-middleware/tracing"
 )
 
 // VerifyHooks defines hooks for the Verify handler.
 // Setup: pre-processing (cannot write to response)
 // Success: called on successful verification
-// Failed: called on failure (default implementation is just an example and can be overridden)
+// Failed: called on failure (default implementation is just an example and can be overridden).
+// For a replayed attestation (adapter.ErrChallengeUsed) err carries a fresh challenge,
+// see problem.ChallengeOf; the default answers it with 409 Conflict and the challenge
 type VerifyHooks struct {
 	Setup   func(r *http.Request)
 	Success func(w http.ResponseWriter, r *http.Request)
@@ -33,97 +43,204 @@ type NewChallengeHooks struct {
 // AppAttestHandler is an HTTP handler for App Attest verification.
 // VerifyHooks and NewChallengeHooks allow customizing success, failure, and pre-processing behavior.
 type AppAttestHandler struct {
-	logger  *slog.Logger
-	adapter adapter.AttestationAdapter
+	logger   *slog.Logger
+	adapter  adapter.AttestationAdapter
+	settings adapter.Settings
+	// Renderer writes the error responses of the default Failed hooks, of
+	// request ID failures and of attestations without a valid challenge.
+	// Defaults to problem.Text; set it to problem.JSON for
+	// application/problem+json.
+	Renderer problem.Renderer
 	VerifyHooks
 	NewChallengeHooks
 }
 
 // NewAppAttestHandler creates a default AppAttestHandler.
 // Default Failed hooks are just examples and can be overridden.
+// The handler reads the Settings of attestAdapter, see adapter.SettingsOf: it
+// reports every request to the observer, traces it with the tracer provider,
+// records an audit.EventAttestationRejected for requests rejected before they
+// reach the adapter with the audit sink, and hands every attestation the
+// adapter rejects as adapter.ErrBadRequest, with the body read by the plugin,
+// to the quarantine sink, except replays, see adapter.WithQuarantine.
 func NewAppAttestHandler(logger *slog.Logger, attestAdapter adapter.AttestationAdapter) *AppAttestHandler {
-	return &AppAttestHandler{
-		logger:  logger,
-		adapter: attestAdapter,
-		VerifyHooks: VerifyHooks{
-			Setup: func(r *http.Request) {},
-			Success: func(w http.ResponseWriter, r *http.Request) {
-				w.WriteHeader(http.StatusOK)
-			},
-			Failed: func(w http.ResponseWriter, r *http.Request, err error) {
-				if errors.Is(err, adapter.ErrBadRequest) {
-					http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-					return
-				}
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			},
+	h := &AppAttestHandler{
+		logger:   logger,
+		adapter:  attestAdapter,
+		settings: adapter.SettingsOf(attestAdapter),
+		Renderer: problem.Text{},
+	}
+	h.VerifyHooks = VerifyHooks{
+		Setup: func(r *http.Request) {},
+		Success: func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
 		},
-		NewChallengeHooks: NewChallengeHooks{
-			Setup: func(r *http.Request) {},
-			Success: func(w http.ResponseWriter, r *http.Request, challenge string) {
-				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-				w.WriteHeader(http.StatusOK)
-				w.Write([]byte(challenge))
-			},
-			Failed: func(w http.ResponseWriter, r *http.Request, err error) {
-				if errors.Is(err, adapter.ErrBadRequest) {
-					http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-					return
-				}
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			},
+		Failed: h.renderError,
+	}
+	h.NewChallengeHooks = NewChallengeHooks{
+		Setup: func(r *http.Request) {},
+		Success: func(w http.ResponseWriter, r *http.Request, challenge string) {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(challenge))
 		},
+		Failed: h.renderError,
+	}
+	return h
+}
+
+// renderError renders err with Renderer, as 409 for adapter.ErrChallengeUsed,
+// 400 for adapter.ErrBadRequest, 403 for adapter.ErrRiskRejected and 500
+// otherwise.
+func (h *AppAttestHandler) renderError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, adapter.ErrChallengeUsed):
+		status = http.StatusConflict
+	case errors.Is(err, adapter.ErrBadRequest):
+		status = http.StatusBadRequest
+	case errors.Is(err, adapter.ErrRiskRejected):
+		status = http.StatusForbidden
 	}
+	h.renderer().Render(w, r, status, err)
+}
+
+func (h *AppAttestHandler) renderer() problem.Renderer {
+	if h.Renderer == nil {
+		return problem.Text{}
+	}
+	return h.Renderer
 }
 
 func (h *AppAttestHandler) Verify(w http.ResponseWriter, r *http.Request) {
-	r, logger, err := h.getLogger(r)
+	h.serve(w, r, tracing.SpanHandlerVerify, metrics.OpAttestation, h.verify)
+}
+
+func (h *AppAttestHandler) NewChallenge(w http.ResponseWriter, r *http.Request) {
+	h.serve(w, r, tracing.SpanHandlerChallenge, metrics.OpChallenge, h.newChallenge)
+}
+
+// verify serves Verify and returns the error the response was written for, if any.
+func (h *AppAttestHandler) verify(w http.ResponseWriter, r *http.Request) error {
+	req, logger, err := h.getLogger(r)
 	if err != nil {
-		h.logger.Error("failed to generate request ID", "err", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
+		return h.requestIDFailed(w, r, err)
 	}
+	r = req
 
 	h.VerifyHooks.Setup(r)
+	payload := &bytes.Buffer{}
+	if h.settings.Quarantine != nil && r.Body != nil {
+		r.Body = teeBody{io.TeeReader(r.Body, payload), r.Body}
+	}
 	err = h.adapter.Verify(r.Context(), &plugin.AttestationRequest{Request: r})
 	if err != nil {
 		if errors.Is(err, adapter.ErrNewChallenge) {
-			h.NewChallenge(w, r)
-			return
+			logger.Info("no challenge assigned, issuing a new challenge", "reason", adapter.ReasonOf(err))
+			if cerr := h.newChallenge(w, r); cerr != nil {
+				return cerr
+			}
+			return err
+		}
+		logger.Error("verification failed", "reason", adapter.ReasonOf(err), "err", err)
+		// Replays are in the audit log already and carry nothing to reproduce.
+		if reason := adapter.ReasonOf(err); errors.Is(err, adapter.ErrBadRequest) && reason != adapter.ReasonChallengeUsed && reason != adapter.ReasonReplayDetected {
+			if err := quarantine.Capture(r.Context(), h.settings.Quarantine, r, quarantine.KindAttestation, payload.Bytes(), string(reason), err); err != nil {
+				logger.Error("failed to quarantine request", "err", err)
+			}
+		}
+		if errors.Is(err, adapter.ErrChallengeUsed) {
+			challenge, cerr := h.adapter.NewChallenge(r.Context(), &plugin.AttestationRequest{Request: r})
+			if cerr != nil {
+				logger.Error("new challenge failed", "reason", adapter.ReasonOf(cerr), "err", cerr)
+				h.NewChallengeHooks.Failed(w, r, cerr)
+				return cerr
+			}
+			err = problem.WithChallenge(err, challenge)
 		}
-		logger.Error("verification failed", "err", err)
 		h.VerifyHooks.Failed(w, r, err)
-		return
+		return err
 	}
 
 	logger.Info("verification succeeded")
 	h.VerifyHooks.Success(w, r)
+	return nil
 }
 
-func (h *AppAttestHandler) NewChallenge(w http.ResponseWriter, r *http.Request) {
-	r, logger, err := h.getLogger(r)
+// newChallenge serves NewChallenge and returns the error the response was written for, if any.
+func (h *AppAttestHandler) newChallenge(w http.ResponseWriter, r *http.Request) error {
+	req, logger, err := h.getLogger(r)
 	if err != nil {
-		h.logger.Error("failed to generate request ID", "err", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
+		return h.requestIDFailed(w, r, err)
 	}
+	r = req
 
 	h.NewChallengeHooks.Setup(r)
 	challenge, err := h.adapter.NewChallenge(r.Context(), &plugin.AttestationRequest{Request: r})
 	if err != nil {
-		logger.Error("new challenge failed", "err", err)
+		logger.Error("new challenge failed", "reason", adapter.ReasonOf(err), "err", err)
 		h.NewChallengeHooks.Failed(w, r, err)
-		return
+		return err
 	}
 
 	logger.Info("new challenge succeeded")
 	h.NewChallengeHooks.Success(w, r, challenge)
+	return nil
+}
+
+// teeBody is a request body that copies what is read from it.
+type teeBody struct {
+	io.Reader
+	io.Closer
+}
+
+// serve calls fn in a span named name.
+func (h *AppAttestHandler) serve(w http.ResponseWriter, r *http.Request, name, operation string, fn func(http.ResponseWriter, *http.Request) error) {
+	ctx, span := tracing.Start(r.Context(), tracing.Tracer(h.settings.TracerProvider), name, tracing.OperationKey.String(operation))
+	defer span.End()
+
+	err := h.observe(w, r.WithContext(ctx), operation, fn)
+	tracing.SetOutcome(span, string(adapter.ReasonOf(err)), err)
+}
+
+// observe calls fn and reports the request to the observer, if set.
+func (h *AppAttestHandler) observe(w http.ResponseWriter, r *http.Request, operation string, fn func(http.ResponseWriter, *http.Request) error) error {
+	if h.settings.Observer == nil {
+		return fn(w, r)
+	}
+	start := time.Now()
+	rec := &metrics.StatusRecorder{ResponseWriter: w}
+	err := fn(rec, r)
+	h.settings.Observer.Request(r.Context(), metrics.RequestEvent{
+		Component: metrics.ComponentHandler,
+		Operation: operation,
+		Status:    rec.Status,
+		Reason:    string(adapter.ReasonOf(err)),
+		Duration:  time.Since(start),
+	})
+	return err
+}
+
+// requestIDFailed answers a request whose request ID could not be generated
+// with 500, records an audit.EventAttestationRejected and returns the error.
+func (h *AppAttestHandler) requestIDFailed(w http.ResponseWriter, r *http.Request, err error) error {
+	h.logger.Error("failed to generate request ID", "err", err)
+	err = adapter.NewVerificationError(adapter.ReasonInternal, err)
+	e := audit.Event{Type: audit.EventAttestationRejected, Reason: string(adapter.ReasonInternal)}
+	if err := audit.Emit(r.Context(), h.settings.AuditSink, r, e); err != nil {
+		h.logger.Error("failed to record audit event", "type", e.Type, "err", err)
+	}
+	h.renderer().Render(w, r, http.StatusInternalServerError, err)
+	return err
 }
 
+// getLogger returns r with a request ID and a logger carrying it. On error the
+// returned request is nil.
 func (h *AppAttestHandler) getLogger(r *http.Request) (*http.Request, *slog.Logger, error) {
 	r, requestID, err := requestid.EnsureRequest(r)
 	if err != nil {
-		return r, nil, err
+		return nil, nil, err
 	}
+	tracing.SetRequestID(r.Context(), requestID)
 	return r, h.logger.With("request_id", requestID), nil
 }
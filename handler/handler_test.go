@@ -2,17 +2,22 @@ package handler_test
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"io"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/sony/sonyflake/v2"
 	"github.com/takimoto3/app-attest-middleware/adapter"
+	"github.com/takimoto3/app-attest-middleware/audit"
 	"github.com/takimoto3/app-attest-middleware/handler"
+	"github.com/takimoto3/app-attest-middleware/metrics"
 	"github.com/takimoto3/app-attest-middleware/plugin"
+	"github.com/takimoto3/app-attest-middleware/problem"
 	"github.com/takimoto3/app-attest-middleware/requestid"
 )
 
@@ -22,6 +27,11 @@ var _ adapter.AttestationAdapter = &mockAdapter{}
 type mockAdapter struct {
 	verifyFunc       func() error
 	newChallengeFunc func() (string, error)
+	settings         adapter.Settings
+}
+
+func (m *mockAdapter) Settings() adapter.Settings {
+	return m.settings
 }
 
 func (m *mockAdapter) Verify(ctx context.Context, _ *plugin.AttestationRequest) error {
@@ -101,3 +111,198 @@ func TestVerifyHandler(t *testing.T) {
 		})
 	}
 }
+
+// useSnowFlake sets a sonyflake request ID generator with a fixed machine ID.
+// The tests of the package must not use another Generator type, since the
+// generator is stored in an atomic.Value.
+func useSnowFlake(t *testing.T, st sonyflake.Settings) {
+	t.Helper()
+	st.MachineID = func() (int, error) { return 1, nil }
+	if err := requestid.UseSnowFlake(st); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandler_ProblemJSON(t *testing.T) {
+	useSnowFlake(t, sonyflake.Settings{})
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cases := map[string]struct {
+		call       func(h *handler.AppAttestHandler, w http.ResponseWriter, r *http.Request)
+		verifyErr  error
+		newErr     error
+		challenge  string
+		wantStatus int
+		wantReason string
+	}{
+		"challenge used": {
+			call:       (*handler.AppAttestHandler).Verify,
+			verifyErr:  adapter.NewVerificationError(adapter.ReasonChallengeUsed, adapter.ErrChallengeUsed),
+			challenge:  "fresh",
+			wantStatus: http.StatusConflict,
+			wantReason: "challenge_used",
+		},
+		"verify failure": {
+			call:       (*handler.AppAttestHandler).Verify,
+			verifyErr:  adapter.NewVerificationError(adapter.ReasonCertificateChainInvalid, errors.New("x509")),
+			wantStatus: http.StatusBadRequest,
+			wantReason: "certificate_chain_invalid",
+		},
+		"new challenge failure": {
+			call:       (*handler.AppAttestHandler).NewChallenge,
+			newErr:     adapter.NewVerificationError(adapter.ReasonStoreUnavailable, errors.New("db")),
+			wantStatus: http.StatusInternalServerError,
+			wantReason: "store_unavailable",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			h := handler.NewAppAttestHandler(logger, &mockAdapter{
+				verifyFunc:       func() error { return tc.verifyErr },
+				newChallengeFunc: func() (string, error) { return tc.challenge, tc.newErr },
+			})
+			h.Renderer = problem.JSON{}
+
+			r := httptest.NewRequest(http.MethodPost, "/attest", nil)
+			r.Header.Set("X-Request-ID", "req-1")
+			w := httptest.NewRecorder()
+			tc.call(h, w, r)
+
+			if w.Code != tc.wantStatus {
+				t.Errorf("expected status %d, got %d", tc.wantStatus, w.Code)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != problem.ContentType {
+				t.Errorf("expected Content-Type %q, got %q", problem.ContentType, ct)
+			}
+			var got problem.Details
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("invalid problem body %q: %v", w.Body.String(), err)
+			}
+			if got.Reason != tc.wantReason || got.RequestID != "req-1" || got.Challenge != tc.challenge {
+				t.Errorf("unexpected problem %+v", got)
+			}
+		})
+	}
+}
+
+func TestHandler_ChallengeUsedFailedHook(t *testing.T) {
+	useSnowFlake(t, sonyflake.Settings{})
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	h := handler.NewAppAttestHandler(logger, &mockAdapter{
+		verifyFunc: func() error {
+			return adapter.NewVerificationError(adapter.ReasonChallengeUsed, adapter.ErrChallengeUsed)
+		},
+		newChallengeFunc: func() (string, error) { return "fresh", nil },
+	})
+	var got error
+	h.VerifyHooks.Failed = func(w http.ResponseWriter, r *http.Request, err error) {
+		got = err
+		w.WriteHeader(http.StatusTeapot)
+	}
+
+	w := httptest.NewRecorder()
+	h.Verify(w, httptest.NewRequest(http.MethodPost, "/attest", nil))
+
+	if w.Code != http.StatusTeapot {
+		t.Errorf("expected status %d, got %d", http.StatusTeapot, w.Code)
+	}
+	if !errors.Is(got, adapter.ErrChallengeUsed) || problem.ChallengeOf(got) != "fresh" {
+		t.Errorf("Failed got err %v with challenge %q, want ErrChallengeUsed with %q", got, problem.ChallengeOf(got), "fresh")
+	}
+}
+
+type requestObserver struct {
+	events []metrics.RequestEvent
+}
+
+func (o *requestObserver) Verification(ctx context.Context, e metrics.VerificationEvent) {}
+func (o *requestObserver) PluginCall(ctx context.Context, e metrics.PluginCallEvent)     {}
+func (o *requestObserver) Request(ctx context.Context, e metrics.RequestEvent) {
+	e.Duration = 0
+	o.events = append(o.events, e)
+}
+
+func TestHandler_Observer(t *testing.T) {
+	useSnowFlake(t, sonyflake.Settings{})
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cases := map[string]struct {
+		call      func(h *handler.AppAttestHandler, w http.ResponseWriter, r *http.Request)
+		verifyErr error
+		want      metrics.RequestEvent
+	}{
+		"verified": {
+			call: (*handler.AppAttestHandler).Verify,
+			want: metrics.RequestEvent{Component: metrics.ComponentHandler, Operation: metrics.OpAttestation, Status: http.StatusOK},
+		},
+		"verify failure": {
+			call:      (*handler.AppAttestHandler).Verify,
+			verifyErr: adapter.NewVerificationError(adapter.ReasonNonceMismatch, nil),
+			want:      metrics.RequestEvent{Component: metrics.ComponentHandler, Operation: metrics.OpAttestation, Status: http.StatusBadRequest, Reason: "nonce_mismatch"},
+		},
+		"challenge issued on verify": {
+			call:      (*handler.AppAttestHandler).Verify,
+			verifyErr: adapter.NewVerificationError(adapter.ReasonChallengeRequired, nil),
+			want:      metrics.RequestEvent{Component: metrics.ComponentHandler, Operation: metrics.OpAttestation, Status: http.StatusOK, Reason: "challenge_required"},
+		},
+		"challenge used": {
+			call:      (*handler.AppAttestHandler).Verify,
+			verifyErr: adapter.NewVerificationError(adapter.ReasonChallengeUsed, adapter.ErrChallengeUsed),
+			want:      metrics.RequestEvent{Component: metrics.ComponentHandler, Operation: metrics.OpAttestation, Status: http.StatusConflict, Reason: "challenge_used"},
+		},
+		"new challenge": {
+			call: (*handler.AppAttestHandler).NewChallenge,
+			want: metrics.RequestEvent{Component: metrics.ComponentHandler, Operation: metrics.OpChallenge, Status: http.StatusOK},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			observer := &requestObserver{}
+			h := handler.NewAppAttestHandler(logger, &mockAdapter{
+				verifyFunc:       func() error { return tc.verifyErr },
+				newChallengeFunc: func() (string, error) { return "challenge", nil },
+				settings:         adapter.Settings{Observer: observer},
+			})
+
+			tc.call(h, httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/attest", nil))
+
+			if len(observer.events) != 1 || observer.events[0] != tc.want {
+				t.Errorf("got events %+v, want [%+v]", observer.events, tc.want)
+			}
+		})
+	}
+}
+
+func TestHandler_RequestIDFailure(t *testing.T) {
+	// The elapsed time exceeds the time bits of the IDs, so NextID fails.
+	useSnowFlake(t, sonyflake.Settings{StartTime: time.Now().AddDate(-200, 0, 0)})
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cases := map[string]struct {
+		call func(h *handler.AppAttestHandler, w http.ResponseWriter, r *http.Request)
+	}{
+		"verify":        {call: (*handler.AppAttestHandler).Verify},
+		"new challenge": {call: (*handler.AppAttestHandler).NewChallenge},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			events := make(audit.Channel, 2)
+			h := handler.NewAppAttestHandler(logger, &mockAdapter{
+				verifyFunc:       func() error { t.Error("adapter called"); return nil },
+				newChallengeFunc: func() (string, error) { t.Error("adapter called"); return "", nil },
+				settings:         adapter.Settings{AuditSink: events},
+			})
+			h.Renderer = problem.JSON{}
+			w := httptest.NewRecorder()
+
+			tc.call(h, w, httptest.NewRequest(http.MethodPost, "/attest", nil))
+
+			if w.Code != http.StatusInternalServerError {
+				t.Errorf("got status %d, want %d", w.Code, http.StatusInternalServerError)
+			}
+			if len(events) != 1 {
+				t.Fatalf("got %d audit events, want 1", len(events))
+			}
+			if e := <-events; e.Type != audit.EventAttestationRejected || e.Reason != string(adapter.ReasonInternal) {
+				t.Errorf("unexpected audit event %+v", e)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"context"
+	"expvar"
+	"strconv"
+)
+
+// Expvar is an Observer that publishes counters and total durations through
+// the standard expvar package, served at /debug/vars by expvar's handler.
+//
+// It publishes one expvar.Map under its name, with the nested maps
+//
+//	verifications            "<operation>.<outcome>[.<reason>]" -> count
+//	verification_seconds     "<operation>.<outcome>"            -> total seconds
+//	plugin_calls             "<operation>.<method>.<outcome>"   -> count
+//	plugin_call_seconds      "<operation>.<method>"             -> total seconds
+//	requests                 "<component>.<operation>.<status>" -> count
+//	request_seconds          "<component>.<operation>"          -> total seconds
+type Expvar struct {
+	verifications       *expvar.Map
+	verificationSeconds *expvar.Map
+	pluginCalls         *expvar.Map
+	pluginCallSeconds   *expvar.Map
+	requests            *expvar.Map
+	requestSeconds      *expvar.Map
+}
+
+var _ Observer = (*Expvar)(nil)
+
+// NewExpvar creates an Expvar published under name.
+// Like expvar.Publish, it panics if name is already in use.
+func NewExpvar(name string) *Expvar {
+	e := &Expvar{
+		verifications:       new(expvar.Map),
+		verificationSeconds: new(expvar.Map),
+		pluginCalls:         new(expvar.Map),
+		pluginCallSeconds:   new(expvar.Map),
+		requests:            new(expvar.Map),
+		requestSeconds:      new(expvar.Map),
+	}
+	root := expvar.NewMap(name)
+	root.Set("verifications", e.verifications)
+	root.Set("verification_seconds", e.verificationSeconds)
+	root.Set("plugin_calls", e.pluginCalls)
+	root.Set("plugin_call_seconds", e.pluginCallSeconds)
+	root.Set("requests", e.requests)
+	root.Set("request_seconds", e.requestSeconds)
+	return e
+}
+
+// Verification implements Observer.
+func (e *Expvar) Verification(ctx context.Context, ev VerificationEvent) {
+	key := ev.Operation + "." + ev.Outcome
+	if ev.Reason != "" {
+		e.verifications.Add(key+"."+ev.Reason, 1)
+	} else {
+		e.verifications.Add(key, 1)
+	}
+	e.verificationSeconds.AddFloat(key, ev.Duration.Seconds())
+}
+
+// PluginCall implements Observer.
+func (e *Expvar) PluginCall(ctx context.Context, ev PluginCallEvent) {
+	key := ev.Operation + "." + ev.Method
+	e.pluginCalls.Add(key+"."+ev.Outcome, 1)
+	e.pluginCallSeconds.AddFloat(key, ev.Duration.Seconds())
+}
+
+// Request implements Observer.
+func (e *Expvar) Request(ctx context.Context, ev RequestEvent) {
+	key := ev.Component + "." + ev.Operation
+	e.requests.Add(key+"."+strconv.Itoa(ev.Status), 1)
+	e.requestSeconds.AddFloat(key, ev.Duration.Seconds())
+}
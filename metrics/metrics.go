@@ -0,0 +1,140 @@
+// Package metrics defines the Observer interface that the adapters, the
+// handler and the middleware report to, and ships two implementations that
+// need no external services: Expvar, which publishes counters through the
+// standard expvar package, and Prometheus, which serves the Prometheus text
+// exposition format.
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Operations reported in events.
+const (
+	OpAttestation = "attestation"
+	OpAssertion   = "assertion"
+	OpChallenge   = "challenge"
+)
+
+// Outcomes reported in events.
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// Components reported in RequestEvent.
+const (
+	ComponentHandler    = "handler"
+	ComponentMiddleware = "middleware"
+)
+
+// VerificationEvent is reported by the adapters after each attestation,
+// assertion or challenge issuance.
+type VerificationEvent struct {
+	// Operation is OpAttestation, OpAssertion or OpChallenge.
+	Operation string
+	// Outcome is OutcomeSuccess or OutcomeFailure.
+	Outcome string
+	// Reason is the reason code of the failure, empty on success.
+	Reason string
+	// Duration is the time spent in the adapter, plugin calls included.
+	Duration time.Duration
+}
+
+// PluginCallEvent is reported by the adapters after each plugin method call.
+type PluginCallEvent struct {
+	// Operation is the adapter operation the call belongs to.
+	Operation string
+	// Method is the plugin method name, e.g. "PublicKeyAndCounter".
+	Method string
+	// Outcome is OutcomeSuccess or OutcomeFailure.
+	Outcome string
+	// Duration is the latency of the call.
+	Duration time.Duration
+}
+
+// RequestEvent is reported by the handler and the middleware after each HTTP request.
+type RequestEvent struct {
+	// Component is ComponentHandler or ComponentMiddleware.
+	Component string
+	// Operation is the endpoint: OpAttestation, OpChallenge or OpAssertion.
+	Operation string
+	// Status is the status code written, or 0 when the middleware passed the
+	// request to the next handler.
+	Status int
+	// Reason is the reason code of the failure, if any.
+	Reason string
+	// Duration is the time spent in the handler, or in the middleware before
+	// the next handler was called.
+	Duration time.Duration
+}
+
+// Observer receives metrics events. Implementations must be safe for concurrent use
+// and should not block.
+type Observer interface {
+	Verification(ctx context.Context, e VerificationEvent)
+	PluginCall(ctx context.Context, e PluginCallEvent)
+	Request(ctx context.Context, e RequestEvent)
+}
+
+// Outcome returns OutcomeFailure if err is non-nil and OutcomeSuccess otherwise.
+func Outcome(err error) string {
+	if err != nil {
+		return OutcomeFailure
+	}
+	return OutcomeSuccess
+}
+
+// Multi returns an Observer that reports every event to all observers.
+func Multi(observers ...Observer) Observer {
+	return multi(observers)
+}
+
+type multi []Observer
+
+func (m multi) Verification(ctx context.Context, e VerificationEvent) {
+	for _, o := range m {
+		o.Verification(ctx, e)
+	}
+}
+
+func (m multi) PluginCall(ctx context.Context, e PluginCallEvent) {
+	for _, o := range m {
+		o.PluginCall(ctx, e)
+	}
+}
+
+func (m multi) Request(ctx context.Context, e RequestEvent) {
+	for _, o := range m {
+		o.Request(ctx, e)
+	}
+}
+
+// StatusRecorder is an http.ResponseWriter that records the status code written.
+type StatusRecorder struct {
+	http.ResponseWriter
+	Status int
+}
+
+// WriteHeader records the status code and writes it.
+func (r *StatusRecorder) WriteHeader(code int) {
+	if r.Status == 0 {
+		r.Status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Write records an implicit 200 status and writes b.
+func (r *StatusRecorder) Write(b []byte) (int, error) {
+	if r.Status == 0 {
+		r.Status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the underlying ResponseWriter, for http.ResponseController.
+func (r *StatusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
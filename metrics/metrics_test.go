@@ -0,0 +1,155 @@
+package metrics
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheus(t *testing.T) {
+	ctx := context.Background()
+	p := NewPrometheus(0.01, 0.1)
+	p.Verification(ctx, VerificationEvent{Operation: OpAssertion, Outcome: OutcomeSuccess, Duration: 5 * time.Millisecond})
+	p.Verification(ctx, VerificationEvent{Operation: OpAssertion, Outcome: OutcomeFailure, Reason: "counter_not_increasing", Duration: 50 * time.Millisecond})
+	p.Verification(ctx, VerificationEvent{Operation: OpAssertion, Outcome: OutcomeFailure, Reason: "counter_not_increasing", Duration: time.Second})
+	p.PluginCall(ctx, PluginCallEvent{Operation: OpAssertion, Method: "UpdateCounter", Outcome: OutcomeFailure, Duration: 2 * time.Millisecond})
+	p.Request(ctx, RequestEvent{Component: ComponentMiddleware, Operation: OpAssertion, Status: 400, Reason: `bad"reason`, Duration: 20 * time.Millisecond})
+
+	w := httptest.NewRecorder()
+	p.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("got Content-Type %q", ct)
+	}
+
+	want := `# HELP app_attest_verifications_total Attestation, assertion and challenge verifications by outcome and reason.
+# TYPE app_attest_verifications_total counter
+app_attest_verifications_total{operation="assertion",outcome="failure",reason="counter_not_increasing"} 2
+app_attest_verifications_total{operation="assertion",outcome="success",reason=""} 1
+# HELP app_attest_verification_duration_seconds Time spent verifying in the adapters.
+# TYPE app_attest_verification_duration_seconds histogram
+app_attest_verification_duration_seconds_bucket{operation="assertion",outcome="failure",le="0.01"} 0
+app_attest_verification_duration_seconds_bucket{operation="assertion",outcome="failure",le="0.1"} 1
+app_attest_verification_duration_seconds_bucket{operation="assertion",outcome="failure",le="+Inf"} 2
+app_attest_verification_duration_seconds_sum{operation="assertion",outcome="failure"} 1.05
+app_attest_verification_duration_seconds_count{operation="assertion",outcome="failure"} 2
+app_attest_verification_duration_seconds_bucket{operation="assertion",outcome="success",le="0.01"} 1
+app_attest_verification_duration_seconds_bucket{operation="assertion",outcome="success",le="0.1"} 1
+app_attest_verification_duration_seconds_bucket{operation="assertion",outcome="success",le="+Inf"} 1
+app_attest_verification_duration_seconds_sum{operation="assertion",outcome="success"} 0.005
+app_attest_verification_duration_seconds_count{operation="assertion",outcome="success"} 1
+# HELP app_attest_plugin_calls_total Plugin method calls by outcome.
+# TYPE app_attest_plugin_calls_total counter
+app_attest_plugin_calls_total{operation="assertion",method="UpdateCounter",outcome="failure"} 1
+# HELP app_attest_plugin_call_duration_seconds Latency of plugin method calls.
+# TYPE app_attest_plugin_call_duration_seconds histogram
+app_attest_plugin_call_duration_seconds_bucket{operation="assertion",method="UpdateCounter",le="0.01"} 1
+app_attest_plugin_call_duration_seconds_bucket{operation="assertion",method="UpdateCounter",le="0.1"} 1
+app_attest_plugin_call_duration_seconds_bucket{operation="assertion",method="UpdateCounter",le="+Inf"} 1
+app_attest_plugin_call_duration_seconds_sum{operation="assertion",method="UpdateCounter"} 0.002
+app_attest_plugin_call_duration_seconds_count{operation="assertion",method="UpdateCounter"} 1
+# HELP app_attest_http_requests_total HTTP requests handled by the handler and the middleware. code is 0 when the request was passed on.
+# TYPE app_attest_http_requests_total counter
+app_attest_http_requests_total{component="middleware",operation="assertion",code="400",reason="bad\"reason"} 1
+# HELP app_attest_http_request_duration_seconds Time spent in the handler and the middleware.
+# TYPE app_attest_http_request_duration_seconds histogram
+app_attest_http_request_duration_seconds_bucket{component="middleware",operation="assertion",le="0.01"} 0
+app_attest_http_request_duration_seconds_bucket{component="middleware",operation="assertion",le="0.1"} 1
+app_attest_http_request_duration_seconds_bucket{component="middleware",operation="assertion",le="+Inf"} 1
+app_attest_http_request_duration_seconds_sum{component="middleware",operation="assertion"} 0.02
+app_attest_http_request_duration_seconds_count{component="middleware",operation="assertion"} 1
+`
+	if got := w.Body.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestPrometheus_Empty(t *testing.T) {
+	var b strings.Builder
+	if _, err := NewPrometheus().WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() != 0 {
+		t.Errorf("expected no output without observations, got %q", b.String())
+	}
+}
+
+func TestExpvar(t *testing.T) {
+	ctx := context.Background()
+	e := NewExpvar("app_attest_test")
+	e.Verification(ctx, VerificationEvent{Operation: OpAttestation, Outcome: OutcomeSuccess, Duration: time.Second})
+	e.Verification(ctx, VerificationEvent{Operation: OpAttestation, Outcome: OutcomeFailure, Reason: "nonce_mismatch", Duration: time.Second})
+	e.PluginCall(ctx, PluginCallEvent{Operation: OpAttestation, Method: "StoreResult", Outcome: OutcomeSuccess, Duration: time.Second})
+	e.Request(ctx, RequestEvent{Component: ComponentHandler, Operation: OpAttestation, Status: 200, Duration: time.Second})
+
+	root := expvar.Get("app_attest_test").(*expvar.Map)
+	tests := map[string]struct {
+		m    string
+		key  string
+		want string
+	}{
+		"success":          {m: "verifications", key: "attestation.success", want: "1"},
+		"failure":          {m: "verifications", key: "attestation.failure.nonce_mismatch", want: "1"},
+		"seconds":          {m: "verification_seconds", key: "attestation.success", want: "1"},
+		"plugin call":      {m: "plugin_calls", key: "attestation.StoreResult.success", want: "1"},
+		"plugin seconds":   {m: "plugin_call_seconds", key: "attestation.StoreResult", want: "1"},
+		"request":          {m: "requests", key: "handler.attestation.200", want: "1"},
+		"request seconds":  {m: "request_seconds", key: "handler.attestation", want: "1"},
+		"unobserved label": {m: "requests", key: "handler.attestation.500"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			v := root.Get(tc.m).(*expvar.Map).Get(tc.key)
+			var got string
+			if v != nil {
+				got = v.String()
+			}
+			if got != tc.want {
+				t.Errorf("got %s.%s = %q, want %q", tc.m, tc.key, got, tc.want)
+			}
+		})
+	}
+}
+
+type countingObserver struct{ verifications, calls, requests int }
+
+func (c *countingObserver) Verification(ctx context.Context, e VerificationEvent) { c.verifications++ }
+func (c *countingObserver) PluginCall(ctx context.Context, e PluginCallEvent)     { c.calls++ }
+func (c *countingObserver) Request(ctx context.Context, e RequestEvent)           { c.requests++ }
+
+func TestMulti(t *testing.T) {
+	a, b := &countingObserver{}, &countingObserver{}
+	m := Multi(a, b)
+	m.Verification(context.Background(), VerificationEvent{})
+	m.PluginCall(context.Background(), PluginCallEvent{})
+	m.Request(context.Background(), RequestEvent{})
+	for _, c := range []*countingObserver{a, b} {
+		if *c != (countingObserver{1, 1, 1}) {
+			t.Errorf("got %+v, want one event of each kind", *c)
+		}
+	}
+}
+
+func TestStatusRecorder(t *testing.T) {
+	tests := map[string]struct {
+		write func(w http.ResponseWriter)
+		want  int
+	}{
+		"explicit":      {write: func(w http.ResponseWriter) { w.WriteHeader(http.StatusTeapot) }, want: http.StatusTeapot},
+		"implicit":      {write: func(w http.ResponseWriter) { w.Write([]byte("ok")) }, want: http.StatusOK},
+		"first wins":    {write: func(w http.ResponseWriter) { w.WriteHeader(http.StatusBadRequest); w.WriteHeader(http.StatusOK) }, want: http.StatusBadRequest},
+		"nothing write": {write: func(w http.ResponseWriter) {}, want: 0},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			rec := &StatusRecorder{ResponseWriter: httptest.NewRecorder()}
+			tc.write(rec)
+			if rec.Status != tc.want {
+				t.Errorf("got status %d, want %d", rec.Status, tc.want)
+			}
+		})
+	}
+}
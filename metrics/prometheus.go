@@ -0,0 +1,195 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the histogram buckets of Prometheus, in seconds.
+var DefaultBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Prometheus is an Observer that keeps counters and histograms in memory and
+// serves them in the Prometheus text exposition format (version 0.0.4), so
+// that a Prometheus server can scrape them without a client library.
+//
+// Metrics:
+//
+//	app_attest_verifications_total{operation,outcome,reason}          counter
+//	app_attest_verification_duration_seconds{operation,outcome}       histogram
+//	app_attest_plugin_calls_total{operation,method,outcome}           counter
+//	app_attest_plugin_call_duration_seconds{operation,method}         histogram
+//	app_attest_http_requests_total{component,operation,code,reason}   counter
+//	app_attest_http_request_duration_seconds{component,operation}     histogram
+type Prometheus struct {
+	buckets []float64
+
+	mu       sync.Mutex
+	families []*family
+	byName   map[string]*family
+}
+
+var _ Observer = (*Prometheus)(nil)
+
+// NewPrometheus creates a Prometheus observer. Histograms use buckets, or
+// DefaultBuckets if none are given.
+func NewPrometheus(buckets ...float64) *Prometheus {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	p := &Prometheus{
+		buckets: slices.Sorted(slices.Values(buckets)),
+		byName:  make(map[string]*family),
+	}
+	p.register("app_attest_verifications_total", "Attestation, assertion and challenge verifications by outcome and reason.", "counter", "operation", "outcome", "reason")
+	p.register("app_attest_verification_duration_seconds", "Time spent verifying in the adapters.", "histogram", "operation", "outcome")
+	p.register("app_attest_plugin_calls_total", "Plugin method calls by outcome.", "counter", "operation", "method", "outcome")
+	p.register("app_attest_plugin_call_duration_seconds", "Latency of plugin method calls.", "histogram", "operation", "method")
+	p.register("app_attest_http_requests_total", "HTTP requests handled by the handler and the middleware. code is 0 when the request was passed on.", "counter", "component", "operation", "code", "reason")
+	p.register("app_attest_http_request_duration_seconds", "Time spent in the handler and the middleware.", "histogram", "component", "operation")
+	return p
+}
+
+// Verification implements Observer.
+func (p *Prometheus) Verification(ctx context.Context, e VerificationEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.byName["app_attest_verifications_total"].get(p.buckets, e.Operation, e.Outcome, e.Reason).value++
+	p.byName["app_attest_verification_duration_seconds"].get(p.buckets, e.Operation, e.Outcome).observe(p.buckets, e.Duration.Seconds())
+}
+
+// PluginCall implements Observer.
+func (p *Prometheus) PluginCall(ctx context.Context, e PluginCallEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.byName["app_attest_plugin_calls_total"].get(p.buckets, e.Operation, e.Method, e.Outcome).value++
+	p.byName["app_attest_plugin_call_duration_seconds"].get(p.buckets, e.Operation, e.Method).observe(p.buckets, e.Duration.Seconds())
+}
+
+// Request implements Observer.
+func (p *Prometheus) Request(ctx context.Context, e RequestEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.byName["app_attest_http_requests_total"].get(p.buckets, e.Component, e.Operation, strconv.Itoa(e.Status), e.Reason).value++
+	p.byName["app_attest_http_request_duration_seconds"].get(p.buckets, e.Component, e.Operation).observe(p.buckets, e.Duration.Seconds())
+}
+
+// Handler returns an http.Handler serving the metrics in the text exposition format.
+func (p *Prometheus) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		p.WriteTo(w)
+	})
+}
+
+// WriteTo writes the metrics in the text exposition format to w.
+func (p *Prometheus) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	p.mu.Lock()
+	for _, f := range p.families {
+		f.write(&b, p.buckets)
+	}
+	p.mu.Unlock()
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func (p *Prometheus) register(name, help, typ string, labels ...string) {
+	f := &family{name: name, help: help, typ: typ, labels: labels, series: make(map[string]*series)}
+	p.families = append(p.families, f)
+	p.byName[name] = f
+}
+
+type family struct {
+	name, help, typ string
+	labels          []string
+	series          map[string]*series
+}
+
+type series struct {
+	labels []string
+	// value is the counter value.
+	value float64
+	// counts, sum and count are the histogram state; counts are per bucket, not cumulative.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (f *family) get(buckets []float64, values ...string) *series {
+	key := strings.Join(values, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: values}
+		if f.typ == "histogram" {
+			s.counts = make([]uint64, len(buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (s *series) observe(buckets []float64, v float64) {
+	if i, _ := slices.BinarySearch(buckets, v); i < len(buckets) {
+		s.counts[i]++
+	}
+	s.sum += v
+	s.count++
+}
+
+func (f *family) write(b *strings.Builder, buckets []float64) {
+	if len(f.series) == 0 {
+		return
+	}
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+	for _, key := range slices.Sorted(maps.Keys(f.series)) {
+		s := f.series[key]
+		labels := formatLabels(f.labels, s.labels)
+		if f.typ != "histogram" {
+			fmt.Fprintf(b, "%s%s %s\n", f.name, wrapLabels(labels), formatFloat(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, le := range buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, wrapLabels(joinLabels(labels, `le="`+formatFloat(le)+`"`)), cumulative)
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, wrapLabels(joinLabels(labels, `le="+Inf"`)), s.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", f.name, wrapLabels(labels), formatFloat(s.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", f.name, wrapLabels(labels), s.count)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+func joinLabels(labels, extra string) string {
+	if labels == "" {
+		return extra
+	}
+	return labels + "," + extra
+}
+
+func wrapLabels(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,29 @@
+package middleware
+
+import (
+	"context"
+
+	"github.com/takimoto3/app-attest-middleware/plugin"
+)
+
+// VerifiedAssertion describes the App Attest key that authenticated a request:
+// its key ID, new counter, App ID, environment and attestation time.
+// The key ID is set when the plugin decodes requests into a
+// plugin.AssertionPayload, as the bundled plugins do, or implements
+// plugin.KeyDescriber. The environment and attestation time are set only when
+// the assertion plugin implements plugin.KeyDescriber.
+type VerifiedAssertion = plugin.AssertionResult
+
+type verifiedAssertionKey struct{}
+
+// FromContext returns the VerifiedAssertion stored by AssertionMiddleware.Use,
+// or nil if the request has not passed the middleware.
+func FromContext(ctx context.Context) *VerifiedAssertion {
+	v, _ := ctx.Value(verifiedAssertionKey{}).(*VerifiedAssertion)
+	return v
+}
+
+// NewContext returns a copy of ctx that carries v.
+func NewContext(ctx context.Context, v *VerifiedAssertion) context.Context {
+	return context.WithValue(ctx, verifiedAssertionKey{}, v)
+}
@@ -6,103 +6,272 @@ import (
 	"io"
 	"log/slog"
 	"net/http"
+	"time"
 
 	"github.com/takimoto3/app-attest-middleware/adapter"
+	"github.com/takimoto3/app-attest-middleware/audit"
+	"github.com/takimoto3/app-attest-middleware/canonical"
+	"github.com/takimoto3/app-attest-middleware/metrics"
 	"github.com/takimoto3/app-attest-middleware/plugin"
+	"github.com/takimoto3/app-attest-middleware/problem"
+	"github.com/takimoto3/app-attest-middleware/quarantine"
 	"github.com/takimoto3/app-attest-middleware/requestid"
+	"github.com/takimoto3/app-attest-middleware/tracing"
 )
 
+var errBodyTooLarge = errors.New("request body exceeded limit")
+
 type Config struct {
 	BodyLimit       int64
 	AttestationURL  string
 	NewChallengeURL string
+	// StepUpURL is where clients complete a step-up when a risk policy with
+	// adapter.RiskStepUp flags their key.
+	StepUpURL string
+	// CanonicalRequest enables canonical request binding. When set, the client
+	// data signed by the assertion is the canonical request built from the
+	// method, path, query, selected headers, body and challenge, instead of the
+	// body alone. See the canonical package for the format.
+	CanonicalRequest *canonical.Config
+	// RequiredMode selects the response when the client must attest or fetch a
+	// new challenge. Defaults to RequiredRedirect.
+	RequiredMode RequiredMode
+	// OnRequired, when set, writes the response when the client must attest or
+	// fetch a new challenge, overriding RequiredMode.
+	OnRequired func(w http.ResponseWriter, r *http.Request, req Requirement)
+	// Renderer writes error responses. Defaults to problem.Text, plain-text
+	// status text bodies; use problem.JSON for application/problem+json.
+	Renderer problem.Renderer
+}
+
+// AssertionHooks defines hooks for the AssertionMiddleware.
+// Setup: pre-processing, before the body is read (cannot write to response)
+// Success: called after successful verification; returns the request passed to the next handler,
+// so it can add response headers or enrich the context
+// Failed: called on verification failure (default renders 400 for adapter.ErrBadRequest,
+// 403 for adapter.ErrRiskRejected and 500 otherwise)
+// AttestationRequired: called when the client must attest its key (default follows RequiredMode / OnRequired)
+// ChallengeRequired: called when the client must fetch a new challenge (default follows RequiredMode / OnRequired)
+// StepUpRequired: called when the client must complete a step-up (default follows RequiredMode / OnRequired)
+type AssertionHooks struct {
+	Setup               func(r *http.Request)
+	Success             func(w http.ResponseWriter, r *http.Request) *http.Request
+	Failed              func(w http.ResponseWriter, r *http.Request, err error)
+	AttestationRequired func(w http.ResponseWriter, r *http.Request, err error)
+	ChallengeRequired   func(w http.ResponseWriter, r *http.Request, err error)
+	StepUpRequired      func(w http.ResponseWriter, r *http.Request, err error)
 }
 
+// AssertionMiddleware verifies App Attest assertions before passing requests to the next handler.
+// AssertionHooks allow customizing success, failure, and pre-processing behavior.
 type AssertionMiddleware struct {
-	logger  *slog.Logger
-	adapter adapter.AssertionAdapter
-	config  Config
+	logger   *slog.Logger
+	adapter  adapter.AssertionAdapter
+	config   Config
+	settings adapter.Settings
+	AssertionHooks
 }
 
-func NewAssertionMiddleware(logger *slog.Logger, config Config, adapter adapter.AssertionAdapter) *AssertionMiddleware {
+// NewAssertionMiddleware creates an AssertionMiddleware. Zero values in config
+// are replaced by their defaults. The middleware reads the Settings of
+// assertionAdapter, see adapter.SettingsOf: it reports every request to the
+// observer, traces it, covering the verification and the next handler, with
+// the tracer provider, records an audit.EventAssertionRejected for requests
+// rejected before they reach the adapter, e.g. oversized bodies, with the
+// audit sink, and hands every assertion the adapter rejects as
+// adapter.ErrBadRequest, with its body, to the quarantine sink, except
+// replays, see adapter.WithQuarantine. It panics if config.CanonicalRequest
+// lists a header that cannot be signed; check a Config built at run time with
+// canonical.Config.Validate first.
+func NewAssertionMiddleware(logger *slog.Logger, config Config, assertionAdapter adapter.AssertionAdapter) *AssertionMiddleware {
 	m := &AssertionMiddleware{
-		logger:  logger,
-		adapter: adapter,
-		config:  config,
+		logger:   logger,
+		adapter:  assertionAdapter,
+		config:   config,
+		settings: adapter.SettingsOf(assertionAdapter),
+	}
+	if config.CanonicalRequest != nil {
+		canonicalRequest, err := config.CanonicalRequest.Normalize()
+		if err != nil {
+			panic("middleware: " + err.Error())
+		}
+		m.config.CanonicalRequest = &canonicalRequest
 	}
 	if m.config.BodyLimit == 0 {
 		m.config.BodyLimit = 10 << 20 // 10MB
 	}
+	if m.config.Renderer == nil {
+		m.config.Renderer = problem.Text{}
+	}
 	if logger == nil {
 		m.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
 	}
+	m.AssertionHooks = AssertionHooks{
+		Setup: func(r *http.Request) {},
+		Success: func(w http.ResponseWriter, r *http.Request) *http.Request {
+			return r
+		},
+		Failed: m.renderError,
+		AttestationRequired: func(w http.ResponseWriter, r *http.Request, err error) {
+			m.respondRequired(w, r, Requirement{Kind: RequiredAttestation, URL: m.config.AttestationURL, Err: err})
+		},
+		ChallengeRequired: func(w http.ResponseWriter, r *http.Request, err error) {
+			m.respondRequired(w, r, Requirement{Kind: RequiredChallenge, URL: m.config.NewChallengeURL, Err: err})
+		},
+		StepUpRequired: func(w http.ResponseWriter, r *http.Request, err error) {
+			m.respondRequired(w, r, Requirement{Kind: RequiredStepUp, URL: m.config.StepUpURL, Err: err})
+		},
+	}
 	return m
 }
 
 func (m *AssertionMiddleware) Use(next http.Handler) http.Handler {
+	tracer := tracing.Tracer(m.settings.TracerProvider)
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		r, requestID, err := requestid.EnsureRequest(r)
+		ctx, span := tracing.Start(r.Context(), tracer, tracing.SpanMiddleware, tracing.OperationKey.String(metrics.OpAssertion))
+		defer span.End()
+		r = r.WithContext(ctx)
+
+		verified, err := m.observe(w, r)
+		tracing.SetOutcome(span, string(adapter.ReasonOf(err)), err)
+		if verified != nil {
+			next.ServeHTTP(w, verified)
+		}
+	})
+}
+
+// observe calls verify and reports the request to the observer, if set. The
+// duration covers verification only, not the next handler.
+func (m *AssertionMiddleware) observe(w http.ResponseWriter, r *http.Request) (*http.Request, error) {
+	if m.settings.Observer == nil {
+		return m.verify(w, r)
+	}
+	start := time.Now()
+	rec := &metrics.StatusRecorder{ResponseWriter: w}
+	verified, err := m.verify(rec, r)
+	m.settings.Observer.Request(r.Context(), metrics.RequestEvent{
+		Component: metrics.ComponentMiddleware,
+		Operation: metrics.OpAssertion,
+		Status:    rec.Status,
+		Reason:    string(adapter.ReasonOf(err)),
+		Duration:  time.Since(start),
+	})
+	return verified, err
+}
+
+// verify verifies the assertion of r. It returns the request to pass to the next
+// handler, or nil and the error the response was written for.
+func (m *AssertionMiddleware) verify(w http.ResponseWriter, r *http.Request) (*http.Request, error) {
+	withID, requestID, err := requestid.EnsureRequest(r)
+	if err != nil {
+		m.logger.Error("failed to generate request ID", "err", err)
+		err = adapter.NewVerificationError(adapter.ReasonInternal, err)
+		m.emitRejected(r, err)
+		m.config.Renderer.Render(w, r, http.StatusInternalServerError, err)
+		return nil, err
+	}
+	r = withID
+	tracing.SetRequestID(r.Context(), requestID)
+	logger := m.logger.With("request_id", requestID)
+	m.AssertionHooks.Setup(r)
+
+	var body []byte
+	if r.Body != nil {
+		body, err = io.ReadAll(io.LimitReader(r.Body, m.config.BodyLimit+1))
 		if err != nil {
-			m.logger.Error("failed to generate request ID", "err", err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			return
+			logger.Error("failed to read request body", "err", err)
+			err = adapter.NewVerificationError(adapter.ReasonMalformedRequest, err)
+			m.emitRejected(r, err)
+			m.AssertionHooks.Failed(w, r, err)
+			return nil, err
 		}
-		logger := m.logger.With("request_id", requestID)
-		var body []byte
-		if r.Body != nil {
-			body, err = io.ReadAll(io.LimitReader(r.Body, m.config.BodyLimit+1))
-			if err != nil {
-				logger.Error("failed to read request body", "err", err)
-				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-				return
-			}
-			if int64(len(body)) > m.config.BodyLimit {
-				logger.Warn("request body exceeded limit",
-					"limit_bytes", m.config.BodyLimit,
-					"actual_bytes", len(body),
-					"remote_addr", r.RemoteAddr,
-					"path", r.URL.Path,
-				)
-				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-				return
-			}
-			r.Body = io.NopCloser(bytes.NewBuffer(body))
+		if int64(len(body)) > m.config.BodyLimit {
+			logger.Warn("request body exceeded limit",
+				"limit_bytes", m.config.BodyLimit,
+				"actual_bytes", len(body),
+				"remote_addr", r.RemoteAddr,
+				"path", r.URL.Path,
+			)
+			err = adapter.NewVerificationError(adapter.ReasonMalformedRequest, errBodyTooLarge)
+			m.emitRejected(r, err)
+			m.AssertionHooks.Failed(w, r, err)
+			return nil, err
 		}
-		req := &plugin.AssertionRequest{
-			Request: r,
-			Body:    body,
+		r.Body = io.NopCloser(bytes.NewBuffer(body))
+	}
+	req := &plugin.AssertionRequest{
+		Request: r,
+		Body:    body,
+	}
+	if m.config.CanonicalRequest != nil {
+		req.ClientData = func(challenge string) ([]byte, error) {
+			return m.config.CanonicalRequest.Build(r, body, challenge)
 		}
+	}
 
-		err = m.adapter.Verify(r.Context(), req)
-		if err != nil {
-			if errors.Is(err, adapter.ErrAttestationRequired) {
-				logger.Info("redirecting to attestation", "url", m.config.AttestationURL)
-				http.Redirect(w, r, m.config.AttestationURL, http.StatusSeeOther)
-			} else if errors.Is(err, adapter.ErrNewChallenge) {
-				logger.Info("redirecting to new challenge", "url", m.config.NewChallengeURL)
-				redirect := m.config.NewChallengeURL
-				if redirect == "" {
-					redirect = r.Header.Get("Referer")
-					logger.Info("fallback to Referer for redirect", "referer", redirect)
-					if redirect == "" {
-						redirect = "/"
-					}
-				}
-				http.Redirect(w, r, redirect, http.StatusSeeOther)
-			} else if errors.Is(err, adapter.ErrBadRequest) {
-				logger.Warn("bad request in assertion middleware")
-				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-			} else if errors.Is(err, adapter.ErrInternal) {
-				logger.Error("internal error in assertion middleware")
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			} else {
-				logger.Error("unexpected error in assertion middleware", "err", err)
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	err = m.adapter.Verify(r.Context(), req)
+	if err != nil {
+		if errors.Is(err, adapter.ErrAttestationRequired) {
+			logger.Info("attestation required", "url", m.config.AttestationURL)
+			m.AssertionHooks.AttestationRequired(w, r, err)
+			return nil, err
+		}
+		if errors.Is(err, adapter.ErrNewChallenge) {
+			logger.Info("new challenge required", "url", m.config.NewChallengeURL)
+			m.AssertionHooks.ChallengeRequired(w, r, err)
+			return nil, err
+		}
+		if errors.Is(err, adapter.ErrStepUpRequired) {
+			logger.Info("step-up required", "reason", adapter.ReasonOf(err), "url", m.config.StepUpURL)
+			m.AssertionHooks.StepUpRequired(w, r, err)
+			return nil, err
+		}
+		if errors.Is(err, adapter.ErrReplayDetected) || errors.Is(err, adapter.ErrChallengeUsed) {
+			logger.Warn("replayed assertion rejected in assertion middleware", "reason", adapter.ReasonOf(err), "err", err)
+		} else if errors.Is(err, adapter.ErrRiskRejected) {
+			logger.Warn("key rejected by risk policy in assertion middleware", "reason", adapter.ReasonOf(err), "err", err)
+		} else if errors.Is(err, adapter.ErrBadRequest) {
+			logger.Warn("bad request in assertion middleware", "reason", adapter.ReasonOf(err), "err", err)
+		} else if errors.Is(err, adapter.ErrInternal) {
+			logger.Error("internal error in assertion middleware", "reason", adapter.ReasonOf(err), "err", err)
+		} else {
+			logger.Error("unexpected error in assertion middleware", "err", err)
+		}
+		// Replays are in the audit log already and carry nothing to reproduce.
+		if reason := adapter.ReasonOf(err); errors.Is(err, adapter.ErrBadRequest) && reason != adapter.ReasonChallengeUsed && reason != adapter.ReasonReplayDetected {
+			if err := quarantine.Capture(r.Context(), m.settings.Quarantine, r, quarantine.KindAssertion, body, string(reason), err); err != nil {
+				logger.Error("failed to quarantine request", "err", err)
 			}
-			return
 		}
+		m.AssertionHooks.Failed(w, r, err)
+		return nil, err
+	}
 
-		logger.Debug("request passed assertion middleware")
-		next.ServeHTTP(w, r)
-	})
+	if req.Result != nil {
+		r = r.WithContext(NewContext(r.Context(), req.Result))
+	}
+	r = m.AssertionHooks.Success(w, r)
+	logger.Debug("request passed assertion middleware")
+	return r, nil
+}
+
+// emitRejected records an assertion rejected before the adapter was called.
+func (m *AssertionMiddleware) emitRejected(r *http.Request, err error) {
+	e := audit.Event{Type: audit.EventAssertionRejected, Reason: string(adapter.ReasonOf(err))}
+	if err := audit.Emit(r.Context(), m.settings.AuditSink, r, e); err != nil {
+		m.logger.Error("failed to record audit event", "type", e.Type, "err", err)
+	}
+}
+
+// renderError renders err with the configured Renderer, as 400 for
+// adapter.ErrBadRequest, 403 for adapter.ErrRiskRejected and 500 otherwise.
+func (m *AssertionMiddleware) renderError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, adapter.ErrBadRequest):
+		status = http.StatusBadRequest
+	case errors.Is(err, adapter.ErrRiskRejected):
+		status = http.StatusForbidden
+	}
+	m.config.Renderer.Render(w, r, status, err)
 }
@@ -3,17 +3,28 @@ package middleware
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/takimoto3/app-attest-middleware/adapter"
+	"github.com/takimoto3/app-attest-middleware/audit"
+	"github.com/takimoto3/app-attest-middleware/canonical"
+	"github.com/takimoto3/app-attest-middleware/metrics"
 	"github.com/takimoto3/app-attest-middleware/plugin"
+	"github.com/takimoto3/app-attest-middleware/problem"
 	"github.com/takimoto3/app-attest-middleware/requestid"
+	"github.com/takimoto3/app-attest-middleware/tracing"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type errReader struct{}
@@ -24,12 +35,17 @@ func (*errReader) Read(p []byte) (n int, err error) {
 
 type mockAdapter struct {
 	verifyFunc func(ctx context.Context, req *plugin.AssertionRequest) error
+	settings   adapter.Settings
 }
 
 func (m *mockAdapter) Verify(ctx context.Context, req *plugin.AssertionRequest) error {
 	return m.verifyFunc(ctx, req)
 }
 
+func (m *mockAdapter) Settings() adapter.Settings {
+	return m.settings
+}
+
 type mockGenerator struct {
 	ID  string
 	Err error
@@ -118,6 +134,16 @@ func TestAssertionMiddleware_Handler(t *testing.T) {
 			body:       "ok",
 			wantStatus: http.StatusBadRequest,
 		},
+		"replayed assertion": {
+			adapterErr: fmt.Errorf("%w: %w", adapter.ErrBadRequest, adapter.ErrReplayDetected),
+			config: Config{
+				AttestationURL:  "/attest",
+				NewChallengeURL: "/challenge",
+				BodyLimit:       1024,
+			},
+			body:       "ok",
+			wantStatus: http.StatusBadRequest,
+		},
 		"internal error": {
 			adapterErr: adapter.ErrInternal,
 			config: Config{
@@ -269,3 +295,510 @@ func TestAssertionMiddleware_Initialization(t *testing.T) {
 		t.Fatal("next handler should be called")
 	}
 }
+
+func TestAssertionMiddleware_CanonicalRequest(t *testing.T) {
+	requestid.UseGenerator(&mockGenerator{ID: "generated_id"})
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := map[string]struct {
+		config Config
+		want   string
+	}{
+		"disabled": {
+			config: Config{BodyLimit: 1024},
+		},
+		"enabled": {
+			config: Config{BodyLimit: 1024, CanonicalRequest: &canonical.Config{Headers: []string{"X-Tenant", "x-tenant"}}},
+			want:   "APPATTEST-REQUEST-V1\nPOST\n/orders\nid=7\nx-tenant\nx-tenant:acme\n" + fmt.Sprintf("%x", sha256.Sum256([]byte("ok"))) + "\nchallenge",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got []byte
+			a := &mockAdapter{
+				verifyFunc: func(ctx context.Context, req *plugin.AssertionRequest) error {
+					if req.ClientData == nil {
+						return nil
+					}
+					var err error
+					got, err = req.ClientData("challenge")
+					return err
+				},
+			}
+			mw := NewAssertionMiddleware(logger, tc.config, a)
+			req := httptest.NewRequest(http.MethodPost, "/orders?id=7", bytes.NewBufferString("ok"))
+			req.Header.Set("X-Tenant", "acme")
+			w := httptest.NewRecorder()
+			mw.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+			}
+			if string(got) != tc.want {
+				t.Errorf("got client data %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewAssertionMiddleware_InvalidCanonicalRequest(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected NewAssertionMiddleware to panic on an assertion header")
+		}
+	}()
+	NewAssertionMiddleware(nil, Config{CanonicalRequest: &canonical.Config{Headers: []string{"X-App-Attest-Challenge"}}}, &mockAdapter{})
+}
+
+func TestAssertionMiddleware_ProblemJSON(t *testing.T) {
+	requestid.UseGenerator(&mockGenerator{ID: "generated_id"})
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := map[string]struct {
+		adapterErr error
+		bodyLimit  int64
+		wantStatus int
+		wantReason string
+	}{
+		"verification failure": {
+			adapterErr: adapter.NewVerificationError(adapter.ReasonCounterNotIncreasing, errors.New("counter")),
+			wantStatus: http.StatusBadRequest,
+			wantReason: "counter_not_increasing",
+		},
+		"store failure": {
+			adapterErr: adapter.NewVerificationError(adapter.ReasonStoreUnavailable, errors.New("db")),
+			wantStatus: http.StatusInternalServerError,
+			wantReason: "store_unavailable",
+		},
+		"risk rejected": {
+			adapterErr: adapter.NewVerificationError(adapter.ReasonRiskMetricExceeded, nil),
+			wantStatus: http.StatusForbidden,
+			wantReason: "risk_metric_exceeded",
+		},
+		"body exceeds limit": {
+			bodyLimit:  1,
+			wantStatus: http.StatusBadRequest,
+			wantReason: "malformed_request",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			a := &mockAdapter{
+				verifyFunc: func(ctx context.Context, req *plugin.AssertionRequest) error {
+					return tc.adapterErr
+				},
+			}
+			mw := NewAssertionMiddleware(logger, Config{BodyLimit: tc.bodyLimit, Renderer: problem.JSON{}}, a)
+			w := httptest.NewRecorder()
+			mw.Use(http.NotFoundHandler()).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString("ok")))
+
+			if w.Code != tc.wantStatus {
+				t.Errorf("got status %d, want %d", w.Code, tc.wantStatus)
+			}
+			var got problem.Details
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("invalid problem body %q: %v", w.Body.String(), err)
+			}
+			if got.Reason != tc.wantReason || got.RequestID != "generated_id" || got.Type != problem.DefaultTypeBase+tc.wantReason {
+				t.Errorf("unexpected problem %+v", got)
+			}
+		})
+	}
+}
+
+func TestAssertionMiddleware_RequiredMode(t *testing.T) {
+	requestid.UseGenerator(&mockGenerator{ID: "generated_id"})
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	var custom Requirement
+
+	tests := map[string]struct {
+		adapterErr   error
+		config       Config
+		wantStatus   int
+		wantRequired string
+		wantLink     string
+		wantLocation string
+		wantProblem  *problem.Details
+	}{
+		"redirect by default": {
+			adapterErr:   adapter.ErrAttestationRequired,
+			config:       Config{AttestationURL: "/attest"},
+			wantStatus:   http.StatusSeeOther,
+			wantLocation: "/attest",
+		},
+		"status for attestation": {
+			adapterErr:   adapter.NewVerificationError(adapter.ReasonUnknownKey, nil),
+			config:       Config{AttestationURL: "/attest", RequiredMode: RequiredStatus, Renderer: problem.JSON{}},
+			wantStatus:   http.StatusUnauthorized,
+			wantRequired: RequiredAttestation,
+			wantLink:     `</attest>; rel="app-attest-attestation"`,
+			wantProblem: &problem.Details{
+				Type:      problem.DefaultTypeBase + "unknown_key",
+				Title:     "Unauthorized",
+				Status:    http.StatusUnauthorized,
+				Reason:    "unknown_key",
+				RequestID: "generated_id",
+				Endpoint:  "/attest",
+			},
+		},
+		"status for challenge": {
+			adapterErr:   adapter.NewVerificationError(adapter.ReasonChallengeExpired, nil),
+			config:       Config{NewChallengeURL: "/challenge", RequiredMode: RequiredStatus, Renderer: problem.JSON{}},
+			wantStatus:   http.StatusPreconditionRequired,
+			wantRequired: RequiredChallenge,
+			wantLink:     `</challenge>; rel="app-attest-challenge"`,
+			wantProblem: &problem.Details{
+				Type:      problem.DefaultTypeBase + "challenge_expired",
+				Title:     "Precondition Required",
+				Status:    http.StatusPreconditionRequired,
+				Reason:    "challenge_expired",
+				RequestID: "generated_id",
+				Endpoint:  "/challenge",
+			},
+		},
+		"status for step-up": {
+			adapterErr:   adapter.NewVerificationError(adapter.ReasonReceiptStale, adapter.ErrStepUpRequired),
+			config:       Config{StepUpURL: "/step-up", RequiredMode: RequiredStatus, Renderer: problem.JSON{}},
+			wantStatus:   http.StatusUnauthorized,
+			wantRequired: RequiredStepUp,
+			wantLink:     `</step-up>; rel="app-attest-step_up"`,
+			wantProblem: &problem.Details{
+				Type:      problem.DefaultTypeBase + "receipt_stale",
+				Title:     "Unauthorized",
+				Status:    http.StatusUnauthorized,
+				Reason:    "receipt_stale",
+				RequestID: "generated_id",
+				Endpoint:  "/step-up",
+			},
+		},
+		"redirect for step-up": {
+			adapterErr:   adapter.NewVerificationError(adapter.ReasonRiskMetricExceeded, adapter.ErrStepUpRequired),
+			config:       Config{StepUpURL: "/step-up"},
+			wantStatus:   http.StatusSeeOther,
+			wantLocation: "/step-up",
+		},
+		"status for step-up without url": {
+			adapterErr:   adapter.NewVerificationError(adapter.ReasonRiskMetricExceeded, adapter.ErrStepUpRequired),
+			config:       Config{},
+			wantStatus:   http.StatusUnauthorized,
+			wantRequired: RequiredStepUp,
+		},
+		"redirect for attestation without url": {
+			adapterErr:   adapter.ErrAttestationRequired,
+			config:       Config{},
+			wantStatus:   http.StatusSeeOther,
+			wantLocation: "/",
+		},
+		"status without url": {
+			adapterErr:   adapter.ErrNewChallenge,
+			config:       Config{RequiredMode: RequiredStatus},
+			wantStatus:   http.StatusPreconditionRequired,
+			wantRequired: RequiredChallenge,
+		},
+		"custom callback": {
+			adapterErr: adapter.ErrNewChallenge,
+			config: Config{
+				NewChallengeURL: "/challenge",
+				RequiredMode:    RequiredStatus,
+				OnRequired: func(w http.ResponseWriter, r *http.Request, req Requirement) {
+					custom = req
+					w.WriteHeader(http.StatusTeapot)
+				},
+			},
+			wantStatus: http.StatusTeapot,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			a := &mockAdapter{
+				verifyFunc: func(ctx context.Context, req *plugin.AssertionRequest) error {
+					return tc.adapterErr
+				},
+			}
+			mw := NewAssertionMiddleware(logger, tc.config, a)
+			w := httptest.NewRecorder()
+			mw.Use(http.NotFoundHandler()).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", nil))
+
+			if w.Code != tc.wantStatus {
+				t.Errorf("got status %d, want %d", w.Code, tc.wantStatus)
+			}
+			if got := w.Header().Get(HeaderRequired); got != tc.wantRequired {
+				t.Errorf("got %s %q, want %q", HeaderRequired, got, tc.wantRequired)
+			}
+			if got := w.Header().Get("Link"); got != tc.wantLink {
+				t.Errorf("got Link %q, want %q", got, tc.wantLink)
+			}
+			if got := w.Header().Get("Location"); got != tc.wantLocation {
+				t.Errorf("got Location %q, want %q", got, tc.wantLocation)
+			}
+			if tc.wantProblem != nil {
+				var got problem.Details
+				if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+					t.Fatalf("invalid problem body %q: %v", w.Body.String(), err)
+				}
+				if got != *tc.wantProblem {
+					t.Errorf("got problem %+v, want %+v", got, *tc.wantProblem)
+				}
+			}
+		})
+	}
+	if custom.Kind != RequiredChallenge || custom.URL != "/challenge" || !errors.Is(custom.Err, adapter.ErrNewChallenge) {
+		t.Errorf("unexpected requirement passed to OnRequired: %+v", custom)
+	}
+}
+
+func TestAssertionMiddleware_VerifiedAssertion(t *testing.T) {
+	requestid.UseGenerator(&mockGenerator{ID: "generated_id"})
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	want := &VerifiedAssertion{KeyInfo: plugin.KeyInfo{KeyID: []byte("key")}, Counter: 3, AppID: "app"}
+
+	a := &mockAdapter{
+		verifyFunc: func(ctx context.Context, req *plugin.AssertionRequest) error {
+			req.Result = want
+			return nil
+		},
+	}
+	var got *VerifiedAssertion
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = FromContext(r.Context())
+	})
+	mw := NewAssertionMiddleware(logger, Config{}, a)
+	mw.Use(next).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if got != want {
+		t.Errorf("FromContext() = %+v, want %+v", got, want)
+	}
+	if v := FromContext(context.Background()); v != nil {
+		t.Errorf("FromContext() on empty context = %+v, want nil", v)
+	}
+}
+
+type ctxKey struct{}
+
+func TestAssertionMiddleware_Hooks(t *testing.T) {
+	requestid.UseGenerator(&mockGenerator{ID: "generated_id"})
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := map[string]struct {
+		adapterErr error
+		body       string
+		wantCalls  string
+		wantStatus int
+	}{
+		"success":              {wantCalls: "setup,success,next", wantStatus: http.StatusAccepted},
+		"failed":               {adapterErr: adapter.ErrBadRequest, wantCalls: "setup,failed", wantStatus: http.StatusTeapot},
+		"body exceeds limit":   {body: "too large", wantCalls: "setup,failed", wantStatus: http.StatusTeapot},
+		"attestation required": {adapterErr: adapter.ErrAttestationRequired, wantCalls: "setup,attestation", wantStatus: http.StatusUnauthorized},
+		"challenge required":   {adapterErr: adapter.ErrNewChallenge, wantCalls: "setup,challenge", wantStatus: http.StatusPreconditionRequired},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			a := &mockAdapter{
+				verifyFunc: func(ctx context.Context, req *plugin.AssertionRequest) error {
+					return tc.adapterErr
+				},
+			}
+			mw := NewAssertionMiddleware(logger, Config{BodyLimit: 4}, a)
+			var calls []string
+			mw.Setup = func(r *http.Request) { calls = append(calls, "setup") }
+			mw.Success = func(w http.ResponseWriter, r *http.Request) *http.Request {
+				calls = append(calls, "success")
+				w.Header().Set("X-Device", "verified")
+				return r.WithContext(context.WithValue(r.Context(), ctxKey{}, "enriched"))
+			}
+			mw.Failed = func(w http.ResponseWriter, r *http.Request, err error) {
+				calls = append(calls, "failed")
+				w.WriteHeader(http.StatusTeapot)
+			}
+			mw.AttestationRequired = func(w http.ResponseWriter, r *http.Request, err error) {
+				calls = append(calls, "attestation")
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+			mw.ChallengeRequired = func(w http.ResponseWriter, r *http.Request, err error) {
+				calls = append(calls, "challenge")
+				w.WriteHeader(http.StatusPreconditionRequired)
+			}
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls = append(calls, "next")
+				if r.Context().Value(ctxKey{}) != "enriched" {
+					t.Error("context enriched by Success is not passed to the next handler")
+				}
+				w.WriteHeader(http.StatusAccepted)
+			})
+
+			w := httptest.NewRecorder()
+			mw.Use(next).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(tc.body)))
+
+			if got := strings.Join(calls, ","); got != tc.wantCalls {
+				t.Errorf("got calls %s, want %s", got, tc.wantCalls)
+			}
+			if w.Code != tc.wantStatus {
+				t.Errorf("got status %d, want %d", w.Code, tc.wantStatus)
+			}
+		})
+	}
+}
+
+type requestObserver struct {
+	events []metrics.RequestEvent
+}
+
+func (o *requestObserver) Verification(ctx context.Context, e metrics.VerificationEvent) {}
+func (o *requestObserver) PluginCall(ctx context.Context, e metrics.PluginCallEvent)     {}
+func (o *requestObserver) Request(ctx context.Context, e metrics.RequestEvent) {
+	e.Duration = 0
+	o.events = append(o.events, e)
+}
+
+func TestAssertionMiddleware_Observer(t *testing.T) {
+	requestid.UseGenerator(&mockGenerator{ID: "generated_id"})
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := map[string]struct {
+		adapterErr error
+		want       metrics.RequestEvent
+		wantNext   bool
+	}{
+		"passed": {
+			want:     metrics.RequestEvent{Component: metrics.ComponentMiddleware, Operation: metrics.OpAssertion},
+			wantNext: true,
+		},
+		"bad signature": {
+			adapterErr: adapter.NewVerificationError(adapter.ReasonBadSignature, nil),
+			want:       metrics.RequestEvent{Component: metrics.ComponentMiddleware, Operation: metrics.OpAssertion, Status: http.StatusBadRequest, Reason: string(adapter.ReasonBadSignature)},
+		},
+		"attestation required": {
+			adapterErr: adapter.NewVerificationError(adapter.ReasonUnknownKey, nil),
+			want:       metrics.RequestEvent{Component: metrics.ComponentMiddleware, Operation: metrics.OpAssertion, Status: http.StatusSeeOther, Reason: string(adapter.ReasonUnknownKey)},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			observer := &requestObserver{}
+			a := &mockAdapter{
+				verifyFunc: func(ctx context.Context, req *plugin.AssertionRequest) error {
+					return tc.adapterErr
+				},
+				settings: adapter.Settings{Observer: observer},
+			}
+			mw := NewAssertionMiddleware(logger, Config{AttestationURL: "/attest"}, a)
+			var called bool
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				w.WriteHeader(http.StatusAccepted)
+			})
+			mw.Use(next).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if called != tc.wantNext {
+				t.Errorf("next handler called = %v, want %v", called, tc.wantNext)
+			}
+			if len(observer.events) != 1 || observer.events[0] != tc.want {
+				t.Errorf("got events %+v, want [%+v]", observer.events, tc.want)
+			}
+		})
+	}
+}
+
+func TestAssertionMiddleware_Tracing(t *testing.T) {
+	requestid.UseGenerator(&mockGenerator{ID: "generated_id"})
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := map[string]struct {
+		adapterErr  error
+		wantOutcome string
+		wantReason  string
+		wantNext    bool
+	}{
+		"passed":        {wantOutcome: "success", wantNext: true},
+		"bad signature": {adapterErr: adapter.NewVerificationError(adapter.ReasonBadSignature, nil), wantOutcome: "failure", wantReason: "bad_signature"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			exporter := tracetest.NewInMemoryExporter()
+			tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+			var adapterSpan trace.SpanContext
+			a := &mockAdapter{
+				verifyFunc: func(ctx context.Context, req *plugin.AssertionRequest) error {
+					adapterSpan = trace.SpanContextFromContext(ctx)
+					return tc.adapterErr
+				},
+				settings: adapter.Settings{TracerProvider: tp},
+			}
+			var called bool
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+			})
+			mw := NewAssertionMiddleware(logger, Config{}, a)
+			mw.Use(next).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if called != tc.wantNext {
+				t.Errorf("next handler called = %v, want %v", called, tc.wantNext)
+			}
+			spans := exporter.GetSpans()
+			if len(spans) != 1 || spans[0].Name != tracing.SpanMiddleware {
+				t.Fatalf("got spans %+v, want one %s span", spans, tracing.SpanMiddleware)
+			}
+			if adapterSpan.SpanID() != spans[0].SpanContext.SpanID() {
+				t.Error("adapter is not called with the middleware span in its context")
+			}
+			attrs := map[string]string{}
+			for _, kv := range spans[0].Attributes {
+				attrs[string(kv.Key)] = kv.Value.AsString()
+			}
+			if attrs["app_attest.request_id"] != "generated_id" || attrs["app_attest.outcome"] != tc.wantOutcome || attrs["app_attest.reason"] != tc.wantReason {
+				t.Errorf("unexpected attributes %v", attrs)
+			}
+		})
+	}
+}
+
+func TestAssertionMiddleware_AuditSink(t *testing.T) {
+	requestid.UseGenerator(&mockGenerator{ID: "generated_id"})
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	events := make(audit.Channel, 1)
+	a := &mockAdapter{
+		verifyFunc: func(ctx context.Context, req *plugin.AssertionRequest) error {
+			t.Error("adapter must not be called for an oversized body")
+			return nil
+		},
+		settings: adapter.Settings{AuditSink: events},
+	}
+	mw := NewAssertionMiddleware(logger, Config{BodyLimit: 4}, a)
+	mw.Use(http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", strings.NewReader("too large")))
+
+	select {
+	case e := <-events:
+		if e.Type != audit.EventAssertionRejected || e.Reason != string(adapter.ReasonMalformedRequest) || e.RequestID != "generated_id" || e.RemoteAddr == "" {
+			t.Errorf("unexpected audit event %+v", e)
+		}
+	default:
+		t.Error("no audit event recorded")
+	}
+}
+
+func TestAssertionMiddleware_RequestIDFailure(t *testing.T) {
+	requestid.UseGenerator(&mockGenerator{Err: errors.New("no machine ID")})
+	defer requestid.UseGenerator(&mockGenerator{ID: "generated_id"})
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	events := make(audit.Channel, 2)
+	a := &mockAdapter{
+		verifyFunc: func(ctx context.Context, req *plugin.AssertionRequest) error {
+			t.Error("adapter must not be called without a request ID")
+			return nil
+		},
+		settings: adapter.Settings{AuditSink: events},
+	}
+	mw := NewAssertionMiddleware(logger, Config{Renderer: problem.JSON{}}, a)
+	w := httptest.NewRecorder()
+	mw.Use(http.NotFoundHandler()).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	if len(events) != 1 {
+		t.Fatalf("got %d audit events, want 1", len(events))
+	}
+	if e := <-events; e.Type != audit.EventAssertionRejected || e.Reason != string(adapter.ReasonInternal) {
+		t.Errorf("unexpected audit event %+v", e)
+	}
+}
@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/takimoto3/app-attest-middleware/problem"
+)
+
+// Header names set by RequiredStatus responses.
+const (
+	// HeaderRequired tells the client what it must do before retrying:
+	// RequiredAttestation, RequiredChallenge or RequiredStepUp.
+	HeaderRequired = "X-App-Attest-Required"
+)
+
+// Values of HeaderRequired and Requirement.Kind.
+const (
+	RequiredAttestation = "attestation"
+	RequiredChallenge   = "challenge"
+	RequiredStepUp      = "step_up"
+)
+
+// RequiredMode selects how the middleware responds when the client must attest
+// its key (adapter.ErrAttestationRequired), fetch a new challenge
+// (adapter.ErrNewChallenge) or complete a step-up (adapter.ErrStepUpRequired).
+type RequiredMode int
+
+const (
+	// RequiredRedirect redirects with 303 See Other to AttestationURL,
+	// NewChallengeURL or StepUpURL. For a new challenge without NewChallengeURL,
+	// it falls back to the Referer header and then to "/". A step-up without
+	// StepUpURL is answered as with RequiredStatus, since a redirect to an
+	// empty URL would loop back to the request.
+	RequiredRedirect RequiredMode = iota
+	// RequiredStatus responds with 401 Unauthorized for an attestation or a
+	// step-up and 428 Precondition Required for a new challenge. The
+	// HeaderRequired header tells which, a Link header points to the endpoint,
+	// and the body is written by Config.Renderer with the endpoint attached (see
+	// problem.WithEndpoint).
+	RequiredStatus
+)
+
+// Requirement describes what the client must do before retrying the request.
+type Requirement struct {
+	// Kind is RequiredAttestation, RequiredChallenge or RequiredStepUp.
+	Kind string
+	// URL is AttestationURL, NewChallengeURL or StepUpURL. It may be empty.
+	URL string
+	// Err is the error returned by the adapter.
+	Err error
+}
+
+// respondRequired writes the response for req according to the configuration.
+func (m *AssertionMiddleware) respondRequired(w http.ResponseWriter, r *http.Request, req Requirement) {
+	if m.config.OnRequired != nil {
+		m.config.OnRequired(w, r, req)
+		return
+	}
+
+	mode := m.config.RequiredMode
+	if mode == RequiredRedirect && req.URL == "" && req.Kind == RequiredStepUp {
+		mode = RequiredStatus
+	}
+	switch mode {
+	case RequiredStatus:
+		status := http.StatusPreconditionRequired
+		switch req.Kind {
+		case RequiredAttestation:
+			status = http.StatusUnauthorized
+			w.Header().Set("WWW-Authenticate", "AppAttest")
+		case RequiredStepUp:
+			status = http.StatusUnauthorized
+		}
+		w.Header().Set(HeaderRequired, req.Kind)
+		if req.URL != "" {
+			w.Header().Set("Link", "<"+req.URL+`>; rel="app-attest-`+req.Kind+`"`)
+		}
+		m.config.Renderer.Render(w, r, status, problem.WithEndpoint(req.Err, req.URL))
+	default:
+		redirect := req.URL
+		if redirect == "" && req.Kind == RequiredChallenge {
+			redirect = r.Header.Get("Referer")
+			if redirect == "" {
+				redirect = "/"
+			}
+		}
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+	}
+}
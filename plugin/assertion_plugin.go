@@ -3,6 +3,7 @@ package plugin
 import (
 	"context"
 	"crypto/ecdsa"
+	"time"
 
 	attest "github.com/takimoto3/app-attest"
 )
@@ -12,6 +13,50 @@ type AssertionRequest struct {
 	Request any
 	Body    []byte
 	Object  any
+	// Result is set by the AssertionAdapter after a successful verification.
+	Result *AssertionResult
+	// ClientData, when set, builds the client data signed by the assertion from
+	// the challenge sent by the client. When nil, the client data is Body.
+	ClientData func(challenge string) ([]byte, error)
+}
+
+// BodyClientData returns the client data of an assertion in the default wire
+// format: the challenge, a line feed and the body. Signing the challenge along
+// with the body binds the assertion to the challenge it was made for, so that
+// it cannot be replayed with another challenge.
+func BodyClientData(challenge string, body []byte) []byte {
+	data := make([]byte, 0, len(challenge)+1+len(body))
+	data = append(data, challenge...)
+	data = append(data, '\n')
+	return append(data, body...)
+}
+
+// KeyInfo describes an attested key.
+type KeyInfo struct {
+	KeyID       []byte
+	Environment attest.Environment
+	// AttestedAt is when the key was attested.
+	AttestedAt time.Time
+	// RiskMetric is the risk metric of the last refreshed receipt of the key,
+	// zero if it was never refreshed.
+	RiskMetric int
+	// ReceiptCreatedAt is the creation time of the last parsed receipt of the
+	// key, zero if it was never parsed.
+	ReceiptCreatedAt time.Time
+}
+
+// AssertionResult describes a verified assertion.
+type AssertionResult struct {
+	// KeyInfo is filled in only when the plugin implements KeyDescriber,
+	// except KeyID, which is also set from a decoded AssertionPayload.
+	KeyInfo
+	// Counter is the new counter of the key.
+	Counter uint32
+	// AppID is the App ID the assertion was verified against.
+	AppID string
+	// Flagged is the reason code of the failed check of a RiskFlag risk
+	// policy (see adapter.WithRiskPolicy), or "" if the key passed.
+	Flagged string
 }
 
 // AssertionPlugin defines the application-specific operations required
@@ -30,3 +75,47 @@ type AssertionPlugin interface {
 	// UpdateCounter saves the latest assertion counter.
 	UpdateCounter(ctx context.Context, r *AssertionRequest, counter uint32) error
 }
+
+// CounterSwapper is an optional interface for AssertionPlugin implementations.
+//
+// When the plugin implements it, the AssertionAdapter calls CompareAndSwapCounter
+// instead of UpdateCounter, so that two requests verified against the same
+// stored counter cannot both succeed.
+type CounterSwapper interface {
+	// CompareAndSwapCounter stores counter only if the stored counter is still old.
+	// It reports whether the counter was updated; false means another request
+	// advanced the counter first.
+	CompareAndSwapCounter(ctx context.Context, r *AssertionRequest, old, counter uint32) (bool, error)
+}
+
+// AssertionChallengeConsumer is an optional interface for AssertionPlugin implementations.
+//
+// When the plugin implements it, the AssertionAdapter consumes the assigned
+// challenge after the assertion has been verified and before the counter is
+// stored, so that a challenge can be used only once.
+//
+// A consumed challenge must stay assigned, i.e. AssignedChallenge must keep
+// returning it, until it expires or a new challenge replaces it, so that a
+// replayed request is rejected with adapter.ErrChallengeUsed instead of looking
+// like a request without a challenge. The adapter asks AssertionChallengeUsed
+// before verifying the assertion, because a replayed assertion would otherwise
+// fail the counter check first.
+type AssertionChallengeConsumer interface {
+	// AssertionChallengeUsed reports whether the given assigned challenge has
+	// already been consumed.
+	AssertionChallengeUsed(ctx context.Context, r *AssertionRequest, challenge string) (bool, error)
+	// ConsumeAssertionChallenge marks the given assigned challenge as used. It
+	// reports whether the challenge was still unused; false means it has
+	// already been consumed.
+	ConsumeAssertionChallenge(ctx context.Context, r *AssertionRequest, challenge string) (bool, error)
+}
+
+// KeyDescriber is an optional interface for AssertionPlugin implementations.
+//
+// When the plugin implements it, the AssertionAdapter calls KeyInfo once the
+// assertion signature is verified, before the challenge is consumed and the
+// counter stored, and stores the result in AssertionRequest.Result.
+type KeyDescriber interface {
+	// KeyInfo returns the attested key that signed the assertion.
+	KeyInfo(ctx context.Context, r *AssertionRequest) (*KeyInfo, error)
+}
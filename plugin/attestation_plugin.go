@@ -12,6 +12,8 @@ type AttestationRequest struct {
 	Request any
 	Result  *attest.Result
 	Object  any
+	// KeyID is set by the AttestationAdapter to the key ID returned by ExtractData.
+	KeyID []byte
 }
 
 // AttestationPlugin defines application-specific hooks used by
@@ -33,3 +35,31 @@ type AttestationPlugin interface {
 	// StoreResult persists the attestation result after successful verification.
 	StoreResult(ctx context.Context, r *AttestationRequest) error
 }
+
+// AttestationChallengeConsumer is an optional interface for AttestationPlugin implementations.
+//
+// When the plugin implements it, the AttestationAdapter consumes the assigned
+// challenge after the attestation has been verified and before StoreResult is
+// called, so that a challenge can be used only once.
+//
+// A consumed challenge must stay assigned, i.e. IsChallengeAssigned must keep
+// reporting it, until it expires or a new challenge replaces it. A replayed
+// request then reaches ConsumeAttestationChallenge and is rejected with
+// adapter.ErrChallengeUsed, instead of looking like a request without a
+// challenge.
+type AttestationChallengeConsumer interface {
+	// ConsumeAttestationChallenge marks the challenge assigned to the request as
+	// used. It reports whether the challenge was still unused; false means it
+	// has already been consumed.
+	ConsumeAttestationChallenge(ctx context.Context, r *AttestationRequest) (bool, error)
+}
+
+// AttestationChallengeExtractor is an optional interface for AttestationPlugin implementations.
+//
+// It is required with stateless challenges (see adapter.WithStatelessChallenges),
+// where the adapter verifies the challenge token itself instead of calling IsChallengeAssigned.
+type AttestationChallengeExtractor interface {
+	// AttestationChallenge returns the challenge sent by the client.
+	// It is called after ExtractData.
+	AttestationChallenge(ctx context.Context, r *AttestationRequest) (string, error)
+}
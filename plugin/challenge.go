@@ -0,0 +1,20 @@
+package plugin
+
+import (
+	"context"
+
+	"github.com/takimoto3/app-attest-middleware/challenge"
+)
+
+// ChallengeBinder is an optional interface for plugins used with stateless challenges
+// (see adapter.WithStatelessChallenges).
+//
+// It lets the plugin bind a challenge to a key ID or session, and choose the purpose
+// of the challenges issued by the NewChallenge endpoint. Without it, challenges are
+// unbound and issued for attestation.
+type ChallengeBinder interface {
+	// ChallengeBinding returns the purpose and binding of the challenge for req,
+	// the original request object. When a challenge is verified, only the binding
+	// is used; the purpose is implied by the flow.
+	ChallengeBinding(ctx context.Context, req any) (challenge.Purpose, string, error)
+}
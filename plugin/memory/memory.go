@@ -0,0 +1,502 @@
+// Package memory provides an in-memory implementation of plugin.AttestationPlugin
+// and plugin.AssertionPlugin.
+//
+// It keeps challenges and attested keys in maps guarded by a mutex and is meant
+// for local development, tests, and as a reference for the semantics the
+// adapters expect from a plugin. State is lost when the process exits.
+package memory
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	attest "github.com/takimoto3/app-attest"
+	"github.com/takimoto3/app-attest-middleware/audit"
+	stateless "github.com/takimoto3/app-attest-middleware/challenge"
+	"github.com/takimoto3/app-attest-middleware/plugin"
+	"github.com/takimoto3/app-attest-middleware/receipt"
+	"github.com/takimoto3/app-attest-middleware/wire"
+)
+
+var (
+	// ErrUnsupportedRequest indicates the original request is not an *http.Request.
+	ErrUnsupportedRequest = errors.New("memory: unsupported request type")
+	// ErrUnknownKey indicates no attested key is stored for the key ID.
+	ErrUnknownKey = errors.New("memory: unknown key")
+	// ErrKeyExists indicates another public key is already stored for the key ID.
+	ErrKeyExists = errors.New("memory: key ID stored with another public key")
+)
+
+var (
+	_ plugin.AttestationPlugin             = (*Plugin)(nil)
+	_ plugin.AttestationChallengeConsumer  = (*Plugin)(nil)
+	_ plugin.AttestationChallengeExtractor = (*Plugin)(nil)
+	_ plugin.AssertionPlugin               = (*Plugin)(nil)
+	_ plugin.AssertionChallengeConsumer    = (*Plugin)(nil)
+	_ plugin.CounterSwapper                = (*Plugin)(nil)
+	_ plugin.ChallengeBinder               = (*Plugin)(nil)
+	_ plugin.KeyDescriber                  = (*Plugin)(nil)
+	_ receipt.Store                        = (*Plugin)(nil)
+)
+
+// Config holds the settings of a Plugin.
+type Config struct {
+	// ChallengeTTL is how long an issued challenge stays valid. Defaults to 5 minutes.
+	ChallengeTTL time.Duration
+	// SessionKey extracts the session key challenges are assigned to.
+	// Defaults to wire.KeyIDSessionKey, the key ID of the X-App-Attest-Key-Id
+	// header in any base64 variant.
+	SessionKey wire.SessionKeyFunc
+	// Decoder decodes attestation and assertion payloads.
+	// Defaults to wire.Decoder, the default wire format.
+	Decoder wire.PayloadDecoder
+	// AuditSink, when set, records an audit.EventKeyRevoked for every revoked key.
+	AuditSink audit.Sink
+}
+
+// Key is an attested key stored by the Plugin.
+type Key struct {
+	KeyID       []byte
+	PublicKey   *ecdsa.PublicKey
+	Counter     uint32
+	Receipt     []byte
+	Environment attest.Environment
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	// RiskMetric and ReceiptCreatedAt are those of the last receipt parsed by
+	// a receipt.Scheduler, and ReceiptRefreshAt is when it is due for a refresh.
+	RiskMetric       int
+	ReceiptCreatedAt time.Time
+	ReceiptRefreshAt time.Time
+}
+
+// challenge is a challenge assigned to a session. A consumed challenge is kept,
+// marked used, until it expires or is replaced, so that a replay is reported
+// as used rather than missing.
+type challenge struct {
+	value   string
+	expires time.Time
+	used    bool
+}
+
+// Plugin implements both plugin.AttestationPlugin and plugin.AssertionPlugin in memory.
+// It is safe for concurrent use.
+type Plugin struct {
+	config Config
+	now    func() time.Time
+
+	mu         sync.Mutex
+	challenges map[string]challenge
+	keys       map[string]*Key
+}
+
+// New creates a Plugin. Zero values in config are replaced by their defaults.
+func New(config Config) *Plugin {
+	p := &Plugin{
+		config:     config,
+		now:        time.Now,
+		challenges: make(map[string]challenge),
+		keys:       make(map[string]*Key),
+	}
+	if p.config.ChallengeTTL == 0 {
+		p.config.ChallengeTTL = 5 * time.Minute
+	}
+	if p.config.SessionKey == nil {
+		p.config.SessionKey = wire.KeyIDSessionKey
+	}
+	if p.config.Decoder == nil {
+		p.config.Decoder = wire.Decoder{}
+	}
+	return p
+}
+
+// NewChallenge creates a random challenge and assigns it to the request's session,
+// replacing any challenge assigned before.
+func (p *Plugin) NewChallenge(ctx context.Context, r *plugin.AttestationRequest) (string, error) {
+	session, err := p.sessionKey(r.Request)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	value := base64.RawURLEncoding.EncodeToString(b)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	for k, c := range p.challenges {
+		if !now.Before(c.expires) {
+			delete(p.challenges, k)
+		}
+	}
+	p.challenges[session] = challenge{value: value, expires: now.Add(p.config.ChallengeTTL)}
+	return value, nil
+}
+
+// ExtractData decodes the attestation payload and returns the attestation object,
+// the SHA256 hash of the challenge and the key ID.
+func (p *Plugin) ExtractData(ctx context.Context, r *plugin.AttestationRequest) (*attest.AttestationObject, []byte, []byte, error) {
+	req, ok := r.Request.(*http.Request)
+	if !ok {
+		return nil, nil, nil, ErrUnsupportedRequest
+	}
+	payload, err := p.config.Decoder.DecodeAttestation(req)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	r.Object = payload
+	hash := sha256.Sum256([]byte(payload.Challenge))
+	return payload.Object, hash[:], payload.KeyID, nil
+}
+
+// IsChallengeAssigned reports whether the challenge sent by the client is the
+// unexpired challenge assigned to its session. ExtractData must be called first.
+func (p *Plugin) IsChallengeAssigned(ctx context.Context, r *plugin.AttestationRequest) (bool, error) {
+	session, err := p.sessionKey(r.Request)
+	if err != nil {
+		return false, err
+	}
+	payload, ok := r.Object.(*plugin.AttestationPayload)
+	if !ok {
+		return false, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok = p.lookupChallenge(session, payload.Challenge)
+	return ok, nil
+}
+
+// ConsumeAttestationChallenge marks the challenge assigned to the request's
+// session as used.
+func (p *Plugin) ConsumeAttestationChallenge(ctx context.Context, r *plugin.AttestationRequest) (bool, error) {
+	session, err := p.sessionKey(r.Request)
+	if err != nil {
+		return false, err
+	}
+	payload, ok := r.Object.(*plugin.AttestationPayload)
+	if !ok {
+		return false, nil
+	}
+	return p.consume(session, payload.Challenge), nil
+}
+
+// AttestationChallenge returns the challenge sent by the client.
+// ExtractData must be called first.
+func (p *Plugin) AttestationChallenge(ctx context.Context, r *plugin.AttestationRequest) (string, error) {
+	payload, ok := r.Object.(*plugin.AttestationPayload)
+	if !ok {
+		return "", errors.New("memory: no attestation payload")
+	}
+	return payload.Challenge, nil
+}
+
+// ChallengeBinding binds stateless challenges to the request's session. A
+// challenge is issued for assertion when the key named by the
+// X-App-Attest-Key-Id header is attested, and for attestation otherwise.
+func (p *Plugin) ChallengeBinding(ctx context.Context, req any) (stateless.Purpose, string, error) {
+	session, err := p.sessionKey(req)
+	if err != nil {
+		return "", "", err
+	}
+	keyID, err := wire.DecodeBase64(req.(*http.Request).Header.Get(wire.HeaderKeyID))
+	if err != nil || len(keyID) == 0 {
+		return stateless.Attest, session, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.keys[string(keyID)]; ok {
+		return stateless.Assert, session, nil
+	}
+	return stateless.Attest, session, nil
+}
+
+// StoreResult stores the attested public key with a counter of zero.
+// Storing the same key again leaves the existing entry untouched; storing
+// another public key for a stored key ID returns ErrKeyExists.
+func (p *Plugin) StoreResult(ctx context.Context, r *plugin.AttestationRequest) error {
+	payload, ok := r.Object.(*plugin.AttestationPayload)
+	if !ok || r.Result == nil {
+		return errors.New("memory: no attestation result")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	id := string(payload.KeyID)
+	if key, ok := p.keys[id]; ok {
+		if !key.PublicKey.Equal(r.Result.PublicKey) {
+			return ErrKeyExists
+		}
+		return nil
+	}
+	now := p.now()
+	p.keys[id] = &Key{
+		KeyID:       payload.KeyID,
+		PublicKey:   r.Result.PublicKey,
+		Receipt:     r.Result.Receipt,
+		Environment: r.Result.Environment,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	return nil
+}
+
+// ParseRequest decodes the assertion payload and returns the assertion object
+// and the challenge sent by the client. Unless the middleware binds the
+// canonical request, the client data is that of the wire format, see
+// wire.UseBodyClientData.
+func (p *Plugin) ParseRequest(ctx context.Context, r *plugin.AssertionRequest) (*attest.AssertionObject, string, error) {
+	req, ok := r.Request.(*http.Request)
+	if !ok {
+		return nil, "", ErrUnsupportedRequest
+	}
+	payload, err := p.config.Decoder.DecodeAssertion(req, r.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	r.Object = payload
+	wire.UseBodyClientData(r)
+	return payload.Object, payload.Challenge, nil
+}
+
+// PublicKeyAndCounter returns the stored public key and counter of the key
+// that signed the assertion, or a nil key if it is unknown.
+// ParseRequest must be called first.
+func (p *Plugin) PublicKeyAndCounter(ctx context.Context, r *plugin.AssertionRequest) (*ecdsa.PublicKey, uint32, error) {
+	payload, ok := r.Object.(*plugin.AssertionPayload)
+	if !ok {
+		return nil, 0, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key, ok := p.keys[string(payload.KeyID)]
+	if !ok {
+		return nil, 0, nil
+	}
+	return key.PublicKey, key.Counter, nil
+}
+
+// KeyInfo returns the key that signed the assertion. ParseRequest must be called first.
+func (p *Plugin) KeyInfo(ctx context.Context, r *plugin.AssertionRequest) (*plugin.KeyInfo, error) {
+	payload, ok := r.Object.(*plugin.AssertionPayload)
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key, ok := p.keys[string(payload.KeyID)]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return &plugin.KeyInfo{
+		KeyID:            key.KeyID,
+		Environment:      key.Environment,
+		AttestedAt:       key.CreatedAt,
+		RiskMetric:       key.RiskMetric,
+		ReceiptCreatedAt: key.ReceiptCreatedAt,
+	}, nil
+}
+
+// AssignedChallenge returns the unexpired challenge assigned to the request's
+// session, or an empty string if there is none.
+func (p *Plugin) AssignedChallenge(ctx context.Context, r *plugin.AssertionRequest) (string, error) {
+	session, err := p.sessionKey(r.Request)
+	if err != nil {
+		return "", err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c, ok := p.challenges[session]
+	if !ok || !p.now().Before(c.expires) {
+		return "", nil
+	}
+	return c.value, nil
+}
+
+// AssertionChallengeUsed reports whether the given challenge of the request's
+// session has been consumed.
+func (p *Plugin) AssertionChallengeUsed(ctx context.Context, r *plugin.AssertionRequest, challenge string) (bool, error) {
+	session, err := p.sessionKey(r.Request)
+	if err != nil {
+		return false, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c, ok := p.lookupChallenge(session, challenge)
+	return ok && c.used, nil
+}
+
+// ConsumeAssertionChallenge marks the given challenge of the request's session as used.
+func (p *Plugin) ConsumeAssertionChallenge(ctx context.Context, r *plugin.AssertionRequest, challenge string) (bool, error) {
+	session, err := p.sessionKey(r.Request)
+	if err != nil {
+		return false, err
+	}
+	return p.consume(session, challenge), nil
+}
+
+// UpdateCounter stores the counter of the key that signed the assertion,
+// unless the stored counter is greater, so that concurrent updates never move
+// it backwards.
+func (p *Plugin) UpdateCounter(ctx context.Context, r *plugin.AssertionRequest, counter uint32) error {
+	payload, ok := r.Object.(*plugin.AssertionPayload)
+	if !ok {
+		return ErrUnknownKey
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key, ok := p.keys[string(payload.KeyID)]
+	if !ok {
+		return ErrUnknownKey
+	}
+	key.Counter = max(key.Counter, counter)
+	key.UpdatedAt = p.now()
+	return nil
+}
+
+// CompareAndSwapCounter stores the counter only if the stored counter is still old.
+func (p *Plugin) CompareAndSwapCounter(ctx context.Context, r *plugin.AssertionRequest, old, counter uint32) (bool, error) {
+	payload, ok := r.Object.(*plugin.AssertionPayload)
+	if !ok {
+		return false, ErrUnknownKey
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key, ok := p.keys[string(payload.KeyID)]
+	if !ok {
+		return false, ErrUnknownKey
+	}
+	if key.Counter != old {
+		return false, nil
+	}
+	key.Counter = counter
+	key.UpdatedAt = p.now()
+	return true, nil
+}
+
+// DueReceipts returns up to limit receipts whose refresh time is not after now,
+// earliest first.
+func (p *Plugin) DueReceipts(ctx context.Context, now time.Time, limit int) ([]receipt.Entry, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var due []*Key
+	for _, key := range p.keys {
+		if len(key.Receipt) > 0 && !key.ReceiptRefreshAt.After(now) {
+			due = append(due, key)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].ReceiptRefreshAt.Before(due[j].ReceiptRefreshAt)
+	})
+	entries := make([]receipt.Entry, 0, min(len(due), limit))
+	for _, key := range due[:min(len(due), limit)] {
+		entries = append(entries, receipt.Entry{KeyID: key.KeyID, Environment: key.Environment, Receipt: key.Receipt})
+	}
+	return entries, nil
+}
+
+// UpdateReceipt replaces the receipt of keyID with r and sets its refresh time.
+func (p *Plugin) UpdateReceipt(ctx context.Context, keyID []byte, r *receipt.Receipt, refreshAt time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key, ok := p.keys[string(keyID)]
+	if !ok {
+		return ErrUnknownKey
+	}
+	key.Receipt = r.Raw
+	key.RiskMetric = r.RiskMetric
+	key.ReceiptCreatedAt = r.CreationTime
+	key.ReceiptRefreshAt = refreshAt
+	key.UpdatedAt = p.now()
+	return nil
+}
+
+// PostponeReceipt sets the refresh time of the receipt of keyID.
+func (p *Plugin) PostponeReceipt(ctx context.Context, keyID []byte, refreshAt time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key, ok := p.keys[string(keyID)]
+	if !ok {
+		return ErrUnknownKey
+	}
+	key.ReceiptRefreshAt = refreshAt
+	return nil
+}
+
+// Key returns a copy of the stored key for keyID.
+func (p *Plugin) Key(keyID []byte) (Key, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key, ok := p.keys[string(keyID)]
+	if !ok {
+		return Key{}, false
+	}
+	return *key, true
+}
+
+// Revoke deletes the key keyID, so that its assertions are rejected with
+// adapter.ErrAttestationRequired. App Attest keys cannot be attested twice, so the
+// device has to generate and attest a new key. reason is recorded in the audit event.
+func (p *Plugin) Revoke(ctx context.Context, keyID []byte, reason string) error {
+	p.mu.Lock()
+	_, ok := p.keys[string(keyID)]
+	delete(p.keys, string(keyID))
+	p.mu.Unlock()
+	if !ok {
+		return ErrUnknownKey
+	}
+	return audit.Emit(ctx, p.config.AuditSink, nil, audit.Event{Type: audit.EventKeyRevoked, KeyID: keyID, Reason: reason})
+}
+
+func (p *Plugin) sessionKey(req any) (string, error) {
+	r, ok := req.(*http.Request)
+	if !ok {
+		return "", ErrUnsupportedRequest
+	}
+	return p.config.SessionKey(r)
+}
+
+// lookupChallenge returns the challenge assigned to session if it is unexpired
+// and equals value. The caller must hold p.mu.
+func (p *Plugin) lookupChallenge(session, value string) (challenge, bool) {
+	c, ok := p.challenges[session]
+	if !ok || !p.now().Before(c.expires) {
+		return challenge{}, false
+	}
+	if subtle.ConstantTimeCompare([]byte(c.value), []byte(value)) != 1 {
+		return challenge{}, false
+	}
+	return c, true
+}
+
+// consume marks the challenge value of session as used. It reports whether the
+// challenge was assigned and unused.
+func (p *Plugin) consume(session, value string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c, ok := p.lookupChallenge(session, value)
+	if !ok || c.used {
+		return false
+	}
+	c.used = true
+	p.challenges[session] = c
+	return true
+}
@@ -0,0 +1,398 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	attest "github.com/takimoto3/app-attest"
+	"github.com/takimoto3/app-attest-middleware/adapter"
+	"github.com/takimoto3/app-attest-middleware/audit"
+	"github.com/takimoto3/app-attest-middleware/plugin"
+	"github.com/takimoto3/app-attest-middleware/plugintest"
+	"github.com/takimoto3/app-attest-middleware/wire"
+)
+
+// stubDecoder returns fixed payloads so that tests do not need CBOR encoding.
+type stubDecoder struct {
+	attestation *plugin.AttestationPayload
+	assertion   *plugin.AssertionPayload
+}
+
+func (d *stubDecoder) DecodeAttestation(r *http.Request) (*plugin.AttestationPayload, error) {
+	if d.attestation == nil {
+		return nil, errors.New("no attestation")
+	}
+	return d.attestation, nil
+}
+
+func (d *stubDecoder) DecodeAssertion(r *http.Request, body []byte) (*plugin.AssertionPayload, error) {
+	if d.assertion == nil {
+		return nil, errors.New("no assertion")
+	}
+	return d.assertion, nil
+}
+
+type stubAttestationService struct {
+	result *attest.Result
+}
+
+func (s *stubAttestationService) Verify(attestObj *attest.AttestationObject, clientDataHash, keyID []byte) (*attest.Result, error) {
+	return s.result, nil
+}
+
+// newRequest returns a request whose X-App-Attest-Key-Id header is session,
+// encoded in standard base64.
+func newRequest(session string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	if session != "" {
+		r.Header.Set("X-App-Attest-Key-Id", base64.StdEncoding.EncodeToString([]byte(session)))
+	}
+	return r
+}
+
+// signAssertion builds an assertion for appID and counter over clientData.
+func signAssertion(t *testing.T, key *ecdsa.PrivateKey, appID string, counter uint32, clientData []byte) *attest.AssertionObject {
+	t.Helper()
+	rpID := sha256.Sum256([]byte(appID))
+	authData := append(rpID[:], 0)
+	authData = binary.BigEndian.AppendUint32(authData, counter)
+	clientDataHash := sha256.Sum256(clientData)
+	nonce := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	digest := sha256.Sum256(nonce[:])
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &attest.AssertionObject{Signature: sig, AuthData: authData}
+}
+
+func TestPlugin_Challenges(t *testing.T) {
+	p := New(Config{ChallengeTTL: time.Minute})
+	now := time.Unix(1700000000, 0)
+	p.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	if _, err := p.NewChallenge(ctx, &plugin.AttestationRequest{Request: newRequest("")}); !errors.Is(err, wire.ErrNoSession) {
+		t.Fatalf("expected ErrNoSession, got %v", err)
+	}
+	if _, err := p.NewChallenge(ctx, &plugin.AttestationRequest{Request: "not a request"}); !errors.Is(err, ErrUnsupportedRequest) {
+		t.Fatalf("expected ErrUnsupportedRequest, got %v", err)
+	}
+
+	c, err := p.NewChallenge(ctx, &plugin.AttestationRequest{Request: newRequest("s1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assigned, err := p.AssignedChallenge(ctx, &plugin.AssertionRequest{Request: newRequest("s1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assigned != c {
+		t.Errorf("AssignedChallenge = %q, want %q", assigned, c)
+	}
+	if other, _ := p.AssignedChallenge(ctx, &plugin.AssertionRequest{Request: newRequest("s2")}); other != "" {
+		t.Errorf("unexpected challenge for another session: %q", other)
+	}
+
+	r := &plugin.AssertionRequest{Request: newRequest("s1")}
+	if ok, _ := p.ConsumeAssertionChallenge(ctx, r, "wrong"); ok {
+		t.Error("consumed a challenge that was not assigned")
+	}
+	if ok, _ := p.ConsumeAssertionChallenge(ctx, r, c); !ok {
+		t.Error("failed to consume the assigned challenge")
+	}
+	if ok, _ := p.ConsumeAssertionChallenge(ctx, r, c); ok {
+		t.Error("consumed the same challenge twice")
+	}
+
+	c, _ = p.NewChallenge(ctx, &plugin.AttestationRequest{Request: newRequest("s1")})
+	now = now.Add(time.Minute)
+	if assigned, _ := p.AssignedChallenge(ctx, r); assigned != "" {
+		t.Errorf("expired challenge still assigned: %q", assigned)
+	}
+	if ok, _ := p.ConsumeAssertionChallenge(ctx, r, c); ok {
+		t.Error("consumed an expired challenge")
+	}
+}
+
+func TestPlugin_SessionKeyEncodings(t *testing.T) {
+	keyID := bytes.Repeat([]byte{0xfb, 0xff}, 16)
+	withKeyID := func(encoding *base64.Encoding) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.Header.Set("X-App-Attest-Key-Id", encoding.EncodeToString(keyID))
+		return r
+	}
+	encodings := map[string]*base64.Encoding{
+		"standard":          base64.StdEncoding,
+		"standard unpadded": base64.RawStdEncoding,
+		"url-safe":          base64.URLEncoding,
+		"url-safe unpadded": base64.RawURLEncoding,
+	}
+	ctx := context.Background()
+
+	for issuedName, issued := range encodings {
+		for sentName, sent := range encodings {
+			t.Run(issuedName+" then "+sentName, func(t *testing.T) {
+				p := New(Config{})
+				c, err := p.NewChallenge(ctx, &plugin.AttestationRequest{Request: withKeyID(issued)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				r := &plugin.AssertionRequest{Request: withKeyID(sent)}
+				if assigned, _ := p.AssignedChallenge(ctx, r); assigned != c {
+					t.Errorf("AssignedChallenge = %q, want %q", assigned, c)
+				}
+				if ok, _ := p.ConsumeAssertionChallenge(ctx, r, c); !ok {
+					t.Error("failed to consume the assigned challenge")
+				}
+			})
+		}
+	}
+}
+
+func TestPlugin_StoreResult(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		pubkey  *ecdsa.PublicKey
+		wantErr error
+	}{
+		"same public key":    {pubkey: &key.PublicKey},
+		"another public key": {pubkey: &other.PublicKey, wantErr: ErrKeyExists},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			p := New(Config{})
+			ctx := context.Background()
+			payload := &plugin.AttestationPayload{KeyID: []byte("key"), Challenge: "c"}
+			if err := p.StoreResult(ctx, &plugin.AttestationRequest{Object: payload, Result: &attest.Result{PublicKey: &key.PublicKey}}); err != nil {
+				t.Fatal(err)
+			}
+			r := &plugin.AssertionRequest{Object: &plugin.AssertionPayload{KeyID: []byte("key")}}
+			if err := p.UpdateCounter(ctx, r, 5); err != nil {
+				t.Fatal(err)
+			}
+
+			err := p.StoreResult(ctx, &plugin.AttestationRequest{Object: payload, Result: &attest.Result{PublicKey: tc.pubkey}})
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("got err %v, want %v", err, tc.wantErr)
+			}
+			stored, ok := p.Key([]byte("key"))
+			if !ok || !stored.PublicKey.Equal(&key.PublicKey) || stored.Counter != 5 {
+				t.Errorf("stored key %+v changed", stored)
+			}
+		})
+	}
+}
+
+func TestPlugin_CompareAndSwapCounter(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := New(Config{})
+	ctx := context.Background()
+	payload := &plugin.AttestationPayload{KeyID: []byte("key"), Challenge: "c"}
+	err = p.StoreResult(ctx, &plugin.AttestationRequest{Object: payload, Result: &attest.Result{PublicKey: &key.PublicKey}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &plugin.AssertionRequest{Object: &plugin.AssertionPayload{KeyID: []byte("key")}}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	swapped := 0
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := p.CompareAndSwapCounter(ctx, r, 0, 1)
+			if err != nil {
+				t.Error(err)
+			}
+			if ok {
+				mu.Lock()
+				swapped++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if swapped != 1 {
+		t.Errorf("counter swapped %d times, want 1", swapped)
+	}
+
+	unknown := &plugin.AssertionRequest{Object: &plugin.AssertionPayload{KeyID: []byte("unknown")}}
+	if _, err := p.CompareAndSwapCounter(ctx, unknown, 0, 1); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("expected ErrUnknownKey, got %v", err)
+	}
+	pub, _, err := p.PublicKeyAndCounter(ctx, unknown)
+	if err != nil || pub != nil {
+		t.Errorf("expected nil key for unknown key ID, got %v, %v", pub, err)
+	}
+}
+
+func TestPlugin_Conformance(t *testing.T) {
+	plugintest.TestPlugin(t, plugintest.Config{
+		New: func(t *testing.T) plugintest.Plugin {
+			return New(Config{ChallengeTTL: 100 * time.Millisecond})
+		},
+		ChallengeTTL: 100 * time.Millisecond,
+	})
+}
+
+func TestPlugin_AdapterFlow(t *testing.T) {
+	const appID = "TEAMID.com.example.app"
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder := &stubDecoder{}
+	p := New(Config{Decoder: decoder})
+	ctx := context.Background()
+
+	attestAdapter := adapter.NewAttestationAdapter(logger, &stubAttestationService{
+		result: &attest.Result{PublicKey: &key.PublicKey, Environment: attest.Production},
+	}, p)
+	assertAdapter := adapter.NewAssertionAdapter(logger, appID, p)
+
+	// Attestation
+	challenge, err := attestAdapter.NewChallenge(ctx, &plugin.AttestationRequest{Request: newRequest("device")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder.attestation = &plugin.AttestationPayload{Object: &attest.AttestationObject{}, KeyID: []byte("device"), Challenge: challenge}
+	if err := attestAdapter.Verify(ctx, &plugin.AttestationRequest{Request: newRequest("device")}); err != nil {
+		t.Fatalf("attestation failed: %v", err)
+	}
+	if err := attestAdapter.Verify(ctx, &plugin.AttestationRequest{Request: newRequest("device")}); !errors.Is(err, adapter.ErrChallengeUsed) {
+		t.Fatalf("expected ErrChallengeUsed on replayed attestation, got %v", err)
+	}
+	stored, ok := p.Key([]byte("device"))
+	if !ok || stored.Environment != attest.Production || stored.Counter != 0 {
+		t.Fatalf("unexpected stored key: %+v, %v", stored, ok)
+	}
+
+	// Assertion
+	challenge, err = attestAdapter.NewChallenge(ctx, &plugin.AttestationRequest{Request: newRequest("device")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte(`{"hello":"world"}`)
+	decoder.assertion = &plugin.AssertionPayload{
+		Object:    signAssertion(t, key, appID, 1, plugin.BodyClientData(challenge, body)),
+		KeyID:     []byte("device"),
+		Challenge: challenge,
+	}
+	ar := &plugin.AssertionRequest{Request: newRequest("device"), Body: body}
+	if err := assertAdapter.Verify(ctx, ar); err != nil {
+		t.Fatalf("assertion failed: %v", err)
+	}
+	if stored, _ := p.Key([]byte("device")); stored.Counter != 1 {
+		t.Errorf("counter = %d, want 1", stored.Counter)
+	}
+	if res := ar.Result; res == nil || string(res.KeyID) != "device" || res.Counter != 1 || res.AppID != appID ||
+		res.Environment != attest.Production || !res.AttestedAt.Equal(stored.CreatedAt) {
+		t.Errorf("unexpected assertion result: %+v", ar.Result)
+	}
+	if err := assertAdapter.Verify(ctx, &plugin.AssertionRequest{Request: newRequest("device"), Body: body}); !errors.Is(err, adapter.ErrChallengeUsed) {
+		t.Errorf("expected ErrChallengeUsed on replayed assertion, got %v", err)
+	}
+
+	decoder.assertion.KeyID = []byte("unknown")
+	if err := assertAdapter.Verify(ctx, &plugin.AssertionRequest{Request: newRequest("device"), Body: body}); !errors.Is(err, adapter.ErrAttestationRequired) {
+		t.Errorf("expected ErrAttestationRequired for unknown key, got %v", err)
+	}
+}
+
+func TestPlugin_Audit(t *testing.T) {
+	const appID = "TEAMID.com.example.app"
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(audit.Channel, 16)
+	decoder := &stubDecoder{}
+	p := New(Config{Decoder: decoder, AuditSink: events})
+	ctx := context.Background()
+	attestAdapter := adapter.NewAttestationAdapter(logger, &stubAttestationService{
+		result: &attest.Result{PublicKey: &key.PublicKey},
+	}, p, adapter.WithAuditSink(events))
+	assertAdapter := adapter.NewAssertionAdapter(logger, appID, p, adapter.WithAuditSink(events))
+
+	challenge, err := attestAdapter.NewChallenge(ctx, &plugin.AttestationRequest{Request: newRequest("device")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder.attestation = &plugin.AttestationPayload{Object: &attest.AttestationObject{}, KeyID: []byte("device"), Challenge: challenge}
+	if err := attestAdapter.Verify(ctx, &plugin.AttestationRequest{Request: newRequest("device")}); err != nil {
+		t.Fatal(err)
+	}
+	challenge, err = attestAdapter.NewChallenge(ctx, &plugin.AttestationRequest{Request: newRequest("device")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte("body")
+	decoder.assertion = &plugin.AssertionPayload{Object: signAssertion(t, key, appID, 1, plugin.BodyClientData(challenge, body)), KeyID: []byte("device"), Challenge: challenge}
+	if err := assertAdapter.Verify(ctx, &plugin.AssertionRequest{Request: newRequest("device"), Body: body}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Revoke(ctx, []byte("device"), "compromised"); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertAdapter.Verify(ctx, &plugin.AssertionRequest{Request: newRequest("device"), Body: body}); !errors.Is(err, adapter.ErrAttestationRequired) {
+		t.Errorf("expected ErrAttestationRequired after revocation, got %v", err)
+	}
+	if err := p.Revoke(ctx, []byte("device"), "again"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("expected ErrUnknownKey revoking twice, got %v", err)
+	}
+	close(events)
+
+	want := []audit.Event{
+		{Type: audit.EventChallengeIssued},
+		{Type: audit.EventAttestationAccepted, KeyID: []byte("device")},
+		{Type: audit.EventChallengeIssued},
+		{Type: audit.EventCounterUpdated, KeyID: []byte("device"), Counter: 1},
+		{Type: audit.EventAssertionAccepted, KeyID: []byte("device")},
+		{Type: audit.EventKeyRevoked, KeyID: []byte("device"), Reason: "compromised"},
+		{Type: audit.EventAssertionRejected, KeyID: []byte("device"), Reason: "unknown_key"},
+	}
+	var i int
+	for got := range events {
+		if i >= len(want) {
+			t.Errorf("unexpected event %+v", got)
+			continue
+		}
+		if got.Type != want[i].Type || string(got.KeyID) != string(want[i].KeyID) || got.Reason != want[i].Reason ||
+			got.Counter != want[i].Counter || got.RemoteAddr == "" && got.Type != audit.EventKeyRevoked {
+			t.Errorf("event %d = %+v, want %+v", i, got, want[i])
+		}
+		i++
+	}
+	if i != len(want) {
+		t.Errorf("got %d events, want %d", i, len(want))
+	}
+}
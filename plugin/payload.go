@@ -0,0 +1,19 @@
+package plugin
+
+import (
+	attest "github.com/takimoto3/app-attest"
+)
+
+// AttestationPayload holds the data a client sends to the attestation endpoint.
+type AttestationPayload struct {
+	Object    *attest.AttestationObject
+	KeyID     []byte
+	Challenge string
+}
+
+// AssertionPayload holds the data a client sends with an assertion-protected request.
+type AssertionPayload struct {
+	Object    *attest.AssertionObject
+	KeyID     []byte
+	Challenge string
+}
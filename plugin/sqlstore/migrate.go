@@ -0,0 +1,75 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+const migrationsTable = "app_attest_schema_migrations"
+
+// Migrate applies the embedded schema migrations that have not been applied yet.
+// Each migration runs in its own transaction and is recorded in the
+// app_attest_schema_migrations table, so Migrate is safe to call on every start.
+func (s *Store) Migrate(ctx context.Context) error {
+	create := "CREATE TABLE IF NOT EXISTS " + migrationsTable + " (version VARCHAR(255) NOT NULL PRIMARY KEY, applied_at BIGINT NOT NULL)"
+	if _, err := s.db.ExecContext(ctx, create); err != nil {
+		return fmt.Errorf("sqlstore: create migrations table: %w", err)
+	}
+
+	names, err := fs.Glob(migrations, "migrations/*.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		version := strings.TrimSuffix(strings.TrimPrefix(name, "migrations/"), ".sql")
+		if err := s.migrate(ctx, name, version); err != nil {
+			return fmt.Errorf("sqlstore: migration %s: %w", version, err)
+		}
+	}
+	return nil
+}
+
+func (s *Store) migrate(ctx context.Context, name, version string) error {
+	data, err := migrations.ReadFile(name)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var applied string
+	err = tx.QueryRowContext(ctx, s.rebind("SELECT version FROM "+migrationsTable+" WHERE version = ?"), version).Scan(&applied)
+	if err == nil {
+		return nil
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+	for _, stmt := range strings.Split(string(data), ";") {
+		if strings.TrimSpace(stmt) == "" {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	insert := s.rebind("INSERT INTO " + migrationsTable + " (version, applied_at) VALUES (?, ?)")
+	if _, err := tx.ExecContext(ctx, insert, version, time.Now().UnixMilli()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,18 @@
+CREATE TABLE app_attest_keys (
+    key_id      VARCHAR(255) NOT NULL PRIMARY KEY,
+    public_key  TEXT         NOT NULL,
+    counter     BIGINT       NOT NULL,
+    receipt     TEXT         NOT NULL,
+    environment INTEGER      NOT NULL,
+    created_at  BIGINT       NOT NULL,
+    updated_at  BIGINT       NOT NULL
+);
+
+CREATE TABLE app_attest_challenges (
+    session_key VARCHAR(255) NOT NULL PRIMARY KEY,
+    challenge   VARCHAR(255) NOT NULL,
+    expires_at  BIGINT       NOT NULL,
+    used        INTEGER      NOT NULL DEFAULT 0
+);
+
+CREATE INDEX app_attest_challenges_expires_at ON app_attest_challenges (expires_at);
@@ -0,0 +1,7 @@
+ALTER TABLE app_attest_keys ADD COLUMN risk_metric INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE app_attest_keys ADD COLUMN receipt_created_at BIGINT NOT NULL DEFAULT 0;
+
+ALTER TABLE app_attest_keys ADD COLUMN receipt_refresh_at BIGINT NOT NULL DEFAULT 0;
+
+CREATE INDEX app_attest_keys_receipt_refresh_at ON app_attest_keys (receipt_refresh_at);
@@ -0,0 +1,626 @@
+// Package sqlstore provides a database/sql implementation of
+// plugin.AttestationPlugin and plugin.AssertionPlugin.
+//
+// Attested keys and challenges are kept in the app_attest_keys and
+// app_attest_challenges tables. The schema ships as embedded migration files
+// and is applied with Store.Migrate. Binary values are stored base64 encoded
+// and timestamps as Unix milliseconds, so the schema works unchanged on
+// SQLite, PostgreSQL and MySQL. Keys and challenges are written with
+// INSERT ... ON CONFLICT, which needs SQLite 3.24 or PostgreSQL 9.5 or later;
+// with MySQLPlaceholder it is rewritten to ON DUPLICATE KEY UPDATE.
+package sqlstore
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	attest "github.com/takimoto3/app-attest"
+	"github.com/takimoto3/app-attest-middleware/audit"
+	"github.com/takimoto3/app-attest-middleware/challenge"
+	"github.com/takimoto3/app-attest-middleware/plugin"
+	"github.com/takimoto3/app-attest-middleware/receipt"
+	"github.com/takimoto3/app-attest-middleware/wire"
+)
+
+var (
+	// ErrUnsupportedRequest indicates the original request is not an *http.Request.
+	ErrUnsupportedRequest = errors.New("sqlstore: unsupported request type")
+	// ErrUnknownKey indicates no attested key is stored for the key ID.
+	ErrUnknownKey = errors.New("sqlstore: unknown key")
+	// ErrKeyExists indicates another public key is already stored for the key ID.
+	ErrKeyExists = errors.New("sqlstore: key ID stored with another public key")
+)
+
+var (
+	_ plugin.AttestationPlugin             = (*Store)(nil)
+	_ plugin.AttestationChallengeConsumer  = (*Store)(nil)
+	_ plugin.AttestationChallengeExtractor = (*Store)(nil)
+	_ plugin.AssertionPlugin               = (*Store)(nil)
+	_ plugin.AssertionChallengeConsumer    = (*Store)(nil)
+	_ plugin.CounterSwapper                = (*Store)(nil)
+	_ plugin.ChallengeBinder               = (*Store)(nil)
+	_ plugin.KeyDescriber                  = (*Store)(nil)
+	_ receipt.Store                        = (*Store)(nil)
+)
+
+// Placeholder selects the bind parameter syntax of the database driver.
+type Placeholder int
+
+const (
+	// QuestionPlaceholder uses "?" (SQLite).
+	QuestionPlaceholder Placeholder = iota
+	// DollarPlaceholder uses "$1", "$2", ... (PostgreSQL).
+	DollarPlaceholder
+	// MySQLPlaceholder uses "?" and MySQL's ON DUPLICATE KEY UPDATE in
+	// place of ON CONFLICT.
+	MySQLPlaceholder
+)
+
+// Config holds the settings of a Store.
+type Config struct {
+	// Placeholder is the bind parameter syntax of the driver. Defaults to QuestionPlaceholder.
+	Placeholder Placeholder
+	// ChallengeTTL is how long an issued challenge stays valid. Defaults to 5 minutes.
+	ChallengeTTL time.Duration
+	// SessionKey extracts the session key challenges are assigned to.
+	// Defaults to wire.KeyIDSessionKey, the key ID of the X-App-Attest-Key-Id
+	// header in any base64 variant.
+	SessionKey wire.SessionKeyFunc
+	// Decoder decodes attestation and assertion payloads.
+	// Defaults to wire.Decoder, the default wire format.
+	Decoder wire.PayloadDecoder
+	// AuditSink, when set, records an audit.EventKeyRevoked for every revoked key.
+	AuditSink audit.Sink
+}
+
+// Key is an attested key stored in the app_attest_keys table.
+type Key struct {
+	KeyID       []byte
+	PublicKey   *ecdsa.PublicKey
+	Counter     uint32
+	Receipt     []byte
+	Environment attest.Environment
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	// RiskMetric and ReceiptCreatedAt are those of the last receipt parsed by
+	// a receipt.Scheduler, and ReceiptRefreshAt is when it is due for a refresh.
+	RiskMetric       int
+	ReceiptCreatedAt time.Time
+	ReceiptRefreshAt time.Time
+}
+
+// Store implements both plugin.AttestationPlugin and plugin.AssertionPlugin on top of database/sql.
+// It is safe for concurrent use, including from several processes sharing one database.
+type Store struct {
+	db     *sql.DB
+	config Config
+	now    func() time.Time
+}
+
+// New creates a Store on db. Zero values in config are replaced by their defaults.
+// Call Migrate before first use to create the tables.
+func New(db *sql.DB, config Config) *Store {
+	s := &Store{
+		db:     db,
+		config: config,
+		now:    time.Now,
+	}
+	if s.config.ChallengeTTL == 0 {
+		s.config.ChallengeTTL = 5 * time.Minute
+	}
+	if s.config.SessionKey == nil {
+		s.config.SessionKey = wire.KeyIDSessionKey
+	}
+	if s.config.Decoder == nil {
+		s.config.Decoder = wire.Decoder{}
+	}
+	return s
+}
+
+// NewChallenge creates a random challenge and assigns it to the request's session,
+// replacing any challenge assigned before in a single upsert, so concurrent
+// calls for one session leave exactly one of their challenges assigned.
+// Expired challenges are purged.
+func (s *Store) NewChallenge(ctx context.Context, r *plugin.AttestationRequest) (string, error) {
+	session, err := s.sessionKey(r.Request)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	value := base64.RawURLEncoding.EncodeToString(b)
+	now := s.now()
+
+	purge := s.rebind("DELETE FROM app_attest_challenges WHERE expires_at <= ?")
+	if _, err := s.db.ExecContext(ctx, purge, now.UnixMilli()); err != nil {
+		return "", err
+	}
+	expiresAt := now.Add(s.config.ChallengeTTL).UnixMilli()
+	upsert := s.rebind("INSERT INTO app_attest_challenges (session_key, challenge, expires_at, used) VALUES (?, ?, ?, 0) ON CONFLICT (session_key) DO UPDATE SET challenge = ?, expires_at = ?, used = 0")
+	if _, err := s.db.ExecContext(ctx, upsert, session, value, expiresAt, value, expiresAt); err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+// ExtractData decodes the attestation payload and returns the attestation object,
+// the SHA256 hash of the challenge and the key ID.
+func (s *Store) ExtractData(ctx context.Context, r *plugin.AttestationRequest) (*attest.AttestationObject, []byte, []byte, error) {
+	req, ok := r.Request.(*http.Request)
+	if !ok {
+		return nil, nil, nil, ErrUnsupportedRequest
+	}
+	payload, err := s.config.Decoder.DecodeAttestation(req)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	r.Object = payload
+	hash := sha256.Sum256([]byte(payload.Challenge))
+	return payload.Object, hash[:], payload.KeyID, nil
+}
+
+// IsChallengeAssigned reports whether the challenge sent by the client is the
+// unexpired challenge assigned to its session. ExtractData must be called first.
+func (s *Store) IsChallengeAssigned(ctx context.Context, r *plugin.AttestationRequest) (bool, error) {
+	session, err := s.sessionKey(r.Request)
+	if err != nil {
+		return false, err
+	}
+	payload, ok := r.Object.(*plugin.AttestationPayload)
+	if !ok {
+		return false, nil
+	}
+	assigned, err := s.assignedChallenge(ctx, session)
+	if err != nil {
+		return false, err
+	}
+	return assigned != "" && subtle.ConstantTimeCompare([]byte(assigned), []byte(payload.Challenge)) == 1, nil
+}
+
+// ConsumeAttestationChallenge marks the challenge assigned to the request's
+// session as used. The row is kept until it expires or is replaced, so that a
+// replay is reported as used rather than missing.
+func (s *Store) ConsumeAttestationChallenge(ctx context.Context, r *plugin.AttestationRequest) (bool, error) {
+	session, err := s.sessionKey(r.Request)
+	if err != nil {
+		return false, err
+	}
+	payload, ok := r.Object.(*plugin.AttestationPayload)
+	if !ok {
+		return false, nil
+	}
+	return s.consume(ctx, session, payload.Challenge)
+}
+
+// AttestationChallenge returns the challenge sent by the client.
+// ExtractData must be called first.
+func (s *Store) AttestationChallenge(ctx context.Context, r *plugin.AttestationRequest) (string, error) {
+	payload, ok := r.Object.(*plugin.AttestationPayload)
+	if !ok {
+		return "", errors.New("sqlstore: no attestation payload")
+	}
+	return payload.Challenge, nil
+}
+
+// ChallengeBinding binds stateless challenges to the request's session. A
+// challenge is issued for assertion when the key named by the
+// X-App-Attest-Key-Id header is attested, and for attestation otherwise.
+func (s *Store) ChallengeBinding(ctx context.Context, req any) (challenge.Purpose, string, error) {
+	session, err := s.sessionKey(req)
+	if err != nil {
+		return "", "", err
+	}
+	keyID, err := wire.DecodeBase64(req.(*http.Request).Header.Get(wire.HeaderKeyID))
+	if err != nil || len(keyID) == 0 {
+		return challenge.Attest, session, nil
+	}
+	var n int
+	query := s.rebind("SELECT COUNT(*) FROM app_attest_keys WHERE key_id = ?")
+	if err := s.db.QueryRowContext(ctx, query, encode(keyID)).Scan(&n); err != nil {
+		return "", "", err
+	}
+	if n > 0 {
+		return challenge.Assert, session, nil
+	}
+	return challenge.Attest, session, nil
+}
+
+// StoreResult stores the attested public key with a counter of zero.
+// Storing the same key again leaves the existing row untouched; storing
+// another public key for a stored key ID returns ErrKeyExists. The row is
+// inserted with ON CONFLICT DO NOTHING, so concurrent calls never overwrite it.
+func (s *Store) StoreResult(ctx context.Context, r *plugin.AttestationRequest) error {
+	payload, ok := r.Object.(*plugin.AttestationPayload)
+	if !ok || r.Result == nil {
+		return errors.New("sqlstore: no attestation result")
+	}
+	der, err := x509.MarshalPKIXPublicKey(r.Result.PublicKey)
+	if err != nil {
+		return err
+	}
+	keyID := encode(payload.KeyID)
+	publicKey := encode(der)
+	now := s.now().UnixMilli()
+
+	insert := s.rebind("INSERT INTO app_attest_keys (key_id, public_key, counter, receipt, environment, created_at, updated_at) VALUES (?, ?, 0, ?, ?, ?, ?) ON CONFLICT (key_id) DO NOTHING")
+	if _, err := s.db.ExecContext(ctx, insert, keyID, publicKey, encode(r.Result.Receipt), int(r.Result.Environment), now, now); err != nil {
+		return err
+	}
+	var stored string
+	if err := s.db.QueryRowContext(ctx, s.rebind("SELECT public_key FROM app_attest_keys WHERE key_id = ?"), keyID).Scan(&stored); err != nil {
+		return err
+	}
+	if stored != publicKey {
+		return ErrKeyExists
+	}
+	return nil
+}
+
+// ParseRequest decodes the assertion payload and returns the assertion object
+// and the challenge sent by the client. Unless the middleware binds the
+// canonical request, the client data is that of the wire format, see
+// wire.UseBodyClientData.
+func (s *Store) ParseRequest(ctx context.Context, r *plugin.AssertionRequest) (*attest.AssertionObject, string, error) {
+	req, ok := r.Request.(*http.Request)
+	if !ok {
+		return nil, "", ErrUnsupportedRequest
+	}
+	payload, err := s.config.Decoder.DecodeAssertion(req, r.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	r.Object = payload
+	wire.UseBodyClientData(r)
+	return payload.Object, payload.Challenge, nil
+}
+
+// PublicKeyAndCounter returns the stored public key and counter of the key
+// that signed the assertion, or a nil key if it is unknown.
+// ParseRequest must be called first.
+func (s *Store) PublicKeyAndCounter(ctx context.Context, r *plugin.AssertionRequest) (*ecdsa.PublicKey, uint32, error) {
+	payload, ok := r.Object.(*plugin.AssertionPayload)
+	if !ok {
+		return nil, 0, nil
+	}
+	key, err := s.Key(ctx, payload.KeyID)
+	if errors.Is(err, ErrUnknownKey) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return key.PublicKey, key.Counter, nil
+}
+
+// KeyInfo returns the key that signed the assertion. ParseRequest must be called first.
+func (s *Store) KeyInfo(ctx context.Context, r *plugin.AssertionRequest) (*plugin.KeyInfo, error) {
+	payload, ok := r.Object.(*plugin.AssertionPayload)
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	var (
+		env, riskMetric             int
+		createdAt, receiptCreatedAt int64
+	)
+	query := s.rebind("SELECT environment, created_at, risk_metric, receipt_created_at FROM app_attest_keys WHERE key_id = ?")
+	err := s.db.QueryRowContext(ctx, query, encode(payload.KeyID)).Scan(&env, &createdAt, &riskMetric, &receiptCreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUnknownKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &plugin.KeyInfo{
+		KeyID:            payload.KeyID,
+		Environment:      attest.Environment(env),
+		AttestedAt:       time.UnixMilli(createdAt),
+		RiskMetric:       riskMetric,
+		ReceiptCreatedAt: unixMilli(receiptCreatedAt),
+	}, nil
+}
+
+// AssignedChallenge returns the unexpired challenge assigned to the request's
+// session, or an empty string if there is none.
+func (s *Store) AssignedChallenge(ctx context.Context, r *plugin.AssertionRequest) (string, error) {
+	session, err := s.sessionKey(r.Request)
+	if err != nil {
+		return "", err
+	}
+	return s.assignedChallenge(ctx, session)
+}
+
+// AssertionChallengeUsed reports whether the given challenge of the request's
+// session has been consumed.
+func (s *Store) AssertionChallengeUsed(ctx context.Context, r *plugin.AssertionRequest, challenge string) (bool, error) {
+	session, err := s.sessionKey(r.Request)
+	if err != nil {
+		return false, err
+	}
+	var used int
+	query := s.rebind("SELECT used FROM app_attest_challenges WHERE session_key = ? AND challenge = ? AND expires_at > ?")
+	err = s.db.QueryRowContext(ctx, query, session, challenge, s.now().UnixMilli()).Scan(&used)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return used != 0, err
+}
+
+// ConsumeAssertionChallenge marks the given challenge of the request's session
+// as used.
+func (s *Store) ConsumeAssertionChallenge(ctx context.Context, r *plugin.AssertionRequest, challenge string) (bool, error) {
+	session, err := s.sessionKey(r.Request)
+	if err != nil {
+		return false, err
+	}
+	return s.consume(ctx, session, challenge)
+}
+
+// UpdateCounter stores the counter of the key that signed the assertion,
+// unless the stored counter is greater, so that concurrent updates never move
+// it backwards.
+func (s *Store) UpdateCounter(ctx context.Context, r *plugin.AssertionRequest, counter uint32) error {
+	payload, ok := r.Object.(*plugin.AssertionPayload)
+	if !ok {
+		return ErrUnknownKey
+	}
+	update := s.rebind("UPDATE app_attest_keys SET counter = CASE WHEN counter < ? THEN ? ELSE counter END, updated_at = ? WHERE key_id = ?")
+	res, err := s.db.ExecContext(ctx, update, int64(counter), int64(counter), s.now().UnixMilli(), encode(payload.KeyID))
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUnknownKey
+	}
+	return nil
+}
+
+// CompareAndSwapCounter stores the counter only if the stored counter is still old.
+// The conditional UPDATE runs in its own transaction.
+func (s *Store) CompareAndSwapCounter(ctx context.Context, r *plugin.AssertionRequest, old, counter uint32) (bool, error) {
+	payload, ok := r.Object.(*plugin.AssertionPayload)
+	if !ok {
+		return false, ErrUnknownKey
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	update := s.rebind("UPDATE app_attest_keys SET counter = ?, updated_at = ? WHERE key_id = ? AND counter = ?")
+	res, err := tx.ExecContext(ctx, update, int64(counter), s.now().UnixMilli(), encode(payload.KeyID), int64(old))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// Key returns the stored key for keyID, or ErrUnknownKey.
+func (s *Store) Key(ctx context.Context, keyID []byte) (*Key, error) {
+	var (
+		publicKey, receipt   string
+		counter              int64
+		env, riskMetric      int
+		createdAt, updatedAt int64
+		receiptCreatedAt     int64
+		receiptRefreshAt     int64
+	)
+	query := s.rebind("SELECT public_key, counter, receipt, environment, created_at, updated_at, risk_metric, receipt_created_at, receipt_refresh_at FROM app_attest_keys WHERE key_id = ?")
+	err := s.db.QueryRowContext(ctx, query, encode(keyID)).Scan(&publicKey, &counter, &receipt, &env, &createdAt, &updatedAt, &riskMetric, &receiptCreatedAt, &receiptRefreshAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUnknownKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := decode(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("sqlstore: decode public key: %w", err)
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("sqlstore: parse public key: %w", err)
+	}
+	ecdsaKey, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("sqlstore: unexpected public key type %T", pub)
+	}
+	rcpt, err := decode(receipt)
+	if err != nil {
+		return nil, fmt.Errorf("sqlstore: decode receipt: %w", err)
+	}
+	return &Key{
+		KeyID:            keyID,
+		PublicKey:        ecdsaKey,
+		Counter:          uint32(counter),
+		Receipt:          rcpt,
+		Environment:      attest.Environment(env),
+		CreatedAt:        time.UnixMilli(createdAt),
+		UpdatedAt:        time.UnixMilli(updatedAt),
+		RiskMetric:       riskMetric,
+		ReceiptCreatedAt: unixMilli(receiptCreatedAt),
+		ReceiptRefreshAt: unixMilli(receiptRefreshAt),
+	}, nil
+}
+
+// DueReceipts returns up to limit receipts whose refresh time is not after now,
+// earliest first.
+func (s *Store) DueReceipts(ctx context.Context, now time.Time, limit int) ([]receipt.Entry, error) {
+	query := s.rebind("SELECT key_id, environment, receipt FROM app_attest_keys WHERE receipt <> '' AND receipt_refresh_at <= ? ORDER BY receipt_refresh_at LIMIT ?")
+	rows, err := s.db.QueryContext(ctx, query, now.UnixMilli(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []receipt.Entry
+	for rows.Next() {
+		var (
+			keyID, rcpt string
+			env         int
+		)
+		if err := rows.Scan(&keyID, &env, &rcpt); err != nil {
+			return nil, err
+		}
+		e := receipt.Entry{Environment: attest.Environment(env)}
+		if e.KeyID, err = decode(keyID); err != nil {
+			return nil, fmt.Errorf("sqlstore: decode key ID: %w", err)
+		}
+		if e.Receipt, err = decode(rcpt); err != nil {
+			return nil, fmt.Errorf("sqlstore: decode receipt: %w", err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// UpdateReceipt replaces the receipt of keyID with r and sets its refresh time.
+func (s *Store) UpdateReceipt(ctx context.Context, keyID []byte, r *receipt.Receipt, refreshAt time.Time) error {
+	update := s.rebind("UPDATE app_attest_keys SET receipt = ?, risk_metric = ?, receipt_created_at = ?, receipt_refresh_at = ?, updated_at = ? WHERE key_id = ?")
+	return s.updateKey(ctx, update, encode(r.Raw), r.RiskMetric, r.CreationTime.UnixMilli(), refreshAt.UnixMilli(), s.now().UnixMilli(), encode(keyID))
+}
+
+// PostponeReceipt sets the refresh time of the receipt of keyID.
+func (s *Store) PostponeReceipt(ctx context.Context, keyID []byte, refreshAt time.Time) error {
+	update := s.rebind("UPDATE app_attest_keys SET receipt_refresh_at = ? WHERE key_id = ?")
+	return s.updateKey(ctx, update, refreshAt.UnixMilli(), encode(keyID))
+}
+
+// updateKey runs the UPDATE query of one key and returns ErrUnknownKey if no row matched.
+func (s *Store) updateKey(ctx context.Context, query string, args ...any) error {
+	res, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUnknownKey
+	}
+	return nil
+}
+
+// Revoke deletes the key keyID, so that its assertions are rejected with
+// adapter.ErrAttestationRequired. App Attest keys cannot be attested twice, so the
+// device has to generate and attest a new key. reason is recorded in the audit event.
+func (s *Store) Revoke(ctx context.Context, keyID []byte, reason string) error {
+	res, err := s.db.ExecContext(ctx, s.rebind("DELETE FROM app_attest_keys WHERE key_id = ?"), encode(keyID))
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUnknownKey
+	}
+	return audit.Emit(ctx, s.config.AuditSink, nil, audit.Event{Type: audit.EventKeyRevoked, KeyID: keyID, Reason: reason})
+}
+
+func (s *Store) assignedChallenge(ctx context.Context, session string) (string, error) {
+	var value string
+	query := s.rebind("SELECT challenge FROM app_attest_challenges WHERE session_key = ? AND expires_at > ?")
+	err := s.db.QueryRowContext(ctx, query, session, s.now().UnixMilli()).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return value, err
+}
+
+func (s *Store) consume(ctx context.Context, session, challenge string) (bool, error) {
+	update := s.rebind("UPDATE app_attest_challenges SET used = 1 WHERE session_key = ? AND challenge = ? AND expires_at > ? AND used = 0")
+	res, err := s.db.ExecContext(ctx, update, session, challenge, s.now().UnixMilli())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func (s *Store) sessionKey(req any) (string, error) {
+	r, ok := req.(*http.Request)
+	if !ok {
+		return "", ErrUnsupportedRequest
+	}
+	return s.config.SessionKey(r)
+}
+
+// onConflict matches the ON CONFLICT clauses rebind rewrites for MySQL.
+var onConflict = regexp.MustCompile(`ON CONFLICT \((\w+)\) DO (UPDATE SET|NOTHING)`)
+
+// rebind rewrites "?" placeholders and ON CONFLICT clauses for the configured
+// driver.
+func (s *Store) rebind(query string) string {
+	if s.config.Placeholder == MySQLPlaceholder {
+		return onConflict.ReplaceAllStringFunc(query, func(clause string) string {
+			m := onConflict.FindStringSubmatch(clause)
+			if m[2] == "NOTHING" {
+				return "ON DUPLICATE KEY UPDATE " + m[1] + " = " + m[1]
+			}
+			return "ON DUPLICATE KEY UPDATE"
+		})
+	}
+	if s.config.Placeholder != DollarPlaceholder {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func encode(b []byte) string {
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func decode(s string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(s)
+}
+
+// unixMilli is time.UnixMilli, except that 0 is the zero time.
+func unixMilli(ms int64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
@@ -0,0 +1,387 @@
+package sqlstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	attest "github.com/takimoto3/app-attest"
+	"github.com/takimoto3/app-attest-middleware/audit"
+	"github.com/takimoto3/app-attest-middleware/plugin"
+	"github.com/takimoto3/app-attest-middleware/plugintest"
+	"github.com/takimoto3/app-attest-middleware/receipt"
+	_ "modernc.org/sqlite"
+)
+
+func newStore(t *testing.T) *Store {
+	t.Helper()
+	return openStore(t, Config{ChallengeTTL: time.Minute})
+}
+
+// openStore returns a migrated Store on a new SQLite database.
+func openStore(t *testing.T, config Config) *Store {
+	t.Helper()
+	dsn := "file:" + filepath.Join(t.TempDir(), "attest.db") + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	s := New(db, config)
+	if err := s.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// newRequest returns a request whose X-App-Attest-Key-Id header is session,
+// encoded in standard base64.
+func newRequest(session string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set("X-App-Attest-Key-Id", base64.StdEncoding.EncodeToString([]byte(session)))
+	return r
+}
+
+func TestStore_Migrate(t *testing.T) {
+	s := newStore(t)
+	// A second run must be a no-op.
+	if err := s.Migrate(context.Background()); err != nil {
+		t.Fatalf("second Migrate failed: %v", err)
+	}
+	var n int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM app_attest_schema_migrations").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("got %d applied migrations, want 2", n)
+	}
+}
+
+func TestStore_Challenges(t *testing.T) {
+	s := newStore(t)
+	now := time.Unix(1700000000, 0)
+	s.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	c, err := s.NewChallenge(ctx, &plugin.AttestationRequest{Request: newRequest("s1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &plugin.AttestationRequest{Request: newRequest("s1"), Object: &plugin.AttestationPayload{Challenge: c}}
+	if ok, err := s.IsChallengeAssigned(ctx, r); err != nil || !ok {
+		t.Fatalf("IsChallengeAssigned = %v, %v, want true", ok, err)
+	}
+	other := &plugin.AttestationRequest{Request: newRequest("s2"), Object: &plugin.AttestationPayload{Challenge: c}}
+	if ok, _ := s.IsChallengeAssigned(ctx, other); ok {
+		t.Error("challenge assigned to another session")
+	}
+	if ok, err := s.ConsumeAttestationChallenge(ctx, r); err != nil || !ok {
+		t.Fatalf("ConsumeAttestationChallenge = %v, %v, want true", ok, err)
+	}
+	if ok, _ := s.ConsumeAttestationChallenge(ctx, r); ok {
+		t.Error("consumed the same challenge twice")
+	}
+	if ok, err := s.IsChallengeAssigned(ctx, r); err != nil || !ok {
+		t.Errorf("IsChallengeAssigned of a consumed challenge = %v, %v, want true", ok, err)
+	}
+
+	c, err = s.NewChallenge(ctx, &plugin.AttestationRequest{Request: newRequest("s1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ar := &plugin.AssertionRequest{Request: newRequest("s1")}
+	if assigned, _ := s.AssignedChallenge(ctx, ar); assigned != c {
+		t.Errorf("AssignedChallenge = %q, want %q", assigned, c)
+	}
+	if used, err := s.AssertionChallengeUsed(ctx, ar, c); err != nil || used {
+		t.Errorf("AssertionChallengeUsed = %v, %v, want false", used, err)
+	}
+	if ok, err := s.ConsumeAssertionChallenge(ctx, ar, c); err != nil || !ok {
+		t.Fatalf("ConsumeAssertionChallenge = %v, %v, want true", ok, err)
+	}
+	if used, err := s.AssertionChallengeUsed(ctx, ar, c); err != nil || !used {
+		t.Errorf("AssertionChallengeUsed of a consumed challenge = %v, %v, want true", used, err)
+	}
+	if assigned, _ := s.AssignedChallenge(ctx, ar); assigned != c {
+		t.Errorf("AssignedChallenge of a consumed challenge = %q, want %q", assigned, c)
+	}
+	now = now.Add(time.Minute)
+	if assigned, _ := s.AssignedChallenge(ctx, ar); assigned != "" {
+		t.Errorf("expired challenge still assigned: %q", assigned)
+	}
+	if ok, _ := s.ConsumeAssertionChallenge(ctx, ar, c); ok {
+		t.Error("consumed an expired challenge")
+	}
+}
+
+func TestStore_SessionKeyEncodings(t *testing.T) {
+	keyID := bytes.Repeat([]byte{0xfb, 0xff}, 16)
+	withKeyID := func(encoding *base64.Encoding) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.Header.Set("X-App-Attest-Key-Id", encoding.EncodeToString(keyID))
+		return r
+	}
+	encodings := map[string]*base64.Encoding{
+		"standard":          base64.StdEncoding,
+		"standard unpadded": base64.RawStdEncoding,
+		"url-safe":          base64.URLEncoding,
+		"url-safe unpadded": base64.RawURLEncoding,
+	}
+	ctx := context.Background()
+	s := newStore(t)
+
+	for issuedName, issued := range encodings {
+		for sentName, sent := range encodings {
+			t.Run(issuedName+" then "+sentName, func(t *testing.T) {
+				c, err := s.NewChallenge(ctx, &plugin.AttestationRequest{Request: withKeyID(issued)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				r := &plugin.AssertionRequest{Request: withKeyID(sent)}
+				if assigned, _ := s.AssignedChallenge(ctx, r); assigned != c {
+					t.Errorf("AssignedChallenge = %q, want %q", assigned, c)
+				}
+				if ok, _ := s.ConsumeAssertionChallenge(ctx, r, c); !ok {
+					t.Error("failed to consume the assigned challenge")
+				}
+			})
+		}
+	}
+}
+
+func TestStore_Keys(t *testing.T) {
+	s := newStore(t)
+	ctx := context.Background()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &plugin.AttestationRequest{
+		Object: &plugin.AttestationPayload{KeyID: []byte("key")},
+		Result: &attest.Result{PublicKey: &key.PublicKey, Receipt: []byte("receipt"), Environment: attest.Sandbox},
+	}
+	for range 2 {
+		if err := s.StoreResult(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stored, err := s.Key(ctx, []byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.PublicKey.Equal(&key.PublicKey) || string(stored.Receipt) != "receipt" || stored.Environment != attest.Sandbox {
+		t.Errorf("unexpected stored key: %+v", stored)
+	}
+
+	ar := &plugin.AssertionRequest{Object: &plugin.AssertionPayload{KeyID: []byte("key")}}
+	if err := s.UpdateCounter(ctx, ar, 5); err != nil {
+		t.Fatal(err)
+	}
+	pub, counter, err := s.PublicKeyAndCounter(ctx, ar)
+	if err != nil || !pub.Equal(&key.PublicKey) || counter != 5 {
+		t.Errorf("PublicKeyAndCounter = %v, %d, %v", pub, counter, err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherReq := &plugin.AttestationRequest{Object: req.Object, Result: &attest.Result{PublicKey: &other.PublicKey}}
+	if err := s.StoreResult(ctx, otherReq); !errors.Is(err, ErrKeyExists) {
+		t.Errorf("StoreResult of another public key = %v, want ErrKeyExists", err)
+	}
+	if pub, counter, err := s.PublicKeyAndCounter(ctx, ar); err != nil || !pub.Equal(&key.PublicKey) || counter != 5 {
+		t.Errorf("PublicKeyAndCounter after another public key = %v, %d, %v", pub, counter, err)
+	}
+	info, err := s.KeyInfo(ctx, ar)
+	if err != nil || string(info.KeyID) != "key" || info.Environment != attest.Sandbox || !info.AttestedAt.Equal(stored.CreatedAt) {
+		t.Errorf("KeyInfo = %+v, %v", info, err)
+	}
+
+	unknown := &plugin.AssertionRequest{Object: &plugin.AssertionPayload{KeyID: []byte("unknown")}}
+	if pub, _, err := s.PublicKeyAndCounter(ctx, unknown); pub != nil || err != nil {
+		t.Errorf("expected nil key for unknown key ID, got %v, %v", pub, err)
+	}
+	if err := s.UpdateCounter(ctx, unknown, 1); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("expected ErrUnknownKey, got %v", err)
+	}
+	if _, err := s.KeyInfo(ctx, unknown); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("expected ErrUnknownKey from KeyInfo, got %v", err)
+	}
+}
+
+func TestStore_Receipts(t *testing.T) {
+	s := newStore(t)
+	ctx := context.Background()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b", "no receipt"} {
+		var rcpt []byte
+		if id != "no receipt" {
+			rcpt = []byte("receipt " + id)
+		}
+		req := &plugin.AttestationRequest{
+			Object: &plugin.AttestationPayload{KeyID: []byte(id)},
+			Result: &attest.Result{PublicKey: &key.PublicKey, Receipt: rcpt, Environment: attest.Sandbox},
+		}
+		if err := s.StoreResult(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.UnixMilli(time.Now().UnixMilli())
+	due, err := s.DueReceipts(ctx, now, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(due) != 2 || due[0].Environment != attest.Sandbox {
+		t.Fatalf("got due receipts %+v, want a and b", due)
+	}
+
+	created := now.Add(-time.Hour)
+	fresh := &receipt.Receipt{Raw: []byte("fresh"), RiskMetric: 3, CreationTime: created}
+	if err := s.UpdateReceipt(ctx, []byte("a"), fresh, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PostponeReceipt(ctx, []byte("b"), now.Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if due, err := s.DueReceipts(ctx, now, 10); err != nil || len(due) != 0 {
+		t.Errorf("got due receipts %+v, %v, want none", due, err)
+	}
+	due, err = s.DueReceipts(ctx, now.Add(3*time.Hour), 1)
+	if err != nil || len(due) != 1 || string(due[0].KeyID) != "a" || string(due[0].Receipt) != "fresh" {
+		t.Errorf("got due receipts %+v, %v, want a first", due, err)
+	}
+
+	stored, err := s.Key(ctx, []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.RiskMetric != 3 || !stored.ReceiptCreatedAt.Equal(created) || !stored.ReceiptRefreshAt.Equal(now.Add(time.Hour)) {
+		t.Errorf("unexpected stored receipt: %+v", stored)
+	}
+	if err := s.PostponeReceipt(ctx, []byte("unknown"), now); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("expected ErrUnknownKey, got %v", err)
+	}
+}
+
+func TestStore_CompareAndSwapCounter(t *testing.T) {
+	s := newStore(t)
+	ctx := context.Background()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.StoreResult(ctx, &plugin.AttestationRequest{
+		Object: &plugin.AttestationPayload{KeyID: []byte("key")},
+		Result: &attest.Result{PublicKey: &key.PublicKey},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &plugin.AssertionRequest{Object: &plugin.AssertionPayload{KeyID: []byte("key")}}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	swapped := 0
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := s.CompareAndSwapCounter(ctx, r, 0, 1)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if ok {
+				mu.Lock()
+				swapped++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if swapped != 1 {
+		t.Errorf("counter swapped %d times, want 1", swapped)
+	}
+}
+
+func TestStore_Conformance(t *testing.T) {
+	plugintest.TestPlugin(t, plugintest.Config{
+		New: func(t *testing.T) plugintest.Plugin {
+			return openStore(t, Config{ChallengeTTL: 100 * time.Millisecond})
+		},
+		ChallengeTTL: 100 * time.Millisecond,
+		Break: func(t *testing.T, p plugintest.Plugin) {
+			p.(*Store).db.Close()
+		},
+	})
+}
+
+func TestStore_Rebind(t *testing.T) {
+	s := &Store{config: Config{Placeholder: DollarPlaceholder}}
+	got := s.rebind("UPDATE t SET a = ? WHERE b = ? AND c = ?")
+	want := "UPDATE t SET a = $1 WHERE b = $2 AND c = $3"
+	if got != want {
+		t.Errorf("rebind = %q, want %q", got, want)
+	}
+}
+
+func TestStore_RebindMySQL(t *testing.T) {
+	s := &Store{config: Config{Placeholder: MySQLPlaceholder}}
+	tests := map[string]string{
+		"INSERT INTO t (a, b) VALUES (?, ?) ON CONFLICT (a) DO NOTHING":          "INSERT INTO t (a, b) VALUES (?, ?) ON DUPLICATE KEY UPDATE a = a",
+		"INSERT INTO t (a, b) VALUES (?, ?) ON CONFLICT (a) DO UPDATE SET b = ?": "INSERT INTO t (a, b) VALUES (?, ?) ON DUPLICATE KEY UPDATE b = ?",
+		"UPDATE t SET a = ? WHERE b = ?":                                         "UPDATE t SET a = ? WHERE b = ?",
+	}
+	for query, want := range tests {
+		if got := s.rebind(query); got != want {
+			t.Errorf("rebind(%q) = %q, want %q", query, got, want)
+		}
+	}
+}
+
+func TestStore_Revoke(t *testing.T) {
+	s := newStore(t)
+	events := make(audit.Channel, 1)
+	s.config.AuditSink = events
+	ctx := context.Background()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.StoreResult(ctx, &plugin.AttestationRequest{
+		Object: &plugin.AttestationPayload{KeyID: []byte("key")},
+		Result: &attest.Result{PublicKey: &key.PublicKey},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Revoke(ctx, []byte("key"), "compromised"); err != nil {
+		t.Fatal(err)
+	}
+	if e := <-events; e.Type != audit.EventKeyRevoked || string(e.KeyID) != "key" || e.Reason != "compromised" {
+		t.Errorf("unexpected audit event %+v", e)
+	}
+	if _, err := s.Key(ctx, []byte("key")); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("expected ErrUnknownKey after revocation, got %v", err)
+	}
+	if err := s.Revoke(ctx, []byte("key"), "again"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("expected ErrUnknownKey revoking twice, got %v", err)
+	}
+}
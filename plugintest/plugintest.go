@@ -0,0 +1,693 @@
+// Package plugintest checks that an implementation of plugin.AttestationPlugin
+// and plugin.AssertionPlugin honors the contract the adapters depend on.
+//
+// Call TestPlugin from the tests of the implementation:
+//
+//	func TestConformance(t *testing.T) {
+//	    plugintest.TestPlugin(t, plugintest.Config{
+//	        New: func(t *testing.T) plugintest.Plugin {
+//	            return myplugin.New(myplugin.Config{ChallengeTTL: 100 * time.Millisecond})
+//	        },
+//	        ChallengeTTL: 100 * time.Millisecond,
+//	    })
+//	}
+//
+// The suite checks that challenges match only the session they are assigned
+// to, expire, replace each other so that concurrent NewChallenge calls leave
+// exactly one assigned and, with the optional consumer interfaces, are
+// single-use even under concurrent consumption and stay assigned, marked used,
+// once consumed; that plugin.ChallengeBinder, if implemented, binds stateless
+// challenges to the session and issues them for assertion once the key is
+// attested; that unknown keys yield a nil public key; that counters never move
+// backwards under concurrent UpdateCounter calls and CompareAndSwapCounter
+// lets exactly one caller win; that StoreResult is idempotent and never
+// replaces a stored key, even under concurrent calls; and that malformed
+// payloads and storage failures are reported as errors rather than zero
+// values.
+package plugintest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	attest "github.com/takimoto3/app-attest"
+	"github.com/takimoto3/app-attest-middleware/attesttest"
+	"github.com/takimoto3/app-attest-middleware/challenge"
+	"github.com/takimoto3/app-attest-middleware/plugin"
+	"github.com/takimoto3/app-attest-middleware/wire"
+)
+
+// Plugin is a backend implementing both plugin interfaces.
+type Plugin interface {
+	plugin.AttestationPlugin
+	plugin.AssertionPlugin
+}
+
+// Encoder builds the requests the plugin decodes.
+type Encoder interface {
+	// ChallengeRequest returns a NewChallenge request in the session of keyID.
+	ChallengeRequest(keyID []byte) *http.Request
+	// AttestationRequest returns a Verify request carrying the CBOR
+	// attestation object and the challenge, in the session of keyID.
+	AttestationRequest(keyID, attestation []byte, challenge string) *http.Request
+	// AssertionRequest returns an assertion-protected request with body,
+	// carrying the CBOR assertion and the challenge, in the session of keyID.
+	AssertionRequest(keyID, assertion []byte, challenge string, body []byte) *http.Request
+}
+
+// WireEncoder encodes requests in the default wire format, with the
+// X-App-Attest-Key-Id header as the session key.
+type WireEncoder struct{}
+
+var _ Encoder = WireEncoder{}
+
+func (WireEncoder) ChallengeRequest(keyID []byte) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/attest/challenge", nil)
+	r.Header.Set(wire.HeaderKeyID, base64.StdEncoding.EncodeToString(keyID))
+	return r
+}
+
+func (WireEncoder) AttestationRequest(keyID, attestation []byte, challenge string) *http.Request {
+	body, err := wire.EncodeAttestation(attestation, keyID, challenge)
+	if err != nil {
+		panic(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/attest/verify", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set(wire.HeaderKeyID, base64.StdEncoding.EncodeToString(keyID))
+	return r
+}
+
+func (WireEncoder) AssertionRequest(keyID, assertion []byte, challenge string, body []byte) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/api", bytes.NewReader(body))
+	wire.SetAssertion(r.Header, assertion, keyID, challenge)
+	return r
+}
+
+// Config holds the settings of TestPlugin.
+type Config struct {
+	// New returns a new plugin whose challenges expire after ChallengeTTL.
+	// Required.
+	New func(t *testing.T) Plugin
+	// ChallengeTTL is the challenge lifetime of the plugins returned by New.
+	// The suite waits for it to elapse, so keep it short. Required.
+	ChallengeTTL time.Duration
+	// Break, when set, makes the storage of p fail, e.g. by closing its
+	// database. Every call that reaches the storage must then return an error.
+	Break func(t *testing.T, p Plugin)
+	// Encoder builds the requests. Defaults to WireEncoder.
+	Encoder Encoder
+}
+
+// TestPlugin runs the conformance suite against the plugins returned by
+// config.New, each in a subtest.
+func TestPlugin(t *testing.T, config Config) {
+	t.Helper()
+	if config.New == nil || config.ChallengeTTL <= 0 {
+		t.Fatal("plugintest: Config.New and Config.ChallengeTTL are required")
+	}
+	if config.Encoder == nil {
+		config.Encoder = WireEncoder{}
+	}
+	ca, err := attesttest.NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &suite{config: config, ca: ca}
+
+	t.Run("ChallengeAssigned", s.testChallengeAssigned)
+	t.Run("ChallengeExpires", s.testChallengeExpires)
+	t.Run("NewChallengeConcurrent", s.testNewChallengeConcurrent)
+	t.Run("ChallengeSingleUse", s.testChallengeSingleUse)
+	t.Run("ChallengeBinding", s.testChallengeBinding)
+	t.Run("UnknownKey", s.testUnknownKey)
+	t.Run("StoreResultIdempotent", s.testStoreResultIdempotent)
+	t.Run("StoreResultConcurrent", s.testStoreResultConcurrent)
+	t.Run("CounterMonotonic", s.testCounterMonotonic)
+	t.Run("CompareAndSwapCounter", s.testCompareAndSwapCounter)
+	t.Run("MalformedPayload", s.testMalformedPayload)
+	t.Run("StorageErrors", s.testStorageErrors)
+}
+
+// concurrency is the number of goroutines of the concurrent checks.
+const concurrency = 16
+
+type suite struct {
+	config Config
+	ca     *attesttest.CA
+}
+
+const appID = "PLUGINTEST.com.example.app"
+
+func (s *suite) device(t *testing.T) *attesttest.Device {
+	t.Helper()
+	d, err := s.ca.NewDevice(appID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func (s *suite) newChallenge(t *testing.T, p Plugin, d *attesttest.Device) string {
+	t.Helper()
+	challenge, err := p.NewChallenge(t.Context(), &plugin.AttestationRequest{Request: s.config.Encoder.ChallengeRequest(d.KeyID())})
+	if err != nil {
+		t.Fatalf("NewChallenge: %v", err)
+	}
+	if challenge == "" {
+		t.Fatal("NewChallenge returned an empty challenge")
+	}
+	return challenge
+}
+
+// attestationRequest returns the request of an attestation of d for
+// challenge, after ExtractData.
+func (s *suite) attestationRequest(t *testing.T, p Plugin, d *attesttest.Device, challenge string) *plugin.AttestationRequest {
+	t.Helper()
+	hash := sha256.Sum256([]byte(challenge))
+	obj, err := d.AttestKey(hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &plugin.AttestationRequest{Request: s.config.Encoder.AttestationRequest(d.KeyID(), obj, challenge)}
+	attestation, clientDataHash, keyID, err := p.ExtractData(t.Context(), r)
+	if err != nil {
+		t.Fatalf("ExtractData: %v", err)
+	}
+	if attestation == nil || !bytes.Equal(clientDataHash, hash[:]) || !bytes.Equal(keyID, d.KeyID()) {
+		t.Fatalf("ExtractData returned object %v, clientDataHash %x, key ID %x; want an object, %x, %x",
+			attestation, clientDataHash, keyID, hash, d.KeyID())
+	}
+	return r
+}
+
+// attest stores the key of d as if its attestation had been verified, and
+// returns the request of the attestation.
+func (s *suite) attest(t *testing.T, p Plugin, d *attesttest.Device) *plugin.AttestationRequest {
+	t.Helper()
+	r := s.attestationRequest(t, p, d, s.newChallenge(t, p, d))
+	r.KeyID = d.KeyID()
+	r.Result = &attest.Result{Environment: d.Environment, Receipt: d.Receipt, PublicKey: d.PublicKey()}
+	if err := p.StoreResult(t.Context(), r); err != nil {
+		t.Fatalf("StoreResult: %v", err)
+	}
+	return r
+}
+
+// assertionRequest returns the request of an assertion of d with challenge,
+// after ParseRequest.
+func (s *suite) assertionRequest(t *testing.T, p Plugin, d *attesttest.Device, challenge string) *plugin.AssertionRequest {
+	t.Helper()
+	body := []byte(`{"plugintest":true}`)
+	hash := sha256.Sum256(plugin.BodyClientData(challenge, body))
+	assertion, err := d.GenerateAssertion(hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &plugin.AssertionRequest{Request: s.config.Encoder.AssertionRequest(d.KeyID(), assertion, challenge, body), Body: body}
+	obj, sent, err := p.ParseRequest(t.Context(), r)
+	if err != nil {
+		t.Fatalf("ParseRequest: %v", err)
+	}
+	if obj == nil || sent != challenge {
+		t.Fatalf("ParseRequest returned object %v, challenge %q; want an object, %q", obj, sent, challenge)
+	}
+	return r
+}
+
+func (s *suite) counter(t *testing.T, p Plugin, r *plugin.AssertionRequest) uint32 {
+	t.Helper()
+	pub, counter, err := p.PublicKeyAndCounter(t.Context(), r)
+	if err != nil {
+		t.Fatalf("PublicKeyAndCounter: %v", err)
+	}
+	if pub == nil {
+		t.Fatal("PublicKeyAndCounter returned a nil key for an attested key")
+	}
+	return counter
+}
+
+func (s *suite) testChallengeAssigned(t *testing.T) {
+	p := s.config.New(t)
+	ctx := t.Context()
+	d := s.device(t)
+	challenge := s.newChallenge(t, p, d)
+
+	tests := map[string]struct {
+		device    *attesttest.Device
+		challenge string
+		want      bool
+	}{
+		"assigned":        {d, challenge, true},
+		"other challenge": {d, challenge + "x", false},
+		"other session":   {s.device(t), challenge, false},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := s.attestationRequest(t, p, tt.device, tt.challenge)
+			assigned, err := p.IsChallengeAssigned(ctx, r)
+			if err != nil {
+				t.Fatalf("IsChallengeAssigned: %v", err)
+			}
+			if assigned != tt.want {
+				t.Errorf("IsChallengeAssigned = %v, want %v", assigned, tt.want)
+			}
+		})
+	}
+
+	r := s.assertionRequest(t, p, d, challenge)
+	if assigned, err := p.AssignedChallenge(ctx, r); err != nil || assigned != challenge {
+		t.Errorf("AssignedChallenge = %q, %v; want %q", assigned, err, challenge)
+	}
+	r = s.assertionRequest(t, p, s.device(t), challenge)
+	if assigned, err := p.AssignedChallenge(ctx, r); err != nil || assigned != "" {
+		t.Errorf("AssignedChallenge of another session = %q, %v; want none", assigned, err)
+	}
+}
+
+func (s *suite) testChallengeExpires(t *testing.T) {
+	p := s.config.New(t)
+	ctx := t.Context()
+	d := s.device(t)
+	challenge := s.newChallenge(t, p, d)
+	time.Sleep(s.config.ChallengeTTL + 50*time.Millisecond)
+
+	r := s.attestationRequest(t, p, d, challenge)
+	if assigned, err := p.IsChallengeAssigned(ctx, r); err != nil || assigned {
+		t.Errorf("IsChallengeAssigned of an expired challenge = %v, %v; want false", assigned, err)
+	}
+	if consumer, ok := p.(plugin.AttestationChallengeConsumer); ok {
+		if consumed, err := consumer.ConsumeAttestationChallenge(ctx, r); err != nil || consumed {
+			t.Errorf("ConsumeAttestationChallenge of an expired challenge = %v, %v; want false", consumed, err)
+		}
+	}
+	ar := s.assertionRequest(t, p, d, challenge)
+	if assigned, err := p.AssignedChallenge(ctx, ar); err != nil || assigned != "" {
+		t.Errorf("AssignedChallenge of an expired challenge = %q, %v; want none", assigned, err)
+	}
+	if consumer, ok := p.(plugin.AssertionChallengeConsumer); ok {
+		if consumed, err := consumer.ConsumeAssertionChallenge(ctx, ar, challenge); err != nil || consumed {
+			t.Errorf("ConsumeAssertionChallenge of an expired challenge = %v, %v; want false", consumed, err)
+		}
+	}
+}
+
+// consumeConcurrently calls consume from concurrent goroutines and returns
+// how many calls reported the challenge as consumed.
+func consumeConcurrently(t *testing.T, consume func() (bool, error)) int {
+	t.Helper()
+	var consumed atomic.Int32
+	var wg sync.WaitGroup
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := consume()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if ok {
+				consumed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	return int(consumed.Load())
+}
+
+func (s *suite) testChallengeSingleUse(t *testing.T) {
+	p := s.config.New(t)
+	ctx := t.Context()
+	attestation, attestationOK := p.(plugin.AttestationChallengeConsumer)
+	assertion, assertionOK := p.(plugin.AssertionChallengeConsumer)
+	if !attestationOK && !assertionOK {
+		t.Skip("the plugin implements neither challenge consumer; challenges can be reused until they expire")
+	}
+
+	if attestationOK {
+		d := s.device(t)
+		r := s.attestationRequest(t, p, d, s.newChallenge(t, p, d))
+		n := consumeConcurrently(t, func() (bool, error) { return attestation.ConsumeAttestationChallenge(ctx, r) })
+		if n != 1 {
+			t.Errorf("ConsumeAttestationChallenge succeeded %d times, want 1", n)
+		}
+		// The consumed challenge stays assigned, so that a replay is reported as used.
+		if assigned, err := p.IsChallengeAssigned(ctx, r); err != nil || !assigned {
+			t.Errorf("IsChallengeAssigned of a consumed challenge = %v, %v; want true", assigned, err)
+		}
+	}
+	if assertionOK {
+		d := s.device(t)
+		challenge := s.newChallenge(t, p, d)
+		r := s.assertionRequest(t, p, d, challenge)
+		if used, err := assertion.AssertionChallengeUsed(ctx, r, challenge); err != nil || used {
+			t.Errorf("AssertionChallengeUsed of a fresh challenge = %v, %v; want false", used, err)
+		}
+		n := consumeConcurrently(t, func() (bool, error) { return assertion.ConsumeAssertionChallenge(ctx, r, challenge) })
+		if n != 1 {
+			t.Errorf("ConsumeAssertionChallenge succeeded %d times, want 1", n)
+		}
+		if assigned, err := p.AssignedChallenge(ctx, r); err != nil || assigned != challenge {
+			t.Errorf("AssignedChallenge after consumption = %q, %v; want %q", assigned, err, challenge)
+		}
+		if used, err := assertion.AssertionChallengeUsed(ctx, r, challenge); err != nil || !used {
+			t.Errorf("AssertionChallengeUsed of a consumed challenge = %v, %v; want true", used, err)
+		}
+	}
+}
+
+func (s *suite) testChallengeBinding(t *testing.T) {
+	p := s.config.New(t)
+	binder, ok := p.(plugin.ChallengeBinder)
+	if !ok {
+		t.Skip("the plugin does not implement plugin.ChallengeBinder; stateless challenges are unbound and issued for attestation")
+	}
+	ctx := t.Context()
+	binding := func(r *http.Request) (challenge.Purpose, string) {
+		t.Helper()
+		purpose, binding, err := binder.ChallengeBinding(ctx, r)
+		if err != nil {
+			t.Fatalf("ChallengeBinding: %v", err)
+		}
+		return purpose, binding
+	}
+	d, other := s.device(t), s.device(t)
+
+	purpose, issued := binding(s.config.Encoder.ChallengeRequest(d.KeyID()))
+	if purpose != challenge.Attest {
+		t.Errorf("purpose before attestation = %q, want %q", purpose, challenge.Attest)
+	}
+	if _, b := binding(s.config.Encoder.ChallengeRequest(other.KeyID())); b == issued {
+		t.Error("the challenges of two sessions have the same binding")
+	}
+	r := s.attest(t, p, d)
+	if _, b := binding(r.Request.(*http.Request)); b != issued {
+		t.Errorf("attestation binding = %q, want %q", b, issued)
+	}
+
+	purpose, issued = binding(s.config.Encoder.ChallengeRequest(d.KeyID()))
+	if purpose != challenge.Assert {
+		t.Errorf("purpose after attestation = %q, want %q", purpose, challenge.Assert)
+	}
+	body := []byte(`{"plugintest":true}`)
+	if _, b := binding(s.config.Encoder.AssertionRequest(d.KeyID(), nil, "c", body)); b != issued {
+		t.Errorf("assertion binding = %q, want %q", b, issued)
+	}
+}
+
+func (s *suite) testUnknownKey(t *testing.T) {
+	p := s.config.New(t)
+	d := s.device(t)
+	r := s.assertionRequest(t, p, d, s.newChallenge(t, p, d))
+	pub, _, err := p.PublicKeyAndCounter(t.Context(), r)
+	if pub != nil || err != nil {
+		t.Errorf("PublicKeyAndCounter of an unknown key = %v, %v; want a nil key and no error", pub, err)
+	}
+}
+
+func (s *suite) testStoreResultIdempotent(t *testing.T) {
+	p := s.config.New(t)
+	ctx := t.Context()
+	d := s.device(t)
+	attestation := s.attest(t, p, d)
+	r := s.assertionRequest(t, p, d, s.newChallenge(t, p, d))
+	if err := p.UpdateCounter(ctx, r, 5); err != nil {
+		t.Fatalf("UpdateCounter: %v", err)
+	}
+
+	if err := p.StoreResult(ctx, attestation); err != nil {
+		t.Fatalf("second StoreResult: %v", err)
+	}
+	pub, counter, err := p.PublicKeyAndCounter(ctx, r)
+	if err != nil {
+		t.Fatalf("PublicKeyAndCounter: %v", err)
+	}
+	if pub == nil || !pub.Equal(d.PublicKey()) {
+		t.Errorf("PublicKeyAndCounter returned key %v, want the attested key", pub)
+	}
+	if counter != 5 {
+		t.Errorf("second StoreResult reset the counter to %d, want 5", counter)
+	}
+
+	other := *attestation
+	other.Result = &attest.Result{Environment: d.Environment, PublicKey: s.device(t).PublicKey()}
+	if err := p.StoreResult(ctx, &other); err == nil {
+		t.Error("StoreResult of another public key for a stored key ID returned no error")
+	}
+	if pub, counter, err := p.PublicKeyAndCounter(ctx, r); err != nil || !pub.Equal(d.PublicKey()) || counter != 5 {
+		t.Errorf("PublicKeyAndCounter after another public key = %v, %d, %v; want the attested key and 5", pub, counter, err)
+	}
+}
+
+func (s *suite) testNewChallengeConcurrent(t *testing.T) {
+	p := s.config.New(t)
+	ctx := t.Context()
+	d := s.device(t)
+	// Only the challenge sent with it matters to IsChallengeAssigned, so one
+	// attestation object serves all checks and they finish within the TTL.
+	obj, err := d.AttestKey(make([]byte, sha256.Size))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var challenges [concurrency]string
+	for i := range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			challenge, err := p.NewChallenge(ctx, &plugin.AttestationRequest{Request: s.config.Encoder.ChallengeRequest(d.KeyID())})
+			if err != nil {
+				t.Errorf("NewChallenge: %v", err)
+			}
+			challenges[i] = challenge
+		}()
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	assigned := 0
+	for _, challenge := range challenges {
+		r := &plugin.AttestationRequest{Request: s.config.Encoder.AttestationRequest(d.KeyID(), obj, challenge)}
+		if _, _, _, err := p.ExtractData(ctx, r); err != nil {
+			t.Fatalf("ExtractData: %v", err)
+		}
+		ok, err := p.IsChallengeAssigned(ctx, r)
+		if err != nil {
+			t.Fatalf("IsChallengeAssigned: %v", err)
+		}
+		if ok {
+			assigned++
+		}
+	}
+	if assigned != 1 {
+		t.Errorf("%d of %d concurrently issued challenges are assigned, want 1", assigned, concurrency)
+	}
+}
+
+func (s *suite) testStoreResultConcurrent(t *testing.T) {
+	p := s.config.New(t)
+	ctx := t.Context()
+	d := s.device(t)
+	attestation := s.attestationRequest(t, p, d, s.newChallenge(t, p, d))
+	attestation.KeyID = d.KeyID()
+	keys := []*ecdsa.PublicKey{d.PublicKey(), s.device(t).PublicKey()}
+
+	var wg sync.WaitGroup
+	var failed [2]atomic.Int32
+	for i := range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := *attestation
+			r.Result = &attest.Result{Environment: d.Environment, Receipt: d.Receipt, PublicKey: keys[i%2]}
+			if err := p.StoreResult(ctx, &r); err != nil {
+				failed[i%2].Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	r := s.assertionRequest(t, p, d, s.newChallenge(t, p, d))
+	pub, counter, err := p.PublicKeyAndCounter(ctx, r)
+	if err != nil || pub == nil {
+		t.Fatalf("PublicKeyAndCounter = %v, %v; want a stored key", pub, err)
+	}
+	winner := 0
+	if pub.Equal(keys[1]) {
+		winner = 1
+	}
+	if !pub.Equal(keys[winner]) || counter != 0 {
+		t.Fatalf("PublicKeyAndCounter = %v, %d; want one of the stored keys and 0", pub, counter)
+	}
+	if n := failed[winner].Load(); n != 0 {
+		t.Errorf("StoreResult of the stored public key failed %d times, want 0", n)
+	}
+	if n := failed[1-winner].Load(); n != concurrency/2 {
+		t.Errorf("StoreResult of the other public key failed %d times, want %d", n, concurrency/2)
+	}
+}
+
+func (s *suite) testCounterMonotonic(t *testing.T) {
+	p := s.config.New(t)
+	ctx := t.Context()
+	d := s.device(t)
+	s.attest(t, p, d)
+	r := s.assertionRequest(t, p, d, s.newChallenge(t, p, d))
+
+	var wg sync.WaitGroup
+	for i := range uint32(concurrency) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := p.UpdateCounter(ctx, r, i+1); err != nil {
+				t.Errorf("UpdateCounter(%d): %v", i+1, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if counter := s.counter(t, p, r); counter != concurrency {
+		t.Errorf("after concurrent UpdateCounter calls up to %d, the counter is %d", concurrency, counter)
+	}
+
+	if err := p.UpdateCounter(ctx, r, 1); err != nil {
+		t.Fatalf("UpdateCounter: %v", err)
+	}
+	if counter := s.counter(t, p, r); counter != concurrency {
+		t.Errorf("UpdateCounter moved the counter back from %d to %d", concurrency, counter)
+	}
+}
+
+func (s *suite) testCompareAndSwapCounter(t *testing.T) {
+	p := s.config.New(t)
+	swapper, ok := p.(plugin.CounterSwapper)
+	if !ok {
+		t.Skip("the plugin does not implement plugin.CounterSwapper")
+	}
+	ctx := t.Context()
+	d := s.device(t)
+	s.attest(t, p, d)
+	r := s.assertionRequest(t, p, d, s.newChallenge(t, p, d))
+
+	var swapped atomic.Int32
+	var wg sync.WaitGroup
+	for i := range uint32(concurrency) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := swapper.CompareAndSwapCounter(ctx, r, 0, i+1)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if ok {
+				swapped.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := swapped.Load(); n != 1 {
+		t.Errorf("CompareAndSwapCounter from 0 succeeded %d times, want 1", n)
+	}
+	counter := s.counter(t, p, r)
+	if counter == 0 {
+		t.Error("CompareAndSwapCounter did not store the counter")
+	}
+	if ok, err := swapper.CompareAndSwapCounter(ctx, r, counter+1, counter+2); err != nil || ok {
+		t.Errorf("CompareAndSwapCounter from a stale counter = %v, %v; want false", ok, err)
+	}
+}
+
+func (s *suite) testMalformedPayload(t *testing.T) {
+	p := s.config.New(t)
+	ctx := t.Context()
+	d := s.device(t)
+	challenge := s.newChallenge(t, p, d)
+	garbage := []byte("not a CBOR payload")
+
+	attestation := &plugin.AttestationRequest{Request: s.config.Encoder.AttestationRequest(d.KeyID(), garbage, challenge)}
+	if obj, _, _, err := p.ExtractData(ctx, attestation); err == nil {
+		t.Errorf("ExtractData of a malformed attestation returned %v and no error", obj)
+	}
+	assertion := &plugin.AssertionRequest{Request: s.config.Encoder.AssertionRequest(d.KeyID(), garbage, challenge, nil)}
+	if obj, _, err := p.ParseRequest(ctx, assertion); err == nil {
+		t.Errorf("ParseRequest of a malformed assertion returned %v and no error", obj)
+	}
+}
+
+func (s *suite) testStorageErrors(t *testing.T) {
+	if s.config.Break == nil {
+		t.Skip("Config.Break is not set")
+	}
+	p := s.config.New(t)
+	ctx := t.Context()
+	d := s.device(t)
+	attestation := s.attest(t, p, d)
+	challenge := s.newChallenge(t, p, d)
+	pending := s.attestationRequest(t, p, d, challenge)
+	r := s.assertionRequest(t, p, d, challenge)
+	s.config.Break(t, p)
+
+	checks := map[string]func() error{
+		"NewChallenge": func() error {
+			_, err := p.NewChallenge(ctx, &plugin.AttestationRequest{Request: s.config.Encoder.ChallengeRequest(d.KeyID())})
+			return err
+		},
+		"IsChallengeAssigned": func() error {
+			_, err := p.IsChallengeAssigned(ctx, pending)
+			return err
+		},
+		"StoreResult": func() error {
+			return p.StoreResult(ctx, attestation)
+		},
+		"PublicKeyAndCounter": func() error {
+			_, _, err := p.PublicKeyAndCounter(ctx, r)
+			return err
+		},
+		"AssignedChallenge": func() error {
+			_, err := p.AssignedChallenge(ctx, r)
+			return err
+		},
+		"UpdateCounter": func() error {
+			return p.UpdateCounter(ctx, r, 1)
+		},
+	}
+	if consumer, ok := p.(plugin.AttestationChallengeConsumer); ok {
+		checks["ConsumeAttestationChallenge"] = func() error {
+			_, err := consumer.ConsumeAttestationChallenge(ctx, pending)
+			return err
+		}
+	}
+	if consumer, ok := p.(plugin.AssertionChallengeConsumer); ok {
+		checks["ConsumeAssertionChallenge"] = func() error {
+			_, err := consumer.ConsumeAssertionChallenge(ctx, r, challenge)
+			return err
+		}
+		checks["AssertionChallengeUsed"] = func() error {
+			_, err := consumer.AssertionChallengeUsed(ctx, r, challenge)
+			return err
+		}
+	}
+	if swapper, ok := p.(plugin.CounterSwapper); ok {
+		checks["CompareAndSwapCounter"] = func() error {
+			_, err := swapper.CompareAndSwapCounter(ctx, r, 0, 1)
+			return err
+		}
+	}
+	for name, call := range checks {
+		if err := call(); err == nil {
+			t.Errorf("%s returned no error with broken storage", name)
+		}
+	}
+}
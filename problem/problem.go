@@ -0,0 +1,154 @@
+// Package problem renders error responses for the handler and the middleware.
+//
+// Text renders plain-text http.StatusText bodies, the historical behavior.
+// JSON renders RFC 9457 application/problem+json documents that carry a stable
+// type URI, the reason code of the adapter.VerificationError and the request ID,
+// so that clients can branch on the failure without scraping status text.
+package problem
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/takimoto3/app-attest-middleware/adapter"
+	"github.com/takimoto3/app-attest-middleware/requestid"
+)
+
+// ContentType is the media type of problem details documents.
+const ContentType = "application/problem+json"
+
+// DefaultTypeBase is the prefix of the type URI of a problem. The reason code is appended to it.
+const DefaultTypeBase = "urn:app-attest:problem:"
+
+// Renderer writes an error response.
+type Renderer interface {
+	// Render writes a response with the given status for err.
+	Render(w http.ResponseWriter, r *http.Request, status int, err error)
+}
+
+// Text renders http.StatusText(status) as a plain-text body, or the challenge
+// attached with WithChallenge, as the NewChallenge handler writes it.
+type Text struct{}
+
+// Render implements Renderer.
+func (Text) Render(w http.ResponseWriter, r *http.Request, status int, err error) {
+	var ce *challengeError
+	if errors.As(err, &ce) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(status)
+		w.Write([]byte(ce.challenge))
+		return
+	}
+	http.Error(w, http.StatusText(status), status)
+}
+
+// Details is an RFC 9457 problem details document.
+type Details struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Reason    string `json:"reason,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	// Endpoint is the endpoint the client should call before retrying, if any.
+	Endpoint string `json:"endpoint,omitempty"`
+	// Challenge is a fresh challenge the client should retry with, if any.
+	Challenge string `json:"challenge,omitempty"`
+}
+
+// endpointError attaches the endpoint the client should call next to an error.
+type endpointError struct {
+	err      error
+	endpoint string
+}
+
+func (e *endpointError) Error() string { return e.err.Error() }
+func (e *endpointError) Unwrap() error { return e.err }
+
+// WithEndpoint returns err annotated with the endpoint the client should call
+// before retrying, e.g. the attestation or challenge URL. JSON renders it as
+// the "endpoint" member. An empty endpoint returns err unchanged.
+func WithEndpoint(err error, endpoint string) error {
+	if endpoint == "" || err == nil {
+		return err
+	}
+	return &endpointError{err: err, endpoint: endpoint}
+}
+
+// challengeError attaches a fresh challenge to an error.
+type challengeError struct {
+	err       error
+	challenge string
+}
+
+func (e *challengeError) Error() string { return e.err.Error() }
+func (e *challengeError) Unwrap() error { return e.err }
+
+// WithChallenge returns err annotated with a fresh challenge the client should
+// retry with. JSON renders it as the "challenge" member. An empty challenge
+// returns err unchanged.
+func WithChallenge(err error, challenge string) error {
+	if challenge == "" || err == nil {
+		return err
+	}
+	return &challengeError{err: err, challenge: challenge}
+}
+
+// ChallengeOf returns the challenge attached to err with WithChallenge, or ""
+// if there is none.
+func ChallengeOf(err error) string {
+	var ce *challengeError
+	if errors.As(err, &ce) {
+		return ce.challenge
+	}
+	return ""
+}
+
+// JSON renders application/problem+json documents.
+//
+// The type is TypeBase followed by the reason code of err, or "about:blank"
+// when err carries no reason. The error message is never included, as it may
+// reveal server internals.
+type JSON struct {
+	// TypeBase is the prefix of type URIs. Defaults to DefaultTypeBase.
+	TypeBase string
+}
+
+// Render implements Renderer.
+func (j JSON) Render(w http.ResponseWriter, r *http.Request, status int, err error) {
+	d := j.Details(r, status, err)
+	w.Header().Set("Content-Type", ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(d)
+}
+
+// Details returns the problem details document rendered for err.
+func (j JSON) Details(r *http.Request, status int, err error) Details {
+	d := Details{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+	}
+	if reason := adapter.ReasonOf(err); reason != "" {
+		base := j.TypeBase
+		if base == "" {
+			base = DefaultTypeBase
+		}
+		d.Type = base + string(reason)
+		d.Reason = string(reason)
+	}
+	var ee *endpointError
+	if errors.As(err, &ee) {
+		d.Endpoint = ee.endpoint
+	}
+	var ce *challengeError
+	if errors.As(err, &ce) {
+		d.Challenge = ce.challenge
+	}
+	if r != nil {
+		d.RequestID = requestid.FromContext(r.Context())
+	}
+	return d
+}
@@ -0,0 +1,136 @@
+package problem
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/takimoto3/app-attest-middleware/adapter"
+	"github.com/takimoto3/app-attest-middleware/requestid"
+)
+
+type fixedGenerator struct{}
+
+func (fixedGenerator) NextID() (string, error) { return "req-1", nil }
+
+func TestJSON_Render(t *testing.T) {
+	requestid.UseGenerator(fixedGenerator{})
+
+	tests := map[string]struct {
+		renderer JSON
+		status   int
+		err      error
+		want     Details
+	}{
+		"verification error": {
+			status: http.StatusBadRequest,
+			err:    adapter.NewVerificationError(adapter.ReasonBadSignature, errors.New("secret detail")),
+			want: Details{
+				Type:      "urn:app-attest:problem:bad_signature",
+				Title:     "Bad Request",
+				Status:    http.StatusBadRequest,
+				Reason:    "bad_signature",
+				RequestID: "req-1",
+			},
+		},
+		"custom type base": {
+			renderer: JSON{TypeBase: "https://api.example.com/problems/"},
+			status:   http.StatusInternalServerError,
+			err:      adapter.NewVerificationError(adapter.ReasonStoreUnavailable, nil),
+			want: Details{
+				Type:      "https://api.example.com/problems/store_unavailable",
+				Title:     "Internal Server Error",
+				Status:    http.StatusInternalServerError,
+				Reason:    "store_unavailable",
+				RequestID: "req-1",
+			},
+		},
+		"fresh challenge": {
+			status: http.StatusConflict,
+			err:    WithChallenge(adapter.NewVerificationError(adapter.ReasonChallengeRequired, nil), "c1"),
+			want: Details{
+				Type:      "urn:app-attest:problem:challenge_required",
+				Title:     "Conflict",
+				Status:    http.StatusConflict,
+				Reason:    "challenge_required",
+				RequestID: "req-1",
+				Challenge: "c1",
+			},
+		},
+		"error without reason": {
+			status: http.StatusInternalServerError,
+			err:    errors.New("boom"),
+			want: Details{
+				Type:      "about:blank",
+				Title:     "Internal Server Error",
+				Status:    http.StatusInternalServerError,
+				RequestID: "req-1",
+			},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			r, _, err := requestid.EnsureRequest(httptest.NewRequest(http.MethodGet, "/hello", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			tc.renderer.Render(w, r, tc.status, tc.err)
+
+			if w.Code != tc.status {
+				t.Errorf("got status %d, want %d", w.Code, tc.status)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != ContentType {
+				t.Errorf("got Content-Type %q, want %q", ct, ContentType)
+			}
+			var got Details
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("invalid JSON body %q: %v", w.Body.String(), err)
+			}
+			if got != tc.want {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestText_Render(t *testing.T) {
+	tests := map[string]struct {
+		status   int
+		err      error
+		wantBody string
+	}{
+		"status text": {
+			status:   http.StatusBadRequest,
+			err:      adapter.ErrBadRequest,
+			wantBody: "Bad Request\n",
+		},
+		"fresh challenge": {
+			status:   http.StatusConflict,
+			err:      WithChallenge(adapter.ErrNewChallenge, "c1"),
+			wantBody: "c1",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			Text{}.Render(w, httptest.NewRequest(http.MethodGet, "/", nil), tc.status, tc.err)
+			if w.Code != tc.status || w.Body.String() != tc.wantBody {
+				t.Errorf("got %d %q, want %d %q", w.Code, w.Body.String(), tc.status, tc.wantBody)
+			}
+		})
+	}
+}
+
+func TestChallengeOf(t *testing.T) {
+	err := fmt.Errorf("wrapped: %w", WithChallenge(adapter.ErrBadRequest, "c1"))
+	if got := ChallengeOf(err); got != "c1" {
+		t.Errorf("ChallengeOf() = %q, want %q", got, "c1")
+	}
+	if got := ChallengeOf(adapter.ErrBadRequest); got != "" {
+		t.Errorf("ChallengeOf() without a challenge = %q, want empty", got)
+	}
+}
@@ -0,0 +1,258 @@
+// Package quarantine captures the payloads of failed verifications so that
+// they can be replayed after the fact, e.g. when an Apple-side or app-side
+// change starts breaking verification.
+//
+// The handler and the middleware hand every attestation or assertion rejected
+// as a bad request to the Sink passed to adapter.WithQuarantine, when one is
+// configured. Dir writes each Record, the raw request with its metadata and
+// without secret headers, to a file in a bounded directory. The Replayer of
+// the replay package re-runs the records through the adapters with the current
+// verifier configuration; the app-attest-replay command does so for a
+// directory.
+package quarantine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/takimoto3/app-attest-middleware/requestid"
+)
+
+// Kind identifies the payload of a record.
+type Kind string
+
+const (
+	KindAttestation Kind = "attestation"
+	KindAssertion   Kind = "assertion"
+)
+
+// DefaultRedactedHeaders are the headers Dir never writes.
+var DefaultRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// Record is a quarantined request.
+type Record struct {
+	Kind      Kind      `json:"kind"`
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	// Reason is the reason code of the rejection, Error its message.
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Method string `json:"method"`
+	Host   string `json:"host,omitempty"`
+	// URL is the request URI, the path and query of the request.
+	URL        string      `json:"url"`
+	RemoteAddr string      `json:"remote_addr,omitempty"`
+	Header     http.Header `json:"header,omitempty"`
+	// Body is the request body, as read by the plugin for attestations. It is
+	// encoded as base64 in JSON.
+	Body []byte `json:"body,omitempty"`
+	// Truncated reports that Body was cut to Config.MaxBodySize.
+	Truncated bool `json:"truncated,omitempty"`
+
+	// Name is the file name of the record, set by ReadDir and ReadFile.
+	Name string `json:"-"`
+}
+
+// Request returns a request with the method, host, URL, headers and body of
+// the record.
+func (rec *Record) Request(ctx context.Context) (*http.Request, error) {
+	r, err := http.NewRequestWithContext(ctx, rec.Method, rec.URL, bytes.NewReader(rec.Body))
+	if err != nil {
+		return nil, err
+	}
+	r.Host = rec.Host
+	r.RemoteAddr = rec.RemoteAddr
+	r.Header = rec.Header.Clone()
+	if r.Header == nil {
+		r.Header = make(http.Header)
+	}
+	return r, nil
+}
+
+// Sink receives quarantined records. Implementations must be safe for concurrent use.
+type Sink interface {
+	Capture(ctx context.Context, rec *Record) error
+}
+
+// Capture records the request r of kind, rejected with err for reason, the
+// adapter.Reason of err, with sink. body is the payload read from r, whose
+// body has already been consumed. A nil sink discards the record.
+func Capture(ctx context.Context, sink Sink, r *http.Request, kind Kind, body []byte, reason string, err error) error {
+	if sink == nil {
+		return nil
+	}
+	rec := &Record{
+		Kind:       kind,
+		Time:       time.Now(),
+		RequestID:  requestid.FromContext(ctx),
+		Reason:     reason,
+		Method:     r.Method,
+		Host:       r.Host,
+		URL:        r.URL.RequestURI(),
+		RemoteAddr: r.RemoteAddr,
+		Header:     r.Header.Clone(),
+		Body:       body,
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	return sink.Capture(ctx, rec)
+}
+
+// Config holds the settings of a Dir.
+type Config struct {
+	// MaxRecords bounds the number of records in the directory; the oldest are
+	// removed first. Defaults to 1000.
+	MaxRecords int
+	// MaxBodySize truncates longer bodies, in bytes. Defaults to 64 KiB.
+	MaxBodySize int
+	// RedactHeaders lists headers to drop in addition to DefaultRedactedHeaders,
+	// e.g. API keys. Names are case-insensitive.
+	RedactHeaders []string
+}
+
+// Dir writes each record as an indented JSON file to a directory, named after
+// its time so that the names sort in capture order.
+type Dir struct {
+	path   string
+	config Config
+	redact []string
+
+	mu    sync.Mutex
+	names []string
+	seq   uint64
+}
+
+var _ Sink = (*Dir)(nil)
+
+// Open creates the directory at path if needed and returns a Dir writing to
+// it. Records already in the directory count towards MaxRecords.
+// Zero values in config are replaced by their defaults.
+func Open(path string, config Config) (*Dir, error) {
+	if config.MaxRecords <= 0 {
+		config.MaxRecords = 1000
+	}
+	if config.MaxBodySize <= 0 {
+		config.MaxBodySize = 64 << 10
+	}
+	if err := os.MkdirAll(path, 0o700); err != nil {
+		return nil, err
+	}
+	names, err := recordNames(path)
+	if err != nil {
+		return nil, err
+	}
+	d := &Dir{path: path, config: config, names: names}
+	for _, name := range append(slices.Clone(DefaultRedactedHeaders), config.RedactHeaders...) {
+		d.redact = append(d.redact, http.CanonicalHeaderKey(name))
+	}
+	return d, nil
+}
+
+// Capture implements Sink. It writes a copy of rec without the redacted
+// headers and removes the oldest records beyond MaxRecords.
+func (d *Dir) Capture(ctx context.Context, rec *Record) error {
+	c := *rec
+	c.Header = rec.Header.Clone()
+	for _, name := range d.redact {
+		c.Header.Del(name)
+	}
+	if len(c.Body) > d.config.MaxBodySize {
+		c.Body = c.Body[:d.config.MaxBodySize]
+		c.Truncated = true
+	}
+	data, err := json.MarshalIndent(&c, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.seq++
+	name := fmt.Sprintf("%s-%06d-%s.json", c.Time.UTC().Format("20060102T150405.000000000Z"), d.seq%1e6, c.Kind)
+	if err := writeFile(filepath.Join(d.path, name), data); err != nil {
+		return err
+	}
+	d.names = append(d.names, name)
+	for len(d.names) > d.config.MaxRecords {
+		if err := os.Remove(filepath.Join(d.path, d.names[0])); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		d.names = d.names[1:]
+	}
+	return nil
+}
+
+// writeFile writes data to a temporary file renamed to path, so that readers
+// never see a partial record.
+func writeFile(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// recordNames returns the sorted names of the records in the directory at path.
+func recordNames(path string) ([]string, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && !strings.HasPrefix(e.Name(), ".") && strings.HasSuffix(e.Name(), ".json") {
+			names = append(names, e.Name())
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// ReadDir reads the records in the directory at path, in capture order.
+func ReadDir(path string) ([]*Record, error) {
+	names, err := recordNames(path)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]*Record, 0, len(names))
+	for _, name := range names {
+		rec, err := ReadFile(filepath.Join(path, name))
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// ReadFile reads the record in the file at path.
+func ReadFile(path string) (*Record, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rec := &Record{}
+	if err := json.Unmarshal(data, rec); err != nil {
+		return nil, fmt.Errorf("quarantine: %s: %w", path, err)
+	}
+	rec.Name = filepath.Base(path)
+	return rec, nil
+}
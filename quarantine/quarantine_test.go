@@ -0,0 +1,128 @@
+package quarantine
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/takimoto3/app-attest-middleware/requestid"
+)
+
+func TestDir_Capture(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quarantine")
+	requestid.UseUUID()
+	d, err := Open(path, Config{MaxRecords: 2, MaxBodySize: 4, RedactHeaders: []string{"x-api-key"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{"one", "two", "three!"} {
+		r := httptest.NewRequest(http.MethodPost, "/api?q="+body, nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		r.Header.Set("Cookie", "session=secret")
+		r.Header.Set("X-Api-Key", "secret")
+		r.Header.Set("X-App-Attest-Key-Id", "a2V5")
+		r.Header.Set("X-Request-ID", "req-"+body)
+		r, _, err := requestid.EnsureRequest(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = Capture(r.Context(), d, r, KindAssertion, []byte(body), "bad_signature", errors.New("invalid signature"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err := ReadDir(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want the 2 newest", len(records))
+	}
+	for i, want := range []struct {
+		requestID, url, body string
+		truncated            bool
+	}{
+		{"req-two", "/api?q=two", "two", false},
+		{"req-three!", "/api?q=three!", "thre", true},
+	} {
+		rec := records[i]
+		if rec.RequestID != want.requestID || rec.URL != want.url || string(rec.Body) != want.body || rec.Truncated != want.truncated {
+			t.Errorf("record %d: got %s %s %q truncated=%v, want %s %s %q truncated=%v",
+				i, rec.RequestID, rec.URL, rec.Body, rec.Truncated, want.requestID, want.url, want.body, want.truncated)
+		}
+		if rec.Kind != KindAssertion || rec.Reason != "bad_signature" || rec.Method != http.MethodPost {
+			t.Errorf("record %d: got kind %s, reason %s, method %s", i, rec.Kind, rec.Reason, rec.Method)
+		}
+		for _, name := range []string{"Authorization", "Cookie", "X-Api-Key"} {
+			if v := rec.Header.Get(name); v != "" {
+				t.Errorf("record %d: header %s not redacted: %q", i, name, v)
+			}
+		}
+		if v := rec.Header.Get("X-App-Attest-Key-Id"); v != "a2V5" {
+			t.Errorf("record %d: got X-App-Attest-Key-Id %q", i, v)
+		}
+	}
+
+	info, err := os.Stat(filepath.Join(path, records[0].Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("got file mode %v, want 0600", perm)
+	}
+	data, err := os.ReadFile(filepath.Join(path, records[0].Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "secret") {
+		t.Errorf("record contains a redacted value: %s", data)
+	}
+
+	// Reopening counts the existing records.
+	d, err = Open(path, Config{MaxRecords: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/api", nil)
+	if err := Capture(context.Background(), d, r, KindAssertion, nil, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if records, err = ReadDir(path); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].RequestID != "req-three!" {
+		t.Errorf("after reopening: got %d records starting with %q", len(records), records[0].RequestID)
+	}
+}
+
+func TestRecord_Request(t *testing.T) {
+	rec := &Record{
+		Method: http.MethodPut,
+		Host:   "api.example.com",
+		URL:    "/items/1?b=2&a=1",
+		Header: http.Header{"Content-Type": {"application/json"}},
+		Body:   []byte(`{"a":1}`),
+	}
+	r, err := rec.Request(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Method != http.MethodPut || r.Host != "api.example.com" || r.URL.Path != "/items/1" || r.URL.RawQuery != "b=2&a=1" {
+		t.Errorf("got %s %s %s?%s", r.Method, r.Host, r.URL.Path, r.URL.RawQuery)
+	}
+	if r.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("got headers %v", r.Header)
+	}
+	body := make([]byte, 16)
+	n, _ := r.Body.Read(body)
+	if string(body[:n]) != `{"a":1}` {
+		t.Errorf("got body %q", body[:n])
+	}
+}
@@ -0,0 +1,169 @@
+// Package replay re-runs quarantined records through the adapters with the
+// current verifier configuration. The app-attest-replay command replays the
+// records of a quarantine directory with it.
+package replay
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	attest "github.com/takimoto3/app-attest"
+	"github.com/takimoto3/app-attest-middleware/adapter"
+	"github.com/takimoto3/app-attest-middleware/canonical"
+	"github.com/takimoto3/app-attest-middleware/plugin"
+	"github.com/takimoto3/app-attest-middleware/quarantine"
+	"github.com/takimoto3/app-attest-middleware/wire"
+)
+
+// ErrNotReplayable is returned by Replayer.Replay for records it cannot
+// replay: truncated bodies, unknown kinds, and attestations without an
+// AttestationService.
+var ErrNotReplayable = errors.New("replay: record not replayable")
+
+// Replayer re-runs quarantined records through the attestation and assertion
+// adapters with its configuration, in place of the plugin of the server.
+//
+// Only the stateless part of the verification is replayed: the payload
+// format, the certificate chain, the nonce, the App ID, the key and the
+// signature. The challenge sent with the record is taken as the assigned one
+// and the stored counter as zero, so records rejected for an expired, used or
+// mismatched challenge, or for a stale counter, pass when replayed.
+// A Replayer is safe for concurrent use.
+type Replayer struct {
+	// AppID is the App ID assertions are verified against.
+	AppID string
+	// AttestationService verifies attestations, e.g.
+	// attest.NewAttestationService(roots, appID). When nil, attestations are
+	// not replayable.
+	AttestationService adapter.AttestationService
+	// PublicKey returns the attested public key with the given ID, or nil if
+	// it is unknown. Keys attested by the attestations replayed successfully
+	// are looked up first. May be nil.
+	PublicKey func(ctx context.Context, keyID []byte) (*ecdsa.PublicKey, error)
+	// Decoder decodes the payloads. Defaults to wire.Decoder.
+	Decoder wire.PayloadDecoder
+	// CanonicalRequest must match middleware.Config.CanonicalRequest.
+	CanonicalRequest *canonical.Config
+
+	mu   sync.Mutex
+	keys map[string]*ecdsa.PublicKey
+}
+
+// Replay verifies the payload of rec again and returns nil if it passes, or
+// the error of the adapter, whose reason adapter.ReasonOf returns.
+func (p *Replayer) Replay(ctx context.Context, rec *quarantine.Record) error {
+	if rec.Truncated {
+		return fmt.Errorf("%w: body truncated", ErrNotReplayable)
+	}
+	r, err := rec.Request(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNotReplayable, err)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	rp := &replayPlugin{p}
+	switch rec.Kind {
+	case quarantine.KindAttestation:
+		if p.AttestationService == nil {
+			return fmt.Errorf("%w: no attestation service", ErrNotReplayable)
+		}
+		return adapter.NewAttestationAdapter(logger, p.AttestationService, rp).Verify(ctx, &plugin.AttestationRequest{Request: r})
+	case quarantine.KindAssertion:
+		req := &plugin.AssertionRequest{Request: r, Body: rec.Body}
+		if p.CanonicalRequest != nil {
+			req.ClientData = func(challenge string) ([]byte, error) {
+				return p.CanonicalRequest.Build(r, rec.Body, challenge)
+			}
+		}
+		return adapter.NewAssertionAdapter(logger, p.AppID, rp).Verify(ctx, req)
+	default:
+		return fmt.Errorf("%w: unknown kind %q", ErrNotReplayable, rec.Kind)
+	}
+}
+
+func (p *Replayer) decoder() wire.PayloadDecoder {
+	if p.Decoder == nil {
+		return wire.Decoder{}
+	}
+	return p.Decoder
+}
+
+func (p *Replayer) publicKey(ctx context.Context, keyID []byte) (*ecdsa.PublicKey, error) {
+	p.mu.Lock()
+	key, ok := p.keys[string(keyID)]
+	p.mu.Unlock()
+	if ok || p.PublicKey == nil {
+		return key, nil
+	}
+	return p.PublicKey(ctx, keyID)
+}
+
+// replayPlugin implements the plugins on top of the payload of a record,
+// without challenge or counter state.
+type replayPlugin struct {
+	*Replayer
+}
+
+var (
+	_ plugin.AttestationPlugin = (*replayPlugin)(nil)
+	_ plugin.AssertionPlugin   = (*replayPlugin)(nil)
+)
+
+func (p *replayPlugin) ExtractData(ctx context.Context, r *plugin.AttestationRequest) (*attest.AttestationObject, []byte, []byte, error) {
+	payload, err := p.decoder().DecodeAttestation(r.Request.(*http.Request))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	r.Object = payload
+	hash := sha256.Sum256([]byte(payload.Challenge))
+	return payload.Object, hash[:], payload.KeyID, nil
+}
+
+func (p *replayPlugin) IsChallengeAssigned(ctx context.Context, r *plugin.AttestationRequest) (bool, error) {
+	return true, nil
+}
+
+func (p *replayPlugin) NewChallenge(ctx context.Context, r *plugin.AttestationRequest) (string, error) {
+	return "", errors.New("replay: challenges are not issued")
+}
+
+// StoreResult remembers the attested key for the assertions replayed next.
+func (p *replayPlugin) StoreResult(ctx context.Context, r *plugin.AttestationRequest) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.keys == nil {
+		p.keys = make(map[string]*ecdsa.PublicKey)
+	}
+	p.keys[string(r.KeyID)] = r.Result.PublicKey
+	return nil
+}
+
+func (p *replayPlugin) ParseRequest(ctx context.Context, r *plugin.AssertionRequest) (*attest.AssertionObject, string, error) {
+	payload, err := p.decoder().DecodeAssertion(r.Request.(*http.Request), r.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	r.Object = payload
+	wire.UseBodyClientData(r)
+	return payload.Object, payload.Challenge, nil
+}
+
+func (p *replayPlugin) PublicKeyAndCounter(ctx context.Context, r *plugin.AssertionRequest) (*ecdsa.PublicKey, uint32, error) {
+	payload := r.Object.(*plugin.AssertionPayload)
+	key, err := p.publicKey(ctx, payload.KeyID)
+	return key, 0, err
+}
+
+func (p *replayPlugin) AssignedChallenge(ctx context.Context, r *plugin.AssertionRequest) (string, error) {
+	return r.Object.(*plugin.AssertionPayload).Challenge, nil
+}
+
+func (p *replayPlugin) UpdateCounter(ctx context.Context, r *plugin.AssertionRequest, counter uint32) error {
+	return nil
+}
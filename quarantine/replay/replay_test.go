@@ -0,0 +1,174 @@
+package replay_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	attest "github.com/takimoto3/app-attest"
+	"github.com/takimoto3/app-attest-middleware/adapter"
+	"github.com/takimoto3/app-attest-middleware/attesttest"
+	"github.com/takimoto3/app-attest-middleware/client"
+	"github.com/takimoto3/app-attest-middleware/handler"
+	"github.com/takimoto3/app-attest-middleware/middleware"
+	"github.com/takimoto3/app-attest-middleware/plugin"
+	"github.com/takimoto3/app-attest-middleware/plugin/memory"
+	"github.com/takimoto3/app-attest-middleware/quarantine"
+	"github.com/takimoto3/app-attest-middleware/quarantine/replay"
+	"github.com/takimoto3/app-attest-middleware/requestid"
+	"github.com/takimoto3/app-attest-middleware/wire"
+)
+
+const appID = "TEAMID1234.com.example.app"
+
+func TestReplay(t *testing.T) {
+	requestid.UseUUID()
+	ca, err := attesttest.NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The server trusts ca only, like a server missing a new Apple root.
+	otherCA, err := attesttest.NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := t.TempDir()
+	dir, err := quarantine.Open(path, quarantine.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := memory.New(memory.Config{})
+	h := handler.NewAppAttestHandler(logger, adapter.NewAttestationAdapter(logger, attest.NewAttestationService(ca.Pool(), appID), store, adapter.WithQuarantine(dir)))
+	m := middleware.NewAssertionMiddleware(logger, middleware.Config{RequiredMode: middleware.RequiredStatus}, adapter.NewAssertionAdapter(logger, appID, store, adapter.WithQuarantine(dir)))
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /challenge", h.NewChallenge)
+	mux.HandleFunc("POST /attest", h.Verify)
+	mux.Handle("POST /api", m.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	config := client.Config{ChallengeURL: srv.URL + "/challenge", AttestURL: srv.URL + "/attest"}
+	ctx := context.Background()
+
+	device, err := ca.NewDevice(appID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := client.New(device, config)
+	if err := c.Attest(ctx); err != nil {
+		t.Fatal(err)
+	}
+	other, err := otherCA.NewDevice(appID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.New(other, config).Attest(ctx); err == nil {
+		t.Fatal("attestation of the other CA accepted")
+	}
+
+	// An assertion over a body other than the one sent.
+	challenge, err := c.Challenge(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(plugin.BodyClientData(challenge, []byte("signed")))
+	assertion, err := device.GenerateAssertion(hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api", strings.NewReader("sent"))
+	req.Header.Set("Authorization", "Bearer secret")
+	wire.SetAssertion(req.Header, assertion, device.KeyID(), challenge)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("tampered assertion: got status %d", res.StatusCode)
+	}
+
+	// A second assertion with a consumed challenge is audited, not quarantined.
+	challenge, err = c.Challenge(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []int{http.StatusOK, http.StatusBadRequest} {
+		hash := sha256.Sum256(plugin.BodyClientData(challenge, []byte("sent")))
+		assertion, err := device.GenerateAssertion(hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api", strings.NewReader("sent"))
+		wire.SetAssertion(req.Header, assertion, device.KeyID(), challenge)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != want {
+			t.Fatalf("assertion %d with one challenge: got status %d, want %d", i, res.StatusCode, want)
+		}
+	}
+
+	records, err := quarantine.ReadDir(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2", len(records))
+	}
+	attestation, tampered := records[0], records[1]
+	if attestation.Kind != quarantine.KindAttestation || attestation.Reason != string(adapter.ReasonCertificateChainInvalid) || attestation.RequestID == "" {
+		t.Errorf("got attestation record %s %s %q", attestation.Kind, attestation.Reason, attestation.RequestID)
+	}
+	if tampered.Kind != quarantine.KindAssertion || tampered.Reason != string(adapter.ReasonBadSignature) || string(tampered.Body) != "sent" {
+		t.Errorf("got assertion record %s %s %q", tampered.Kind, tampered.Reason, tampered.Body)
+	}
+	if tampered.Header.Get("Authorization") != "" {
+		t.Error("Authorization header not redacted")
+	}
+
+	// Replayed once the other root is trusted.
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Root)
+	roots.AddCert(otherCA.Root)
+	tests := map[string]struct {
+		replayer *replay.Replayer
+		want     []error
+	}{
+		"current configuration": {
+			replayer: &replay.Replayer{
+				AppID:              appID,
+				AttestationService: attest.NewAttestationService(roots, appID),
+				PublicKey: func(ctx context.Context, keyID []byte) (*ecdsa.PublicKey, error) {
+					return device.PublicKey(), nil
+				},
+			},
+			want: []error{nil, attest.ErrInvalidSignature},
+		},
+		"no attestation service": {
+			replayer: &replay.Replayer{AppID: appID},
+			want:     []error{replay.ErrNotReplayable, adapter.ErrAttestationRequired},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			for i, rec := range records {
+				err := tt.replayer.Replay(ctx, rec)
+				if !errors.Is(err, tt.want[i]) {
+					t.Errorf("record %d: got error %v, want %v", i, err, tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package receipt
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	attest "github.com/takimoto3/app-attest"
+)
+
+// Apple's attestation data endpoints.
+const (
+	ProductionURL  = "https://data.appattest.apple.com/v1/attestationData"
+	DevelopmentURL = "https://data-development.appattest.apple.com/v1/attestationData"
+)
+
+// MaxResponseSize is the largest response body Refresh reads. A base64 encoded
+// receipt is a few kilobytes.
+const MaxResponseSize = 64 << 10
+
+var (
+	// ErrNotModified indicates the receipt was sent before its NotBefore time (304).
+	ErrNotModified = errors.New("receipt: not modified")
+	// ErrIncorrectEnvironment indicates the receipt was sent to the endpoint of
+	// the other environment (400).
+	ErrIncorrectEnvironment = errors.New("receipt: incorrect environment")
+	// ErrUnauthorized indicates the token was rejected or does not match the receipt (401).
+	ErrUnauthorized = errors.New("receipt: unauthorized")
+	// ErrNoData indicates no data is available for the receipt (404).
+	ErrNoData = errors.New("receipt: no data")
+	// ErrTooManyRequests indicates the endpoint rate limited the client (429).
+	ErrTooManyRequests = errors.New("receipt: too many requests")
+	// ErrResponseTooLarge indicates the response body exceeds MaxResponseSize.
+	ErrResponseTooLarge = errors.New("receipt: response too large")
+)
+
+// TokenFunc returns the value of the Authorization header of a request to the
+// attestation data endpoint. See DeviceCheckToken.
+type TokenFunc func(ctx context.Context) (string, error)
+
+// ClientConfig holds the settings of a Client.
+type ClientConfig struct {
+	// URL is the attestation data endpoint of production receipts. Defaults to ProductionURL.
+	URL string
+	// DevelopmentURL is the attestation data endpoint of development receipts.
+	// Defaults to DevelopmentURL.
+	DevelopmentURL string
+	// HTTPClient sends the requests. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+	// Token authenticates the requests. It is required.
+	Token TokenFunc
+}
+
+// StatusError is returned when the endpoint answers with a status that has no
+// sentinel error.
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("receipt: unexpected status %d: %s", e.StatusCode, e.Body)
+}
+
+// Client exchanges receipts for fresh ones at Apple's attestation data endpoint.
+// It is safe for concurrent use.
+//
+// It does not wrap fraud.Client of github.com/takimoto3/app-attest: that client
+// is bound to a single environment when it is created, while a Scheduler
+// refreshes the receipts of production and development keys from one store,
+// and it would pull in github.com/takimoto3/appleapi-core and its token
+// provider just to build the Authorization header, which TokenFunc already
+// supplies. Refresh maps the status codes as fraud.Client does, except that
+// those without a sentinel error here are returned as a *StatusError.
+type Client struct {
+	config ClientConfig
+}
+
+// NewClient creates a Client. Zero values in config are replaced by their defaults.
+func NewClient(config ClientConfig) *Client {
+	c := &Client{config: config}
+	if c.config.URL == "" {
+		c.config.URL = ProductionURL
+	}
+	if c.config.DevelopmentURL == "" {
+		c.config.DevelopmentURL = DevelopmentURL
+	}
+	if c.config.HTTPClient == nil {
+		c.config.HTTPClient = http.DefaultClient
+	}
+	return c
+}
+
+// Refresh sends the DER encoded receipt to the endpoint of env and returns the
+// fresh receipt. It does not verify the returned receipt; see Verifier. A
+// response body larger than MaxResponseSize is rejected with
+// ErrResponseTooLarge.
+func (c *Client) Refresh(ctx context.Context, env attest.Environment, receipt []byte) ([]byte, error) {
+	if c.config.Token == nil {
+		return nil, errors.New("receipt: no token")
+	}
+	token, err := c.config.Token(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("receipt: token: %w", err)
+	}
+	url := c.config.URL
+	if env == attest.Sandbox {
+		url = c.config.DevelopmentURL
+	}
+	body := base64.StdEncoding.EncodeToString(receipt)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", token)
+
+	res, err := c.config.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(res.Body, MaxResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxResponseSize {
+		return nil, ErrResponseTooLarge
+	}
+	data = bytes.TrimSpace(data)
+	switch res.StatusCode {
+	case http.StatusOK:
+		fresh, err := base64.StdEncoding.DecodeString(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("receipt: decode response: %w", err)
+		}
+		return fresh, nil
+	case http.StatusNotModified:
+		return nil, ErrNotModified
+	case http.StatusBadRequest:
+		if bytes.Contains(data, []byte("Incorrect Environment")) {
+			return nil, ErrIncorrectEnvironment
+		}
+	case http.StatusUnauthorized:
+		return nil, ErrUnauthorized
+	case http.StatusNotFound:
+		return nil, ErrNoData
+	case http.StatusTooManyRequests:
+		return nil, ErrTooManyRequests
+	}
+	return nil, &StatusError{StatusCode: res.StatusCode, Body: string(data)}
+}
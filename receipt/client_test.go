@@ -0,0 +1,155 @@
+package receipt_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	attest "github.com/takimoto3/app-attest"
+	"github.com/takimoto3/app-attest-middleware/attesttest"
+	"github.com/takimoto3/app-attest-middleware/receipt"
+	"github.com/takimoto3/app-attest-middleware/receipt/receipttest"
+)
+
+func TestClient_Refresh(t *testing.T) {
+	ca, err := attesttest.NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	device, err := ca.NewDevice(appID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := ca.NewReceipt(attesttest.ReceiptTemplate{AppID: appID, PublicKey: device.PublicKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := receipttest.NewServer(ca)
+	defer srv.Close()
+	srv.SetRiskMetric(device.KeyID(), 12)
+	ctx := context.Background()
+
+	// The fake server answers 304 until the NotBefore time of the receipt.
+	client := receipt.NewClient(receipt.ClientConfig{URL: srv.URL, Token: srv.Token})
+	if _, err := client.Refresh(ctx, attest.Production, old); !errors.Is(err, receipt.ErrNotModified) {
+		t.Fatalf("got error %v, want ErrNotModified", err)
+	}
+	past := time.Now().Add(-time.Hour)
+	old, err = ca.NewReceipt(attesttest.ReceiptTemplate{AppID: appID, PublicKey: device.PublicKey(), CreationTime: past, NotBefore: past})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := client.Refresh(ctx, attest.Production, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh, err := receipt.NewVerifier(ca.Pool(), appID).Verify(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fresh.Type != receipt.TypeReceipt || fresh.RiskMetric != 12 {
+		t.Errorf("got %s receipt with risk metric %d", fresh.Type, fresh.RiskMetric)
+	}
+
+	// Development receipts go to the development endpoint.
+	dev := receipt.NewClient(receipt.ClientConfig{URL: "http://127.0.0.1:0", DevelopmentURL: srv.URL, Token: srv.Token})
+	if _, err := dev.Refresh(ctx, attest.Sandbox, old); err != nil {
+		t.Errorf("development endpoint: %v", err)
+	}
+	unauthorized := receipt.NewClient(receipt.ClientConfig{URL: srv.URL, Token: func(ctx context.Context) (string, error) { return "wrong", nil }})
+	if _, err := unauthorized.Refresh(ctx, attest.Production, old); !errors.Is(err, receipt.ErrUnauthorized) {
+		t.Errorf("wrong token: got error %v", err)
+	}
+}
+
+func TestClient_RefreshStatus(t *testing.T) {
+	tests := map[string]struct {
+		status  int
+		body    string
+		wantErr error
+	}{
+		"not modified":          {status: http.StatusNotModified, wantErr: receipt.ErrNotModified},
+		"incorrect environment": {status: http.StatusBadRequest, body: "Incorrect Environment", wantErr: receipt.ErrIncorrectEnvironment},
+		"unauthorized":          {status: http.StatusUnauthorized, wantErr: receipt.ErrUnauthorized},
+		"no data":               {status: http.StatusNotFound, wantErr: receipt.ErrNoData},
+		"too many requests":     {status: http.StatusTooManyRequests, wantErr: receipt.ErrTooManyRequests},
+		"response too large":    {status: http.StatusOK, body: strings.Repeat("A", receipt.MaxResponseSize+4), wantErr: receipt.ErrResponseTooLarge},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+			client := receipt.NewClient(receipt.ClientConfig{URL: srv.URL, Token: func(ctx context.Context) (string, error) { return "token", nil }})
+			if _, err := client.Refresh(context.Background(), attest.Production, []byte("receipt")); !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "maintenance", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	client := receipt.NewClient(receipt.ClientConfig{URL: srv.URL, Token: func(ctx context.Context) (string, error) { return "token", nil }})
+	_, err := client.Refresh(context.Background(), attest.Production, []byte("receipt"))
+	var statusErr *receipt.StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got error %v, want a StatusError", err)
+	}
+}
+
+func TestDeviceCheckToken(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := receipt.DeviceCheckToken("TEAMID1234", "KEYID56789", key)
+	jwt, err := token(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := token(context.Background()); again != jwt {
+		t.Error("token not reused")
+	}
+
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		t.Fatalf("got %d parts", len(parts))
+	}
+	var header, claims map[string]any
+	for i, v := range []*map[string]any{&header, &claims} {
+		data, err := base64.RawURLEncoding.DecodeString(parts[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(data, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if header["alg"] != "ES256" || header["kid"] != "KEYID56789" || claims["iss"] != "TEAMID1234" || claims["iat"] == nil {
+		t.Errorf("got header %v, claims %v", header, claims)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(sig) != 64 {
+		t.Fatalf("got signature of %d bytes, %v", len(sig), err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(&key.PublicKey, digest[:], r, s) {
+		t.Error("invalid signature")
+	}
+}
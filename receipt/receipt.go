@@ -0,0 +1,121 @@
+// Package receipt parses App Attest receipts and keeps them fresh.
+//
+// Every attestation embeds a receipt (attest.Result.Receipt), a PKCS#7
+// signed set of attributes describing the attested key. Exchanging a receipt
+// at Apple's attestation data endpoint returns a fresh receipt with a risk
+// metric, the number of keys attested for the app on the device over the
+// last 30 days. A high risk metric points at a device that mints many keys.
+//
+// Verifier checks and parses receipts, Client exchanges a receipt for a fresh
+// one, and Scheduler refreshes the receipts of a Store before they expire:
+//
+//	verifier := receipt.NewVerifier(roots, appID)
+//	client := receipt.NewClient(receipt.ClientConfig{Token: receipt.DeviceCheckToken(teamID, keyID, key)})
+//	scheduler := receipt.NewScheduler(logger, verifier, client, store, receipt.SchedulerConfig{})
+//	go scheduler.Run(ctx)
+//
+// A receipt does not record the App Attest environment it was issued in. It
+// is the environment of the attestation (attest.Result.Environment) and
+// selects the endpoint the receipt is refreshed at.
+package receipt
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"time"
+
+	fraudreceipt "github.com/takimoto3/app-attest/fraud/receipt"
+)
+
+// Receipt types.
+const (
+	// TypeAttest is the type of the receipt embedded in an attestation.
+	TypeAttest = "ATTEST"
+	// TypeReceipt is the type of a receipt returned by the attestation data endpoint.
+	TypeReceipt = "RECEIPT"
+)
+
+// Receipt attribute fields not parsed by the app-attest library.
+const (
+	fieldNotBefore = 19
+	fieldExpires   = 21
+)
+
+// ErrInvalidReceipt indicates the receipt cannot be parsed, its signature does
+// not chain to the trusted roots, or it was issued for another app.
+var ErrInvalidReceipt = errors.New("receipt: invalid receipt")
+
+// Receipt is a verified App Attest receipt.
+type Receipt struct {
+	AppID     string
+	PublicKey *ecdsa.PublicKey
+	// Type is TypeAttest or TypeReceipt.
+	Type         string
+	CreationTime time.Time
+	// RiskMetric is the number of keys attested for the app on the device.
+	// Receipts of TypeAttest carry no risk metric and report zero.
+	RiskMetric int
+	// NotBefore is the earliest time the receipt can be refreshed.
+	NotBefore time.Time
+	// Expires is when the receipt expires.
+	Expires time.Time
+	// Raw is the DER encoded PKCS#7 receipt.
+	Raw []byte
+}
+
+// Verifier verifies and parses receipts.
+type Verifier struct {
+	appID  string
+	parser *fraudreceipt.ReceiptVerifier
+}
+
+// NewVerifier creates a Verifier accepting receipts signed by a certificate
+// that chains to roots and issued for appID (team ID + "." + bundle ID).
+func NewVerifier(roots *x509.CertPool, appID string) *Verifier {
+	return &Verifier{appID: appID, parser: fraudreceipt.NewReceiptVerifier(roots)}
+}
+
+// Verify checks the signature and the app ID of the DER encoded receipt data
+// and returns its fields. Errors wrap ErrInvalidReceipt.
+func (v *Verifier) Verify(data []byte) (*Receipt, error) {
+	parsed, err := v.parser.ParseAndVerify(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidReceipt, err)
+	}
+	if parsed.AppID != v.appID {
+		return nil, fmt.Errorf("%w: app ID %q", ErrInvalidReceipt, parsed.AppID)
+	}
+	if parsed.Type != TypeAttest && parsed.Type != TypeReceipt {
+		return nil, fmt.Errorf("%w: type %q", ErrInvalidReceipt, parsed.Type)
+	}
+	r := &Receipt{
+		AppID:        parsed.AppID,
+		PublicKey:    parsed.PublicKey,
+		Type:         parsed.Type,
+		CreationTime: parsed.CreationTime,
+		RiskMetric:   parsed.RiskMetric,
+		Raw:          data,
+	}
+	for _, attr := range parsed.Unknown {
+		var t *time.Time
+		switch attr.Type {
+		case fieldNotBefore:
+			t = &r.NotBefore
+		case fieldExpires:
+			t = &r.Expires
+		default:
+			continue
+		}
+		var value []byte
+		if _, err := asn1.Unmarshal(attr.Raw.FullBytes, &value); err != nil {
+			return nil, fmt.Errorf("%w: field %d: %w", ErrInvalidReceipt, attr.Type, err)
+		}
+		if *t, err = time.Parse(time.RFC3339, string(value)); err != nil {
+			return nil, fmt.Errorf("%w: field %d: %w", ErrInvalidReceipt, attr.Type, err)
+		}
+	}
+	return r, nil
+}
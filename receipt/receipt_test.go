@@ -0,0 +1,104 @@
+package receipt_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/takimoto3/app-attest-middleware/attesttest"
+	"github.com/takimoto3/app-attest-middleware/receipt"
+)
+
+const appID = "TEAMID1234.com.example.app"
+
+func TestVerifier_Verify(t *testing.T) {
+	ca, err := attesttest.NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCA, err := attesttest.NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	device, err := ca.NewDevice(appID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	tests := map[string]struct {
+		ca       *attesttest.CA
+		template attesttest.ReceiptTemplate
+		want     *receipt.Receipt
+		wantErr  error
+	}{
+		"attestation receipt": {
+			ca:       ca,
+			template: attesttest.ReceiptTemplate{AppID: appID, PublicKey: device.PublicKey(), CreationTime: created},
+			want: &receipt.Receipt{
+				AppID:        appID,
+				Type:         receipt.TypeAttest,
+				CreationTime: created,
+				NotBefore:    created.AddDate(0, 0, 1),
+				Expires:      created.AddDate(0, 0, 90),
+			},
+		},
+		"refreshed receipt": {
+			ca: ca,
+			template: attesttest.ReceiptTemplate{
+				AppID:        appID,
+				PublicKey:    device.PublicKey(),
+				Type:         receipt.TypeReceipt,
+				CreationTime: created,
+				NotBefore:    created.Add(time.Hour),
+				Expires:      created.AddDate(0, 0, 30),
+				RiskMetric:   7,
+			},
+			want: &receipt.Receipt{
+				AppID:        appID,
+				Type:         receipt.TypeReceipt,
+				CreationTime: created,
+				RiskMetric:   7,
+				NotBefore:    created.Add(time.Hour),
+				Expires:      created.AddDate(0, 0, 30),
+			},
+		},
+		"other app": {
+			ca:       ca,
+			template: attesttest.ReceiptTemplate{AppID: "TEAMID1234.com.example.other", PublicKey: device.PublicKey()},
+			wantErr:  receipt.ErrInvalidReceipt,
+		},
+		"untrusted signer": {
+			ca:       otherCA,
+			template: attesttest.ReceiptTemplate{AppID: appID, PublicKey: device.PublicKey()},
+			wantErr:  receipt.ErrInvalidReceipt,
+		},
+	}
+	verifier := receipt.NewVerifier(ca.Pool(), appID)
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			data, err := tt.ca.NewReceipt(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := verifier.Verify(data)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if tt.want == nil {
+				return
+			}
+			if got.AppID != tt.want.AppID || got.Type != tt.want.Type || got.RiskMetric != tt.want.RiskMetric ||
+				!got.CreationTime.Equal(tt.want.CreationTime) || !got.NotBefore.Equal(tt.want.NotBefore) || !got.Expires.Equal(tt.want.Expires) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if !got.PublicKey.Equal(device.PublicKey()) || string(got.Raw) != string(data) {
+				t.Error("public key or raw receipt not returned")
+			}
+		})
+	}
+
+	if _, err := verifier.Verify([]byte("not a receipt")); !errors.Is(err, receipt.ErrInvalidReceipt) {
+		t.Errorf("garbage: got error %v", err)
+	}
+}
@@ -0,0 +1,150 @@
+// Package receipttest provides a fake App Attest attestation data endpoint for
+// tests of receipt refreshes.
+//
+// A Server accepts the receipts minted by an attesttest.CA and answers with
+// fresh receipts of type "RECEIPT" signed by the same CA:
+//
+//	srv := receipttest.NewServer(ca)
+//	defer srv.Close()
+//	client := receipt.NewClient(receipt.ClientConfig{URL: srv.URL, DevelopmentURL: srv.URL, Token: srv.Token})
+package receipttest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	attest "github.com/takimoto3/app-attest"
+	"github.com/takimoto3/app-attest-middleware/attesttest"
+	fraudreceipt "github.com/takimoto3/app-attest/fraud/receipt"
+)
+
+// token is the Authorization header the Server expects.
+const token = "receipttest token"
+
+// Server is a fake attestation data endpoint. It is safe for concurrent use.
+type Server struct {
+	*httptest.Server
+
+	ca       *attesttest.CA
+	verifier *fraudreceipt.ReceiptVerifier
+
+	mu          sync.Mutex
+	riskMetrics map[string]int
+	status      int
+	requests    int
+}
+
+// NewServer starts a Server accepting the receipts of ca. Close it when done.
+func NewServer(ca *attesttest.CA) *Server {
+	s := &Server{
+		ca:          ca,
+		verifier:    fraudreceipt.NewReceiptVerifier(ca.Pool()),
+		riskMetrics: make(map[string]int),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Token is a receipt.TokenFunc returning the token the Server accepts.
+func (s *Server) Token(ctx context.Context) (string, error) {
+	return token, nil
+}
+
+// SetRiskMetric sets the risk metric of the receipts refreshed for keyID.
+// It defaults to 1.
+func (s *Server) SetRiskMetric(keyID []byte, metric int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.riskMetrics[string(keyID)] = metric
+}
+
+// SetStatus makes the Server answer every request with status, e.g. to
+// simulate an outage. Zero restores the normal behavior.
+func (s *Server) SetStatus(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+// Requests returns the number of requests received.
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests++
+	status := s.status
+	s.mu.Unlock()
+	switch {
+	case status != 0:
+		http.Error(w, http.StatusText(status), status)
+		return
+	case r.Method != http.MethodPost:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	case r.Header.Get("Authorization") != token:
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Bad Payload", http.StatusBadRequest)
+		return
+	}
+	data, err := base64.StdEncoding.DecodeString(string(body))
+	if err != nil {
+		http.Error(w, "Bad Payload", http.StatusBadRequest)
+		return
+	}
+	old, err := s.verifier.ParseAndVerify(data)
+	if err != nil || old.PublicKey == nil {
+		http.Error(w, "Bad Payload", http.StatusBadRequest)
+		return
+	}
+	for _, attr := range old.Unknown {
+		var value []byte
+		if attr.Type != 19 {
+			continue
+		}
+		if _, err := asn1.Unmarshal(attr.Raw.FullBytes, &value); err != nil {
+			http.Error(w, "Bad Payload", http.StatusBadRequest)
+			return
+		}
+		if notBefore, err := time.Parse(time.RFC3339, string(value)); err == nil && time.Now().Before(notBefore) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	keyID := sha256.Sum256(attest.MarshalUncompressed(old.PublicKey))
+	s.mu.Lock()
+	metric, ok := s.riskMetrics[string(keyID[:])]
+	s.mu.Unlock()
+	if !ok {
+		metric = 1
+	}
+	now := time.Now()
+	fresh, err := s.ca.NewReceipt(attesttest.ReceiptTemplate{
+		AppID:        old.AppID,
+		PublicKey:    old.PublicKey,
+		Type:         "RECEIPT",
+		CreationTime: now,
+		RiskMetric:   metric,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, base64.StdEncoding.EncodeToString(fresh))
+}
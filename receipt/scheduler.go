@@ -0,0 +1,183 @@
+package receipt
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"time"
+
+	attest "github.com/takimoto3/app-attest"
+)
+
+// Entry is a stored receipt due for a refresh.
+type Entry struct {
+	KeyID       []byte
+	Environment attest.Environment
+	// Receipt is the DER encoded receipt.
+	Receipt []byte
+}
+
+// Store keeps the receipts of attested keys and when to refresh them.
+// plugin/memory and plugin/sqlstore implement it.
+type Store interface {
+	// DueReceipts returns up to limit receipts whose refresh time is not after
+	// now, earliest first. Keys without a receipt are never due. The refresh
+	// time of a newly attested key is the zero time.
+	DueReceipts(ctx context.Context, now time.Time, limit int) ([]Entry, error)
+	// UpdateReceipt replaces the receipt of keyID with r and sets its refresh time.
+	UpdateReceipt(ctx context.Context, keyID []byte, r *Receipt, refreshAt time.Time) error
+	// PostponeReceipt keeps the receipt of keyID and sets its refresh time.
+	PostponeReceipt(ctx context.Context, keyID []byte, refreshAt time.Time) error
+}
+
+// SchedulerConfig holds the settings of a Scheduler.
+type SchedulerConfig struct {
+	// Interval is how often Run refreshes due receipts. Defaults to 1 hour.
+	Interval time.Duration
+	// Lead is how long before its expiry a receipt is refreshed. Defaults to 7 days.
+	Lead time.Duration
+	// RetryInterval is how long a failed refresh is postponed. Defaults to Interval.
+	RetryInterval time.Duration
+	// BatchSize is the number of receipts refreshed per pass. Defaults to 100.
+	BatchSize int
+}
+
+// Scheduler refreshes the receipts of a Store before they expire.
+type Scheduler struct {
+	logger   *slog.Logger
+	verifier *Verifier
+	client   *Client
+	store    Store
+	config   SchedulerConfig
+	now      func() time.Time
+}
+
+// NewScheduler creates a Scheduler. Zero values in config are replaced by their defaults.
+func NewScheduler(logger *slog.Logger, verifier *Verifier, client *Client, store Store, config SchedulerConfig) *Scheduler {
+	s := &Scheduler{
+		logger:   logger,
+		verifier: verifier,
+		client:   client,
+		store:    store,
+		config:   config,
+		now:      time.Now,
+	}
+	if s.config.Interval == 0 {
+		s.config.Interval = time.Hour
+	}
+	if s.config.Lead == 0 {
+		s.config.Lead = 7 * 24 * time.Hour
+	}
+	if s.config.RetryInterval == 0 {
+		s.config.RetryInterval = s.config.Interval
+	}
+	if s.config.BatchSize == 0 {
+		s.config.BatchSize = 100
+	}
+	return s
+}
+
+// Run calls RefreshDue every Interval until ctx is done, and returns ctx.Err().
+func (s *Scheduler) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := s.RefreshDue(ctx); err != nil && ctx.Err() == nil {
+			s.logger.Error("failed to refresh receipts", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// RefreshDue refreshes the due receipts of the store, one batch at a time, and
+// returns the number of receipts refreshed.
+//
+// A receipt that cannot be refreshed yet is only parsed, so that the store
+// learns its refresh time. A failed refresh is logged and postponed by
+// RetryInterval. Only store errors are returned.
+func (s *Scheduler) RefreshDue(ctx context.Context) (int, error) {
+	refreshed := 0
+	now := s.now()
+	for {
+		entries, err := s.store.DueReceipts(ctx, now, s.config.BatchSize)
+		if err != nil {
+			return refreshed, err
+		}
+		for _, e := range entries {
+			ok, err := s.refresh(ctx, e, now)
+			if err != nil {
+				return refreshed, err
+			}
+			if ok {
+				refreshed++
+			}
+		}
+		if len(entries) < s.config.BatchSize {
+			return refreshed, nil
+		}
+	}
+}
+
+// refresh refreshes the receipt of e and reports whether it was replaced.
+// It returns store errors only.
+func (s *Scheduler) refresh(ctx context.Context, e Entry, now time.Time) (bool, error) {
+	current, err := s.verifier.Verify(e.Receipt)
+	if err != nil {
+		s.logger.Warn("stored receipt is invalid", "key_id", base64.StdEncoding.EncodeToString(e.KeyID), "err", err)
+	}
+	if current != nil && now.Before(current.NotBefore) {
+		return false, s.store.UpdateReceipt(ctx, e.KeyID, current, s.refreshAt(current, now))
+	}
+
+	fresh, err := s.exchange(ctx, e)
+	if err != nil {
+		s.logger.Warn("failed to refresh receipt", "key_id", base64.StdEncoding.EncodeToString(e.KeyID), "err", err)
+		return false, s.store.PostponeReceipt(ctx, e.KeyID, now.Add(s.config.RetryInterval))
+	}
+	return true, s.store.UpdateReceipt(ctx, e.KeyID, fresh, s.refreshAt(fresh, now))
+}
+
+// exchange exchanges the receipt of e for a fresh one and verifies it.
+func (s *Scheduler) exchange(ctx context.Context, e Entry) (*Receipt, error) {
+	data, err := s.client.Refresh(ctx, e.Environment, e.Receipt)
+	if err != nil {
+		return nil, err
+	}
+	fresh, err := s.verifier.Verify(data)
+	if err != nil {
+		return nil, err
+	}
+	keyID := sha256.Sum256(attest.MarshalUncompressed(fresh.PublicKey))
+	if !bytes.Equal(keyID[:], e.KeyID) {
+		return nil, fmt.Errorf("%w: refreshed receipt is for another key", ErrInvalidReceipt)
+	}
+	return fresh, nil
+}
+
+// refreshAt returns when to refresh r: Lead before it expires, but not before
+// its NotBefore time. Attestation receipts carry no risk metric and are
+// refreshed as soon as possible. Receipts without an expiry, and receipts that
+// would be due again at once, are refreshed after RetryInterval.
+func (s *Scheduler) refreshAt(r *Receipt, now time.Time) time.Time {
+	at := now.Add(s.config.RetryInterval)
+	switch {
+	case r.Type == TypeAttest:
+		at = r.NotBefore
+	case !r.Expires.IsZero():
+		at = r.Expires.Add(-s.config.Lead)
+	}
+	if at.Before(r.NotBefore) {
+		at = r.NotBefore
+	}
+	if !at.After(now) {
+		at = now.Add(s.config.RetryInterval)
+	}
+	return at
+}
@@ -0,0 +1,122 @@
+package receipt_test
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"testing"
+	"time"
+
+	attest "github.com/takimoto3/app-attest"
+	"github.com/takimoto3/app-attest-middleware/attesttest"
+	"github.com/takimoto3/app-attest-middleware/plugin"
+	"github.com/takimoto3/app-attest-middleware/plugin/memory"
+	"github.com/takimoto3/app-attest-middleware/receipt"
+	"github.com/takimoto3/app-attest-middleware/receipt/receipttest"
+)
+
+func TestScheduler_RefreshDue(t *testing.T) {
+	ca, err := attesttest.NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCA, err := attesttest.NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := receipttest.NewServer(ca)
+	defer srv.Close()
+	store := memory.New(memory.Config{})
+	ctx := context.Background()
+	past := time.Now().Add(-time.Hour)
+
+	attestKey := func(ca *attesttest.CA, template attesttest.ReceiptTemplate) *attesttest.Device {
+		t.Helper()
+		device, err := ca.NewDevice(appID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.AppID, template.PublicKey = appID, device.PublicKey()
+		data, err := ca.NewReceipt(template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.StoreResult(ctx, &plugin.AttestationRequest{
+			Object: &plugin.AttestationPayload{KeyID: device.KeyID()},
+			Result: &attest.Result{PublicKey: device.PublicKey(), Receipt: data, Environment: attest.Production},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return device
+	}
+	fresh := attestKey(ca, attesttest.ReceiptTemplate{})
+	due := attestKey(ca, attesttest.ReceiptTemplate{CreationTime: past, NotBefore: past})
+	untrusted := attestKey(otherCA, attesttest.ReceiptTemplate{CreationTime: past, NotBefore: past})
+	srv.SetRiskMetric(due.KeyID(), 5)
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	client := receipt.NewClient(receipt.ClientConfig{URL: srv.URL, Token: srv.Token})
+	scheduler := receipt.NewScheduler(logger, receipt.NewVerifier(ca.Pool(), appID), client, store, receipt.SchedulerConfig{})
+	n, err := scheduler.RefreshDue(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || srv.Requests() != 2 {
+		t.Fatalf("refreshed %d receipts with %d requests, want 1 with 2", n, srv.Requests())
+	}
+
+	tests := map[string]struct {
+		device     *attesttest.Device
+		riskMetric int
+		// refreshAfter and refreshBefore bound the refresh time of the receipt.
+		refreshAfter, refreshBefore time.Time
+	}{
+		"not refreshable yet": {
+			device:        fresh,
+			refreshAfter:  time.Now().Add(23 * time.Hour),
+			refreshBefore: time.Now().Add(25 * time.Hour),
+		},
+		"refreshed": {
+			device:        due,
+			riskMetric:    5,
+			refreshAfter:  time.Now().AddDate(0, 0, 82),
+			refreshBefore: time.Now().AddDate(0, 0, 84),
+		},
+		"refresh failed": {
+			device:        untrusted,
+			refreshAfter:  time.Now().Add(59 * time.Minute),
+			refreshBefore: time.Now().Add(61 * time.Minute),
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			key, ok := store.Key(tt.device.KeyID())
+			if !ok {
+				t.Fatal("key not found")
+			}
+			if key.RiskMetric != tt.riskMetric {
+				t.Errorf("got risk metric %d, want %d", key.RiskMetric, tt.riskMetric)
+			}
+			if key.ReceiptRefreshAt.Before(tt.refreshAfter) || key.ReceiptRefreshAt.After(tt.refreshBefore) {
+				t.Errorf("got refresh time %v, want between %v and %v", key.ReceiptRefreshAt, tt.refreshAfter, tt.refreshBefore)
+			}
+		})
+	}
+
+	// Nothing is due any more.
+	if n, err := scheduler.RefreshDue(ctx); n != 0 || err != nil || srv.Requests() != 2 {
+		t.Errorf("second pass refreshed %d receipts with %d requests, %v", n, srv.Requests(), err)
+	}
+
+	// An outage postpones the refresh.
+	srv.SetStatus(http.StatusServiceUnavailable)
+	outage := attestKey(ca, attesttest.ReceiptTemplate{CreationTime: past, NotBefore: past})
+	if n, err := scheduler.RefreshDue(ctx); n != 0 || err != nil {
+		t.Errorf("outage: refreshed %d receipts, %v", n, err)
+	}
+	if key, _ := store.Key(outage.KeyID()); key.ReceiptRefreshAt.Before(time.Now().Add(59 * time.Minute)) {
+		t.Errorf("outage: got refresh time %v", key.ReceiptRefreshAt)
+	}
+}
@@ -0,0 +1,64 @@
+package receipt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// tokenLifetime is how long a DeviceCheck token is reused. Apple rejects
+// tokens issued more than an hour ago.
+const tokenLifetime = 30 * time.Minute
+
+// DeviceCheckToken returns a TokenFunc that signs ES256 JSON Web Tokens with
+// the DeviceCheck private key key, whose key ID is keyID, for the developer
+// team teamID. A token is reused for 30 minutes.
+func DeviceCheckToken(teamID, keyID string, key *ecdsa.PrivateKey) TokenFunc {
+	var (
+		mu      sync.Mutex
+		token   string
+		expires time.Time
+	)
+	return func(ctx context.Context) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		now := time.Now()
+		if now.Before(expires) {
+			return token, nil
+		}
+		t, err := signToken(teamID, keyID, key, now)
+		if err != nil {
+			return "", err
+		}
+		token, expires = t, now.Add(tokenLifetime)
+		return token, nil
+	}
+}
+
+func signToken(teamID, keyID string, key *ecdsa.PrivateKey, now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "ES256", "kid": keyID})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]any{"iss": teamID, "iat": now.Unix()})
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	// JWS encodes ES256 signatures as the 32-byte big-endian r and s.
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return signed + "." + enc.EncodeToString(sig), nil
+}
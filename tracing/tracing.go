@@ -0,0 +1,85 @@
+// Package tracing holds the OpenTelemetry conventions shared by the adapters,
+// the handler and the middleware.
+//
+// Tracing is enabled by passing a trace.TracerProvider to
+// adapter.WithTracerProvider. The handler and the middleware of the adapter
+// open the root span of a request with the same provider; the adapters add a span for the verification, one
+// for each plugin method call and one for the cryptographic verification
+// step. Every span carries the request ID and, once finished, the outcome and
+// reason code.
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	"github.com/takimoto3/app-attest-middleware/metrics"
+	"github.com/takimoto3/app-attest-middleware/requestid"
+)
+
+// ScopeName is the instrumentation scope name of the tracers.
+const ScopeName = "github.com/takimoto3/app-attest-middleware"
+
+// Span names.
+const (
+	SpanMiddleware       = "app_attest.middleware"
+	SpanHandlerVerify    = "app_attest.handler.verify"
+	SpanHandlerChallenge = "app_attest.handler.new_challenge"
+	SpanAttestation      = "app_attest.adapter.attestation"
+	SpanAssertion        = "app_attest.adapter.assertion"
+	SpanChallenge        = "app_attest.adapter.challenge"
+	SpanServiceVerify    = "app_attest.service.verify"
+	SpanPluginCallPrefix = "app_attest.plugin."
+)
+
+// Attribute keys.
+const (
+	RequestIDKey = attribute.Key("app_attest.request_id")
+	OperationKey = attribute.Key("app_attest.operation")
+	MethodKey    = attribute.Key("app_attest.plugin.method")
+	OutcomeKey   = attribute.Key("app_attest.outcome")
+	ReasonKey    = attribute.Key("app_attest.reason")
+)
+
+// Tracer returns the tracer of tp, or a no-op tracer if tp is nil.
+func Tracer(tp trace.TracerProvider) trace.Tracer {
+	if tp == nil {
+		tp = noop.NewTracerProvider()
+	}
+	return tp.Tracer(ScopeName)
+}
+
+// Start starts a span with the request ID of ctx, if any, and attrs.
+// A nil tracer starts a no-op span.
+func Start(ctx context.Context, tracer trace.Tracer, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if tracer == nil {
+		tracer = Tracer(nil)
+	}
+	if id := requestid.FromContext(ctx); id != "" {
+		attrs = append(attrs, RequestIDKey.String(id))
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// SetRequestID sets the request ID on the span of ctx. The handler and the
+// middleware call it once the request ID is known.
+func SetRequestID(ctx context.Context, id string) {
+	trace.SpanFromContext(ctx).SetAttributes(RequestIDKey.String(id))
+}
+
+// SetOutcome sets the outcome and reason code of span, and marks it as failed
+// if err is non-nil.
+func SetOutcome(span trace.Span, reason string, err error) {
+	span.SetAttributes(OutcomeKey.String(metrics.Outcome(err)))
+	if reason != "" {
+		span.SetAttributes(ReasonKey.String(reason))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, reason)
+	}
+}
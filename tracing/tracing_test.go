@@ -0,0 +1,84 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/takimoto3/app-attest-middleware/requestid"
+)
+
+type fixedGenerator struct{}
+
+func (fixedGenerator) NextID() (string, error) { return "req-1", nil }
+
+func TestSpans(t *testing.T) {
+	requestid.UseGenerator(fixedGenerator{})
+	r, _, err := requestid.EnsureRequest(httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		reason     string
+		err        error
+		wantAttrs  map[attribute.Key]string
+		wantStatus codes.Code
+	}{
+		"success": {
+			wantAttrs:  map[attribute.Key]string{RequestIDKey: "req-1", OperationKey: "assertion", OutcomeKey: "success"},
+			wantStatus: codes.Unset,
+		},
+		"failure": {
+			reason:     "bad_signature",
+			err:        errors.New("invalid signature"),
+			wantAttrs:  map[attribute.Key]string{RequestIDKey: "req-1", OperationKey: "assertion", OutcomeKey: "failure", ReasonKey: "bad_signature"},
+			wantStatus: codes.Error,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			exporter := tracetest.NewInMemoryExporter()
+			tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+			_, span := Start(r.Context(), Tracer(tp), SpanAssertion, OperationKey.String("assertion"))
+			SetOutcome(span, tc.reason, tc.err)
+			span.End()
+
+			spans := exporter.GetSpans()
+			if len(spans) != 1 {
+				t.Fatalf("got %d spans, want 1", len(spans))
+			}
+			got := map[attribute.Key]string{}
+			for _, kv := range spans[0].Attributes {
+				got[kv.Key] = kv.Value.AsString()
+			}
+			for k, v := range tc.wantAttrs {
+				if got[k] != v {
+					t.Errorf("attribute %s = %q, want %q", k, got[k], v)
+				}
+			}
+			if len(got) != len(tc.wantAttrs) {
+				t.Errorf("got attributes %v, want %v", got, tc.wantAttrs)
+			}
+			if spans[0].Status.Code != tc.wantStatus {
+				t.Errorf("got status %v, want %v", spans[0].Status.Code, tc.wantStatus)
+			}
+		})
+	}
+}
+
+func TestStart_NilTracer(t *testing.T) {
+	ctx, span := Start(context.Background(), nil, SpanAssertion)
+	SetOutcome(span, "", nil)
+	span.End()
+	if span.IsRecording() || ctx == nil {
+		t.Error("nil tracer must start a non-recording span")
+	}
+}
@@ -0,0 +1,25 @@
+package wire
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+)
+
+// EncodeAttestation returns the JSON attestation body for the raw CBOR
+// attestation object, the raw key identifier and the challenge.
+func EncodeAttestation(attestationObject, keyID []byte, challenge string) ([]byte, error) {
+	return json.Marshal(attestationBody{
+		AttestationObject: base64.StdEncoding.EncodeToString(attestationObject),
+		KeyID:             base64.StdEncoding.EncodeToString(keyID),
+		Challenge:         challenge,
+	})
+}
+
+// SetAssertion sets the assertion headers on h for the raw CBOR assertion,
+// the raw key identifier and the challenge.
+func SetAssertion(h http.Header, assertion, keyID []byte, challenge string) {
+	h.Set(HeaderAssertion, base64.StdEncoding.EncodeToString(assertion))
+	h.Set(HeaderKeyID, base64.StdEncoding.EncodeToString(keyID))
+	h.Set(HeaderChallenge, challenge)
+}
@@ -0,0 +1,25 @@
+package wire
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrNoSession indicates the session key could not be extracted from the request.
+var ErrNoSession = errors.New("no session key")
+
+// SessionKeyFunc extracts the key that challenges are assigned to from a request,
+// e.g. a session cookie or a device identifier header.
+type SessionKeyFunc func(r *http.Request) (string, error)
+
+// HeaderSessionKey returns a SessionKeyFunc that reads the session key from the named header.
+func HeaderSessionKey(name string) SessionKeyFunc {
+	return func(r *http.Request) (string, error) {
+		v := r.Header.Get(name)
+		if v == "" {
+			return "", fmt.Errorf("%w: header %s is empty", ErrNoSession, name)
+		}
+		return v, nil
+	}
+}
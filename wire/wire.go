@@ -0,0 +1,297 @@
+// Package wire implements the default App Attest wire format.
+//
+// Plugins can delegate ExtractData and ParseRequest to Decoder instead of
+// inventing their own encoding. The bundled plugin/memory and plugin/sqlstore
+// implementations use it by default.
+//
+// # Attestation
+//
+// The attestation is posted as a JSON body with Content-Type application/json:
+//
+//	{
+//	  "attestationObject": "<base64 of the CBOR attestation object returned by attestKey>",
+//	  "keyId": "<base64 of the key identifier returned by generateKey>",
+//	  "challenge": "<challenge issued by the server>"
+//	}
+//
+// The client computes clientDataHash as SHA256(challenge) when calling attestKey.
+//
+// # Assertion
+//
+// An assertion-protected request carries the assertion in headers:
+//
+//	X-App-Attest-Assertion: <base64 of the CBOR assertion returned by generateAssertion>
+//	X-App-Attest-Key-Id:    <base64 of the key identifier>
+//	X-App-Attest-Challenge: <challenge issued by the server>
+//
+// The client data signed by generateAssertion is the challenge, a line feed
+// ('\n') and the request body, as built by plugin.BodyClientData, unless the
+// middleware is configured for canonical request binding. Plugins decoding
+// the wire format opt into it with UseBodyClientData. The client passes
+// SHA256 of the client data as clientDataHash. Since the challenge travels in
+// an unsigned header, signing it is what binds the assertion to it.
+//
+// Binary values may use any of the standard or URL-safe base64 alphabets,
+// with or without padding.
+package wire
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode"
+
+	attest "github.com/takimoto3/app-attest"
+	"github.com/takimoto3/app-attest-middleware/adapter"
+	"github.com/takimoto3/app-attest-middleware/plugin"
+)
+
+// Header names of the assertion wire format.
+const (
+	HeaderAssertion = "X-App-Attest-Assertion"
+	HeaderKeyID     = "X-App-Attest-Key-Id"
+	HeaderChallenge = "X-App-Attest-Challenge"
+)
+
+// Default limits of a zero Decoder.
+const (
+	DefaultMaxBodySize      = 64 << 10
+	DefaultMaxAttestation   = 32 << 10
+	DefaultMaxAssertion     = 4 << 10
+	DefaultMaxChallengeSize = 512
+)
+
+// keyIDSize is the size of a key identifier, the SHA256 hash of the public key.
+const keyIDSize = 32
+
+// attestationFormat is the only attestation statement format used by App Attest.
+const attestationFormat = "apple-appattest"
+
+// PayloadDecoder decodes App Attest payloads from incoming HTTP requests.
+// It is used by the bundled plugin implementations to implement
+// ExtractData and ParseRequest.
+type PayloadDecoder interface {
+	// DecodeAttestation decodes the attestation payload from r.
+	DecodeAttestation(r *http.Request) (*plugin.AttestationPayload, error)
+	// DecodeAssertion decodes the assertion payload from r.
+	// body is the request body already read by the middleware.
+	DecodeAssertion(r *http.Request, body []byte) (*plugin.AssertionPayload, error)
+}
+
+var _ PayloadDecoder = Decoder{}
+
+// Decoder decodes the default wire format. The zero value uses the default limits.
+// Every error it returns is an *adapter.VerificationError with reason
+// adapter.ReasonMalformedCBOR or adapter.ReasonMalformedRequest, which matches
+// adapter.ErrBadRequest.
+type Decoder struct {
+	// MaxBodySize limits the attestation JSON body in bytes.
+	MaxBodySize int64
+	// MaxAttestationSize limits the decoded CBOR attestation object in bytes.
+	MaxAttestationSize int
+	// MaxAssertionSize limits the decoded CBOR assertion in bytes.
+	MaxAssertionSize int
+	// MaxChallengeSize limits the challenge in bytes.
+	MaxChallengeSize int
+}
+
+type attestationBody struct {
+	AttestationObject string `json:"attestationObject"`
+	KeyID             string `json:"keyId"`
+	Challenge         string `json:"challenge"`
+}
+
+// DecodeAttestation decodes the JSON attestation body of r.
+func (d Decoder) DecodeAttestation(r *http.Request) (*plugin.AttestationPayload, error) {
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		mt, _, err := mime.ParseMediaType(ct)
+		if err != nil || mt != "application/json" {
+			return nil, badRequest("unsupported content type %q", ct)
+		}
+	}
+	if r.Body == nil {
+		return nil, badRequest("missing body")
+	}
+	limit := orDefault64(d.MaxBodySize, DefaultMaxBodySize)
+	data, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, badRequest("read body: %v", err)
+	}
+	if int64(len(data)) > limit {
+		return nil, badRequest("body exceeds %d bytes", limit)
+	}
+
+	var body attestationBody
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		return nil, badRequest("decode body: %v", err)
+	}
+
+	raw, err := decodeField("attestationObject", body.AttestationObject, orDefault(d.MaxAttestationSize, DefaultMaxAttestation))
+	if err != nil {
+		return nil, err
+	}
+	obj := &attest.AttestationObject{}
+	if err := obj.UnmarshalCBOR(raw); err != nil {
+		return nil, malformedCBOR("attestationObject: %v", err)
+	}
+	if obj.Format != attestationFormat {
+		return nil, badRequest("attestationObject: unexpected fmt %q", obj.Format)
+	}
+	if len(obj.AuthData) == 0 {
+		return nil, badRequest("attestationObject: missing authData")
+	}
+	if len(obj.AttStmt.X5C) == 0 {
+		return nil, badRequest("attestationObject: missing x5c")
+	}
+
+	keyID, err := decodeKeyID("keyId", body.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.validateChallenge("challenge", body.Challenge); err != nil {
+		return nil, err
+	}
+	return &plugin.AttestationPayload{Object: obj, KeyID: keyID, Challenge: body.Challenge}, nil
+}
+
+// DecodeAssertion decodes the assertion headers of r. body is not used; the
+// adapter verifies it as part of the client data, see UseBodyClientData.
+func (d Decoder) DecodeAssertion(r *http.Request, body []byte) (*plugin.AssertionPayload, error) {
+	raw, err := decodeField(HeaderAssertion, r.Header.Get(HeaderAssertion), orDefault(d.MaxAssertionSize, DefaultMaxAssertion))
+	if err != nil {
+		return nil, err
+	}
+	obj := &attest.AssertionObject{}
+	if err := obj.UnmarshalCBOR(raw); err != nil {
+		return nil, malformedCBOR("%s: %v", HeaderAssertion, err)
+	}
+	if len(obj.Signature) == 0 {
+		return nil, badRequest("%s: missing signature", HeaderAssertion)
+	}
+	if len(obj.AuthData) == 0 {
+		return nil, badRequest("%s: missing authenticatorData", HeaderAssertion)
+	}
+
+	keyID, err := decodeKeyID(HeaderKeyID, r.Header.Get(HeaderKeyID))
+	if err != nil {
+		return nil, err
+	}
+	challenge := r.Header.Get(HeaderChallenge)
+	if err := d.validateChallenge(HeaderChallenge, challenge); err != nil {
+		return nil, err
+	}
+	return &plugin.AssertionPayload{Object: obj, KeyID: keyID, Challenge: challenge}, nil
+}
+
+// UseBodyClientData sets r.ClientData, unless the middleware already set it,
+// to plugin.BodyClientData of the challenge and r.Body, the client data of
+// the wire format. Plugins call it from ParseRequest.
+func UseBodyClientData(r *plugin.AssertionRequest) {
+	if r.ClientData != nil {
+		return
+	}
+	r.ClientData = func(challenge string) ([]byte, error) {
+		return plugin.BodyClientData(challenge, r.Body), nil
+	}
+}
+
+func (d Decoder) validateChallenge(field, challenge string) error {
+	if challenge == "" {
+		return badRequest("%s: missing", field)
+	}
+	if max := orDefault(d.MaxChallengeSize, DefaultMaxChallengeSize); len(challenge) > max {
+		return badRequest("%s: exceeds %d bytes", field, max)
+	}
+	for _, c := range challenge {
+		if c > unicode.MaxASCII || !unicode.IsPrint(c) {
+			return badRequest("%s: contains non-printable or non-ASCII characters", field)
+		}
+	}
+	return nil
+}
+
+func decodeKeyID(field, value string) ([]byte, error) {
+	keyID, err := decodeField(field, value, base64.StdEncoding.EncodedLen(keyIDSize))
+	if err != nil {
+		return nil, err
+	}
+	if len(keyID) != keyIDSize {
+		return nil, badRequest("%s: got %d bytes, want %d", field, len(keyID), keyIDSize)
+	}
+	return keyID, nil
+}
+
+// decodeField decodes a required base64 value whose decoded size must not exceed max.
+func decodeField(field, value string, max int) ([]byte, error) {
+	if value == "" {
+		return nil, badRequest("%s: missing", field)
+	}
+	if base64.RawStdEncoding.DecodedLen(len(value)) > max {
+		return nil, badRequest("%s: exceeds %d bytes", field, max)
+	}
+	b, err := DecodeBase64(value)
+	if err != nil {
+		return nil, badRequest("%s: %v", field, err)
+	}
+	return b, nil
+}
+
+// DecodeBase64 decodes s in any of the standard or URL-safe base64 alphabets,
+// with or without padding.
+func DecodeBase64(s string) ([]byte, error) {
+	enc := base64.RawStdEncoding
+	if strings.ContainsAny(s, "-_") {
+		enc = base64.RawURLEncoding
+	}
+	b, err := enc.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, errors.New("invalid base64")
+	}
+	return b, nil
+}
+
+// KeyIDSessionKey is a SessionKeyFunc that assigns challenges to the
+// key ID of the X-App-Attest-Key-Id header. The key ID is re-encoded in padded
+// standard base64, so that a client gets the same session whichever base64
+// variant it sends.
+func KeyIDSessionKey(r *http.Request) (string, error) {
+	v := r.Header.Get(HeaderKeyID)
+	if v == "" {
+		return "", fmt.Errorf("%w: header %s is empty", ErrNoSession, HeaderKeyID)
+	}
+	keyID, err := DecodeBase64(v)
+	if err != nil {
+		return "", fmt.Errorf("%w: header %s: %v", ErrNoSession, HeaderKeyID, err)
+	}
+	return base64.StdEncoding.EncodeToString(keyID), nil
+}
+
+func badRequest(format string, args ...any) error {
+	return adapter.NewVerificationError(adapter.ReasonMalformedRequest, fmt.Errorf(format, args...))
+}
+
+func malformedCBOR(format string, args ...any) error {
+	return adapter.NewVerificationError(adapter.ReasonMalformedCBOR, fmt.Errorf(format, args...))
+}
+
+func orDefault(v, def int) int {
+	if v <= 0 {
+		return def
+	}
+	return v
+}
+
+func orDefault64(v, def int64) int64 {
+	if v <= 0 {
+		return def
+	}
+	return v
+}
@@ -0,0 +1,278 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/takimoto3/app-attest-middleware/adapter"
+	"github.com/takimoto3/app-attest-middleware/plugin"
+)
+
+// cborHeader encodes a CBOR major type and length.
+func cborHeader(mt byte, n int) []byte {
+	switch {
+	case n < 24:
+		return []byte{mt<<5 | byte(n)}
+	case n < 256:
+		return []byte{mt<<5 | 24, byte(n)}
+	default:
+		return binary.BigEndian.AppendUint16([]byte{mt<<5 | 25}, uint16(n))
+	}
+}
+
+func cborText(s string) []byte  { return append(cborHeader(3, len(s)), s...) }
+func cborBytes(b []byte) []byte { return append(cborHeader(2, len(b)), b...) }
+
+func attestationCBOR(format string, authData []byte, x5c ...[]byte) []byte {
+	out := cborHeader(5, 3)
+	out = append(out, cborText("fmt")...)
+	out = append(out, cborText(format)...)
+	out = append(out, cborText("attStmt")...)
+	out = append(out, cborHeader(5, 2)...)
+	out = append(out, cborText("x5c")...)
+	out = append(out, cborHeader(4, len(x5c))...)
+	for _, c := range x5c {
+		out = append(out, cborBytes(c)...)
+	}
+	out = append(out, cborText("receipt")...)
+	out = append(out, cborBytes([]byte("receipt"))...)
+	out = append(out, cborText("authData")...)
+	out = append(out, cborBytes(authData)...)
+	return out
+}
+
+func assertionCBOR(signature, authData []byte) []byte {
+	out := cborHeader(5, 2)
+	out = append(out, cborText("signature")...)
+	out = append(out, cborBytes(signature)...)
+	out = append(out, cborText("authenticatorData")...)
+	out = append(out, cborBytes(authData)...)
+	return out
+}
+
+func TestDecoder_DecodeAttestation(t *testing.T) {
+	keyID := bytes.Repeat([]byte{1}, 32)
+	valid := attestationCBOR("apple-appattest", []byte("authdata"), []byte("cert"))
+	b64 := base64.StdEncoding.EncodeToString
+
+	tests := map[string]struct {
+		body        string
+		contentType string
+		decoder     Decoder
+		wantErr     string
+	}{
+		"valid": {
+			body: `{"attestationObject":"` + b64(valid) + `","keyId":"` + b64(keyID) + `","challenge":"c1"}`,
+		},
+		"url-safe unpadded base64": {
+			body:        `{"attestationObject":"` + base64.RawURLEncoding.EncodeToString(valid) + `","keyId":"` + base64.RawURLEncoding.EncodeToString(keyID) + `","challenge":"c1"}`,
+			contentType: "application/json; charset=utf-8",
+		},
+		"wrong content type": {
+			body:        `{}`,
+			contentType: "text/plain",
+			wantErr:     "unsupported content type",
+		},
+		"invalid json": {
+			body:    `{`,
+			wantErr: "decode body",
+		},
+		"unknown field": {
+			body:    `{"attestationObject":"` + b64(valid) + `","keyId":"` + b64(keyID) + `","challenge":"c1","extra":1}`,
+			wantErr: "unknown field",
+		},
+		"body too large": {
+			body:    `{"attestationObject":"` + b64(valid) + `","keyId":"` + b64(keyID) + `","challenge":"c1"}`,
+			decoder: Decoder{MaxBodySize: 10},
+			wantErr: "body exceeds 10 bytes",
+		},
+		"missing attestationObject": {
+			body:    `{"keyId":"` + b64(keyID) + `","challenge":"c1"}`,
+			wantErr: "attestationObject: missing",
+		},
+		"attestationObject too large": {
+			body:    `{"attestationObject":"` + b64(valid) + `","keyId":"` + b64(keyID) + `","challenge":"c1"}`,
+			decoder: Decoder{MaxAttestationSize: 8},
+			wantErr: "attestationObject: exceeds 8 bytes",
+		},
+		"malformed cbor": {
+			body:    `{"attestationObject":"` + b64([]byte{0xa1}) + `","keyId":"` + b64(keyID) + `","challenge":"c1"}`,
+			wantErr: "malformed_cbor: attestationObject",
+		},
+		"unexpected format": {
+			body:    `{"attestationObject":"` + b64(attestationCBOR("packed", []byte("a"), []byte("c"))) + `","keyId":"` + b64(keyID) + `","challenge":"c1"}`,
+			wantErr: `unexpected fmt "packed"`,
+		},
+		"missing x5c": {
+			body:    `{"attestationObject":"` + b64(attestationCBOR("apple-appattest", []byte("a"))) + `","keyId":"` + b64(keyID) + `","challenge":"c1"}`,
+			wantErr: "missing x5c",
+		},
+		"invalid base64 keyId": {
+			body:    `{"attestationObject":"` + b64(valid) + `","keyId":"***","challenge":"c1"}`,
+			wantErr: "keyId: invalid base64",
+		},
+		"short keyId": {
+			body:    `{"attestationObject":"` + b64(valid) + `","keyId":"` + b64([]byte("short")) + `","challenge":"c1"}`,
+			wantErr: "keyId: got 5 bytes, want 32",
+		},
+		"missing challenge": {
+			body:    `{"attestationObject":"` + b64(valid) + `","keyId":"` + b64(keyID) + `"}`,
+			wantErr: "challenge: missing",
+		},
+		"challenge too large": {
+			body:    `{"attestationObject":"` + b64(valid) + `","keyId":"` + b64(keyID) + `","challenge":"` + strings.Repeat("c", 600) + `"}`,
+			wantErr: "challenge: exceeds 512 bytes",
+		},
+		"non-printable challenge": {
+			body:    `{"attestationObject":"` + b64(valid) + `","keyId":"` + b64(keyID) + `","challenge":"c\n1"}`,
+			wantErr: "non-printable",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/attest/verify", strings.NewReader(tc.body))
+			if tc.contentType != "" {
+				r.Header.Set("Content-Type", tc.contentType)
+			}
+			payload, err := tc.decoder.DecodeAttestation(r)
+			if tc.wantErr != "" {
+				if !errors.Is(err, adapter.ErrBadRequest) {
+					t.Errorf("error %v does not wrap adapter.ErrBadRequest", err)
+				}
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("got error %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !bytes.Equal(payload.KeyID, keyID) || payload.Challenge != "c1" || string(payload.Object.AuthData) != "authdata" {
+				t.Errorf("unexpected payload: %+v", payload)
+			}
+		})
+	}
+}
+
+func TestDecoder_DecodeAssertion(t *testing.T) {
+	keyID := bytes.Repeat([]byte{2}, 32)
+	valid := assertionCBOR([]byte("sig"), []byte("authdata"))
+
+	tests := map[string]struct {
+		assertion []byte
+		keyID     []byte
+		challenge string
+		wantErr   string
+	}{
+		"valid":             {assertion: valid, keyID: keyID, challenge: "c1"},
+		"missing assertion": {keyID: keyID, challenge: "c1", wantErr: HeaderAssertion + ": missing"},
+		"malformed cbor":    {assertion: []byte{0x01}, keyID: keyID, challenge: "c1", wantErr: "malformed_cbor"},
+		"missing signature": {assertion: assertionCBOR(nil, []byte("a")), keyID: keyID, challenge: "c1", wantErr: "missing signature"},
+		"too large":         {assertion: assertionCBOR(bytes.Repeat([]byte{1}, 5000), []byte("a")), keyID: keyID, challenge: "c1", wantErr: "exceeds"},
+		"missing key id":    {assertion: valid, challenge: "c1", wantErr: HeaderKeyID + ": missing"},
+		"missing challenge": {assertion: valid, keyID: keyID, wantErr: HeaderChallenge + ": missing"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/hello", nil)
+			if tc.assertion != nil {
+				r.Header.Set(HeaderAssertion, base64.StdEncoding.EncodeToString(tc.assertion))
+			}
+			if tc.keyID != nil {
+				r.Header.Set(HeaderKeyID, base64.StdEncoding.EncodeToString(tc.keyID))
+			}
+			if tc.challenge != "" {
+				r.Header.Set(HeaderChallenge, tc.challenge)
+			}
+			payload, err := Decoder{}.DecodeAssertion(r, nil)
+			if tc.wantErr != "" {
+				if !errors.Is(err, adapter.ErrBadRequest) {
+					t.Errorf("error %v does not wrap adapter.ErrBadRequest", err)
+				}
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("got error %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !bytes.Equal(payload.KeyID, keyID) || payload.Challenge != "c1" || string(payload.Object.Signature) != "sig" {
+				t.Errorf("unexpected payload: %+v", payload)
+			}
+		})
+	}
+}
+
+func TestKeyIDSessionKey(t *testing.T) {
+	keyID := bytes.Repeat([]byte{0xfb, 0xff}, 16)
+	want := base64.StdEncoding.EncodeToString(keyID)
+
+	tests := map[string]struct {
+		header  string
+		want    string
+		wantErr error
+	}{
+		"standard":          {header: want, want: want},
+		"standard unpadded": {header: base64.RawStdEncoding.EncodeToString(keyID), want: want},
+		"url-safe":          {header: base64.URLEncoding.EncodeToString(keyID), want: want},
+		"url-safe unpadded": {header: base64.RawURLEncoding.EncodeToString(keyID), want: want},
+		"missing":           {wantErr: ErrNoSession},
+		"invalid":           {header: "not base64!", wantErr: ErrNoSession},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tc.header != "" {
+				r.Header.Set(HeaderKeyID, tc.header)
+			}
+			got, err := KeyIDSessionKey(r)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("got err %v, want %v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	keyID := bytes.Repeat([]byte{3}, 32)
+	body, err := EncodeAttestation(attestationCBOR("apple-appattest", []byte("a"), []byte("c")), keyID, "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	if _, err := (Decoder{}).DecodeAttestation(r); err != nil {
+		t.Errorf("DecodeAttestation of encoded body failed: %v", err)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	SetAssertion(r.Header, assertionCBOR([]byte("s"), []byte("a")), keyID, "c2")
+	if _, err := (Decoder{}).DecodeAssertion(r, nil); err != nil {
+		t.Errorf("DecodeAssertion of encoded headers failed: %v", err)
+	}
+}
+
+func TestUseBodyClientData(t *testing.T) {
+	r := &plugin.AssertionRequest{Body: []byte("body")}
+	UseBodyClientData(r)
+	if got, err := r.ClientData("c1"); err != nil || string(got) != "c1\nbody" {
+		t.Errorf("got client data %q, %v, want %q", got, err, "c1\nbody")
+	}
+
+	canonical := func(challenge string) ([]byte, error) { return []byte("canonical"), nil }
+	r = &plugin.AssertionRequest{Body: []byte("body"), ClientData: canonical}
+	UseBodyClientData(r)
+	if got, _ := r.ClientData("c1"); string(got) != "canonical" {
+		t.Errorf("got client data %q, want the ClientData set by the middleware", got)
+	}
+}